@@ -0,0 +1,275 @@
+package config
+
+import (
+	"github.com/edwinavalos/common/logger"
+	"github.com/spf13/viper"
+	"time"
+)
+
+// Settings holds the dns-verifier specific configuration that isn't part of the common config, it is read
+// from the same configuration file so NewConfig has to be called first.
+type Settings struct {
+	CloudProvider      CloudProviderSettings      `mapstructure:"cloud_provider"`
+	ACME               ACMESettings               `mapstructure:"acme"`
+	Encryption         EncryptionSettings         `mapstructure:"encryption"`
+	Jobs               JobSettings                `mapstructure:"jobs"`
+	RateLimits         RateLimitSettings          `mapstructure:"rate_limits"`
+	TLS                TLSSettings                `mapstructure:"tls"`
+	Hooks              HookSettings               `mapstructure:"hooks"`
+	Propagation        PropagationSettings        `mapstructure:"propagation"`
+	ChallengeDNS       ChallengeDNSSettings       `mapstructure:"challenge_dns"`
+	RFC2136            RFC2136Settings            `mapstructure:"rfc2136"`
+	DomainStore        DomainStoreSettings        `mapstructure:"domain_store"`
+	FileStore          FileStoreSettings          `mapstructure:"file_store"`
+	DomainClaims       DomainClaimSettings        `mapstructure:"domain_claims"`
+	Notifications      NotificationSettings       `mapstructure:"notifications"`
+	DomainRetention    DomainRetentionSettings    `mapstructure:"domain_retention"`
+	VerificationExpiry VerificationExpirySettings `mapstructure:"verification_expiry"`
+}
+
+type CloudProviderSettings struct {
+	Region     string `mapstructure:"region"`
+	BucketName string `mapstructure:"bucket_name"`
+}
+
+type ACMESettings struct {
+	// DefaultProfile is used when a certificate request doesn't name a profile
+	DefaultProfile string               `mapstructure:"default_profile"`
+	Profiles       map[string]CAProfile `mapstructure:"profiles"`
+	// FallbackOrder lists the profiles to move an order on to when a CA rate limits us, errors out or isn't allowed
+	// by the domain's CAA records, its first entry replaces the default profile
+	FallbackOrder []string `mapstructure:"fallback_order"`
+	// RenewBefore is how long before it expires a certificate is ordered again
+	RenewBefore time.Duration `mapstructure:"renew_before"`
+}
+
+// CAProfile describes an ACME certificate authority and the account we hold with it, or a private CA of our own
+type CAProfile struct {
+	// Type is "acme", the default, or "internal" for names that can't pass ACME validation
+	Type         string             `mapstructure:"type"`
+	Internal     InternalCASettings `mapstructure:"internal"`
+	DirectoryURL string             `mapstructure:"directory_url"`
+	// AccountKeyLocation is a local DER account key that gets imported into the file store the first time the
+	// profile is used, afterwards the file store copy is the only one used
+	AccountKeyLocation string `mapstructure:"account_key_location"`
+	// Email overrides the le_settings admin email as the account contact
+	Email string `mapstructure:"email"`
+	// EABKeyID and EABHMACKey are the External Account Binding credentials handed out by CAs like ZeroSSL or
+	// Google Trust Services, the HMAC key is base64url encoded as given by the CA
+	EABKeyID   string `mapstructure:"eab_key_id"`
+	EABHMACKey string `mapstructure:"eab_hmac_key"`
+	// RootsFile is a PEM bundle of roots trusted for this CA's certificates on top of the system ones, for staging
+	// and test CAs
+	RootsFile string `mapstructure:"roots_file"`
+}
+
+// InternalCASettings configure a CA profile of type internal, lifetimes that aren't set use the defaults of cert_service
+type InternalCASettings struct {
+	Organization         string        `mapstructure:"organization"`
+	RootLifetime         time.Duration `mapstructure:"root_lifetime"`
+	IntermediateLifetime time.Duration `mapstructure:"intermediate_lifetime"`
+	LeafLifetime         time.Duration `mapstructure:"leaf_lifetime"`
+	CRLLifetime          time.Duration `mapstructure:"crl_lifetime"`
+	// CRLURL is put in the certificates we issue as their CRL distribution point, e.g.
+	// https://verifier.example.com/api/v1/ca/<profile>/crl
+	CRLURL string `mapstructure:"crl_url"`
+}
+
+type EncryptionSettings struct {
+	// Backend wraps the data keys secrets are encrypted with before they reach shared storage, "local" or "kms"
+	Backend string `mapstructure:"backend"`
+	// MasterKeyFile holds the base64 encoded 32 byte key the local backend wraps data keys with
+	MasterKeyFile string `mapstructure:"master_key_file"`
+	// PreviousMasterKeyFiles are retired master keys that can still unwrap data keys until rewrap-keys has run
+	PreviousMasterKeyFiles []string `mapstructure:"previous_master_key_files"`
+	KMSKeyID               string   `mapstructure:"kms_key_id"`
+}
+
+type JobSettings struct {
+	// TableName defaults to the storage table name with a -jobs suffix on DynamoDB and to the domain table name with a
+	// _jobs suffix on SQL
+	TableName    string        `mapstructure:"table_name"`
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	// LeaseDuration is how long a single attempt may run before another worker can pick the job up
+	LeaseDuration time.Duration `mapstructure:"lease_duration"`
+	MaxAttempts   int           `mapstructure:"max_attempts"`
+	// RetryBackoff is doubled for every failed attempt
+	RetryBackoff time.Duration `mapstructure:"retry_backoff"`
+	// Retention is how long finished jobs can still be looked up before they expire
+	Retention time.Duration `mapstructure:"retention"`
+}
+
+// RateLimitSettings are the budgets we keep ourselves to so that a CA's rate limits are never hit, a zero limit
+// turns that budget off
+type RateLimitSettings struct {
+	CertificatesPerRegisteredDomain int           `mapstructure:"certificates_per_registered_domain"`
+	CertificatesWindow              time.Duration `mapstructure:"certificates_window"`
+	FailedValidationsPerHostname    int           `mapstructure:"failed_validations_per_hostname"`
+	FailedValidationsWindow         time.Duration `mapstructure:"failed_validations_window"`
+	NewOrdersPerAccount             int           `mapstructure:"new_orders_per_account"`
+	NewOrdersWindow                 time.Duration `mapstructure:"new_orders_window"`
+}
+
+// TLSSettings configure the optional HTTPS listener that serves the certificates we issued
+type TLSSettings struct {
+	Enabled bool   `mapstructure:"enabled"`
+	Addr    string `mapstructure:"addr"`
+	// RefreshInterval is how often served certificates are reloaded from the file store to pick up renewals
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
+	// CacheSize is how many server names are kept in memory, the least recently used ones are dropped first
+	CacheSize int `mapstructure:"cache_size"`
+}
+
+// HookSettings configure what is run after a certificate is issued or renewed, a hook without a path or url is off
+type HookSettings struct {
+	PEMDirectory PEMDirectoryHookSettings `mapstructure:"pem_directory"`
+	Command      CommandHookSettings      `mapstructure:"command"`
+	Webhook      WebhookHookSettings      `mapstructure:"webhook"`
+}
+
+type PEMDirectoryHookSettings struct {
+	Path string `mapstructure:"path"`
+	// OwnerUID and OwnerGID are applied to the written files when set
+	OwnerUID *int `mapstructure:"owner_uid"`
+	OwnerGID *int `mapstructure:"owner_gid"`
+	// FileMode is an octal string like "0640", private keys are never written with more than 0600
+	FileMode string `mapstructure:"file_mode"`
+}
+
+type CommandHookSettings struct {
+	Path    string        `mapstructure:"path"`
+	Args    []string      `mapstructure:"args"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+type WebhookHookSettings struct {
+	URL string `mapstructure:"url"`
+	// Secret is the HMAC-SHA256 key notifications are signed with
+	Secret  string        `mapstructure:"secret"`
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+// PropagationSettings configure the check that every authoritative nameserver serves a challenge record before the
+// CA is asked to validate it
+type PropagationSettings struct {
+	// Timeout is how long a completion waits for the nameservers to agree before the job retries later
+	Timeout      time.Duration `mapstructure:"timeout"`
+	PollInterval time.Duration `mapstructure:"poll_interval"`
+	QueryTimeout time.Duration `mapstructure:"query_timeout"`
+	// Resolvers are the recursive resolvers used to find the authoritative nameservers, host:port, the system
+	// resolvers are used when empty
+	Resolvers []string `mapstructure:"resolvers"`
+}
+
+// ChallengeDNSSettings configure the embedded authoritative DNS server that customers CNAME their _acme-challenge
+// names to, Zone has to be delegated to Nameserver
+type ChallengeDNSSettings struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Listen is the address the UDP and TCP listeners bind, e.g. ":53" or "127.0.0.1:5353" locally
+	Listen     string `mapstructure:"listen"`
+	Zone       string `mapstructure:"zone"`
+	Nameserver string `mapstructure:"nameserver"`
+	// AdminEmail goes into the SOA of the zone
+	AdminEmail string `mapstructure:"admin_email"`
+	TTL        uint32 `mapstructure:"ttl"`
+}
+
+// RFC2136Settings configure the dynamic updates we send to the nameservers customers run themselves
+type RFC2136Settings struct {
+	// AllowPrivateServers lets customers point updates at loopback, link-local and private addresses, only turn it on
+	// when every customer is trusted with the networks the verifier can reach
+	AllowPrivateServers bool `mapstructure:"allow_private_servers"`
+}
+
+// DomainStoreSettings choose the database users and their domains are kept in
+type DomainStoreSettings struct {
+	// Backend is one of "dynamodb", the default, "memory" or "sql"
+	Backend  string                `mapstructure:"backend"`
+	DynamoDB DynamoDBStoreSettings `mapstructure:"dynamodb"`
+	SQL      SQLStoreSettings      `mapstructure:"sql"`
+}
+
+type DynamoDBStoreSettings struct {
+	// TableName holds one item per domain, "<storage table>-domains" when empty
+	TableName string `mapstructure:"table_name"`
+	// LegacyFallback reads domains that are still nested in the user items of the storage table, on unless set to
+	// false, which can be done once `dns-verifier migrate-domains` has run
+	LegacyFallback *bool `mapstructure:"legacy_fallback"`
+	// Tables is how the storage, domain and job tables are created and what they are checked against on startup
+	Tables TableSettings `mapstructure:"tables"`
+}
+
+type TableSettings struct {
+	// BillingMode is "pay_per_request", the default, or "provisioned"
+	BillingMode string `mapstructure:"billing_mode"`
+	// ReadCapacity and WriteCapacity are only used by provisioned tables and their indexes, 10 when not set
+	ReadCapacity  int64 `mapstructure:"read_capacity"`
+	WriteCapacity int64 `mapstructure:"write_capacity"`
+	// PointInTimeRecovery is turned on for the tables that get created
+	PointInTimeRecovery bool `mapstructure:"point_in_time_recovery"`
+	DeletionProtection  bool `mapstructure:"deletion_protection"`
+	// FailOnDrift stops the startup when an existing table doesn't match these settings, the drift is only logged
+	// otherwise
+	FailOnDrift bool `mapstructure:"fail_on_drift"`
+}
+
+type FileStoreSettings struct {
+	// Backend is one of "s3", the default, which uses the cloud_provider bucket, "local" or "memory"
+	Backend string                 `mapstructure:"backend"`
+	Local   LocalFileStoreSettings `mapstructure:"local"`
+}
+
+type LocalFileStoreSettings struct {
+	// Directory holds one file per object, it is restricted to the owner on startup
+	Directory string `mapstructure:"directory"`
+}
+
+type SQLStoreSettings struct {
+	// Driver is the database/sql driver name, e.g. "sqlite" or "postgres"
+	Driver    string `mapstructure:"driver"`
+	DSN       string `mapstructure:"dsn"`
+	TableName string `mapstructure:"table_name"`
+}
+
+// DomainClaimSettings decide what happens when a user verifies a domain another user has already verified
+type DomainClaimSettings struct {
+	// Policy is "first_verified", the default, "supersede" or "admin_review"
+	Policy string `mapstructure:"policy"`
+}
+
+// NotificationSettings configure where notifications for users, e.g. about superseded domain claims, are sent
+type NotificationSettings struct {
+	Webhook WebhookHookSettings `mapstructure:"webhook"`
+}
+
+// DomainRetentionSettings decide how long deleted domains can be restored and what purging them cleans up
+type DomainRetentionSettings struct {
+	// Retention is how long a deleted domain is kept, 30 days by default
+	Retention time.Duration `mapstructure:"retention"`
+	// PurgeInterval is how often the purger looks for domains past their retention, hourly by default
+	PurgeInterval time.Duration `mapstructure:"purge_interval"`
+	// RevokeCertificates revokes the certificate of a purged domain with the CA that issued it
+	RevokeCertificates bool `mapstructure:"revoke_certificates"`
+}
+
+// VerificationExpirySettings decide how long domains can wait to be verified
+type VerificationExpirySettings struct {
+	// KeyLifetime is how long a verification key is accepted, 7 days by default
+	KeyLifetime time.Duration `mapstructure:"key_lifetime"`
+	// WarnBefore is how long before a key expires, or a domain is deleted, the owner is notified, a day by default
+	WarnBefore time.Duration `mapstructure:"warn_before"`
+	// DeleteUnverifiedAfter deletes domains that were never verified this long after they were added, 0 keeps them
+	DeleteUnverifiedAfter time.Duration `mapstructure:"delete_unverified_after"`
+	// SweepInterval is how often pending verifications are checked, hourly by default
+	SweepInterval time.Duration `mapstructure:"sweep_interval"`
+}
+
+func NewSettings() *Settings {
+	var settings Settings
+	err := viper.Unmarshal(&settings)
+	if err != nil {
+		logger.Error("unable to read dns-verifier settings, exiting. %s", err)
+		panic(err)
+	}
+	return &settings
+}
@@ -0,0 +1,46 @@
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// AWSKMS is the KMSClient of AWS KMS, credentials come from the default AWS config chain like they do for S3 and
+// DynamoDB
+type AWSKMS struct {
+	client *kms.Client
+}
+
+func NewAWSKMS(ctx context.Context, region string) (*AWSKMS, error) {
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx, awsconfig.WithRegion(region))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load aws config for kms: %w", err)
+	}
+	return &AWSKMS{client: kms.NewFromConfig(awsCfg)}, nil
+}
+
+func (k *AWSKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	output, err := k.client.Encrypt(ctx, &kms.EncryptInput{
+		KeyId:     aws.String(keyID),
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms key: %s unable to encrypt: %w", keyID, err)
+	}
+	return output.CiphertextBlob, nil
+}
+
+// Decrypt passes the key id along so KMS refuses ciphertext that was wrapped by another key
+func (k *AWSKMS) Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	output, err := k.client.Decrypt(ctx, &kms.DecryptInput{
+		KeyId:          aws.String(keyID),
+		CiphertextBlob: ciphertext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("kms key: %s unable to decrypt: %w", keyID, err)
+	}
+	return output.Plaintext, nil
+}
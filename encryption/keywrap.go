@@ -0,0 +1,221 @@
+package encryption
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var ErrUnknownKey = errors.New("unknown key encryption key")
+
+// KeyWrapper is a key encryption backend, it wraps the per-object data keys. UnwrapKey has to keep working for the
+// key ids of retired keys until everything sealed with them has been rewrapped.
+type KeyWrapper interface {
+	// KeyID names the key new data keys are wrapped with
+	KeyID() string
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error)
+}
+
+// legacyOpener is implemented by wrappers holding the keys version 1 data was sealed with directly
+type legacyOpener interface {
+	openLegacy(nonce []byte, ciphertext []byte) ([]byte, error)
+}
+
+// LocalKeyWrapper wraps data keys with master keys read from local files, previous master keys are kept around to
+// unwrap what hasn't been rewrapped yet
+type LocalKeyWrapper struct {
+	current string
+	keys    map[string]cipher.AEAD
+	// order is current first, then the previous keys as configured
+	order []string
+}
+
+func NewLocalKeyWrapper(masterKey []byte, previousMasterKeys ...[]byte) (*LocalKeyWrapper, error) {
+	w := &LocalKeyWrapper{
+		keys: map[string]cipher.AEAD{},
+	}
+	for i, key := range append([][]byte{masterKey}, previousMasterKeys...) {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid master key: %w", err)
+		}
+		sum := sha256.Sum256(key)
+		keyID := "local:" + hex.EncodeToString(sum[:8])
+		if i == 0 {
+			w.current = keyID
+		}
+		if _, ok := w.keys[keyID]; !ok {
+			w.order = append(w.order, keyID)
+		}
+		w.keys[keyID] = aead
+	}
+	return w, nil
+}
+
+// NewLocalKeyWrapperFromFiles reads base64 encoded 32 byte master keys, e.g. ones made with `openssl rand -base64 32`
+func NewLocalKeyWrapperFromFiles(masterKeyFile string, previousMasterKeyFiles []string) (*LocalKeyWrapper, error) {
+	if masterKeyFile == "" {
+		return nil, ErrNoMasterKey
+	}
+	masterKey, err := readMasterKeyFile(masterKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	var previousKeys [][]byte
+	for _, file := range previousMasterKeyFiles {
+		key, err := readMasterKeyFile(file)
+		if err != nil {
+			return nil, err
+		}
+		previousKeys = append(previousKeys, key)
+	}
+
+	return NewLocalKeyWrapper(masterKey, previousKeys...)
+}
+
+func readMasterKeyFile(masterKeyFile string) ([]byte, error) {
+	encodedKey, err := os.ReadFile(masterKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read master key file: %w", err)
+	}
+	masterKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encodedKey)))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode master key file: %s: %w", masterKeyFile, err)
+	}
+	return masterKey, nil
+}
+
+func (w *LocalKeyWrapper) KeyID() string {
+	return w.current
+}
+
+func (w *LocalKeyWrapper) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	aead := w.keys[w.current]
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, dataKey, nil), nil
+}
+
+func (w *LocalKeyWrapper) UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error) {
+	aead, ok := w.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", keyID, ErrUnknownKey)
+	}
+	if len(wrappedKey) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped key is too short")
+	}
+	nonce, ciphertext := wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func (w *LocalKeyWrapper) openLegacy(nonce []byte, ciphertext []byte) ([]byte, error) {
+	// Version 1 data doesn't say which master key sealed it
+	for _, keyID := range w.order {
+		plaintext, err := w.keys[keyID].Open(nil, nonce, ciphertext, nil)
+		if err == nil {
+			return plaintext, nil
+		}
+	}
+	return nil, fmt.Errorf("no master key opens the data")
+}
+
+// KMSClient is the part of a KMS that envelope encryption needs, shaped after the Encrypt and Decrypt calls of AWS KMS
+type KMSClient interface {
+	Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error)
+}
+
+// KMSKeyWrapper wraps data keys with a key that never leaves the KMS, rotating means pointing it at a new key id
+type KMSKeyWrapper struct {
+	client KMSClient
+	keyID  string
+}
+
+func NewKMSKeyWrapper(client KMSClient, keyID string) *KMSKeyWrapper {
+	return &KMSKeyWrapper{
+		client: client,
+		keyID:  keyID,
+	}
+}
+
+func (w *KMSKeyWrapper) KeyID() string {
+	return w.keyID
+}
+
+func (w *KMSKeyWrapper) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	return w.client.Encrypt(ctx, w.keyID, dataKey)
+}
+
+func (w *KMSKeyWrapper) UnwrapKey(ctx context.Context, keyID string, wrappedKey []byte) ([]byte, error) {
+	return w.client.Decrypt(ctx, keyID, wrappedKey)
+}
+
+// LocalKMS is an in-process stand-in for a KMS, for tests and local development. Its keys are gone when the process
+// exits, so is everything sealed with them.
+type LocalKMS struct {
+	mu   sync.RWMutex
+	keys map[string]*LocalKeyWrapper
+}
+
+func NewLocalKMS() *LocalKMS {
+	return &LocalKMS{
+		keys: map[string]*LocalKeyWrapper{},
+	}
+}
+
+// CreateKey adds a random key under keyID
+func (k *LocalKMS) CreateKey(keyID string) error {
+	key := make([]byte, dataKeySize)
+	_, err := io.ReadFull(rand.Reader, key)
+	if err != nil {
+		return err
+	}
+	wrapper, err := NewLocalKeyWrapper(key)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[keyID] = wrapper
+	return nil
+}
+
+func (k *LocalKMS) Encrypt(ctx context.Context, keyID string, plaintext []byte) ([]byte, error) {
+	wrapper, err := k.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return wrapper.WrapKey(ctx, plaintext)
+}
+
+func (k *LocalKMS) Decrypt(ctx context.Context, keyID string, ciphertext []byte) ([]byte, error) {
+	wrapper, err := k.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return wrapper.UnwrapKey(ctx, wrapper.KeyID(), ciphertext)
+}
+
+func (k *LocalKMS) key(keyID string) (*LocalKeyWrapper, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	wrapper, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", keyID, ErrUnknownKey)
+	}
+	return wrapper, nil
+}
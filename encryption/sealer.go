@@ -0,0 +1,208 @@
+package encryption
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"io"
+)
+
+const (
+	// legacySealedVersion data was encrypted with the master key itself
+	legacySealedVersion = 1
+	// envelopeVersion data is encrypted with its own data key, which is wrapped by the key encryption backend
+	envelopeVersion = 2
+
+	dataKeySize = 32
+)
+
+var (
+	ErrNoMasterKey = errors.New("no encryption master key configured")
+	ErrNotSealed   = errors.New("data is not sealed")
+)
+
+// sealedBox is the stored form of sealed data
+type sealedBox struct {
+	Version    int    `json:"version"`
+	KeyID      string `json:"key_id,omitempty"`
+	WrappedKey []byte `json:"wrapped_key,omitempty"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// Sealer encrypts small secrets like private keys before they are written to shared storage. Every sealed object
+// gets its own AES-256-GCM data key, only the wrapped data key ever reaches the key encryption backend.
+type Sealer struct {
+	wrapper KeyWrapper
+}
+
+func NewSealer(wrapper KeyWrapper) *Sealer {
+	return &Sealer{wrapper: wrapper}
+}
+
+// NewSealerFromSettings builds the sealer of the configured backend. The kms backend wraps data keys with kmsClient,
+// which is AWS KMS in the binary.
+func NewSealerFromSettings(settings appconfig.EncryptionSettings, kmsClient KMSClient) (*Sealer, error) {
+	switch settings.Backend {
+	case "", "local":
+		wrapper, err := NewLocalKeyWrapperFromFiles(settings.MasterKeyFile, settings.PreviousMasterKeyFiles)
+		if err != nil {
+			return nil, err
+		}
+		return NewSealer(wrapper), nil
+	case "kms":
+		if kmsClient == nil {
+			return nil, fmt.Errorf("encryption backend kms needs a KMS client")
+		}
+		if settings.KMSKeyID == "" {
+			return nil, fmt.Errorf("encryption backend kms needs a kms_key_id")
+		}
+		return NewSealer(NewKMSKeyWrapper(kmsClient, settings.KMSKeyID)), nil
+	default:
+		return nil, fmt.Errorf("unknown encryption backend: %s", settings.Backend)
+	}
+}
+
+func (s *Sealer) Seal(ctx context.Context, plaintext []byte) ([]byte, error) {
+	if s == nil {
+		return nil, ErrNoMasterKey
+	}
+
+	dataKey := make([]byte, dataKeySize)
+	_, err := io.ReadFull(rand.Reader, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate data key: %w", err)
+	}
+	wrappedKey, err := s.wrapper.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to wrap data key: %w", err)
+	}
+
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate nonce: %w", err)
+	}
+
+	return json.Marshal(sealedBox{
+		Version:    envelopeVersion,
+		KeyID:      s.wrapper.KeyID(),
+		WrappedKey: wrappedKey,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, nil),
+	})
+}
+
+// Open decrypts sealed data, ErrNotSealed means the data was stored before it was encrypted
+func (s *Sealer) Open(ctx context.Context, sealed []byte) ([]byte, error) {
+	if s == nil {
+		return nil, ErrNoMasterKey
+	}
+	box, err := unmarshalBox(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	var plaintext []byte
+	switch box.Version {
+	case legacySealedVersion:
+		plaintext, err = s.openLegacy(box)
+	case envelopeVersion:
+		var dataKey []byte
+		dataKey, err = s.wrapper.UnwrapKey(ctx, box.KeyID, box.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to unwrap data key: %w", err)
+		}
+		plaintext, err = openWithKey(dataKey, box.Nonce, box.Ciphertext)
+	default:
+		return nil, fmt.Errorf("unsupported sealed data version: %d", box.Version)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sealed data: %w", err)
+	}
+	return plaintext, nil
+}
+
+// Rewrap wraps the data key of sealed data with the current key encryption key, the ciphertext itself is left alone.
+// It reports false when the data already used the current key.
+func (s *Sealer) Rewrap(ctx context.Context, sealed []byte) ([]byte, bool, error) {
+	if s == nil {
+		return nil, false, ErrNoMasterKey
+	}
+	box, err := unmarshalBox(sealed)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch box.Version {
+	case legacySealedVersion:
+		plaintext, err := s.openLegacy(box)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to open sealed data: %w", err)
+		}
+		resealed, err := s.Seal(ctx, plaintext)
+		return resealed, err == nil, err
+	case envelopeVersion:
+		if box.KeyID == s.wrapper.KeyID() {
+			return sealed, false, nil
+		}
+		dataKey, err := s.wrapper.UnwrapKey(ctx, box.KeyID, box.WrappedKey)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to unwrap data key: %w", err)
+		}
+		box.WrappedKey, err = s.wrapper.WrapKey(ctx, dataKey)
+		if err != nil {
+			return nil, false, fmt.Errorf("unable to wrap data key: %w", err)
+		}
+		box.KeyID = s.wrapper.KeyID()
+		rewrapped, err := json.Marshal(box)
+		return rewrapped, err == nil, err
+	default:
+		return nil, false, fmt.Errorf("unsupported sealed data version: %d", box.Version)
+	}
+}
+
+func (s *Sealer) openLegacy(box sealedBox) ([]byte, error) {
+	legacy, ok := s.wrapper.(legacyOpener)
+	if !ok {
+		return nil, fmt.Errorf("version %d data can only be opened with a local master key", legacySealedVersion)
+	}
+	return legacy.openLegacy(box.Nonce, box.Ciphertext)
+}
+
+func unmarshalBox(sealed []byte) (sealedBox, error) {
+	var box sealedBox
+	err := json.Unmarshal(sealed, &box)
+	if err != nil || box.Version == 0 {
+		return sealedBox{}, ErrNotSealed
+	}
+	return box, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key has to be 32 bytes, got: %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func openWithKey(key []byte, nonce []byte, ciphertext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"github.com/edwinavalos/common/logger"
 	"github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/encryption"
 	"github.com/edwinavalos/dns-verifier/server"
+	"github.com/edwinavalos/dns-verifier/service/backup_service"
 	"github.com/edwinavalos/dns-verifier/service/cert_service"
+	"github.com/edwinavalos/dns-verifier/service/dns_service"
 	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/service/hook_service"
+	"github.com/edwinavalos/dns-verifier/service/notification_service"
 	"github.com/edwinavalos/dns-verifier/storage"
+	_ "github.com/lib/pq"
 	"math/rand"
+	_ "modernc.org/sqlite"
+	"os"
 	"time"
 )
 
@@ -16,18 +26,214 @@ func main() {
 	rand.Seed(time.Now().Unix())
 
 	cfg := config.NewConfig()
-	datastore, err := storage.NewDataStore(cfg)
+	settings := config.NewSettings()
+	domainStore, err := storage.NewDomainStore(cfg, settings.DomainStore)
 	if err != nil {
 		panic(err)
 	}
 
-	filestore, err := storage.NewFileStore(cfg)
+	filestore, err := storage.NewFileStore(settings)
 	if err != nil {
 		panic(err)
 	}
 
-	domainService := domain_service.New(cfg, datastore)
-	certService := cert_service.New(cfg, filestore, domainService)
+	jobStore, err := storage.OpenJobStore(domainStore, settings.Jobs, settings.DomainStore.DynamoDB.Tables)
+	if err != nil {
+		panic(err)
+	}
+
+	var kmsClient encryption.KMSClient
+	if settings.Encryption.Backend == "kms" {
+		kmsClient, err = encryption.NewAWSKMS(context.TODO(), settings.CloudProvider.Region)
+		if err != nil {
+			panic(err)
+		}
+	}
+	sealer, err := encryption.NewSealerFromSettings(settings.Encryption, kmsClient)
+	if err != nil {
+		panic(err)
+	}
+
+	hooks, err := hook_service.NewFromSettings(settings.Hooks)
+	if err != nil {
+		panic(err)
+	}
+
+	notifications, err := notification_service.NewFromSettings(settings.Notifications)
+	if err != nil {
+		panic(err)
+	}
+
+	domainService := domain_service.New(cfg, domainStore,
+		domain_service.WithClaimPolicy(settings.DomainClaims.Policy),
+		domain_service.WithNotifications(notifications),
+		domain_service.WithRetention(settings.DomainRetention.Retention),
+		domain_service.WithVerificationExpiry(settings.VerificationExpiry),
+	)
+	certService := cert_service.New(cfg, filestore, domainService,
+		cert_service.WithACMESettings(settings.ACME),
+		cert_service.WithSealer(sealer),
+		cert_service.WithRateLimits(settings.RateLimits),
+		cert_service.WithHooks(hooks),
+		cert_service.WithPropagationChecker(dns_service.NewChecker(settings.Propagation)),
+		cert_service.WithChallengeDNS(settings.ChallengeDNS),
+		cert_service.WithRFC2136Provider(settings.RFC2136),
+		cert_service.WithRetention(settings.DomainRetention),
+		cert_service.WithJobStore(jobStore, settings.Jobs),
+	)
+
+	if len(os.Args) > 1 {
+		backupService := backup_service.New(domainStore, filestore, sealer)
+		runCommand(os.Args[1], os.Args[2:], domainService, certService, backupService, domainStore)
+		return
+	}
+
+	go certService.RunJobWorker(context.Background())
+	go certService.RunPurger(context.Background())
+	go domainService.RunExpirySweeper(context.Background())
+
+	if settings.ChallengeDNS.Enabled {
+		responder, err := dns_service.NewResponder(settings.ChallengeDNS, certService)
+		if err != nil {
+			panic(err)
+		}
+		err = responder.Start()
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if settings.TLS.Enabled {
+		// Nothing is served on customer domains yet, the API stays on the internal listener
+		tlsSrv := server.NewTLSServer(settings.TLS, domainService, certService, nil)
+		go func() {
+			err := tlsSrv.ListenAndServeTLS("", "")
+			if err != nil {
+				logger.Error("https listener stopped: %s", err)
+			}
+		}()
+	}
+
 	srv := server.NewServer(cfg, domainService, certService)
 	srv.ListenAndServe()
 }
+
+// runCommand runs a one off maintenance command instead of the server
+func runCommand(command string, args []string, domainService *domain_service.Service, certService *cert_service.Service, backupService *backup_service.Service, domainStore storage.DomainStore) {
+	switch command {
+	case "backup":
+		flags := flag.NewFlagSet("backup", flag.ExitOnError)
+		encrypt := flags.Bool("encrypt", false, "seal the archive with the configured master key")
+		_ = flags.Parse(args)
+		if flags.NArg() != 1 {
+			logger.Error("usage: backup [-encrypt] <archive>")
+			os.Exit(2)
+		}
+		file, err := os.OpenFile(flags.Arg(0), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			logger.Error("backup: %s", err)
+			os.Exit(1)
+		}
+		manifest, err := backupService.Backup(context.Background(), file, *encrypt)
+		if err == nil {
+			err = file.Close()
+		}
+		if err != nil {
+			_ = file.Close()
+			_ = os.Remove(flags.Arg(0))
+			logger.Error("backup: %s", err)
+			os.Exit(1)
+		}
+		logger.Info("backup: %s users: %d domains: %d claims: %d objects: %d", flags.Arg(0), manifest.Users, manifest.Domains, manifest.Claims, manifest.Objects)
+	case "restore":
+		flags := flag.NewFlagSet("restore", flag.ExitOnError)
+		mode := flags.String("mode", backup_service.MergeMode, "merge keeps existing domains and objects, overwrite replaces them")
+		dryRun := flags.Bool("dry-run", false, "only count what would be restored")
+		_ = flags.Parse(args)
+		if flags.NArg() != 1 {
+			logger.Error("usage: restore [-mode merge|overwrite] [-dry-run] <archive>")
+			os.Exit(2)
+		}
+		file, err := os.Open(flags.Arg(0))
+		if err != nil {
+			logger.Error("restore: %s", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		manifest, result, err := backupService.Restore(context.Background(), file, backup_service.RestoreOptions{Mode: *mode, DryRun: *dryRun})
+		if err != nil {
+			logger.Error("restore: %s", err)
+			os.Exit(1)
+		}
+		logger.Info("restore: backup from: %s dry run: %t domains created: %d overwritten: %d skipped: %d failed: %d claims created: %d overwritten: %d skipped: %d failed: %d objects created: %d overwritten: %d skipped: %d failed: %d",
+			manifest.CreatedAt, *dryRun, result.Domains.Created, result.Domains.Overwritten, result.Domains.Skipped, result.Domains.Failed,
+			result.Claims.Created, result.Claims.Overwritten, result.Claims.Skipped, result.Claims.Failed,
+			result.Objects.Created, result.Objects.Overwritten, result.Objects.Skipped, result.Objects.Failed)
+		if result.Domains.Failed > 0 || result.Claims.Failed > 0 || result.Objects.Failed > 0 {
+			os.Exit(1)
+		}
+	case "migrate-domains":
+		dynamoStore, ok := domainStore.(*storage.DynamoDomainStore)
+		if !ok {
+			logger.Error("migrate-domains: only the dynamodb domain_store has legacy items")
+			os.Exit(1)
+		}
+		result, err := dynamoStore.MigrateLegacyDomains(context.Background())
+		if err != nil {
+			logger.Error("migrate-domains: %s", err)
+			os.Exit(1)
+		}
+		logger.Info("migrate-domains: users: %d copied: %d already migrated: %d failed: %d", result.Users, result.Copied, result.AlreadyMigrated, result.Failed)
+		if result.Failed > 0 {
+			os.Exit(1)
+		}
+	case "expire-verifications":
+		result, err := domainService.SweepPendingVerifications(context.Background())
+		if err != nil {
+			logger.Error("expire-verifications: %s", err)
+			os.Exit(1)
+		}
+		logger.Info("expire-verifications: key warnings: %d keys expired: %d deletion warnings: %d deleted: %d failed: %d",
+			result.KeyWarnings, result.KeysExpired, result.DeleteWarnings, result.Deleted, result.Failed)
+		if result.Failed > 0 {
+			os.Exit(1)
+		}
+	case "purge-domains":
+		result, err := certService.PurgeDeletedDomains(context.Background())
+		if err != nil {
+			logger.Error("purge-domains: %s", err)
+			os.Exit(1)
+		}
+		logger.Info("purge-domains: purged: %d revoked: %d failed: %d", result.Purged, result.Revoked, result.Failed)
+		if result.Failed > 0 {
+			os.Exit(1)
+		}
+	case "migrate-schema":
+		result, err := storage.UpgradeSchema(context.Background(), domainStore, func(done int, total int) {
+			if done%100 == 0 || done == total {
+				logger.Info("migrate-schema: %d of %d records", done, total)
+			}
+		})
+		if err != nil {
+			logger.Error("migrate-schema: %s", err)
+			os.Exit(1)
+		}
+		logger.Info("migrate-schema: records: %d upgraded: %d current: %d failed: %d", result.Records, result.Upgraded, result.Current, result.Failed)
+		if result.Failed > 0 {
+			os.Exit(1)
+		}
+	case "rewrap-keys":
+		result, err := certService.RewrapKeys(context.Background())
+		if err != nil {
+			logger.Error("rewrap-keys: %s", err)
+			os.Exit(1)
+		}
+		logger.Info("rewrap-keys: rewrapped: %d encrypted: %d unchanged: %d failed: %d", result.Rewrapped, result.Encrypted, result.Unchanged, result.Failed)
+		if result.Failed > 0 {
+			os.Exit(1)
+		}
+	default:
+		logger.Error("unknown command: %s", command)
+		os.Exit(2)
+	}
+}
@@ -1,33 +1,83 @@
 package v1
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/edwinavalos/common/config"
 	"github.com/edwinavalos/common/logger"
 	"github.com/edwinavalos/dns-verifier/service/cert_service"
+	"github.com/edwinavalos/dns-verifier/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type CertificateReq struct {
 	UserId uuid.UUID `json:"user_id"`
 	Domain string    `json:"domain"`
+	// CAProfile picks the CA to order from, the configured default is used when empty
+	CAProfile string `json:"ca_profile,omitempty"`
 }
 
 type RequestCertificateResp struct {
 	Domain      string `json:"domain,omitempty"`
 	RecordName  string `json:"record_name,omitempty"`
 	RecordValue string `json:"record_value,omitempty"`
-	Error       string `json:"error,omitempty"`
+	// RetryAt is set when a rate limit budget is used up and tells when the request can be made again
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+	// Issued is set when an internal CA issued the certificate right away, there is no record to create then
+	Issued bool `json:"issued,omitempty"`
+	// ChallengeProvider is set when we published the record ourselves, the order is then completed by JobID
+	ChallengeProvider string `json:"challenge_provider,omitempty"`
+	JobID             string `json:"job_id,omitempty"`
+	Error             string `json:"error,omitempty"`
 }
 
 type CompleteCertificateRequestResp struct {
 	Domain  string `json:"domain,omitempty"`
+	JobID   string `json:"job_id,omitempty"`
 	Message string `json:"message,omitempty"`
 	Error   string `json:"error,omitempty"`
 }
 
+type ListCertificatesResp struct {
+	Certificates []cert_service.CertificateDetails `json:"certificates"`
+	Error        string                            `json:"error,omitempty"`
+}
+
+type ChallengeDelegationResp struct {
+	Delegation *cert_service.ChallengeDelegation `json:"delegation,omitempty"`
+	Error      string                            `json:"error,omitempty"`
+}
+
+type DNSProviderResp struct {
+	Settings *cert_service.RFC2136Settings `json:"settings,omitempty"`
+	Error    string                        `json:"error,omitempty"`
+}
+
+type RevokeCertificateReq struct {
+	Domain string `json:"domain"`
+}
+
+type RevokeCertificateResp struct {
+	Domain  string `json:"domain,omitempty"`
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+type AccountKeyRolloverReq struct {
+	CAProfile string `json:"ca_profile,omitempty"`
+}
+
+type AccountKeyRolloverResp struct {
+	CAProfile string `json:"ca_profile,omitempty"`
+	Message   string `json:"message,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
 type CertHandler struct {
 	certService *cert_service.Service
 	cfg         *config.Config
@@ -54,8 +104,40 @@ func (h *CertHandler) HandleRequestCertificate(c *gin.Context) {
 		return
 	}
 
-	recordName, recordValue, alreadyValid, err := h.certService.RequestCertificate(newCertReq.UserId, newCertReq.Domain, h.cfg.LEAdminEmail())
+	recordName, recordValue, alreadyValid, err := h.certService.RequestCertificate(newCertReq.UserId, newCertReq.Domain, h.cfg.LEAdminEmail(), newCertReq.CAProfile)
 	if err != nil {
+		if errors.Is(err, cert_service.ErrUnknownCAProfile) {
+			c.JSON(http.StatusBadRequest, RequestCertificateResp{
+				Domain: newCertReq.Domain,
+				Error:  err.Error(),
+			})
+			return
+		}
+		if errors.Is(err, cert_service.ErrDomainNotVerified) {
+			c.JSON(http.StatusForbidden, RequestCertificateResp{
+				Domain: newCertReq.Domain,
+				Error:  err.Error(),
+			})
+			return
+		}
+		if errors.Is(err, storage.ErrVersionConflict) {
+			c.JSON(http.StatusConflict, RequestCertificateResp{
+				Domain: newCertReq.Domain,
+				Error:  err.Error(),
+			})
+			return
+		}
+		var budgetErr *cert_service.BudgetExceededError
+		if errors.As(err, &budgetErr) {
+			c.Header("Retry-After", strconv.Itoa(int(time.Until(budgetErr.RetryAt).Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, RequestCertificateResp{
+				Domain:  newCertReq.Domain,
+				RetryAt: &budgetErr.RetryAt,
+				Error:   err.Error(),
+			})
+			return
+		}
+
 		if alreadyValid {
 			c.JSON(http.StatusAccepted, RequestCertificateResp{
 				Domain:      newCertReq.Domain,
@@ -74,14 +156,30 @@ func (h *CertHandler) HandleRequestCertificate(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, RequestCertificateResp{
+	resp := RequestCertificateResp{
 		Domain:      newCertReq.Domain,
 		RecordName:  recordName,
 		RecordValue: recordValue,
-	})
+		Issued:      recordName == "" && recordValue == "",
+	}
+	record, err := h.certService.GetIssuanceRecord(context.TODO(), newCertReq.Domain)
+	if err == nil && record.ChallengeProvider != "" && !resp.Issued {
+		// Nothing to wait on the customer for, so the order is completed right away
+		resp.ChallengeProvider = record.ChallengeProvider
+		job, err := h.certService.SubmitCompletionJob(context.TODO(), newCertReq.UserId, newCertReq.Domain)
+		if err != nil {
+			logger.Error("domain: %s unable to submit completion job: %s", newCertReq.Domain, err)
+		} else {
+			resp.JobID = job.ID.String()
+		}
+	}
+
+	c.JSON(http.StatusOK, resp)
 	return
 }
 
+// HandleCompleteCertificateRequest queues the completion of a certificate order, the outcome is polled for with
+// HandleGetJob because waiting on the CA doesn't fit in a request
 func (h *CertHandler) HandleCompleteCertificateRequest(c *gin.Context) {
 	var newCertReq CertificateReq
 	err := c.BindJSON(&newCertReq)
@@ -98,18 +196,314 @@ func (h *CertHandler) HandleCompleteCertificateRequest(c *gin.Context) {
 		return
 	}
 
-	err = h.certService.CompleteCertificateRequest(userId, domain, "")
+	job, err := h.certService.SubmitCompletionJob(context.TODO(), userId, domain)
 	if err != nil {
-		logger.Error("ran into issue complete certificate request: %s", err)
+		logger.Error("ran into issue submitting certificate completion job: %s", err)
 		c.JSON(http.StatusInternalServerError, CompleteCertificateRequestResp{
 			Error: fmt.Sprintf("domain: %s, unable to complete certificate request: %s", domain, err),
 		})
 		return
 	}
 
-	c.JSON(http.StatusOK, CompleteCertificateRequestResp{
+	c.JSON(http.StatusAccepted, CompleteCertificateRequestResp{
 		Domain:  domain,
-		Message: "got a cert",
+		JobID:   job.ID.String(),
+		Message: "certificate request is being completed",
+	})
+	return
+}
+
+func (h *CertHandler) HandleGetJob(c *gin.Context) {
+	jobID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ran into error parsing uuid: %s", err.Error())})
+		return
+	}
+
+	job, err := h.certService.GetJob(context.TODO(), jobID)
+	if err != nil {
+		if errors.Is(err, storage.ErrJobNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable to get job: %s", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, job)
+	return
+}
+
+// HandleListCertificates lists the stored certificates of a user, or of everyone when userID isn't given
+func (h *CertHandler) HandleListCertificates(c *gin.Context) {
+	filter := cert_service.CertificateFilter{
+		Issuer:  c.Query("issuer"),
+		KeyType: c.Query("keyType"),
+	}
+	if expiringWithinDays := c.Query("expiringWithinDays"); expiringWithinDays != "" {
+		days, err := strconv.Atoi(expiringWithinDays)
+		if err != nil || days < 0 {
+			c.JSON(http.StatusBadRequest, ListCertificatesResp{Error: fmt.Sprintf("invalid expiringWithinDays: %s", expiringWithinDays)})
+			return
+		}
+		filter.ExpiringWithinDays = &days
+	}
+
+	var certs []cert_service.CertificateDetails
+	userID := c.Query("userID")
+	if userID == "" {
+		var err error
+		certs, err = h.certService.ListAllCertificates(context.TODO(), filter)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ListCertificatesResp{Error: fmt.Sprintf("ran into error listing all certificates: %s", err)})
+			return
+		}
+		c.JSON(http.StatusOK, ListCertificatesResp{Certificates: certs})
+		return
+	}
+
+	userUUID, err := uuid.Parse(userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ListCertificatesResp{Error: fmt.Sprintf("ran into error parsing uuid: %s", err)})
+		return
+	}
+	certs, err = h.certService.ListUserCertificates(context.TODO(), userUUID, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ListCertificatesResp{Error: fmt.Sprintf("ran into error listing certificates for user: %s err: %s", userID, err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, ListCertificatesResp{Certificates: certs})
+	return
+}
+
+// HandleAccountKeyRollover replaces the ACME account key of a CA profile, this is an admin operation
+func (h *CertHandler) HandleAccountKeyRollover(c *gin.Context) {
+	var rolloverReq AccountKeyRolloverReq
+	err := c.BindJSON(&rolloverReq)
+	if err != nil {
+		return
+	}
+
+	err = h.certService.RolloverAccountKey(context.TODO(), rolloverReq.CAProfile)
+	if err != nil {
+		if errors.Is(err, cert_service.ErrUnknownCAProfile) {
+			c.JSON(http.StatusBadRequest, AccountKeyRolloverResp{CAProfile: rolloverReq.CAProfile, Error: err.Error()})
+			return
+		}
+		logger.Error("unable to rollover account key: %s", err)
+		c.JSON(http.StatusInternalServerError, AccountKeyRolloverResp{
+			CAProfile: rolloverReq.CAProfile,
+			Error:     fmt.Sprintf("unable to rollover account key: %s", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, AccountKeyRolloverResp{
+		CAProfile: rolloverReq.CAProfile,
+		Message:   "account key rolled over",
+	})
+	return
+}
+
+// HandleDownloadCertificate returns the PEM chain of a domain, ACME and internal CA certificates alike
+func (h *CertHandler) HandleDownloadCertificate(c *gin.Context) {
+	domain := c.Query("domain")
+	userID, err := uuid.Parse(c.Query("userID"))
+	if err != nil || domain == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing userID or domain in request"})
+		return
+	}
+
+	chainPEM, err := h.certService.GetCertificateChainPEM(context.TODO(), userID, domain)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("no certificate for: %s", domain)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable to get certificate: %s", err)})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/pem-certificate-chain", chainPEM)
+	return
+}
+
+// HandleCreateChallengeDelegation returns the name the customer CNAMEs _acme-challenge.<domain> to, after which we
+// publish the challenges of every order and renewal ourselves
+func (h *CertHandler) HandleCreateChallengeDelegation(c *gin.Context) {
+	var delegationReq CertificateReq
+	err := c.BindJSON(&delegationReq)
+	if err != nil {
+		return
+	}
+	if delegationReq.UserId == uuid.Nil || delegationReq.Domain == "" {
+		c.JSON(http.StatusBadRequest, ChallengeDelegationResp{Error: "missing user_id or domain in request"})
+		return
+	}
+
+	delegation, err := h.certService.CreateChallengeDelegation(context.TODO(), delegationReq.UserId, delegationReq.Domain)
+	if err != nil {
+		if errors.Is(err, cert_service.ErrChallengeDNSDisabled) {
+			c.JSON(http.StatusNotFound, ChallengeDelegationResp{Error: err.Error()})
+			return
+		}
+		if errors.Is(err, cert_service.ErrDomainNotVerified) {
+			c.JSON(http.StatusForbidden, ChallengeDelegationResp{Error: err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ChallengeDelegationResp{Error: fmt.Sprintf("unable to create challenge delegation: %s", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, ChallengeDelegationResp{Delegation: &delegation})
+	return
+}
+
+// HandlePutDNSProvider stores the RFC 2136 settings we publish the challenges of a domain with, the TSIG secret
+// isn't returned
+func (h *CertHandler) HandlePutDNSProvider(c *gin.Context) {
+	var providerReq cert_service.RFC2136Settings
+	err := c.BindJSON(&providerReq)
+	if err != nil {
+		return
+	}
+	if providerReq.UserID == uuid.Nil || providerReq.Domain == "" {
+		c.JSON(http.StatusBadRequest, DNSProviderResp{Error: "missing user_id or domain in request"})
+		return
+	}
+
+	err = h.certService.PutRFC2136Settings(context.TODO(), providerReq)
+	if err != nil {
+		if errors.Is(err, cert_service.ErrInvalidDNSProvider) {
+			c.JSON(http.StatusBadRequest, DNSProviderResp{Error: err.Error()})
+			return
+		}
+		if errors.Is(err, cert_service.ErrDomainNotVerified) {
+			c.JSON(http.StatusForbidden, DNSProviderResp{Error: err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, DNSProviderResp{Error: fmt.Sprintf("unable to save dns provider: %s", err)})
+		return
+	}
+
+	settings, err := h.certService.GetRFC2136Settings(context.TODO(), providerReq.UserID, providerReq.Domain)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, DNSProviderResp{Error: fmt.Sprintf("unable to get dns provider: %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, DNSProviderResp{Settings: &settings})
+	return
+}
+
+// HandleGetDNSProvider returns the RFC 2136 settings of a domain without the TSIG secret
+func (h *CertHandler) HandleGetDNSProvider(c *gin.Context) {
+	domain := c.Query("domain")
+	userID, err := uuid.Parse(c.Query("userID"))
+	if err != nil || domain == "" {
+		c.JSON(http.StatusBadRequest, DNSProviderResp{Error: "missing userID or domain in request"})
+		return
+	}
+
+	settings, err := h.certService.GetRFC2136Settings(context.TODO(), userID, domain)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			c.JSON(http.StatusNotFound, DNSProviderResp{Error: fmt.Sprintf("no dns provider for: %s", domain)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, DNSProviderResp{Error: fmt.Sprintf("unable to get dns provider: %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, DNSProviderResp{Settings: &settings})
+	return
+}
+
+// HandleDeleteDNSProvider goes back to returning the challenge record of a domain for the customer to create
+func (h *CertHandler) HandleDeleteDNSProvider(c *gin.Context) {
+	domain := c.Query("domain")
+	userID, err := uuid.Parse(c.Query("userID"))
+	if err != nil || domain == "" {
+		c.JSON(http.StatusBadRequest, DNSProviderResp{Error: "missing userID or domain in request"})
+		return
+	}
+
+	err = h.certService.DeleteRFC2136Settings(context.TODO(), userID, domain)
+	if err != nil {
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			c.JSON(http.StatusNotFound, DNSProviderResp{Error: fmt.Sprintf("no dns provider for: %s", domain)})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, DNSProviderResp{Error: fmt.Sprintf("unable to delete dns provider: %s", err)})
+		return
+	}
+	c.JSON(http.StatusOK, DNSProviderResp{})
+	return
+}
+
+// HandleGetCARoot returns the root certificate of an internal CA profile
+func (h *CertHandler) HandleGetCARoot(c *gin.Context) {
+	rootPEM, err := h.certService.InternalCARoot(context.TODO(), c.Param("profile"))
+	if err != nil {
+		if errors.Is(err, cert_service.ErrUnknownCAProfile) || errors.Is(err, cert_service.ErrNotInternalCA) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable to get root: %s", err)})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/x-pem-file", rootPEM)
+	return
+}
+
+// HandleGetCRL returns the CRL of an internal CA profile, this is the crl_url put in the certificates it issues
+func (h *CertHandler) HandleGetCRL(c *gin.Context) {
+	crl, err := h.certService.InternalCACRL(context.TODO(), c.Param("profile"))
+	if err != nil {
+		if errors.Is(err, cert_service.ErrUnknownCAProfile) || errors.Is(err, cert_service.ErrNotInternalCA) {
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable to get crl: %s", err)})
+		return
+	}
+
+	c.Data(http.StatusOK, "application/pkix-crl", crl)
+	return
+}
+
+// HandleRevokeInternalCertificate puts the certificate of a domain on its internal CA's CRL, this is an admin operation
+func (h *CertHandler) HandleRevokeInternalCertificate(c *gin.Context) {
+	var revokeReq RevokeCertificateReq
+	err := c.BindJSON(&revokeReq)
+	if err != nil {
+		return
+	}
+	if revokeReq.Domain == "" {
+		c.JSON(http.StatusBadRequest, RevokeCertificateResp{Error: "missing domain in request"})
+		return
+	}
+
+	err = h.certService.RevokeInternalCertificate(context.TODO(), revokeReq.Domain)
+	if err != nil {
+		if errors.Is(err, cert_service.ErrNotInternalCA) {
+			c.JSON(http.StatusBadRequest, RevokeCertificateResp{Domain: revokeReq.Domain, Error: err.Error()})
+			return
+		}
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			c.JSON(http.StatusNotFound, RevokeCertificateResp{Domain: revokeReq.Domain, Error: err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, RevokeCertificateResp{
+			Domain: revokeReq.Domain,
+			Error:  fmt.Sprintf("unable to revoke certificate: %s", err),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, RevokeCertificateResp{
+		Domain:  revokeReq.Domain,
+		Message: "certificate revoked",
 	})
 	return
 }
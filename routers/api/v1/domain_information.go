@@ -2,12 +2,16 @@ package v1
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/edwinavalos/common/models"
 	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 type GenerateOwnershipKeyReq struct {
@@ -35,6 +39,12 @@ type DomainVerificationResp struct {
 
 type VerifyDomainsResp map[string]DomainVerificationResp
 
+type ListDomainsResp struct {
+	Domains    []models.DomainInformation `json:"domains"`
+	NextCursor string                     `json:"next_cursor,omitempty"`
+	Error      string                     `json:"error,omitempty"`
+}
+
 type CreateDomainInformationReq struct {
 	DomainName string    `json:"domain_name"`
 	UserID     uuid.UUID `json:"user_id"`
@@ -43,12 +53,34 @@ type CreateDomainInformationReq struct {
 type DeleteDomainInformationReq struct {
 	DomainName string    `json:"domain_name"`
 	UserID     uuid.UUID `json:"user_id"`
+	Reason     string    `json:"reason"`
+	// DeletedBy defaults to the user the domain belongs to, admins deleting a domain put themselves here
+	DeletedBy string `json:"deleted_by"`
 }
 
 type DeleteDomainInformationResp struct {
-	DomainName string `json:"domain_name,omitempty"`
-	Message    string `json:"message,omitempty"`
-	Error      string `json:"error,omitempty"`
+	DomainName string             `json:"domain_name,omitempty"`
+	Message    string             `json:"message,omitempty"`
+	Deleted    *storage.Tombstone `json:"deleted,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+type DomainHistoryResp struct {
+	DomainName string                       `json:"domain_name,omitempty"`
+	Deleted    *storage.Tombstone           `json:"deleted,omitempty"`
+	Pending    *storage.PendingVerification `json:"pending,omitempty"`
+	History    []storage.AuditEvent         `json:"history"`
+	Error      string                       `json:"error,omitempty"`
+}
+
+type RestoreDomainReq struct {
+	DomainName string    `json:"domain_name"`
+	UserID     uuid.UUID `json:"user_id"`
+}
+
+type AwardClaimReq struct {
+	DomainName string    `json:"domain_name"`
+	UserID     uuid.UUID `json:"user_id"`
 }
 
 type Record string
@@ -74,33 +106,68 @@ func NewDomainHandler(service *domain_service.Service) *DomainHandler {
 	}
 }
 
+// HandleGetDomainInformation lists domains a page at a time, of one user when userID is given. The filters are
+// verified, hasCertificate, delegation (arecord or cname) and prefix, the next page is asked for with the returned
+// next_cursor.
 func (d *DomainHandler) HandleGetDomainInformation(c *gin.Context) {
-	var retRecords map[string]models.DomainInformation
-	userID := c.Query("userID")
-	if userID == "" {
-		retRecordMap, err := d.domainService.GetAllRecords(context.TODO())
+	var filter storage.DomainFilter
+	if userID := c.Query("userID"); userID != "" {
+		userUUID, err := uuid.Parse(userID)
 		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("ran into error getting all records: %s", err.Error())})
+			c.JSON(http.StatusBadRequest, ListDomainsResp{Error: fmt.Sprintf("ran into error parsing uuid: %s", err.Error())})
 			return
 		}
-		c.JSON(http.StatusOK, retRecordMap)
+		filter.UserID = userUUID
+	}
+	var err error
+	filter.Verified, err = boolQuery(c, "verified")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ListDomainsResp{Error: err.Error()})
 		return
 	}
-	userUUID, err := uuid.Parse(userID)
+	filter.HasCertificate, err = boolQuery(c, "hasCertificate")
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ran into error parsing uuid: %s", err.Error())})
+		c.JSON(http.StatusBadRequest, ListDomainsResp{Error: err.Error()})
 		return
 	}
-	retRecords, err = d.domainService.GetUserDomains(context.TODO(), userUUID)
+	filter.Delegation = c.Query("delegation")
+	filter.NamePrefix = c.Query("prefix")
+
+	limit := 0
+	if c.Query("limit") != "" {
+		limit, err = strconv.Atoi(c.Query("limit"))
+		if err != nil || limit <= 0 || limit > storage.MaxPageSize {
+			c.JSON(http.StatusBadRequest, ListDomainsResp{Error: fmt.Sprintf("limit must be between 1 and %d", storage.MaxPageSize)})
+			return
+		}
+	}
+
+	page, err := d.domainService.ListDomains(context.TODO(), filter, limit, c.Query("cursor"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("ran into error creating user recordmap: %s", err.Error())})
+		if errors.Is(err, storage.ErrInvalidCursor) || errors.Is(err, storage.ErrInvalidFilter) {
+			c.JSON(http.StatusBadRequest, ListDomainsResp{Error: err.Error()})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ListDomainsResp{Error: fmt.Sprintf("ran into error listing domains: %s", err.Error())})
 		return
 	}
 
-	c.JSON(http.StatusOK, retRecords)
+	c.JSON(http.StatusOK, ListDomainsResp{Domains: page.Domains, NextCursor: page.NextCursor})
 	return
 }
 
+// boolQuery parses an optional true/false query parameter, nil when it isn't given
+func boolQuery(c *gin.Context, name string) (*bool, error) {
+	if c.Query(name) == "" {
+		return nil, nil
+	}
+	value, err := strconv.ParseBool(c.Query(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", name)
+	}
+	return &value, nil
+}
+
 // HandleGenerateOwnershipKey
 // TODO: This behavior of wiping out the verification is probably too stronk, need to make it only create one if
 //
@@ -115,6 +182,10 @@ func (d *DomainHandler) HandleGenerateOwnershipKey(c *gin.Context) {
 	domainName := newGenerateOwnershipKeyReq.DomainName
 	userID := newGenerateOwnershipKeyReq.UserID
 	verificationKey, err := d.domainService.GenerateOwnershipKey(context.TODO(), userID, domainName)
+	if errors.Is(err, storage.ErrVersionConflict) {
+		c.JSON(http.StatusConflict, GenerateOwnershipKeyResp{DomainName: domainName, Error: err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, GenerateOwnershipKeyResp{Error: fmt.Sprintf("unable to generate ownership key: %s", err)})
 		return
@@ -142,30 +213,36 @@ func (d *DomainHandler) HandleVerifyOwnership(c *gin.Context) {
 
 	domainName := newVerifyOwnershipReq.DomainName
 	userID := newVerifyOwnershipReq.UserID
-	domain, err := d.domainService.GetDomainByUser(context.TODO(), userID, domainName)
+	_, err = d.domainService.GetDomainByUser(context.TODO(), userID, domainName)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("unable to find given user: %s with domain: %s", userID, domainName)})
 		return
 	}
 
-	result, err := d.domainService.VerifyTXTRecord(c, domain.Verification.Zone, domain.Verification.Key)
+	result, err := d.domainService.VerifyOwnership(context.TODO(), userID, domainName)
 	if err != nil {
+		if errors.Is(err, domain_service.ErrDomainClaimed) {
+			c.JSON(http.StatusConflict, VerifyDomainResp{DomainName: domainName, Error: err.Error()})
+			return
+		}
+		if errors.Is(err, domain_service.ErrClaimPendingReview) {
+			c.JSON(http.StatusAccepted, VerifyDomainResp{DomainName: domainName, Error: err.Error()})
+			return
+		}
+		if errors.Is(err, domain_service.ErrNoVerificationKey) {
+			c.JSON(http.StatusBadRequest, VerifyDomainResp{DomainName: domainName, Error: err.Error()})
+			return
+		}
+		if errors.Is(err, storage.ErrVersionConflict) {
+			c.JSON(http.StatusConflict, VerifyDomainResp{DomainName: domainName, Error: err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable to verify domain: %s", err)})
 		return
 	}
 
-	if domain.Verification.Verified != result {
-		domain.Verification.Verified = result
-	}
-
-	err = d.domainService.PutDomain(context.TODO(), domain)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err})
-		return
-	}
-
 	c.JSON(http.StatusOK, VerifyDomainResp{
-		DomainName: domain.DomainName,
+		DomainName: domainName,
 		Status:     result,
 	})
 
@@ -231,7 +308,15 @@ func (d *DomainHandler) HandleCreateDomainInformation(c *gin.Context) {
 		DomainName: domain,
 		UserID:     userID,
 	}
-	err = d.domainService.PutDomain(context.TODO(), newDomain)
+	err = d.domainService.CreateDomain(context.TODO(), newDomain)
+	if errors.Is(err, domain_service.ErrDomainExists) {
+		c.JSON(http.StatusAccepted, gin.H{"message": "DomainInformation already exists"})
+		return
+	}
+	if errors.Is(err, domain_service.ErrDomainDeleted) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("domain: %s is deleted, restore it instead", domain)})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("ran into error putting domain: %s err: %s", domain, err)})
 		return
@@ -249,13 +334,51 @@ func (d *DomainHandler) HandleDeleteDomainInformation(c *gin.Context) {
 
 	domainName := newDeleteDomainInformationReq.DomainName
 	userID := newDeleteDomainInformationReq.UserID
-	err := d.domainService.DeleteDomain(context.TODO(), userID, domainName)
+	tombstone, err := d.domainService.DeleteDomain(context.TODO(), userID, domainName, newDeleteDomainInformationReq.DeletedBy, newDeleteDomainInformationReq.Reason)
+	if errors.Is(err, domain_service.ErrDomainDeleted) {
+		c.JSON(http.StatusAccepted, DeleteDomainInformationResp{DomainName: domainName, Message: fmt.Sprintf("%s is already deleted", domainName)})
+		return
+	}
+	if errors.Is(err, storage.ErrVersionConflict) {
+		c.JSON(http.StatusConflict, DeleteDomainInformationResp{Error: fmt.Sprintf("unable to delete domain: %s err %s", domainName, err)})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, DeleteDomainInformationResp{Error: fmt.Sprintf("unable to delete domain: %s err %s", domainName, err)})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%s deleted", domainName)})
+	c.JSON(http.StatusOK, DeleteDomainInformationResp{
+		DomainName: domainName,
+		Message:    fmt.Sprintf("%s deleted, it can be restored until %s", domainName, tombstone.PurgeAfter.Format(time.RFC3339)),
+		Deleted:    &tombstone,
+	})
+	return
+}
+
+func (d *DomainHandler) HandleRestoreDomain(c *gin.Context) {
+	var restoreDomainReq RestoreDomainReq
+	err := c.BindJSON(&restoreDomainReq)
+	if err != nil {
+		return
+	}
+
+	domainName := restoreDomainReq.DomainName
+	err = d.domainService.RestoreDomain(context.TODO(), restoreDomainReq.UserID, domainName)
+	if errors.Is(err, domain_service.ErrDomainNotDeleted) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("domain: %s is not deleted", domainName)})
+		return
+	}
+	if errors.Is(err, storage.ErrVersionConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("unable to restore domain: %s err: %s", domainName, err)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable to restore domain: %s err: %s", domainName, err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%s restored", domainName)})
 	return
 }
 
@@ -284,3 +407,75 @@ func (d *DomainHandler) HandleVerifyDelegation(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"verified": verified})
 	return
 }
+
+// HandleGetDomainClaims returns every user's entry for a domain name
+// HandleGetDomainHistory returns the audit history of one domain, it stays available while the domain is deleted
+func (d *DomainHandler) HandleGetDomainHistory(c *gin.Context) {
+	domainName := c.Query("domain")
+	userID, err := uuid.Parse(c.Query("userID"))
+	if domainName == "" || err != nil {
+		c.JSON(http.StatusBadRequest, DomainHistoryResp{Error: "missing domain or valid userID in request"})
+		return
+	}
+
+	record, err := d.domainService.GetDomainHistory(context.TODO(), userID, domainName)
+	if err != nil {
+		c.JSON(http.StatusNotFound, DomainHistoryResp{DomainName: domainName, Error: err.Error()})
+		return
+	}
+
+	history := record.History
+	if history == nil {
+		history = []storage.AuditEvent{}
+	}
+	c.JSON(http.StatusOK, DomainHistoryResp{
+		DomainName: domainName,
+		Deleted:    record.Deleted,
+		Pending:    record.Pending,
+		History:    history,
+	})
+	return
+}
+
+func (d *DomainHandler) HandleGetDomainClaims(c *gin.Context) {
+	domainName := c.Query("domain")
+	if domainName == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing domain in request"})
+		return
+	}
+
+	claims, err := d.domainService.GetDomainClaims(context.TODO(), domainName)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable to get claims for: %s: %s", domainName, err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, claims)
+	return
+}
+
+// HandleAwardClaim settles a contested domain in favour of one user
+func (d *DomainHandler) HandleAwardClaim(c *gin.Context) {
+	var awardReq AwardClaimReq
+	err := c.BindJSON(&awardReq)
+	if err != nil {
+		return
+	}
+	if awardReq.DomainName == "" || awardReq.UserID == uuid.Nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing domain_name or user_id"})
+		return
+	}
+
+	err = d.domainService.AwardClaim(context.TODO(), awardReq.UserID, awardReq.DomainName)
+	if errors.Is(err, storage.ErrVersionConflict) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("unable to award claim: %s", err)})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": fmt.Sprintf("%s awarded to: %s", awardReq.DomainName, awardReq.UserID)})
+	return
+}
@@ -17,6 +17,8 @@ func InitRouter(conf *config.Config, domainService *domain_service.Service, cert
 	{
 		apiv1.POST("/domain", v1DomainHandler.HandleCreateDomainInformation)
 		apiv1.DELETE("/domain", v1DomainHandler.HandleDeleteDomainInformation)
+		apiv1.POST("/domain/restore", v1DomainHandler.HandleRestoreDomain)
+		apiv1.GET("/domain/history", v1DomainHandler.HandleGetDomainHistory)
 
 		apiv1.POST("/domain/verificationKey", v1DomainHandler.HandleGenerateOwnershipKey)
 		//apiv1.DELETE("/domain/verification", v1.HandleDeleteVerification)
@@ -30,6 +32,21 @@ func InitRouter(conf *config.Config, domainService *domain_service.Service, cert
 
 		apiv1.POST("/cert/request", v1CertHandler.HandleRequestCertificate)
 		apiv1.POST("/cert/complete", v1CertHandler.HandleCompleteCertificateRequest)
+		apiv1.GET("/cert/jobs/:id", v1CertHandler.HandleGetJob)
+		apiv1.GET("/certs", v1CertHandler.HandleListCertificates)
+		apiv1.GET("/cert", v1CertHandler.HandleDownloadCertificate)
+		apiv1.POST("/cert/delegation", v1CertHandler.HandleCreateChallengeDelegation)
+		apiv1.PUT("/cert/dnsProvider", v1CertHandler.HandlePutDNSProvider)
+		apiv1.GET("/cert/dnsProvider", v1CertHandler.HandleGetDNSProvider)
+		apiv1.DELETE("/cert/dnsProvider", v1CertHandler.HandleDeleteDNSProvider)
+
+		apiv1.GET("/ca/:profile/root", v1CertHandler.HandleGetCARoot)
+		apiv1.GET("/ca/:profile/crl", v1CertHandler.HandleGetCRL)
+
+		apiv1.POST("/admin/acme/keyRollover", v1CertHandler.HandleAccountKeyRollover)
+		apiv1.POST("/admin/ca/revoke", v1CertHandler.HandleRevokeInternalCertificate)
+		apiv1.GET("/admin/domain/claims", v1DomainHandler.HandleGetDomainClaims)
+		apiv1.POST("/admin/domain/claim", v1DomainHandler.HandleAwardClaim)
 	}
 	return r
 }
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/service/cert_service"
+	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTLSAddr            = ":8443"
+	defaultTLSRefreshInterval = 10 * time.Minute
+	defaultTLSCacheSize       = 10000
+	// missingCertificateTTL keeps names we have no certificate for from hitting the file store on every handshake
+	missingCertificateTTL  = time.Minute
+	loadCertificateTimeout = 5 * time.Second
+)
+
+// NewTLSServer returns an HTTPS server that terminates TLS for our verified custom domains with the certificates
+// cert_service stored for them and hands the requests to handler. The management API is never served on customer
+// domains, a nil handler answers every request with 404.
+func NewTLSServer(settings appconfig.TLSSettings, domainService *domain_service.Service, certService *cert_service.Service, handler http.Handler) *http.Server {
+	if settings.Addr == "" {
+		settings.Addr = defaultTLSAddr
+	}
+	if settings.RefreshInterval <= 0 {
+		settings.RefreshInterval = defaultTLSRefreshInterval
+	}
+	if settings.CacheSize <= 0 {
+		settings.CacheSize = defaultTLSCacheSize
+	}
+
+	if handler == nil {
+		handler = http.NotFoundHandler()
+	}
+	cache := newCertificateCache(domainService, certService, settings.RefreshInterval, settings.CacheSize)
+	return &http.Server{
+		Addr:    settings.Addr,
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: cache.GetCertificate,
+		},
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+	}
+}
+
+// errDomainNotServed is returned for names without a verified claim that isn't deleted
+var errDomainNotServed = errors.New("domain isn't verified")
+
+type cachedCertificate struct {
+	name       string
+	cert       *tls.Certificate
+	err        error
+	loadedAt   time.Time
+	refreshing bool
+}
+
+// certificateCache keeps the certificates we serve in memory. Entries older than the refresh interval keep being
+// served while they are reloaded in the background, which is how renewals get picked up without a restart. The cache
+// holds at most maxEntries names and drops the least recently used one when it is full, so clients sending random
+// server names can't grow it.
+type certificateCache struct {
+	domainService   *domain_service.Service
+	certService     *cert_service.Service
+	refreshInterval time.Duration
+	maxEntries      int
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order has the most recently used entry at the front
+	order *list.List
+}
+
+func newCertificateCache(domainService *domain_service.Service, certService *cert_service.Service, refreshInterval time.Duration, maxEntries int) *certificateCache {
+	return &certificateCache{
+		domainService:   domainService,
+		certService:     certService,
+		refreshInterval: refreshInterval,
+		maxEntries:      maxEntries,
+		entries:         map[string]*list.Element{},
+		order:           list.New(),
+	}
+}
+
+func (c *certificateCache) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	if name == "" {
+		return nil, fmt.Errorf("client didn't send a server name")
+	}
+
+	c.mu.Lock()
+	if element, ok := c.entries[name]; ok {
+		entry := element.Value.(*cachedCertificate)
+		if entry.cert != nil {
+			c.order.MoveToFront(element)
+			stale := time.Since(entry.loadedAt) > c.refreshInterval || time.Now().After(entry.cert.Leaf.NotAfter)
+			if stale && !entry.refreshing {
+				entry.refreshing = true
+				go c.refresh(name)
+			}
+			c.mu.Unlock()
+			return entry.cert, nil
+		}
+		if time.Since(entry.loadedAt) < missingCertificateTTL {
+			c.order.MoveToFront(element)
+			c.mu.Unlock()
+			return nil, entry.err
+		}
+		c.remove(element)
+	}
+	c.mu.Unlock()
+
+	return c.load(name)
+}
+
+func (c *certificateCache) load(name string) (*tls.Certificate, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), loadCertificateTimeout)
+	defer cancel()
+
+	cert, err := c.lookup(ctx, name)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) && !errors.Is(err, errDomainNotServed) {
+		logger.Error("domain: %s unable to load certificate: %s", name, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[name]; ok {
+		previous := element.Value.(*cachedCertificate)
+		// A certificate we already serve is kept when a reload fails, but not once its domain is unverified or deleted
+		if previous.cert != nil && err != nil && !errors.Is(err, errDomainNotServed) {
+			previous.refreshing = false
+			previous.loadedAt = time.Now()
+			return previous.cert, nil
+		}
+		c.remove(element)
+	}
+	if err != nil {
+		err = fmt.Errorf("no certificate for: %s", name)
+	}
+	c.add(&cachedCertificate{
+		name:     name,
+		cert:     cert,
+		err:      err,
+		loadedAt: time.Now(),
+	})
+	return cert, err
+}
+
+// lookup only reads the file store for names a user verified, so unknown names cost one domain store read
+func (c *certificateCache) lookup(ctx context.Context, name string) (*tls.Certificate, error) {
+	verified, err := c.domainService.HasVerifiedClaim(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, fmt.Errorf("domain: %s %w", name, errDomainNotServed)
+	}
+	return c.certService.LoadTLSCertificate(ctx, name)
+}
+
+func (c *certificateCache) refresh(name string) {
+	_, _ = c.load(name)
+}
+
+// add expects c.mu to be held
+func (c *certificateCache) add(entry *cachedCertificate) {
+	c.entries[entry.name] = c.order.PushFront(entry)
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove expects c.mu to be held
+func (c *certificateCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*cachedCertificate).name)
+}
@@ -0,0 +1,258 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/encryption"
+	"github.com/edwinavalos/dns-verifier/service/cert_service"
+	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.New()
+	os.Exit(m.Run())
+}
+
+type tlsTestEnv struct {
+	domainService *domain_service.Service
+	certService   *cert_service.Service
+	userID        uuid.UUID
+}
+
+func newTLSTestEnv(t *testing.T) *tlsTestEnv {
+	t.Helper()
+	wrapper, err := encryption.NewLocalKeyWrapper(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	domainService := domain_service.New(nil, storage.NewMemoryDomainStore())
+	return &tlsTestEnv{
+		domainService: domainService,
+		certService:   cert_service.New(nil, storage.NewMemoryFileStore(), domainService, cert_service.WithSealer(encryption.NewSealer(wrapper))),
+		userID:        uuid.New(),
+	}
+}
+
+// addDomain stores the domain and a self-signed certificate for it
+func (e *tlsTestEnv) addDomain(t *testing.T, domain string, verified bool) {
+	t.Helper()
+	ctx := context.Background()
+	err := e.domainService.CreateDomain(ctx, models.DomainInformation{
+		DomainName:   domain,
+		UserID:       e.userID,
+		Verification: models.Verification{Verified: verified},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = e.certService.WriteToStorage(ctx, privateKey, domain, [][]byte{der})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// serve starts the TLS server on a localhost port and returns its address
+func (e *tlsTestEnv) serve(t *testing.T, settings appconfig.TLSSettings) string {
+	t.Helper()
+	return e.serveHandler(t, settings, nil)
+}
+
+func (e *tlsTestEnv) serveHandler(t *testing.T, settings appconfig.TLSSettings, handler http.Handler) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewTLSServer(settings, e.domainService, e.certService, handler)
+	go func() { _ = srv.ServeTLS(listener, "", "") }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return listener.Addr().String()
+}
+
+func handshake(addr string, serverName string) (*x509.Certificate, error) {
+	conn, err := tls.Dial("tcp", addr, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0], nil
+}
+
+func TestTLSServerOnlyServesVerifiedDomains(t *testing.T) {
+	env := newTLSTestEnv(t)
+	env.addDomain(t, "verified.example.com", true)
+	env.addDomain(t, "pending.example.com", false)
+	env.addDomain(t, "deleted.example.com", true)
+	_, err := env.domainService.DeleteDomain(context.Background(), env.userID, "deleted.example.com", "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := env.serve(t, appconfig.TLSSettings{})
+
+	cert, err := handshake(addr, "Verified.Example.com.")
+	if err != nil {
+		t.Fatalf("handshake for verified.example.com: %s", err)
+	}
+	if cert.Subject.CommonName != "verified.example.com" {
+		t.Errorf("served certificate for: %s", cert.Subject.CommonName)
+	}
+
+	for _, name := range []string{"pending.example.com", "deleted.example.com", "unknown.example.com"} {
+		if _, err := handshake(addr, name); err == nil {
+			t.Errorf("handshake for %s succeeded, want it refused", name)
+		}
+	}
+}
+
+func TestCertificateCacheDropsDeletedDomainsOnRefresh(t *testing.T) {
+	env := newTLSTestEnv(t)
+	env.addDomain(t, "verified.example.com", true)
+	cache := newCertificateCache(env.domainService, env.certService, time.Hour, 10)
+	hello := &tls.ClientHelloInfo{ServerName: "verified.example.com"}
+
+	if _, err := cache.GetCertificate(hello); err != nil {
+		t.Fatal(err)
+	}
+	_, err := env.domainService.DeleteDomain(context.Background(), env.userID, "verified.example.com", "test", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.load("verified.example.com"); err == nil {
+		t.Fatal("reload after the domain was deleted kept serving its certificate")
+	}
+	if _, err := cache.GetCertificate(hello); err == nil {
+		t.Fatal("deleted domain's certificate is still served")
+	}
+}
+
+func TestCertificateCacheIsBounded(t *testing.T) {
+	env := newTLSTestEnv(t)
+	env.addDomain(t, "verified.example.com", true)
+	cache := newCertificateCache(env.domainService, env.certService, time.Hour, 5)
+
+	if _, err := cache.GetCertificate(&tls.ClientHelloInfo{ServerName: "verified.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		_, _ = cache.GetCertificate(&tls.ClientHelloInfo{ServerName: fmt.Sprintf("random-%d.example.com", i)})
+		// The verified name keeps being used so it stays cached
+		if i%2 == 0 {
+			if _, err := cache.GetCertificate(&tls.ClientHelloInfo{ServerName: "verified.example.com"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.order.Len() != 5 || len(cache.entries) != 5 {
+		t.Fatalf("cache holds %d names, %d in the index, want 5", cache.order.Len(), len(cache.entries))
+	}
+	if _, ok := cache.entries["verified.example.com"]; !ok {
+		t.Error("recently used verified.example.com was evicted")
+	}
+	if _, ok := cache.entries["random-0.example.com"]; ok {
+		t.Error("least recently used random-0.example.com wasn't evicted")
+	}
+}
+
+func TestCertificateCacheExpiresMissingNames(t *testing.T) {
+	env := newTLSTestEnv(t)
+	cache := newCertificateCache(env.domainService, env.certService, time.Hour, 10)
+	hello := &tls.ClientHelloInfo{ServerName: "later.example.com"}
+
+	if _, err := cache.GetCertificate(hello); err == nil {
+		t.Fatal("unknown name was served")
+	}
+	env.addDomain(t, "later.example.com", true)
+	// Still the cached miss until missingCertificateTTL passes
+	if _, err := cache.GetCertificate(hello); err == nil {
+		t.Fatal("cached miss wasn't used")
+	}
+
+	cache.mu.Lock()
+	cache.entries["later.example.com"].Value.(*cachedCertificate).loadedAt = time.Now().Add(-missingCertificateTTL)
+	cache.mu.Unlock()
+	if _, err := cache.GetCertificate(hello); err != nil {
+		t.Fatalf("expired miss wasn't reloaded: %s", err)
+	}
+}
+
+// get requests path from addr over TLS for serverName
+func get(t *testing.T, addr string, serverName string, path string) (int, string) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+	}}
+	resp, err := client.Get("https://" + addr + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+func TestTLSServerDoesNotServeManagementAPI(t *testing.T) {
+	env := newTLSTestEnv(t)
+	env.addDomain(t, "verified.example.com", true)
+	addr := env.serve(t, appconfig.TLSSettings{})
+
+	for _, path := range []string{"/api/v1/admin/domain/claims", "/api/v1/admin/acme/keyRollover", "/"} {
+		status, _ := get(t, addr, "verified.example.com", path)
+		if status != http.StatusNotFound {
+			t.Errorf("GET %s = %d, want 404", path, status)
+		}
+	}
+}
+
+func TestTLSServerUsesHandler(t *testing.T) {
+	env := newTLSTestEnv(t)
+	env.addDomain(t, "verified.example.com", true)
+	addr := env.serveHandler(t, appconfig.TLSSettings{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "hello "+r.Host)
+	}))
+
+	status, body := get(t, addr, "verified.example.com", "/")
+	if status != http.StatusOK || body != "hello "+addr {
+		t.Errorf("GET / = %d %q", status, body)
+	}
+}
@@ -0,0 +1,417 @@
+package backup_service
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/dns-verifier/encryption"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"io"
+	"strings"
+	"time"
+)
+
+// FormatVersion is written to the manifest of every archive, restores refuse archives from a newer version. Version
+// 2 added the name claims.
+const FormatVersion = 2
+
+const (
+	manifestEntry = "manifest.json"
+	domainsEntry  = "domains.jsonl"
+	claimsEntry   = "claims.jsonl"
+	objectsDir    = "objects/"
+
+	MergeMode     = "merge"
+	OverwriteMode = "overwrite"
+)
+
+// objectPrefixes are the parts of the file store this service writes, the bucket can be shared with others
+var objectPrefixes = []string{
+	"mastodon_le_certs/",
+	"acme_accounts/",
+	"acme_ledger/",
+	"challenge_dns/",
+	"internal_ca/",
+}
+
+var (
+	ErrUnsupportedArchive = errors.New("unsupported backup archive")
+	ErrUnknownRestoreMode = errors.New("unknown restore mode")
+)
+
+// Manifest describes an archive, it is its first entry
+type Manifest struct {
+	FormatVersion int       `json:"format_version"`
+	CreatedAt     time.Time `json:"created_at"`
+	Users         int       `json:"users"`
+	Domains       int       `json:"domains"`
+	Claims        int       `json:"claims"`
+	Objects       int       `json:"objects"`
+}
+
+// RestoreOptions choose what a restore does with domains and objects that already exist
+type RestoreOptions struct {
+	// Mode is MergeMode, which keeps what exists, or OverwriteMode, which replaces it with the archived copy
+	Mode string
+	// DryRun counts what would be restored without writing anything
+	DryRun bool
+}
+
+type RestoreCounts struct {
+	Created     int `json:"created"`
+	Overwritten int `json:"overwritten"`
+	Skipped     int `json:"skipped"`
+	Failed      int `json:"failed"`
+}
+
+type RestoreResult struct {
+	Domains RestoreCounts `json:"domains"`
+	Claims  RestoreCounts `json:"claims"`
+	Objects RestoreCounts `json:"objects"`
+}
+
+// Service writes the domain store and the certificate objects to a single archive and restores them from it. The
+// archive is a gzipped tar of a manifest, the domain records and name claims as JSON lines and the objects as files,
+// it doesn't
+// depend on the domain store backend so it can be restored into another one.
+type Service struct {
+	domainStore storage.DomainStore
+	fileStorage storage.CertificateStore
+	sealer      *encryption.Sealer
+}
+
+func New(domainStore storage.DomainStore, fileStorage storage.CertificateStore, sealer *encryption.Sealer) *Service {
+	return &Service{
+		domainStore: domainStore,
+		fileStorage: fileStorage,
+		sealer:      sealer,
+	}
+}
+
+// Backup writes an archive of every domain record and certificate object to w. An encrypted archive is sealed with
+// the configured master key and needs it to be restored. Private keys are copied as stored, so they stay sealed in
+// either case.
+func (s *Service) Backup(ctx context.Context, w io.Writer, encrypt bool) (Manifest, error) {
+	if !encrypt {
+		return s.writeArchive(ctx, w)
+	}
+
+	var archive bytes.Buffer
+	manifest, err := s.writeArchive(ctx, &archive)
+	if err != nil {
+		return Manifest{}, err
+	}
+	sealed, err := s.sealer.Seal(ctx, archive.Bytes())
+	if err != nil {
+		return Manifest{}, fmt.Errorf("unable to encrypt backup: %w", err)
+	}
+	_, err = w.Write(sealed)
+	return manifest, err
+}
+
+func (s *Service) writeArchive(ctx context.Context, w io.Writer) (Manifest, error) {
+	records, err := s.domainStore.ListDomainRecords(ctx)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("unable to list domains: %w", err)
+	}
+	var objectKeys []string
+	for _, prefix := range objectPrefixes {
+		keys, err := s.fileStorage.List(ctx, prefix)
+		if err != nil {
+			return Manifest{}, err
+		}
+		objectKeys = append(objectKeys, keys...)
+	}
+
+	users := map[string]bool{}
+	names := map[string]bool{}
+	var domainNames []string
+	var domains bytes.Buffer
+	for _, record := range records {
+		users[record.UserID] = true
+		if !names[record.DomainName] {
+			names[record.DomainName] = true
+			domainNames = append(domainNames, record.DomainName)
+		}
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("domain: %s unable to marshal: %w", record.DomainName, err)
+		}
+		domains.Write(recordBytes)
+		domains.WriteByte('\n')
+	}
+
+	// Without their claims restored domains could be verified again by anyone, the claims are kept per name
+	var claims bytes.Buffer
+	claimCount := 0
+	for _, domainName := range domainNames {
+		claim, err := s.domainStore.GetNameClaim(ctx, domainName)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("domain: %s unable to get name claim: %w", domainName, err)
+		}
+		if claim.UserID == uuid.Nil {
+			continue
+		}
+		claimBytes, err := json.Marshal(claim)
+		if err != nil {
+			return Manifest{}, fmt.Errorf("domain: %s unable to marshal name claim: %w", domainName, err)
+		}
+		claims.Write(claimBytes)
+		claims.WriteByte('\n')
+		claimCount++
+	}
+	manifest := Manifest{
+		FormatVersion: FormatVersion,
+		CreatedAt:     time.Now(),
+		Users:         len(users),
+		Domains:       len(records),
+		Claims:        claimCount,
+		Objects:       len(objectKeys),
+	}
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err = writeEntry(tw, manifestEntry, manifestBytes, manifest.CreatedAt)
+	if err == nil {
+		err = writeEntry(tw, domainsEntry, domains.Bytes(), manifest.CreatedAt)
+	}
+	if err == nil {
+		err = writeEntry(tw, claimsEntry, claims.Bytes(), manifest.CreatedAt)
+	}
+	for _, objectKey := range objectKeys {
+		if err != nil {
+			break
+		}
+		var object []byte
+		object, err = s.fileStorage.Get(ctx, objectKey)
+		if err == nil {
+			err = writeEntry(tw, objectsDir+objectKey, object, manifest.CreatedAt)
+		}
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		return Manifest{}, fmt.Errorf("unable to write backup: %w", err)
+	}
+	return manifest, nil
+}
+
+func writeEntry(tw *tar.Writer, name string, content []byte, modTime time.Time) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    int64(len(content)),
+		ModTime: modTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(content)
+	return err
+}
+
+// Restore reads an archive written by Backup into the configured domain store and file store. Failures of single
+// domains or objects are counted and logged, the restore goes on with the rest.
+func (s *Service) Restore(ctx context.Context, r io.Reader, opts RestoreOptions) (Manifest, RestoreResult, error) {
+	var result RestoreResult
+	switch opts.Mode {
+	case "":
+		opts.Mode = MergeMode
+	case MergeMode, OverwriteMode:
+	default:
+		return Manifest{}, result, fmt.Errorf("%w: %s", ErrUnknownRestoreMode, opts.Mode)
+	}
+
+	archive, err := io.ReadAll(r)
+	if err != nil {
+		return Manifest{}, result, err
+	}
+	// Plain archives start with the gzip magic number, anything else has to be sealed
+	if !bytes.HasPrefix(archive, []byte{0x1f, 0x8b}) {
+		archive, err = s.sealer.Open(ctx, archive)
+		if err != nil {
+			return Manifest{}, result, fmt.Errorf("%w: %s", ErrUnsupportedArchive, err)
+		}
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return Manifest{}, result, fmt.Errorf("%w: %s", ErrUnsupportedArchive, err)
+	}
+	defer gz.Close()
+
+	var manifest Manifest
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, result, fmt.Errorf("unable to read backup: %w", err)
+		}
+
+		switch {
+		case header.Name == manifestEntry:
+			err = json.NewDecoder(tr).Decode(&manifest)
+			if err != nil {
+				return manifest, result, fmt.Errorf("%w: unable to read manifest: %s", ErrUnsupportedArchive, err)
+			}
+			if manifest.FormatVersion < 1 || manifest.FormatVersion > FormatVersion {
+				return manifest, result, fmt.Errorf("%w: format version: %d", ErrUnsupportedArchive, manifest.FormatVersion)
+			}
+		case manifest.FormatVersion == 0:
+			return manifest, result, fmt.Errorf("%w: %s comes before the manifest", ErrUnsupportedArchive, header.Name)
+		case header.Name == domainsEntry:
+			err = s.restoreDomains(ctx, tr, opts, &result.Domains)
+			if err != nil {
+				return manifest, result, err
+			}
+		case header.Name == claimsEntry:
+			err = s.restoreClaims(ctx, tr, opts, &result.Claims)
+			if err != nil {
+				return manifest, result, err
+			}
+		case strings.HasPrefix(header.Name, objectsDir):
+			object, err := io.ReadAll(tr)
+			if err != nil {
+				return manifest, result, fmt.Errorf("unable to read backup: %w", err)
+			}
+			s.restoreObject(ctx, strings.TrimPrefix(header.Name, objectsDir), object, opts, &result.Objects)
+		default:
+			logger.Info("backup entry: %s isn't known, skipping it", header.Name)
+		}
+	}
+	return manifest, result, nil
+}
+
+func (s *Service) restoreDomains(ctx context.Context, r io.Reader, opts RestoreOptions, counts *RestoreCounts) error {
+	scanner := bufio.NewScanner(r)
+	// History makes records bigger than the default token size
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		var record storage.DomainRecord
+		err := json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return fmt.Errorf("%w: unable to read domain: %s", ErrUnsupportedArchive, err)
+		}
+		err = s.restoreDomain(ctx, record, opts, counts)
+		if err != nil {
+			logger.Error("domain: %s of user: %s unable to restore: %s", record.DomainName, record.UserID, err)
+			counts.Failed++
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *Service) restoreDomain(ctx context.Context, record storage.DomainRecord, opts RestoreOptions, counts *RestoreCounts) error {
+	current, err := s.domainStore.GetDomainRecord(ctx, record.Domain.UserID, record.DomainName)
+	exists := err == nil
+	if err != nil && !errors.Is(err, storage.ErrDomainNotFound) {
+		return err
+	}
+	if exists && opts.Mode == MergeMode {
+		counts.Skipped++
+		return nil
+	}
+
+	if !opts.DryRun {
+		// The store versions the restored record on top of whatever it holds now
+		record.Version = current.Version
+		_, err = s.domainStore.PutDomainRecord(ctx, record)
+		if err != nil {
+			return err
+		}
+	}
+	if exists {
+		counts.Overwritten++
+	} else {
+		counts.Created++
+	}
+	return nil
+}
+
+func (s *Service) restoreClaims(ctx context.Context, r io.Reader, opts RestoreOptions, counts *RestoreCounts) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		var claim storage.NameClaim
+		err := json.Unmarshal(scanner.Bytes(), &claim)
+		if err != nil {
+			return fmt.Errorf("%w: unable to read name claim: %s", ErrUnsupportedArchive, err)
+		}
+		err = s.restoreClaim(ctx, claim, opts, counts)
+		if err != nil {
+			logger.Error("domain: %s unable to restore name claim of user: %s: %s", claim.DomainName, claim.UserID, err)
+			counts.Failed++
+		}
+	}
+	return scanner.Err()
+}
+
+// restoreClaim hands the name to the archived holder, merging keeps a claim somebody holds now
+func (s *Service) restoreClaim(ctx context.Context, claim storage.NameClaim, opts RestoreOptions, counts *RestoreCounts) error {
+	current, err := s.domainStore.GetNameClaim(ctx, claim.DomainName)
+	if err != nil {
+		return err
+	}
+	exists := current.UserID != uuid.Nil
+	if current.UserID == claim.UserID || exists && opts.Mode == MergeMode {
+		counts.Skipped++
+		return nil
+	}
+
+	if !opts.DryRun {
+		err = s.domainStore.SwapNameClaim(ctx, claim.DomainName, current.UserID, claim.UserID)
+		if err != nil {
+			return err
+		}
+	}
+	if exists {
+		counts.Overwritten++
+	} else {
+		counts.Created++
+	}
+	return nil
+}
+
+func (s *Service) restoreObject(ctx context.Context, objectKey string, object []byte, opts RestoreOptions, counts *RestoreCounts) {
+	_, err := s.fileStorage.Stat(ctx, objectKey)
+	exists := err == nil
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		logger.Error("unable to restore: %s: %s", objectKey, err)
+		counts.Failed++
+		return
+	}
+	if exists && opts.Mode == MergeMode {
+		counts.Skipped++
+		return
+	}
+
+	if !opts.DryRun {
+		err = s.fileStorage.Put(ctx, objectKey, object)
+		if err != nil {
+			logger.Error("unable to restore: %s: %s", objectKey, err)
+			counts.Failed++
+			return
+		}
+	}
+	if exists {
+		counts.Overwritten++
+	} else {
+		counts.Created++
+	}
+}
@@ -0,0 +1,367 @@
+package backup_service
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/encryption"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.New()
+	os.Exit(m.Run())
+}
+
+func newTestSealer(t *testing.T, keyByte byte) *encryption.Sealer {
+	t.Helper()
+	wrapper, err := encryption.NewLocalKeyWrapper(bytes.Repeat([]byte{keyByte}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryption.NewSealer(wrapper)
+}
+
+func newTestSQLDomainStore(t *testing.T) *storage.SQLDomainStore {
+	t.Helper()
+	store, err := storage.NewSQLDomainStore(appconfig.SQLStoreSettings{
+		Driver: "sqlite",
+		DSN:    "file:" + filepath.Join(t.TempDir(), "verifier.db") + "?_pragma=busy_timeout(5000)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// sourceData is what the tests back up: a verified domain with its name claim, a pending one and objects inside and
+// outside the prefixes this service owns
+type sourceData struct {
+	verifiedUser uuid.UUID
+	pendingUser  uuid.UUID
+	objects      map[string][]byte
+}
+
+func newSource(t *testing.T) (*Service, sourceData) {
+	t.Helper()
+	ctx := context.Background()
+	domainStore := storage.NewMemoryDomainStore()
+	fileStore := storage.NewMemoryFileStore()
+	data := sourceData{
+		verifiedUser: uuid.New(),
+		pendingUser:  uuid.New(),
+		objects: map[string][]byte{
+			"mastodon_le_certs/example.com/cert.pem":  []byte("certificate"),
+			"acme_accounts/default/account.key":       []byte("sealed account key"),
+			"challenge_dns/domains/example.com.json":  []byte(`{"domain":"example.com"}`),
+			"internal_ca/internal/revoked/abcd.json":  []byte(`{"serial_number":"abcd"}`),
+			"acme_ledger/default/orders/x/1-abc.json": []byte(`{}`),
+		},
+	}
+
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	records := []storage.DomainRecord{
+		{
+			Domain: models.DomainInformation{
+				DomainName:   "example.com",
+				UserID:       data.verifiedUser,
+				Verification: models.Verification{Key: "key-1", Zone: "zone-1", Verified: true},
+			},
+			History: []storage.AuditEvent{{At: since, Event: "verified", Actor: "dns-verifier"}},
+		},
+		{
+			Domain: models.DomainInformation{
+				DomainName:   "pending.example.com",
+				UserID:       data.pendingUser,
+				Verification: models.Verification{Key: "key-2", Zone: "zone-2"},
+			},
+			Pending: &storage.PendingVerification{Since: since},
+		},
+	}
+	for _, record := range records {
+		_, err := domainStore.PutDomainRecord(ctx, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := domainStore.SwapNameClaim(ctx, "example.com", uuid.Nil, data.verifiedUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, object := range data.objects {
+		err = fileStore.Put(ctx, key, object)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Not ours, the bucket can be shared
+	err = fileStore.Put(ctx, "someone_else/file", []byte("not backed up"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(domainStore, fileStore, newTestSealer(t, 7)), data
+}
+
+func backup(t *testing.T, s *Service, encrypt bool) []byte {
+	t.Helper()
+	var archive bytes.Buffer
+	_, err := s.Backup(context.Background(), &archive, encrypt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+func TestBackupRestoresIntoSQLStore(t *testing.T) {
+	ctx := context.Background()
+	source, data := newSource(t)
+	var archive bytes.Buffer
+	manifest, err := source.Backup(ctx, &archive, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.FormatVersion != FormatVersion || manifest.Users != 2 || manifest.Domains != 2 || manifest.Claims != 1 || manifest.Objects != len(data.objects) {
+		t.Fatalf("manifest: %+v", manifest)
+	}
+
+	domainStore := newTestSQLDomainStore(t)
+	fileStore := storage.NewMemoryFileStore()
+	target := New(domainStore, fileStore, newTestSealer(t, 7))
+	_, result, err := target.Restore(ctx, &archive, RestoreOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := RestoreResult{
+		Domains: RestoreCounts{Created: 2},
+		Claims:  RestoreCounts{Created: 1},
+		Objects: RestoreCounts{Created: len(data.objects)},
+	}
+	if result != want {
+		t.Fatalf("result: %+v, want %+v", result, want)
+	}
+
+	verified, err := domainStore.GetDomainRecord(ctx, data.verifiedUser, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if verified.Domain.Verification != (models.Verification{Key: "key-1", Zone: "zone-1", Verified: true}) || len(verified.History) != 1 {
+		t.Fatalf("verified domain: %+v", verified)
+	}
+	pending, err := domainStore.GetDomainRecord(ctx, data.pendingUser, "pending.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending.Pending == nil || pending.Domain.Verification.Verified {
+		t.Fatalf("pending domain: %+v", pending)
+	}
+	claim, err := domainStore.GetNameClaim(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.UserID != data.verifiedUser {
+		t.Fatalf("name claim: %s, want %s", claim.UserID, data.verifiedUser)
+	}
+	for key, object := range data.objects {
+		restored, err := fileStore.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(restored, object) {
+			t.Fatalf("%s: %q, want %q", key, restored, object)
+		}
+	}
+	_, err = fileStore.Get(ctx, "someone_else/file")
+	if !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Fatalf("object outside our prefixes: %v, want it left out", err)
+	}
+}
+
+func TestRestoreDryRunWritesNothing(t *testing.T) {
+	ctx := context.Background()
+	source, data := newSource(t)
+	archive := backup(t, source, false)
+
+	domainStore := storage.NewMemoryDomainStore()
+	fileStore := storage.NewMemoryFileStore()
+	target := New(domainStore, fileStore, newTestSealer(t, 7))
+	_, result, err := target.Restore(ctx, bytes.NewReader(archive), RestoreOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Domains.Created != 2 || result.Claims.Created != 1 || result.Objects.Created != len(data.objects) {
+		t.Fatalf("result: %+v", result)
+	}
+
+	records, err := domainStore.ListDomainRecords(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := fileStore.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim, err := domainStore.GetNameClaim(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 || len(keys) != 0 || claim.UserID != uuid.Nil {
+		t.Fatalf("dry run wrote %d domains, %d objects and claim: %s", len(records), len(keys), claim.UserID)
+	}
+}
+
+func TestRestoreMergeAndOverwrite(t *testing.T) {
+	source, data := newSource(t)
+	archive := backup(t, source, false)
+
+	tests := []struct {
+		mode string
+		want RestoreResult
+		// restored reports whether the archived copies replaced what the target held
+		restored bool
+	}{
+		{
+			mode: MergeMode,
+			want: RestoreResult{
+				Domains: RestoreCounts{Created: 1, Skipped: 1},
+				Claims:  RestoreCounts{Skipped: 1},
+				Objects: RestoreCounts{Created: len(data.objects) - 1, Skipped: 1},
+			},
+		},
+		{
+			mode: OverwriteMode,
+			want: RestoreResult{
+				Domains: RestoreCounts{Created: 1, Overwritten: 1},
+				Claims:  RestoreCounts{Overwritten: 1},
+				Objects: RestoreCounts{Created: len(data.objects) - 1, Overwritten: 1},
+			},
+			restored: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			ctx := context.Background()
+			domainStore := storage.NewMemoryDomainStore()
+			fileStore := storage.NewMemoryFileStore()
+			// The target already has its own copy of the verified domain, the certificate and another claim holder
+			_, err := domainStore.PutDomainRecord(ctx, storage.DomainRecord{
+				Domain: models.DomainInformation{
+					DomainName:   "example.com",
+					UserID:       data.verifiedUser,
+					Verification: models.Verification{Key: "current-key"},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			otherHolder := uuid.New()
+			err = domainStore.SwapNameClaim(ctx, "example.com", uuid.Nil, otherHolder)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = fileStore.Put(ctx, "mastodon_le_certs/example.com/cert.pem", []byte("current certificate"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target := New(domainStore, fileStore, newTestSealer(t, 7))
+			_, result, err := target.Restore(ctx, bytes.NewReader(archive), RestoreOptions{Mode: test.mode})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != test.want {
+				t.Fatalf("result: %+v, want %+v", result, test.want)
+			}
+
+			record, err := domainStore.GetDomainRecord(ctx, data.verifiedUser, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			certificate, err := fileStore.Get(ctx, "mastodon_le_certs/example.com/cert.pem")
+			if err != nil {
+				t.Fatal(err)
+			}
+			claim, err := domainStore.GetNameClaim(ctx, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.restored {
+				if record.Domain.Verification.Key != "key-1" || string(certificate) != "certificate" || claim.UserID != data.verifiedUser {
+					t.Fatalf("overwrite kept: key %s certificate %q claim %s", record.Domain.Verification.Key, certificate, claim.UserID)
+				}
+				return
+			}
+			if record.Domain.Verification.Key != "current-key" || string(certificate) != "current certificate" || claim.UserID != otherHolder {
+				t.Fatalf("merge replaced: key %s certificate %q claim %s", record.Domain.Verification.Key, certificate, claim.UserID)
+			}
+		})
+	}
+}
+
+func TestRestoreRejectsWrongKey(t *testing.T) {
+	source, _ := newSource(t)
+	archive := backup(t, source, true)
+
+	target := New(storage.NewMemoryDomainStore(), storage.NewMemoryFileStore(), newTestSealer(t, 8))
+	_, _, err := target.Restore(context.Background(), bytes.NewReader(archive), RestoreOptions{})
+	if !errors.Is(err, ErrUnsupportedArchive) {
+		t.Fatalf("err: %v, want %s", err, ErrUnsupportedArchive)
+	}
+}
+
+func TestRestoreRejectsNewerFormat(t *testing.T) {
+	var archive bytes.Buffer
+	gz := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(gz)
+	manifestBytes, err := json.Marshal(Manifest{FormatVersion: FormatVersion + 1, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeEntry(tw, manifestEntry, manifestBytes, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = writeEntry(tw, domainsEntry, []byte(`{"domain_name":"example.com"}`+"\n"), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	domainStore := storage.NewMemoryDomainStore()
+	target := New(domainStore, storage.NewMemoryFileStore(), newTestSealer(t, 7))
+	_, _, err = target.Restore(context.Background(), &archive, RestoreOptions{})
+	if !errors.Is(err, ErrUnsupportedArchive) {
+		t.Fatalf("err: %v, want %s", err, ErrUnsupportedArchive)
+	}
+	records, err := domainStore.ListDomainRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("restored %d domains from an archive it refused", len(records))
+	}
+}
+
+func TestRestoreRejectsUnknownMode(t *testing.T) {
+	target := New(storage.NewMemoryDomainStore(), storage.NewMemoryFileStore(), newTestSealer(t, 7))
+	_, _, err := target.Restore(context.Background(), bytes.NewReader(nil), RestoreOptions{Mode: "replace"})
+	if !errors.Is(err, ErrUnknownRestoreMode) {
+		t.Fatalf("err: %v, want %s", err, ErrUnknownRestoreMode)
+	}
+}
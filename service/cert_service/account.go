@@ -0,0 +1,198 @@
+package cert_service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/encryption"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"os"
+	"time"
+)
+
+// accountKeyCacheTTL bounds how long a replica keeps using an account key after another replica rolled it over
+const accountKeyCacheTTL = time.Minute
+
+type cachedAccountKey struct {
+	key      *ecdsa.PrivateKey
+	loadedAt time.Time
+}
+
+// WithSealer sets the sealer used to encrypt the ACME account keys kept in the file store
+func WithSealer(sealer *encryption.Sealer) ServiceOpt {
+	return func(s *Service) {
+		s.sealer = sealer
+	}
+}
+
+func accountKeyObjectKey(profileName string) string {
+	return fmt.Sprintf("acme_accounts/%s/account.key", profileName)
+}
+
+func pendingAccountKeyObjectKey(profileName string) string {
+	return fmt.Sprintf("acme_accounts/%s/account.key.pending", profileName)
+}
+
+// accountKey returns the ACME account key of a profile. The key is shared by every replica through the file store,
+// the first replica to need it imports the legacy key file at account_key_location or generates a new key.
+func (s *Service) accountKey(ctx context.Context, profileName string, profile appconfig.CAProfile) (*ecdsa.PrivateKey, error) {
+	if cached, ok := s.accountKeys.Load(profileName); ok {
+		entry := cached.(cachedAccountKey)
+		if time.Since(entry.loadedAt) < accountKeyCacheTTL {
+			return entry.key, nil
+		}
+	}
+
+	privateKey, err := s.loadAccountKey(ctx, profileName)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		privateKey, err = s.initAccountKey(ctx, profileName, profile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.accountKeys.Store(profileName, cachedAccountKey{key: privateKey, loadedAt: time.Now()})
+	return privateKey, nil
+}
+
+func (s *Service) loadAccountKey(ctx context.Context, profileName string) (*ecdsa.PrivateKey, error) {
+	sealed, err := s.fileStorage.Get(ctx, accountKeyObjectKey(profileName))
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes, err := s.sealer.Open(ctx, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("CA profile: %s unable to decrypt account key: %w", profileName, err)
+	}
+	return parseAccountKey(keyBytes)
+}
+
+func (s *Service) initAccountKey(ctx context.Context, profileName string, profile appconfig.CAProfile) (*ecdsa.PrivateKey, error) {
+	privateKey, err := readLegacyAccountKey(profile.AccountKeyLocation)
+	if err != nil {
+		return nil, err
+	}
+	if privateKey != nil {
+		logger.Info("CA profile: %s importing account key from: %s", profileName, profile.AccountKeyLocation)
+	} else {
+		logger.Info("CA profile: %s has no account key, generating one", profileName)
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("problem generating key: %w", err)
+		}
+	}
+
+	sealed, err := s.sealAccountKey(ctx, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	// Replicas starting together all get here, only the first key created is used and the others load it
+	err = s.fileStorage.Create(ctx, accountKeyObjectKey(profileName), sealed)
+	if errors.Is(err, storage.ErrObjectExists) {
+		logger.Info("CA profile: %s account key was created by another replica, loading it", profileName)
+		return s.loadAccountKey(ctx, profileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return privateKey, nil
+}
+
+func (s *Service) saveAccountKey(ctx context.Context, privateKey *ecdsa.PrivateKey, objectKey string) error {
+	sealed, err := s.sealAccountKey(ctx, privateKey)
+	if err != nil {
+		return err
+	}
+	return s.fileStorage.Put(ctx, objectKey, sealed)
+}
+
+func (s *Service) sealAccountKey(ctx context.Context, privateKey *ecdsa.PrivateKey) ([]byte, error) {
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("problem marshalling private key: %w", err)
+	}
+	sealed, err := s.sealer.Seal(ctx, keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encrypt account key: %w", err)
+	}
+	return sealed, nil
+}
+
+// readLegacyAccountKey reads the DER account key that used to be kept on local disk, a missing file isn't an error
+func readLegacyAccountKey(keyLocation string) (*ecdsa.PrivateKey, error) {
+	if keyLocation == "" {
+		return nil, nil
+	}
+	dBytes, err := os.ReadFile(keyLocation)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read privateKey file: %w", err)
+	}
+
+	return parseAccountKey(dBytes)
+}
+
+func parseAccountKey(keyBytes []byte) (*ecdsa.PrivateKey, error) {
+	privateKeyVal, err := x509.ParsePKCS8PrivateKey(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing privateKey: %w", err)
+	}
+	privateKey, ok := privateKeyVal.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("unable to convert file into private key")
+	}
+	return privateKey, nil
+}
+
+// RolloverAccountKey replaces the account key of a profile with a new one through the ACME key change flow. The new
+// key is stored as pending before the CA is told about it so a failed save never leaves us without a working key.
+func (s *Service) RolloverAccountKey(ctx context.Context, profile string) error {
+	profileName, _, err := s.resolveProfile(profile)
+	if err != nil {
+		return err
+	}
+
+	client, _, err := s.acmeClient(ctx, profileName)
+	if err != nil {
+		return err
+	}
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return fmt.Errorf("problem generating key: %w", err)
+	}
+	err = s.saveAccountKey(ctx, newKey, pendingAccountKeyObjectKey(profileName))
+	if err != nil {
+		return fmt.Errorf("unable to store pending account key: %w", err)
+	}
+
+	err = client.AccountKeyRollover(ctx, newKey)
+	if err != nil {
+		return fmt.Errorf("CA profile: %s account key rollover failed: %w", profileName, err)
+	}
+
+	err = s.saveAccountKey(ctx, newKey, accountKeyObjectKey(profileName))
+	if err != nil {
+		return fmt.Errorf("CA profile: %s rolled over but unable to store new key, it is kept at: %s: %w",
+			profileName, pendingAccountKeyObjectKey(profileName), err)
+	}
+	s.accountKeys.Store(profileName, cachedAccountKey{key: newKey, loadedAt: time.Now()})
+	logger.Info("CA profile: %s account key rolled over", profileName)
+
+	// The pending copy is only needed while the new key might not have been saved
+	err = s.fileStorage.Delete(ctx, pendingAccountKeyObjectKey(profileName))
+	if err != nil {
+		logger.Error("CA profile: %s unable to delete pending account key: %s", profileName, err)
+	}
+
+	return nil
+}
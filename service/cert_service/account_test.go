@@ -0,0 +1,46 @@
+package cert_service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"sync"
+	"testing"
+)
+
+func TestAccountKeyRacingReplicasShareOneKey(t *testing.T) {
+	fileStore := storage.NewMemoryFileStore()
+	sealer := newTestSealer(t)
+
+	const replicas = 8
+	keys := make([]*ecdsa.PrivateKey, replicas)
+	errs := make([]error, replicas)
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := New(nil, fileStore, nil, WithSealer(sealer))
+			keys[i], errs[i] = s.accountKey(context.Background(), "default", appconfig.CAProfile{})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < replicas; i++ {
+		if errs[i] != nil {
+			t.Fatalf("replica %d: %s", i, errs[i])
+		}
+		if !keys[i].Equal(keys[0]) {
+			t.Fatalf("replica %d got a different account key than replica 0", i)
+		}
+	}
+
+	stored, err := New(nil, fileStore, nil, WithSealer(sealer)).loadAccountKey(context.Background(), "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.Equal(keys[0]) {
+		t.Fatal("stored account key isn't the one the replicas use")
+	}
+}
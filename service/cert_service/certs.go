@@ -6,42 +6,64 @@ import (
 	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
-	cryptorand "crypto/rand"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"github.com/aws/smithy-go/rand"
 	"github.com/edwinavalos/common/config"
 	"github.com/edwinavalos/common/logger"
 	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/encryption"
+	"github.com/edwinavalos/dns-verifier/service/dns_service"
 	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/service/hook_service"
 	"github.com/edwinavalos/dns-verifier/storage"
-	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/challenge"
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/google/uuid"
 	"golang.org/x/crypto/acme"
 	"net"
-	"os"
-	"path/filepath"
-	"runtime"
-	"strings"
+	"sync"
 	"time"
 )
 
 type Service struct {
-	fileStorage   *storage.VerifierFileStore
-	domainService *domain_service.Service
-	cfg           *config.Config
+	fileStorage        storage.CertificateStore
+	domainService      *domain_service.Service
+	cfg                *config.Config
+	acmeSettings       appconfig.ACMESettings
+	registeredProfiles sync.Map
+	sealer             *encryption.Sealer
+	accountKeys        sync.Map
+	jobStore           storage.JobStore
+	jobSettings        appconfig.JobSettings
+	jobKick            chan struct{}
+	rateLimits         appconfig.RateLimitSettings
+	hooks              *hook_service.Service
+	internalCAs        sync.Map
+	propagation        *dns_service.Checker
+	challengeProviders []ChallengeProvider
+	challengeZone      string
+	// allowPrivateDNSServers lets RFC 2136 updates go to loopback, link-local and private addresses
+	allowPrivateDNSServers bool
+	retention              appconfig.DomainRetentionSettings
 }
 
-func New(conf *config.Config, fileStorage *storage.VerifierFileStore, domainService *domain_service.Service) *Service {
-	return &Service{
+type ServiceOpt func(s *Service)
+
+func New(conf *config.Config, fileStorage storage.CertificateStore, domainService *domain_service.Service, opts ...ServiceOpt) *Service {
+	s := &Service{
 		fileStorage:   fileStorage,
 		domainService: domainService,
 		cfg:           conf,
+		jobKick:       make(chan struct{}, 1),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return s
 }
 
 type certRequestUser struct {
@@ -60,50 +82,12 @@ func (u *certRequestUser) GetPrivateKey() crypto.PrivateKey {
 	return u.key
 }
 
-func (s *Service) getRequestUserCert() (*ecdsa.PrivateKey, error) {
-	var privateKey *ecdsa.PrivateKey
-	_, err := os.Stat(s.cfg.LEPrivateKeyLocation())
-	if err != nil {
-		var err2 error
-		privateKey, err2 = ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
-		if err2 != nil {
-			return nil, fmt.Errorf("problem generating key: %w", err2)
-		}
-
-		keyBytes, err3 := x509.MarshalPKCS8PrivateKey(privateKey)
-		if err3 != nil {
-			return nil, fmt.Errorf("problem marshalling private key: %w", err3)
-		}
-		err4 := os.WriteFile(s.cfg.LEPrivateKeyLocation(), keyBytes, 0644)
-		if err4 != nil {
-			return nil, fmt.Errorf("problem writing private key file: %w", err4)
-		}
-	} else {
-		dBytes, err2 := os.ReadFile(s.cfg.LEPrivateKeyLocation())
-		if err2 != nil {
-			return nil, fmt.Errorf("unable to read privateKey file: %w", err2)
-		}
-
-		privateKeyVal, err3 := x509.ParsePKCS8PrivateKey(dBytes)
-		if err3 != nil {
-			return nil, fmt.Errorf("error parsing privateKey: %w", err3)
-		}
-		var ok bool
-		privateKey, ok = privateKeyVal.(*ecdsa.PrivateKey)
-		if !ok {
-			return nil, fmt.Errorf("unable to convert file into private key")
-		}
-	}
-
-	return privateKey, nil
-}
-
-func (s *Service) recordInPlace(domainInfo models.DomainInformation) bool {
+func (s *Service) recordInPlace(ctx context.Context, domainInfo models.DomainInformation) bool {
 	if domainInfo.Verification.Key == "" || domainInfo.Verification.Zone == "" {
 		return false
 	}
 
-	found, err := s.domainService.VerifyTXTRecord(context.TODO(), domainInfo.Verification.Zone, domainInfo.Verification.Key)
+	found, err := s.domainService.VerifyTXTRecord(ctx, domainInfo.Verification.Zone, domainInfo.Verification.Key)
 	if err != nil || !found {
 		return false
 	}
@@ -111,41 +95,90 @@ func (s *Service) recordInPlace(domainInfo models.DomainInformation) bool {
 	return true
 }
 
-func (s *Service) CompleteCertificateRequest(userID uuid.UUID, domain string, email string) error {
+// CompleteCertificateRequest accepts the DNS challenge of the pending order and stores the issued certificate, it
+// waits on the CA so it should run from a job rather than an HTTP handler. When the CA rate limits us or refuses the
+// domain over CAA a new order is placed with the next CA profile and a *FallbackError is returned.
+func (s *Service) CompleteCertificateRequest(ctx context.Context, userID uuid.UUID, domain string, email string) error {
+	err := s.completeCertificateRequest(ctx, userID, domain)
+	class, fallback := classifyACMEError(err)
+	// Server errors while completing are left to the job retries, the order is still good at this CA. The same goes
+	// for our own budgets, the job waits until they free up.
+	var budgetErr *BudgetExceededError
+	if !fallback || class == FailureServerError || errors.As(err, &budgetErr) {
+		return err
+	}
+
+	record, recordErr := s.GetIssuanceRecord(ctx, domain)
+	if recordErr != nil {
+		return err
+	}
+	next, ok := s.nextProfile(record.CAProfile)
+	if !ok {
+		return err
+	}
+
+	logger.Error("domain: %s CA profile: %s failed with %s, falling back to: %s: %s", domain, record.CAProfile, class, next, err)
+	fallbacks := append(record.Fallbacks, FallbackAttempt{
+		CAProfile: record.CAProfile,
+		Class:     class,
+		Error:     err.Error(),
+		At:        time.Now(),
+	})
+	recordName, recordValue, _, requestErr := s.requestCertificate(ctx, userID, domain, next, fallbacks)
+	if requestErr != nil {
+		return fmt.Errorf("%w, falling back to CA profile: %s failed too: %s", err, next, requestErr)
+	}
+
+	return &FallbackError{
+		From:        record.CAProfile,
+		To:          next,
+		Class:       class,
+		RecordName:  recordName,
+		RecordValue: recordValue,
+		Err:         err,
+	}
+}
+
+func (s *Service) completeCertificateRequest(ctx context.Context, userID uuid.UUID, domain string) error {
 	// Retrieve our domain info from the database
-	domainInfo, err := s.domainService.GetDomainByUser(context.TODO(), userID, domain)
+	domainInfo, err := s.domainService.GetDomainByUser(ctx, userID, domain)
 	if err != nil {
 		return fmt.Errorf("domain: %s unable to get DomainInfo from database: %w", domain, err)
 	}
 
-	inPlace := s.recordInPlace(domainInfo)
-	if !inPlace {
-		return fmt.Errorf("unable to verify that your record is in place before completing request")
+	// The order has to be completed against the CA it was created with
+	record, err := s.GetIssuanceRecord(ctx, domain)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to get issuance record: %w", domain, err)
+	}
+	if s.isInternalCAProfile(record.CAProfile) {
+		return s.issueInternalCertificate(ctx, userID, domain, domainInfo, record.CAProfile, record.Fallbacks)
 	}
 
-	privateKey, err := s.getRequestUserCert()
+	// Every failed validation counts against the CA's limits, so the record has to be everywhere the CA might look
+	err = s.waitForChallengeRecord(ctx, domainInfo)
 	if err != nil {
-		return fmt.Errorf("unable to requestUserCert(): %w", err)
+		return err
 	}
 
 	// Create our client which will interact with the acme api
-	client := &acme.Client{
-		Key:          privateKey,
-		DirectoryURL: s.cfg.LECADirURL(),
+	client, privateKey, err := s.acmeClient(ctx, record.CAProfile)
+	if err != nil {
+		return err
 	}
 
 	certInfo := domainInfo.Verification.CertInfo
 	if domainInfo.Verification.Verified == true && certInfo.CertURL != "" {
-		certs, err := client.FetchCert(context.TODO(), certInfo.CertURL, true)
+		certs, err := client.FetchCert(ctx, certInfo.CertURL, true)
 		if err != nil {
 			return err
 		}
 
-		err2 := s.WriteToStorage(privateKey, domain, certs)
+		err2 := s.WriteToStorage(ctx, privateKey, domain, certs)
 		if err2 != nil {
 			return err2
 		}
-		return nil
+		return s.scheduleDeployment(ctx, userID, domain)
 	}
 
 	if certInfo.OrderURL == "" {
@@ -153,7 +186,7 @@ func (s *Service) CompleteCertificateRequest(userID uuid.UUID, domain string, em
 	}
 
 	identifiers := acme.DomainIDs(domain)
-	authOrder, err := client.GetOrder(context.TODO(), certInfo.OrderURL)
+	authOrder, err := client.GetOrder(ctx, certInfo.OrderURL)
 	if err != nil || authOrder.Status == acme.StatusInvalid {
 		return fmt.Errorf("AuthorizeOrder: %v", err)
 	}
@@ -163,7 +196,7 @@ func (s *Service) CompleteCertificateRequest(userID uuid.UUID, domain string, em
 	if certInfo.AuthzURL == "" {
 		return fmt.Errorf("missing authz_url")
 	}
-	authz, err := client.GetAuthorization(context.TODO(), certInfo.AuthzURL)
+	authz, err := client.GetAuthorization(ctx, certInfo.AuthzURL)
 	if err != nil {
 		return err
 	}
@@ -171,39 +204,61 @@ func (s *Service) CompleteCertificateRequest(userID uuid.UUID, domain string, em
 	if certInfo.ChallengeURL == "" {
 		return fmt.Errorf("missing challenge_url")
 	}
-	chal, err := client.GetChallenge(context.TODO(), certInfo.ChallengeURL)
+	chal, err := client.GetChallenge(ctx, certInfo.ChallengeURL)
 	if err != nil {
 		return err
 	}
 
-	err = completeDNS01(context.TODO(), client, authz, chal, authOrder)
+	// Validating and finalizing both have to fit in our rate limit budgets
+	err = s.checkValidationBudget(ctx, record.CAProfile, domain)
 	if err != nil {
 		return err
 	}
 
+	err = completeDNS01(ctx, client, authz, chal, authOrder)
+	if err != nil {
+		var authzErr *acme.AuthorizationError
+		if errors.As(err, &authzErr) {
+			s.recordLedgerEvent(ctx, record.CAProfile, domain, LedgerFailedValidation)
+		}
+		return err
+	}
+
 	csr, privateKey := newCSR(identifiers)
-	ders, curl, err := client.CreateOrderCert(context.TODO(), authOrder.FinalizeURL, csr, true)
+	ders, curl, err := client.CreateOrderCert(ctx, authOrder.FinalizeURL, csr, true)
 	if err != nil {
-		return fmt.Errorf("CreateOrderCert: %v", err)
+		return fmt.Errorf("CreateOrderCert: %w", err)
 	}
+	s.recordLedgerEvent(ctx, record.CAProfile, domain, LedgerIssuance)
+	s.cleanUpChallenge(ctx, userID, domain, record, domainInfo.Verification.Key)
 	certInfo.CertURL = curl
-	domainInfo.Verification.Verified = true
-	domainInfo.Verification.CertInfo = certInfo
-	err = s.domainService.PutDomain(context.TODO(), domainInfo)
+	domainInfo, err = s.domainService.UpdateDomain(ctx, userID, domain, func(di *models.DomainInformation) error {
+		di.Verification.Verified = true
+		di.Verification.CertInfo = certInfo
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 	logger.Info("cert URL: %s", curl)
 
-	err2 := s.WriteToStorage(privateKey, domain, ders)
+	record.UserID = userID
+	record.IssuedAt = time.Now()
+	record.IssuedBy = record.CAProfile
+	err = s.putIssuanceRecord(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	err2 := s.WriteToStorage(ctx, privateKey, domain, ders)
 	if err2 != nil {
 		return err2
 	}
 
-	return nil
+	return s.scheduleDeployment(ctx, userID, domain)
 }
 
-func (s *Service) WriteToStorage(privateKey *ecdsa.PrivateKey, domain string, ders [][]byte) error {
+func (s *Service) WriteToStorage(ctx context.Context, privateKey *ecdsa.PrivateKey, domain string, ders [][]byte) error {
 	keyBytes, err := x509.MarshalECPrivateKey(privateKey)
 	if err != nil {
 		return err
@@ -222,7 +277,12 @@ func (s *Service) WriteToStorage(privateKey *ecdsa.PrivateKey, domain string, de
 		return fmt.Errorf("failed to encode PEM block: %v\n", err)
 	}
 
-	err = s.fileStorage.SaveBuf(privBuf, fmt.Sprintf("mastodon_le_certs/%s/cert.key", domain))
+	sealed, err := s.sealer.Seal(ctx, privBuf.Bytes())
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to encrypt private key: %w", domain, err)
+	}
+
+	err = s.fileStorage.Put(ctx, privateKeyObjectKey(domain), sealed)
 	if err != nil {
 		return err
 	}
@@ -231,14 +291,21 @@ func (s *Service) WriteToStorage(privateKey *ecdsa.PrivateKey, domain string, de
 	for _, slice := range ders {
 		mergedDers = append(mergedDers, slice...)
 	}
-	secondBuf := bytes.NewBuffer(mergedDers)
-	err = s.fileStorage.SaveBuf(*secondBuf, fmt.Sprintf("mastodon_le_certs/%s/cert.crt", domain))
+	err = s.fileStorage.Put(ctx, certificateObjectKey(domain), mergedDers)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func certificateObjectKey(domain string) string {
+	return fmt.Sprintf("mastodon_le_certs/%s/cert.crt", domain)
+}
+
+func privateKeyObjectKey(domain string) string {
+	return fmt.Sprintf("mastodon_le_certs/%s/cert.key", domain)
+}
+
 func newCSR(identifiers []acme.AuthzID) ([]byte, *ecdsa.PrivateKey) {
 	var csr x509.CertificateRequest
 	for _, id := range identifiers {
@@ -275,18 +342,18 @@ func completeDNS01(ctx context.Context, client *acme.Client, z *acme.Authorizati
 
 	newChal, err := client.Accept(ctx, chal)
 	if err != nil {
-		return fmt.Errorf("accept(%q): %v", chal.URI, err)
+		return fmt.Errorf("accept(%q): %w", chal.URI, err)
 	}
 	logger.Info("%+v", newChal)
 
-	_, err = client.WaitAuthorization(context.TODO(), z.URI)
+	_, err = client.WaitAuthorization(ctx, z.URI)
 	if err != nil {
 		return err
 	}
 
 	logger.Info("all challenges are done")
 	if _, err := client.WaitOrder(ctx, order.URI); err != nil {
-		return fmt.Errorf("waitOrder(%q): %v", order.URI, err)
+		return fmt.Errorf("waitOrder(%q): %w", order.URI, err)
 	}
 
 	return nil
@@ -317,42 +384,82 @@ func getDnsChallenge(z *acme.Authorization) *acme.Challenge {
 	return chal
 }
 
-func (s *Service) RequestCertificate(userId uuid.UUID, domain string, email string) (string, string, bool, error) {
-
-	// Get the private key for the cert administrator account
-	privateKey, err := s.getRequestUserCert()
+// RequestCertificate creates an order for the domain with the CA of the given profile, an empty profile uses the
+// default one. Orders that fail because the CA rate limits us, errors out or is refused by CAA move on to the next
+// profile of the fallback order.
+func (s *Service) RequestCertificate(userId uuid.UUID, domain string, email string, profile string) (string, string, bool, error) {
+	chain, err := s.profileChain(profile)
 	if err != nil {
-		return "", "", false, fmt.Errorf("unable to requestUserCert(): %w", err)
+		return "", "", false, err
 	}
 
-	// Create our client which will interact with the acme api
-	client := &acme.Client{
-		Key:          privateKey,
-		DirectoryURL: s.cfg.LECADirURL(),
+	var fallbacks []FallbackAttempt
+	for i, profileName := range chain {
+		recordName, recordValue, alreadyValid, err := s.requestCertificate(context.TODO(), userId, domain, profileName, fallbacks)
+		class, fallback := classifyACMEError(err)
+		if !fallback || i == len(chain)-1 {
+			return recordName, recordValue, alreadyValid, err
+		}
+
+		logger.Error("domain: %s CA profile: %s failed with %s, falling back to: %s: %s", domain, profileName, class, chain[i+1], err)
+		fallbacks = append(fallbacks, FallbackAttempt{
+			CAProfile: profileName,
+			Class:     class,
+			Error:     err.Error(),
+			At:        time.Now(),
+		})
 	}
 
+	return "", "", false, fmt.Errorf("no CA profiles to request a certificate from")
+}
+
+func (s *Service) requestCertificate(ctx context.Context, userId uuid.UUID, domain string, profileName string, fallbacks []FallbackAttempt) (string, string, bool, error) {
 	// Retrieve our domain info from the database
-	domainInfo, err := s.domainService.GetDomainByUser(context.TODO(), userId, domain)
+	domainInfo, err := s.domainService.GetDomainByUser(ctx, userId, domain)
 	if err != nil {
 		return "", "", false, fmt.Errorf("domain: %s unable to get DomainInfo from database: %w", domain, err)
 	}
 
-	// Log in and get our account information
-	//var account *acme.Account
+	// A certificate that is good for longer than the renewal window doesn't need a new order
+	validity, err := s.CertificateValid(ctx, domain)
+	if err != nil {
+		return "", "", false, err
+	}
+	if validity.Valid {
+		return "", "", true, fmt.Errorf("%w until: %s", ErrCertificateValid, validity.NotAfter.Format(time.RFC3339))
+	}
+
+	// Internal CAs issue right away, there is no challenge to hand out
+	if s.isInternalCAProfile(profileName) {
+		err = s.issueInternalCertificate(ctx, userId, domain, domainInfo, profileName, fallbacks)
+		return "", "", false, err
+	}
+
+	record, err := s.GetIssuanceRecord(ctx, domain)
+	if err != nil {
+		return "", "", false, fmt.Errorf("domain: %s unable to get issuance record: %w", domain, err)
+	}
+
 	certInfo := domainInfo.Verification.CertInfo
-	if certInfo.CertURL != "" {
-		// the url parameter is legacy and not used
-		_, err = client.GetReg(context.TODO(), "")
-		if err != nil {
-			return "", "", false, err
-		}
-	} else {
-		_, err = client.UpdateReg(context.TODO(), &acme.Account{})
+	// An order from another CA can't be continued with this one
+	if record.CAProfile != profileName {
+		certInfo = models.CertInfo{}
+	}
+
+	// New orders have to fit in our rate limit budgets before the CA hears from us
+	if certInfo.OrderURL == "" {
+		err = s.checkOrderBudget(ctx, profileName, domain)
 		if err != nil {
 			return "", "", false, err
 		}
 	}
 
+	// Create our client which will interact with the acme api, this also logs in or registers our account
+	client, _, err := s.acmeClient(ctx, profileName)
+	if err != nil {
+		return "", "", false, err
+	}
+
 	// Identifiers is an acme construct for our domain names
 	identifiers := acme.DomainIDs(domain)
 
@@ -360,20 +467,26 @@ func (s *Service) RequestCertificate(userId uuid.UUID, domain string, email stri
 	// this kicks off the process
 	var authOrder *acme.Order
 	if certInfo.OrderURL == "" {
-		authOrder, err = client.AuthorizeOrder(context.TODO(), identifiers)
+		authOrder, err = client.AuthorizeOrder(ctx, identifiers)
 		if err != nil {
 			return "", "", false, err
 		}
+		s.recordLedgerEvent(ctx, profileName, domain, LedgerOrder)
 	} else {
-		authOrder, err = client.GetOrder(context.TODO(), certInfo.OrderURL)
+		authOrder, err = client.GetOrder(ctx, certInfo.OrderURL)
 		if err != nil {
 			return "", "", false, err
 		}
 		if authOrder.Status == acme.StatusInvalid {
-			authOrder, err = client.AuthorizeOrder(context.TODO(), identifiers)
+			err = s.checkOrderBudget(ctx, profileName, domain)
+			if err != nil {
+				return "", "", false, err
+			}
+			authOrder, err = client.AuthorizeOrder(ctx, identifiers)
 			if err != nil {
 				return "", "", false, err
 			}
+			s.recordLedgerEvent(ctx, profileName, domain, LedgerOrder)
 		}
 		// We need to set this because it doesn't get populated by GetOrder
 		if authOrder.URI == "" {
@@ -387,7 +500,7 @@ func (s *Service) RequestCertificate(userId uuid.UUID, domain string, email stri
 	var zurls []string
 	zone := fmt.Sprintf("_acme-challenge.%s", domain)
 	for _, u := range authOrder.AuthzURLs {
-		z, err := client.GetAuthorization(context.TODO(), u)
+		z, err := client.GetAuthorization(ctx, u)
 		if err != nil {
 			return "", "", false, fmt.Errorf("GetAuthorization(%q): %v", u, err)
 		}
@@ -399,10 +512,17 @@ func (s *Service) RequestCertificate(userId uuid.UUID, domain string, email stri
 				return "", "", true, fmt.Errorf("unable to get dns token from challenge")
 			}
 			certInfo.ChallengeURL = chal.URI
-			domainInfo.Verification.Key = dnsToken
-			domainInfo.Verification.Zone = zone
-			domainInfo.Verification.CertInfo = certInfo
-			err = s.domainService.PutDomain(context.TODO(), domainInfo)
+			domainInfo, err = s.domainService.UpdateDomain(ctx, userId, domain, func(di *models.DomainInformation) error {
+				di.Verification.Key = dnsToken
+				di.Verification.Zone = zone
+				di.Verification.CertInfo = certInfo
+				return nil
+			})
+			if err != nil {
+				return "", "", true, err
+			}
+			record.startOrder(userId, profileName, authOrder.URI, fallbacks, "")
+			err = s.putIssuanceRecord(ctx, record)
 			if err != nil {
 				return "", "", true, err
 			}
@@ -415,7 +535,7 @@ func (s *Service) RequestCertificate(userId uuid.UUID, domain string, email stri
 		var dnsToken string
 		var chal *acme.Challenge
 		if z.Status == acme.StatusPending {
-			dnsToken, chal, err = request(context.TODO(), client, z)
+			dnsToken, chal, err = request(ctx, client, z)
 			if err != nil {
 				return "", "", false, fmt.Errorf("unable to request certificate: %w", err)
 			}
@@ -423,14 +543,34 @@ func (s *Service) RequestCertificate(userId uuid.UUID, domain string, email stri
 		if chal == nil || dnsToken == "" {
 			return "", "", false, fmt.Errorf("unable to find dns challenge")
 		}
-		domainInfo.Verification.Zone = zone
-		domainInfo.Verification.Key = dnsToken
+		// Domains delegated to a challenge provider don't need the customer to do anything
+		provider, err := s.challengeProviderFor(ctx, userId, domain)
+		if err != nil {
+			return "", "", false, err
+		}
+		var providerName string
+		if provider != nil {
+			err = provider.Present(ctx, userId, domain, dnsToken)
+			if err != nil {
+				return "", "", false, fmt.Errorf("domain: %s unable to publish challenge with: %s: %w", domain, provider.Name(), err)
+			}
+			providerName = provider.Name()
+		}
 		certInfo.OrderURL = authOrder.URI
 		certInfo.ChallengeURL = chal.URI
 		certInfo.AuthzURL = z.URI
 		certInfo.FinalizeURL = authOrder.FinalizeURL
-		domainInfo.Verification.CertInfo = certInfo
-		err = s.domainService.PutDomain(context.TODO(), domainInfo)
+		domainInfo, err = s.domainService.UpdateDomain(ctx, userId, domain, func(di *models.DomainInformation) error {
+			di.Verification.Zone = zone
+			di.Verification.Key = dnsToken
+			di.Verification.CertInfo = certInfo
+			return nil
+		})
+		if err != nil {
+			return "", "", false, err
+		}
+		record.startOrder(userId, profileName, authOrder.URI, fallbacks, providerName)
+		err = s.putIssuanceRecord(ctx, record)
 		if err != nil {
 			return "", "", false, err
 		}
@@ -459,91 +599,3 @@ func toStringList(ips []net.IP) []string {
 	}
 	return retList
 }
-
-func saveCertificates(publicKeyLocation string, privateKeyLocation string, basePath string, certificates *certificate.Resource) error {
-	generatedLocation := filepath.Join(basePath + "/keys/.generated")
-	logger.Info("Saving public key to: %s", publicKeyLocation)
-	err := os.WriteFile(publicKeyLocation, certificates.Certificate, 0644)
-	if err != nil {
-		return err
-	}
-
-	logger.Info("Saving private key to: %s", privateKeyLocation)
-	err = os.WriteFile(privateKeyLocation, certificates.PrivateKey, 0600)
-	if err != nil {
-		return err
-	}
-
-	logger.Info("Touching generated file: %s", generatedLocation)
-	_, err = os.Create(generatedLocation)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func CertificateExistsAndValid(domain string, service string) (bool, bool, error) {
-	publicKeyLocation, _, err := DomainToKeyLocations(domain, service)
-	if err != nil {
-		return false, false, err
-	}
-
-	_, err = os.Stat(publicKeyLocation)
-	if os.IsNotExist(err) {
-		return false, false, nil
-	}
-
-	dBytes, err := os.ReadFile(publicKeyLocation)
-	if err != nil {
-		return false, true, err
-	}
-
-	certChain := decodePem(dBytes)
-	var result bool
-	for _, cert := range certChain.Certificate {
-		x509Cert, err := x509.ParseCertificate(cert)
-		if err != nil {
-			return false, true, err
-		}
-		if x509Cert.Subject.CommonName == domain {
-			result = x509Cert.NotAfter.After(time.Now())
-		}
-	}
-
-	return result, true, nil
-}
-
-func decodePem(certInput []byte) tls.Certificate {
-	var cert tls.Certificate
-	var certDERBlock *pem.Block
-	for {
-		certDERBlock, certInput = pem.Decode(certInput)
-		if certDERBlock == nil {
-			break
-		}
-		if certDERBlock.Type == "CERTIFICATE" {
-			cert.Certificate = append(cert.Certificate, certDERBlock.Bytes)
-		}
-	}
-	return cert
-}
-
-func DomainToKeyLocations(domain string, service string) (string, string, error) {
-	var pathTemplate string
-	switch runtime.GOOS {
-	case "windows":
-		pathTemplate = "C:\\mastodon\\%s_%s\\keys\\"
-	case "linux":
-		pathTemplate = "/root/certs/%s_%s/keys/"
-	}
-
-	domainSanitized := strings.Replace(domain, ".", "_", -1)
-	path := fmt.Sprintf(pathTemplate, service, domainSanitized)
-	publicKeyPath := filepath.Join(path, "/cert.crt")
-	privateKeyPath := filepath.Join(path, "/cert.key")
-
-	publicKeyPath = strings.Replace(publicKeyPath, "\\", "/", -1)
-	privateKeyPath = strings.Replace(privateKeyPath, "\\", "/", -1)
-
-	return publicKeyPath, privateKeyPath, nil
-}
@@ -0,0 +1,78 @@
+package cert_service
+
+import (
+	"context"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/google/uuid"
+)
+
+// ChallengeProvider publishes DNS-01 records itself, domains it handles only have to be set up once by the customer
+// instead of for every order
+type ChallengeProvider interface {
+	Name() string
+	// Handles reports whether the provider can publish the challenge records of the domain
+	Handles(ctx context.Context, userID uuid.UUID, domain string) (bool, error)
+	Present(ctx context.Context, userID uuid.UUID, domain string, value string) error
+	CleanUp(ctx context.Context, userID uuid.UUID, domain string, value string) error
+}
+
+// WithChallengeProvider adds a provider, providers are asked in the order they were added
+func WithChallengeProvider(provider ChallengeProvider) ServiceOpt {
+	return func(s *Service) {
+		s.challengeProviders = append(s.challengeProviders, provider)
+	}
+}
+
+// challengeProviderFor returns the first provider that handles the domain, nil means the customer has to create the
+// challenge record
+func (s *Service) challengeProviderFor(ctx context.Context, userID uuid.UUID, domain string) (ChallengeProvider, error) {
+	for _, provider := range s.challengeProviders {
+		handles, err := provider.Handles(ctx, userID, domain)
+		if err != nil {
+			return nil, fmt.Errorf("domain: %s challenge provider: %s: %w", domain, provider.Name(), err)
+		}
+		if handles {
+			return provider, nil
+		}
+	}
+	return nil, nil
+}
+
+// requireVerifiedClaim keeps anyone but the verified holder of a domain from changing where its challenges are
+// published, whoever can do that can get certificates for it
+func (s *Service) requireVerifiedClaim(ctx context.Context, userID uuid.UUID, domain string) error {
+	holds, err := s.domainService.HoldsVerifiedClaim(ctx, userID, domain)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to get DomainInfo from database: %w", domain, err)
+	}
+	if !holds {
+		return fmt.Errorf("domain: %s %w", domain, ErrDomainNotVerified)
+	}
+	return nil
+}
+
+func (s *Service) challengeProviderByName(name string) ChallengeProvider {
+	for _, provider := range s.challengeProviders {
+		if provider.Name() == name {
+			return provider
+		}
+	}
+	return nil
+}
+
+// cleanUpChallenge removes a published challenge record once the order no longer needs it, failing to is only logged
+// because stale tokens don't hurt validation of new ones
+func (s *Service) cleanUpChallenge(ctx context.Context, userID uuid.UUID, domain string, record IssuanceRecord, value string) {
+	if record.ChallengeProvider == "" {
+		return
+	}
+	provider := s.challengeProviderByName(record.ChallengeProvider)
+	if provider == nil {
+		return
+	}
+	err := provider.CleanUp(ctx, userID, domain, value)
+	if err != nil {
+		logger.Error("domain: %s unable to clean up challenge with: %s: %s", domain, provider.Name(), err)
+	}
+}
@@ -0,0 +1,237 @@
+package cert_service
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/service/dns_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	delegatedChallengeProviderName = "challenge_dns"
+	// challengeLabelLength is the hex length of the random label each domain gets under the challenge zone
+	challengeLabelLength = 32
+	// maxChallengeValues keeps a few tokens around so that parallel orders of a domain can validate
+	maxChallengeValues = 4
+)
+
+var ErrChallengeDNSDisabled = errors.New("challenge dns is not enabled")
+
+// ChallengeDelegation is where the _acme-challenge name of a domain has to be CNAMEd to for us to publish its
+// challenges
+type ChallengeDelegation struct {
+	Domain     string    `json:"domain"`
+	UserID     uuid.UUID `json:"user_id"`
+	RecordName string    `json:"record_name"`
+	Target     string    `json:"target"`
+	CreatedAt  time.Time `json:"created_at"`
+	// CNAMEInPlace is looked up when the delegation is read, it isn't stored
+	CNAMEInPlace bool `json:"cname_in_place"`
+}
+
+// WithChallengeDNS publishes challenges of delegated domains in the zone served by the embedded DNS responder
+func WithChallengeDNS(settings appconfig.ChallengeDNSSettings) ServiceOpt {
+	return func(s *Service) {
+		if !settings.Enabled || settings.Zone == "" {
+			return
+		}
+		s.challengeZone = strings.ToLower(strings.TrimSuffix(settings.Zone, "."))
+		s.challengeProviders = append(s.challengeProviders, &delegatedChallengeProvider{s: s})
+	}
+}
+
+func challengeDelegationObjectKey(domain string) string {
+	return fmt.Sprintf("challenge_dns/domains/%s.json", domain)
+}
+
+func challengeRecordsObjectKey(label string) string {
+	return fmt.Sprintf("challenge_dns/records/%s.json", label)
+}
+
+// CreateChallengeDelegation returns the CNAME target of a domain, making one the first time. Only the verified holder
+// of the domain can create one or take it over from a previous holder.
+func (s *Service) CreateChallengeDelegation(ctx context.Context, userID uuid.UUID, domain string) (ChallengeDelegation, error) {
+	if s.challengeZone == "" {
+		return ChallengeDelegation{}, ErrChallengeDNSDisabled
+	}
+	err := s.requireVerifiedClaim(ctx, userID, domain)
+	if err != nil {
+		return ChallengeDelegation{}, err
+	}
+
+	delegation, err := s.getChallengeDelegation(ctx, domain)
+	if err == nil && delegation.UserID == userID {
+		delegation.CNAMEInPlace = cnameInPlace(ctx, delegation)
+		return delegation, nil
+	}
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		return ChallengeDelegation{}, err
+	}
+
+	// A domain that moved to another user gets a new label, the old one may still be CNAMEd to
+	label := make([]byte, challengeLabelLength/2)
+	_, err = cryptorand.Read(label)
+	if err != nil {
+		return ChallengeDelegation{}, fmt.Errorf("unable to generate challenge label: %w", err)
+	}
+	delegation = ChallengeDelegation{
+		Domain:     domain,
+		UserID:     userID,
+		RecordName: fmt.Sprintf("_acme-challenge.%s", domain),
+		Target:     fmt.Sprintf("%s.%s", hex.EncodeToString(label), s.challengeZone),
+		CreatedAt:  time.Now(),
+	}
+	delegationBytes, err := json.Marshal(delegation)
+	if err != nil {
+		return ChallengeDelegation{}, err
+	}
+	err = s.fileStorage.Put(ctx, challengeDelegationObjectKey(domain), delegationBytes)
+	if err != nil {
+		return ChallengeDelegation{}, err
+	}
+
+	delegation.CNAMEInPlace = cnameInPlace(ctx, delegation)
+	return delegation, nil
+}
+
+func (s *Service) getChallengeDelegation(ctx context.Context, domain string) (ChallengeDelegation, error) {
+	delegationBytes, err := s.fileStorage.Get(ctx, challengeDelegationObjectKey(domain))
+	if err != nil {
+		return ChallengeDelegation{}, err
+	}
+	var delegation ChallengeDelegation
+	err = json.Unmarshal(delegationBytes, &delegation)
+	if err != nil {
+		return ChallengeDelegation{}, fmt.Errorf("domain: %s unable to unmarshal challenge delegation: %w", domain, err)
+	}
+	return delegation, nil
+}
+
+func cnameInPlace(ctx context.Context, delegation ChallengeDelegation) bool {
+	cname, err := net.DefaultResolver.LookupCNAME(ctx, delegation.RecordName)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(strings.TrimSuffix(cname, "."), delegation.Target)
+}
+
+// TXTValues serves the challenge zone for the embedded DNS responder
+func (s *Service) TXTValues(ctx context.Context, name string) ([]string, error) {
+	label := strings.TrimSuffix(strings.ToLower(strings.TrimSuffix(name, ".")), "."+s.challengeZone)
+	// Anything that can't be one of our labels is answered without going to the file store
+	if !validChallengeLabel(label) {
+		return nil, fmt.Errorf("%s: %w", name, dns_service.ErrNoRecords)
+	}
+
+	values, err := s.getChallengeValues(ctx, label)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, fmt.Errorf("%s: %w", name, dns_service.ErrNoRecords)
+	}
+	return values, err
+}
+
+func validChallengeLabel(label string) bool {
+	if len(label) != challengeLabelLength {
+		return false
+	}
+	_, err := hex.DecodeString(label)
+	return err == nil
+}
+
+func (s *Service) getChallengeValues(ctx context.Context, label string) ([]string, error) {
+	valuesBytes, err := s.fileStorage.Get(ctx, challengeRecordsObjectKey(label))
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	err = json.Unmarshal(valuesBytes, &values)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal challenge records: %s: %w", label, err)
+	}
+	return values, nil
+}
+
+func (s *Service) putChallengeValues(ctx context.Context, label string, values []string) error {
+	valuesBytes, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return s.fileStorage.Put(ctx, challengeRecordsObjectKey(label), valuesBytes)
+}
+
+// delegatedChallengeProvider publishes challenges under the label a domain's _acme-challenge name is CNAMEd to
+type delegatedChallengeProvider struct {
+	s *Service
+}
+
+func (p *delegatedChallengeProvider) Name() string {
+	return delegatedChallengeProviderName
+}
+
+func (p *delegatedChallengeProvider) Handles(ctx context.Context, userID uuid.UUID, domain string) (bool, error) {
+	delegation, err := p.s.getChallengeDelegation(ctx, domain)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return delegation.UserID == userID && cnameInPlace(ctx, delegation), nil
+}
+
+func (p *delegatedChallengeProvider) Present(ctx context.Context, userID uuid.UUID, domain string, value string) error {
+	label, err := p.label(ctx, domain)
+	if err != nil {
+		return err
+	}
+	values, err := p.s.getChallengeValues(ctx, label)
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		return err
+	}
+	if contains(values, value) {
+		return nil
+	}
+	values = append(values, value)
+	if len(values) > maxChallengeValues {
+		values = values[len(values)-maxChallengeValues:]
+	}
+	return p.s.putChallengeValues(ctx, label, values)
+}
+
+func (p *delegatedChallengeProvider) CleanUp(ctx context.Context, userID uuid.UUID, domain string, value string) error {
+	label, err := p.label(ctx, domain)
+	if err != nil {
+		return err
+	}
+	values, err := p.s.getChallengeValues(ctx, label)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var remaining []string
+	for _, v := range values {
+		if v != value {
+			remaining = append(remaining, v)
+		}
+	}
+	return p.s.putChallengeValues(ctx, label, remaining)
+}
+
+func (p *delegatedChallengeProvider) label(ctx context.Context, domain string) (string, error) {
+	delegation, err := p.s.getChallengeDelegation(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(delegation.Target, "."+p.s.challengeZone), nil
+}
@@ -0,0 +1,166 @@
+package cert_service
+
+import (
+	"context"
+	"errors"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/service/dns_service"
+	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"strings"
+	"testing"
+	"time"
+)
+
+// putVerifiedDomain stores a domain the user verified and holds the name claim of
+func putVerifiedDomain(t *testing.T, domainStore *storage.MemoryDomainStore, userID uuid.UUID, domain string) {
+	t.Helper()
+	ctx := context.Background()
+	err := domainStore.PutDomainInfo(ctx, models.DomainInformation{
+		DomainName:   domain,
+		UserID:       userID,
+		Verification: models.Verification{Verified: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = domainStore.SwapNameClaim(ctx, domain, uuid.Nil, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestResponderServesDelegatedChallenges follows the path a CA takes for a domain whose _acme-challenge name is
+// CNAMEd to us: it asks the responder for the TXT records of the CNAME target
+func TestResponderServesDelegatedChallenges(t *testing.T) {
+	ctx := context.Background()
+	const domain = "shop.example.test"
+	settings := appconfig.ChallengeDNSSettings{
+		Enabled:    true,
+		Listen:     "127.0.0.1:0",
+		Zone:       "challenges.verifier.test",
+		Nameserver: "ns1.verifier.test",
+	}
+	domainStore := storage.NewMemoryDomainStore()
+	userID := uuid.New()
+	putVerifiedDomain(t, domainStore, userID, domain)
+	s := newTestService(t, storage.NewMemoryFileStore(), WithChallengeDNS(settings))
+	s.domainService = domain_service.New(nil, domainStore)
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	delegation, err := s.CreateChallengeDelegation(lookupCtx, userID, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(delegation.Target, ".challenges.verifier.test") {
+		t.Fatalf("CNAME target = %s", delegation.Target)
+	}
+	provider := &delegatedChallengeProvider{s: s}
+	err = provider.Present(ctx, userID, domain, "dns-01-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	responder, err := dns_service.NewResponder(settings, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = responder.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = responder.Shutdown(context.Background()) })
+
+	queryTXT := func(name string) *dns.Msg {
+		t.Helper()
+		req := new(dns.Msg)
+		req.SetQuestion(dns.Fqdn(name), dns.TypeTXT)
+		resp, _, err := new(dns.Client).Exchange(req, responder.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// Resolvers may change the case of the target they were pointed at
+	resp := queryTXT(strings.ToUpper(delegation.Target))
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("rcode: %s answers: %v", dns.RcodeToString[resp.Rcode], resp.Answer)
+	}
+	if txt, ok := resp.Answer[0].(*dns.TXT); !ok || len(txt.Txt) != 1 || txt.Txt[0] != "dns-01-value" {
+		t.Errorf("answer = %v, want the presented challenge", resp.Answer[0])
+	}
+
+	// The delegated name itself isn't in our zone, the domain's own DNS serves the CNAME
+	if resp := queryTXT(delegation.RecordName); resp.Rcode != dns.RcodeRefused {
+		t.Errorf("%s rcode: %s, want REFUSED", delegation.RecordName, dns.RcodeToString[resp.Rcode])
+	}
+	unknownLabel := strings.Repeat("0", challengeLabelLength) + ".challenges.verifier.test"
+	if resp := queryTXT(unknownLabel); resp.Rcode != dns.RcodeNameError {
+		t.Errorf("unknown label rcode: %s, want NXDOMAIN", dns.RcodeToString[resp.Rcode])
+	}
+
+	err = provider.CleanUp(ctx, userID, domain, "dns-01-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := queryTXT(delegation.Target); resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 {
+		t.Errorf("after clean up rcode: %s answers: %v, want none", dns.RcodeToString[resp.Rcode], resp.Answer)
+	}
+}
+
+func TestChallengeDelegationNeedsVerifiedClaim(t *testing.T) {
+	ctx := context.Background()
+	const domain = "shop.example.test"
+	settings := appconfig.ChallengeDNSSettings{Enabled: true, Zone: "challenges.verifier.test"}
+	domainStore := storage.NewMemoryDomainStore()
+	holder := uuid.New()
+	putVerifiedDomain(t, domainStore, holder, domain)
+	// The other user added the domain and even has a verified record, but the claim is the holder's
+	other := uuid.New()
+	err := domainStore.PutDomainInfo(ctx, models.DomainInformation{
+		DomainName:   domain,
+		UserID:       other,
+		Verification: models.Verification{Verified: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unverified := uuid.New()
+	err = domainStore.PutDomainInfo(ctx, models.DomainInformation{DomainName: domain, UserID: unverified})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestService(t, storage.NewMemoryFileStore(), WithChallengeDNS(settings))
+	s.domainService = domain_service.New(nil, domainStore)
+
+	lookupCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	delegation, err := s.CreateChallengeDelegation(lookupCtx, holder, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, userID := range []uuid.UUID{other, unverified, uuid.New()} {
+		_, err = s.CreateChallengeDelegation(lookupCtx, userID, domain)
+		if err == nil {
+			t.Fatalf("user: %s replaced the delegation of the claim holder", userID)
+		}
+	}
+	_, err = s.CreateChallengeDelegation(lookupCtx, unverified, domain)
+	if !errors.Is(err, ErrDomainNotVerified) {
+		t.Fatalf("unverified user: %v, want %s", err, ErrDomainNotVerified)
+	}
+
+	stored, err := s.getChallengeDelegation(ctx, domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.UserID != holder || stored.Target != delegation.Target {
+		t.Fatalf("delegation: %+v, want the holder's target %s", stored, delegation.Target)
+	}
+}
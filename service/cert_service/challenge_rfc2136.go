@@ -0,0 +1,257 @@
+package cert_service
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	rfc2136ChallengeProviderName = "rfc2136"
+	defaultRFC2136TTL            = 60
+	rfc2136Timeout               = 10 * time.Second
+	// tsigFudge is the clock skew the server allows for our signature
+	tsigFudge = 300
+)
+
+var (
+	ErrInvalidDNSProvider = errors.New("invalid dns provider settings")
+	tsigAlgorithms        = map[string]string{
+		"hmac-sha1":   dns.HmacSHA1,
+		"hmac-sha224": dns.HmacSHA224,
+		"hmac-sha256": dns.HmacSHA256,
+		"hmac-sha384": dns.HmacSHA384,
+		"hmac-sha512": dns.HmacSHA512,
+	}
+)
+
+// RFC2136Settings is how to reach the primary nameserver of a domain for dynamic updates. They are sealed in the file
+// store next to the certificate of the domain because the TSIG secret can change any record of the zone.
+type RFC2136Settings struct {
+	Domain string    `json:"domain"`
+	UserID uuid.UUID `json:"user_id"`
+	// Server is the host:port updates are sent to, port 53 when left out
+	Server string `json:"server"`
+	// Zone is looked up from the authoritative nameservers when empty
+	Zone          string `json:"zone,omitempty"`
+	TSIGKeyName   string `json:"tsig_key_name"`
+	TSIGAlgorithm string `json:"tsig_algorithm"`
+	// TSIGSecret is base64 like in a BIND key statement, it is never returned by the API
+	TSIGSecret string `json:"tsig_secret,omitempty"`
+	TTL        uint32 `json:"ttl,omitempty"`
+}
+
+// WithRFC2136Provider publishes challenges of domains that have RFC 2136 settings with dynamic updates
+func WithRFC2136Provider(settings appconfig.RFC2136Settings) ServiceOpt {
+	return func(s *Service) {
+		s.allowPrivateDNSServers = settings.AllowPrivateServers
+		s.challengeProviders = append(s.challengeProviders, &rfc2136Provider{s: s})
+	}
+}
+
+func rfc2136ObjectKey(domain string) string {
+	return fmt.Sprintf("mastodon_le_certs/%s/rfc2136.sealed", domain)
+}
+
+// PutRFC2136Settings validates and stores the dynamic update settings of a domain, only its verified holder can set them
+func (s *Service) PutRFC2136Settings(ctx context.Context, settings RFC2136Settings) error {
+	err := s.requireVerifiedClaim(ctx, settings.UserID, settings.Domain)
+	if err != nil {
+		return err
+	}
+
+	if settings.Server == "" || settings.TSIGKeyName == "" || settings.TSIGSecret == "" {
+		return fmt.Errorf("%w: server, tsig_key_name and tsig_secret are required", ErrInvalidDNSProvider)
+	}
+	if _, _, err := net.SplitHostPort(settings.Server); err != nil {
+		settings.Server = net.JoinHostPort(settings.Server, "53")
+	}
+	_, err = s.rfc2136ServerAddr(ctx, settings.Server)
+	if err != nil {
+		return err
+	}
+	if settings.TSIGAlgorithm == "" {
+		settings.TSIGAlgorithm = "hmac-sha256"
+	}
+	settings.TSIGAlgorithm = strings.ToLower(strings.TrimSuffix(settings.TSIGAlgorithm, "."))
+	if _, ok := tsigAlgorithms[settings.TSIGAlgorithm]; !ok {
+		return fmt.Errorf("%w: unsupported tsig_algorithm: %s", ErrInvalidDNSProvider, settings.TSIGAlgorithm)
+	}
+	if _, err := base64.StdEncoding.DecodeString(settings.TSIGSecret); err != nil {
+		return fmt.Errorf("%w: tsig_secret isn't base64", ErrInvalidDNSProvider)
+	}
+
+	settingsBytes, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	sealed, err := s.sealer.Seal(ctx, settingsBytes)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to encrypt dns provider settings: %w", settings.Domain, err)
+	}
+	return s.fileStorage.Put(ctx, rfc2136ObjectKey(settings.Domain), sealed)
+}
+
+// GetRFC2136Settings returns the dynamic update settings of a domain of the user without the TSIG secret
+func (s *Service) GetRFC2136Settings(ctx context.Context, userID uuid.UUID, domain string) (RFC2136Settings, error) {
+	settings, err := s.getRFC2136Settings(ctx, domain)
+	if err != nil {
+		return RFC2136Settings{}, err
+	}
+	if settings.UserID != userID {
+		return RFC2136Settings{}, fmt.Errorf("%s: %w", rfc2136ObjectKey(domain), storage.ErrObjectNotFound)
+	}
+	settings.TSIGSecret = ""
+	return settings, nil
+}
+
+// DeleteRFC2136Settings stops publishing the challenges of a domain with dynamic updates
+func (s *Service) DeleteRFC2136Settings(ctx context.Context, userID uuid.UUID, domain string) error {
+	_, err := s.GetRFC2136Settings(ctx, userID, domain)
+	if err != nil {
+		return err
+	}
+	return s.fileStorage.Delete(ctx, rfc2136ObjectKey(domain))
+}
+
+// rfc2136ServerAddr resolves the server updates go to and returns the address to send them to. Updates are sent from
+// inside our network, so servers that resolve to loopback, link-local or private addresses are refused unless they
+// are allowed. It runs again before every update because the name can resolve somewhere else by then.
+func (s *Service) rfc2136ServerAddr(ctx context.Context, server string) (string, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		return "", fmt.Errorf("%w: server: %s", ErrInvalidDNSProvider, err)
+	}
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", fmt.Errorf("%w: unable to resolve server: %s", ErrInvalidDNSProvider, err)
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("%w: server: %s has no addresses", ErrInvalidDNSProvider, host)
+	}
+	if !s.allowPrivateDNSServers {
+		for _, ip := range ips {
+			if privateAddress(ip.IP) {
+				return "", fmt.Errorf("%w: server: %s resolves to private address: %s", ErrInvalidDNSProvider, host, ip.IP)
+			}
+		}
+	}
+	return net.JoinHostPort(ips[0].IP.String(), port), nil
+}
+
+func privateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast()
+}
+
+func (s *Service) getRFC2136Settings(ctx context.Context, domain string) (RFC2136Settings, error) {
+	sealed, err := s.fileStorage.Get(ctx, rfc2136ObjectKey(domain))
+	if err != nil {
+		return RFC2136Settings{}, err
+	}
+	settingsBytes, err := s.sealer.Open(ctx, sealed)
+	if err != nil {
+		return RFC2136Settings{}, fmt.Errorf("domain: %s unable to decrypt dns provider settings: %w", domain, err)
+	}
+	var settings RFC2136Settings
+	err = json.Unmarshal(settingsBytes, &settings)
+	if err != nil {
+		return RFC2136Settings{}, fmt.Errorf("domain: %s unable to unmarshal dns provider settings: %w", domain, err)
+	}
+	return settings, nil
+}
+
+// rfc2136Provider adds and removes the challenge TXT record on the domain's own primary nameserver
+type rfc2136Provider struct {
+	s *Service
+}
+
+func (p *rfc2136Provider) Name() string {
+	return rfc2136ChallengeProviderName
+}
+
+func (p *rfc2136Provider) Handles(ctx context.Context, userID uuid.UUID, domain string) (bool, error) {
+	settings, err := p.s.getRFC2136Settings(ctx, domain)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return settings.UserID == userID, nil
+}
+
+func (p *rfc2136Provider) Present(ctx context.Context, userID uuid.UUID, domain string, value string) error {
+	return p.update(ctx, domain, value, true)
+}
+
+func (p *rfc2136Provider) CleanUp(ctx context.Context, userID uuid.UUID, domain string, value string) error {
+	return p.update(ctx, domain, value, false)
+}
+
+func (p *rfc2136Provider) update(ctx context.Context, domain string, value string, insert bool) error {
+	settings, err := p.s.getRFC2136Settings(ctx, domain)
+	if err != nil {
+		return err
+	}
+	if settings.Zone == "" {
+		if p.s.propagation == nil {
+			return fmt.Errorf("domain: %s dns provider settings need a zone", domain)
+		}
+		settings.Zone, err = p.s.propagation.FindZone(ctx, fmt.Sprintf("_acme-challenge.%s", domain))
+		if err != nil {
+			return err
+		}
+	}
+	return p.send(ctx, settings, domain, value, insert)
+}
+
+// send signs the update with the TSIG key of the domain, it goes over TCP as servers commonly require for updates
+func (p *rfc2136Provider) send(ctx context.Context, settings RFC2136Settings, domain string, value string, insert bool) error {
+	name := dns.Fqdn(fmt.Sprintf("_acme-challenge.%s", domain))
+	ttl := settings.TTL
+	if ttl == 0 {
+		ttl = defaultRFC2136TTL
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+		Txt: []string{value},
+	}
+	msg := new(dns.Msg)
+	msg.SetUpdate(dns.Fqdn(settings.Zone))
+	if insert {
+		msg.Insert([]dns.RR{rr})
+	} else {
+		msg.Remove([]dns.RR{rr})
+	}
+
+	keyName := dns.Fqdn(settings.TSIGKeyName)
+	msg.SetTsig(keyName, tsigAlgorithms[settings.TSIGAlgorithm], tsigFudge, time.Now().Unix())
+	client := &dns.Client{
+		Net:        "tcp",
+		Timeout:    rfc2136Timeout,
+		TsigSecret: map[string]string{keyName: settings.TSIGSecret},
+	}
+	addr, err := p.s.rfc2136ServerAddr(ctx, settings.Server)
+	if err != nil {
+		return err
+	}
+	resp, _, err := client.ExchangeContext(ctx, msg, addr)
+	if err != nil {
+		return fmt.Errorf("dynamic update to: %s failed: %w", settings.Server, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("dynamic update to: %s refused: %s", settings.Server, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
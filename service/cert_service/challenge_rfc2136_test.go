@@ -0,0 +1,289 @@
+package cert_service
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testRFC2136Domain = "shop.example.test"
+
+var testTSIGSecret = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+
+func newRFC2136TestService(t *testing.T, allowPrivate bool) (*Service, uuid.UUID) {
+	t.Helper()
+	domainStore := storage.NewMemoryDomainStore()
+	userID := uuid.New()
+	putVerifiedDomain(t, domainStore, userID, testRFC2136Domain)
+	s := newTestService(t, storage.NewMemoryFileStore(), WithRFC2136Provider(appconfig.RFC2136Settings{AllowPrivateServers: allowPrivate}))
+	s.domainService = domain_service.New(nil, domainStore)
+	return s, userID
+}
+
+func TestPutRFC2136SettingsValidation(t *testing.T) {
+	ctx := context.Background()
+	s, userID := newRFC2136TestService(t, false)
+	valid := RFC2136Settings{
+		Domain:      testRFC2136Domain,
+		UserID:      userID,
+		Server:      "192.0.2.53",
+		TSIGKeyName: "acme-key",
+		TSIGSecret:  testTSIGSecret,
+	}
+
+	tests := []struct {
+		name   string
+		modify func(settings *RFC2136Settings)
+		want   error
+	}{
+		{name: "valid"},
+		{name: "missing server", modify: func(settings *RFC2136Settings) { settings.Server = "" }, want: ErrInvalidDNSProvider},
+		{name: "missing key name", modify: func(settings *RFC2136Settings) { settings.TSIGKeyName = "" }, want: ErrInvalidDNSProvider},
+		{name: "missing secret", modify: func(settings *RFC2136Settings) { settings.TSIGSecret = "" }, want: ErrInvalidDNSProvider},
+		{name: "secret isn't base64", modify: func(settings *RFC2136Settings) { settings.TSIGSecret = "not base64!" }, want: ErrInvalidDNSProvider},
+		{name: "unsupported algorithm", modify: func(settings *RFC2136Settings) { settings.TSIGAlgorithm = "hmac-md5" }, want: ErrInvalidDNSProvider},
+		{name: "loopback", modify: func(settings *RFC2136Settings) { settings.Server = "127.0.0.1:5353" }, want: ErrInvalidDNSProvider},
+		{name: "loopback name", modify: func(settings *RFC2136Settings) { settings.Server = "localhost" }, want: ErrInvalidDNSProvider},
+		{name: "ipv6 loopback", modify: func(settings *RFC2136Settings) { settings.Server = "[::1]:53" }, want: ErrInvalidDNSProvider},
+		{name: "private", modify: func(settings *RFC2136Settings) { settings.Server = "10.0.0.53" }, want: ErrInvalidDNSProvider},
+		{name: "link-local", modify: func(settings *RFC2136Settings) { settings.Server = "169.254.169.254" }, want: ErrInvalidDNSProvider},
+		{name: "ipv6 link-local", modify: func(settings *RFC2136Settings) { settings.Server = "fe80::1" }, want: ErrInvalidDNSProvider},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings := valid
+			if test.modify != nil {
+				test.modify(&settings)
+			}
+			err := s.PutRFC2136Settings(ctx, settings)
+			if test.want == nil && err != nil {
+				t.Fatal(err)
+			}
+			if !errors.Is(err, test.want) {
+				t.Fatalf("err: %v, want %s", err, test.want)
+			}
+		})
+	}
+
+	stored, err := s.getRFC2136Settings(ctx, testRFC2136Domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Server != "192.0.2.53:53" || stored.TSIGAlgorithm != "hmac-sha256" || stored.TSIGSecret != testTSIGSecret {
+		t.Fatalf("stored settings: %+v", stored)
+	}
+}
+
+func TestPutRFC2136SettingsAllowsPrivateServers(t *testing.T) {
+	s, userID := newRFC2136TestService(t, true)
+	err := s.PutRFC2136Settings(context.Background(), RFC2136Settings{
+		Domain:      testRFC2136Domain,
+		UserID:      userID,
+		Server:      "127.0.0.1:5353",
+		TSIGKeyName: "acme-key",
+		TSIGSecret:  testTSIGSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPutRFC2136SettingsNeedsVerifiedClaim(t *testing.T) {
+	s, _ := newRFC2136TestService(t, true)
+	other := uuid.New()
+	err := s.domainService.CreateDomain(context.Background(), models.DomainInformation{DomainName: testRFC2136Domain, UserID: other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.PutRFC2136Settings(context.Background(), RFC2136Settings{
+		Domain:      testRFC2136Domain,
+		UserID:      other,
+		Server:      "127.0.0.1:5353",
+		TSIGKeyName: "acme-key",
+		TSIGSecret:  testTSIGSecret,
+	})
+	if !errors.Is(err, ErrDomainNotVerified) {
+		t.Fatalf("err: %v, want %s", err, ErrDomainNotVerified)
+	}
+}
+
+func TestGetRFC2136SettingsStripsSecret(t *testing.T) {
+	ctx := context.Background()
+	s, userID := newRFC2136TestService(t, true)
+	err := s.PutRFC2136Settings(ctx, RFC2136Settings{
+		Domain:      testRFC2136Domain,
+		UserID:      userID,
+		Server:      "127.0.0.1:5353",
+		TSIGKeyName: "acme-key",
+		TSIGSecret:  testTSIGSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings, err := s.GetRFC2136Settings(ctx, userID, testRFC2136Domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if settings.TSIGSecret != "" || settings.TSIGKeyName != "acme-key" {
+		t.Fatalf("settings: %+v, want the key name without the secret", settings)
+	}
+	_, err = s.GetRFC2136Settings(ctx, uuid.New(), testRFC2136Domain)
+	if !errors.Is(err, storage.ErrObjectNotFound) {
+		t.Fatalf("another user's settings: %v, want %s", err, storage.ErrObjectNotFound)
+	}
+}
+
+// updateServer is a primary nameserver that accepts dynamic updates signed with its TSIG key and keeps the TXT
+// records they leave
+type updateServer struct {
+	addr string
+	mu   sync.Mutex
+	txt  map[string][]string
+}
+
+func newUpdateServer(t *testing.T, keyName string, secret string) *updateServer {
+	t.Helper()
+	u := &updateServer{txt: map[string][]string{}}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.addr = listener.Addr().String()
+	server := &dns.Server{
+		Listener:   listener,
+		TsigSecret: map[string]string{dns.Fqdn(keyName): secret},
+		Handler:    dns.HandlerFunc(u.serveDNS),
+		// The default refuses everything but queries and notifies
+		MsgAcceptFunc: func(dh dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return u
+}
+
+func (u *updateServer) serveDNS(w dns.ResponseWriter, r *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	tsig := r.IsTsig()
+	if tsig == nil || w.TsigStatus() != nil {
+		resp.Rcode = dns.RcodeNotAuth
+		_ = w.WriteMsg(resp)
+		return
+	}
+
+	u.mu.Lock()
+	for _, rr := range r.Ns {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		name := txt.Hdr.Name
+		if txt.Hdr.Class == dns.ClassNONE {
+			u.txt[name] = removeValues(u.txt[name], txt.Txt)
+		} else {
+			u.txt[name] = append(u.txt[name], txt.Txt...)
+		}
+	}
+	u.mu.Unlock()
+
+	resp.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+	_ = w.WriteMsg(resp)
+}
+
+func (u *updateServer) records(name string) []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.txt[dns.Fqdn(name)]...)
+}
+
+func removeValues(values []string, removed []string) []string {
+	var kept []string
+	for _, value := range values {
+		keep := true
+		for _, r := range removed {
+			if value == r {
+				keep = false
+			}
+		}
+		if keep {
+			kept = append(kept, value)
+		}
+	}
+	return kept
+}
+
+func TestRFC2136ProviderUpdatesServer(t *testing.T) {
+	ctx := context.Background()
+	s, userID := newRFC2136TestService(t, true)
+	server := newUpdateServer(t, "acme-key", testTSIGSecret)
+	err := s.PutRFC2136Settings(ctx, RFC2136Settings{
+		Domain:      testRFC2136Domain,
+		UserID:      userID,
+		Server:      server.addr,
+		Zone:        "example.test",
+		TSIGKeyName: "acme-key",
+		TSIGSecret:  testTSIGSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := s.challengeProviderByName(rfc2136ChallengeProviderName)
+	handles, err := provider.Handles(ctx, userID, testRFC2136Domain)
+	if err != nil || !handles {
+		t.Fatalf("handles: %t err: %v", handles, err)
+	}
+	err = provider.Present(ctx, userID, testRFC2136Domain, "dns-01-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recordName := "_acme-challenge." + testRFC2136Domain
+	if records := server.records(recordName); len(records) != 1 || records[0] != "dns-01-value" {
+		t.Fatalf("after present: %v", records)
+	}
+	err = provider.CleanUp(ctx, userID, testRFC2136Domain, "dns-01-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if records := server.records(recordName); len(records) != 0 {
+		t.Fatalf("after clean up: %v", records)
+	}
+}
+
+func TestRFC2136ProviderWrongSecretIsRefused(t *testing.T) {
+	ctx := context.Background()
+	s, userID := newRFC2136TestService(t, true)
+	server := newUpdateServer(t, "acme-key", base64.StdEncoding.EncodeToString([]byte("another secret")))
+	err := s.PutRFC2136Settings(ctx, RFC2136Settings{
+		Domain:      testRFC2136Domain,
+		UserID:      userID,
+		Server:      server.addr,
+		Zone:        "example.test",
+		TSIGKeyName: "acme-key",
+		TSIGSecret:  testTSIGSecret,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := s.challengeProviderByName(rfc2136ChallengeProviderName)
+	err = provider.Present(ctx, userID, testRFC2136Domain, "dns-01-value")
+	if err == nil || !strings.Contains(err.Error(), "NOTAUTH") {
+		t.Fatalf("an update signed with the wrong secret: %v, want NOTAUTH", err)
+	}
+	if records := server.records("_acme-challenge." + testRFC2136Domain); len(records) != 0 {
+		t.Fatalf("records: %v", records)
+	}
+}
@@ -0,0 +1,161 @@
+package cert_service
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/dns-verifier/service/hook_service"
+	"github.com/google/uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+type HookStatus string
+
+const (
+	HookPending   HookStatus = "pending"
+	HookSucceeded HookStatus = "succeeded"
+	HookFailed    HookStatus = "failed"
+)
+
+// HookOutcome is how deploying the current certificate of a domain with one hook went
+type HookOutcome struct {
+	Status        HookStatus `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastAttemptAt time.Time  `json:"last_attempt_at,omitempty"`
+}
+
+// WithHooks runs the deployment hooks after every certificate we write to storage
+func WithHooks(hooks *hook_service.Service) ServiceOpt {
+	return func(s *Service) {
+		s.hooks = hooks
+	}
+}
+
+// scheduleDeployment marks every hook pending for the certificate that was just stored and hands them to the job
+// worker, which retries the ones that fail
+func (s *Service) scheduleDeployment(ctx context.Context, userID uuid.UUID, domain string) error {
+	if s.hooks == nil || len(s.hooks.Names()) == 0 {
+		return nil
+	}
+
+	record, err := s.GetIssuanceRecord(ctx, domain)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to get issuance record: %w", domain, err)
+	}
+	record.Hooks = map[string]HookOutcome{}
+	for _, name := range s.hooks.Names() {
+		record.Hooks[name] = HookOutcome{Status: HookPending}
+	}
+	err = s.putIssuanceRecord(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	if s.jobStore == nil {
+		err = s.RunDeploymentHooks(ctx, domain)
+		if err != nil {
+			logger.Error("domain: %s %s", domain, err)
+		}
+		return nil
+	}
+	_, err = s.submitJob(ctx, deploymentJobKind, userID, domain)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to schedule deployment: %w", domain, err)
+	}
+	return nil
+}
+
+// RunDeploymentHooks runs the hooks that haven't deployed the current certificate of a domain yet and records how
+// each of them went
+func (s *Service) RunDeploymentHooks(ctx context.Context, domain string) error {
+	if s.hooks == nil {
+		return nil
+	}
+
+	record, err := s.GetIssuanceRecord(ctx, domain)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to get issuance record: %w", domain, err)
+	}
+
+	var names []string
+	for name, outcome := range record.Hooks {
+		if outcome.Status != HookSucceeded {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	sort.Strings(names)
+
+	event, err := s.deploymentEvent(ctx, record)
+	if err != nil {
+		return err
+	}
+
+	results := s.hooks.Run(ctx, event, names...)
+	var failed []string
+	for _, name := range names {
+		outcome := record.Hooks[name]
+		hookErr, ran := results[name]
+		if !ran {
+			// The hook was removed from the config since the certificate was issued
+			delete(record.Hooks, name)
+			continue
+		}
+		outcome.Attempts++
+		outcome.LastAttemptAt = time.Now()
+		if hookErr != nil {
+			outcome.Status = HookFailed
+			outcome.LastError = hookErr.Error()
+			failed = append(failed, hookErr.Error())
+		} else {
+			outcome.Status = HookSucceeded
+			outcome.LastError = ""
+		}
+		record.Hooks[name] = outcome
+	}
+
+	err = s.putIssuanceRecord(ctx, record)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to store hook outcomes: %w", domain, err)
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+func (s *Service) deploymentEvent(ctx context.Context, record IssuanceRecord) (hook_service.Event, error) {
+	cert, err := s.LoadTLSCertificate(ctx, record.Domain)
+	if err != nil {
+		return hook_service.Event{}, fmt.Errorf("domain: %s unable to load certificate: %w", record.Domain, err)
+	}
+
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		return hook_service.Event{}, fmt.Errorf("domain: %s unable to marshal private key: %w", record.Domain, err)
+	}
+
+	var chainPEM []byte
+	for _, der := range cert.Certificate {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	return hook_service.Event{
+		Domain:         record.Domain,
+		UserID:         record.UserID,
+		CAProfile:      record.IssuedBy,
+		SerialNumber:   cert.Leaf.SerialNumber.Text(16),
+		NotBefore:      cert.Leaf.NotBefore,
+		NotAfter:       cert.Leaf.NotAfter,
+		CertificatePEM: chainPEM,
+		PrivateKeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}),
+	}, nil
+}
@@ -0,0 +1,84 @@
+package cert_service
+
+import (
+	"context"
+	"errors"
+	"github.com/edwinavalos/dns-verifier/service/hook_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"strings"
+	"testing"
+)
+
+// countingHook fails its first failures runs
+type countingHook struct {
+	name     string
+	failures int
+	runs     int
+	events   []hook_service.Event
+}
+
+func (h *countingHook) Name() string {
+	return h.name
+}
+
+func (h *countingHook) Run(ctx context.Context, event hook_service.Event) error {
+	h.runs++
+	h.events = append(h.events, event)
+	if h.runs <= h.failures {
+		return errors.New("reload refused")
+	}
+	return nil
+}
+
+func TestDeploymentHookOutcomesAndRetries(t *testing.T) {
+	flaky := &countingHook{name: "flaky", failures: 1}
+	steady := &countingHook{name: "steady"}
+	s := newTestService(t, storage.NewMemoryFileStore(), WithHooks(hook_service.New(flaky, steady)))
+	ctx := context.Background()
+	writeSelfSignedCertificate(t, s, testDomain)
+
+	err := s.scheduleDeployment(ctx, uuid.New(), testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := s.GetIssuanceRecord(ctx, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed, succeeded := record.Hooks["flaky"], record.Hooks["steady"]
+	if failed.Status != HookFailed || failed.Attempts != 1 || !strings.Contains(failed.LastError, "reload refused") {
+		t.Errorf("flaky outcome = %+v", failed)
+	}
+	if succeeded.Status != HookSucceeded || succeeded.Attempts != 1 || succeeded.LastError != "" || succeeded.LastAttemptAt.IsZero() {
+		t.Errorf("steady outcome = %+v", succeeded)
+	}
+	event := steady.events[0]
+	if event.Domain != testDomain || !strings.Contains(string(event.PrivateKeyPEM), "PRIVATE KEY") || !strings.Contains(string(event.CertificatePEM), "CERTIFICATE") {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	// The retry only runs the hook that failed
+	err = s.RunDeploymentHooks(ctx, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err = s.GetIssuanceRecord(ctx, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outcome := record.Hooks["flaky"]; outcome.Status != HookSucceeded || outcome.Attempts != 2 || outcome.LastError != "" {
+		t.Errorf("flaky outcome after retry = %+v", outcome)
+	}
+	if steady.runs != 1 || record.Hooks["steady"].Attempts != 1 {
+		t.Errorf("expected the succeeded hook not to run again, ran %d times", steady.runs)
+	}
+
+	err = s.RunDeploymentHooks(ctx, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flaky.runs != 2 {
+		t.Errorf("expected nothing to run once every hook succeeded, flaky ran %d times", flaky.runs)
+	}
+}
@@ -0,0 +1,136 @@
+package cert_service
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/acme"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// FailureClass is a kind of CA failure that makes us move an order on to the next CA profile
+type FailureClass string
+
+const (
+	FailureRateLimited FailureClass = "rate_limited"
+	FailureServerError FailureClass = "server_error"
+	FailureCAA         FailureClass = "caa"
+)
+
+// FallbackAttempt records a CA that we moved away from while getting a certificate
+type FallbackAttempt struct {
+	CAProfile string       `json:"ca_profile"`
+	Class     FailureClass `json:"class"`
+	Error     string       `json:"error"`
+	At        time.Time    `json:"at"`
+}
+
+// FallbackError is returned when completing an order failed at one CA and a new order was placed with the next
+// one. DNS-01 values are bound to the account, so the new challenge record has to be published before completing again.
+type FallbackError struct {
+	From        string
+	To          string
+	Class       FailureClass
+	RecordName  string
+	RecordValue string
+	Err         error
+}
+
+func (e *FallbackError) Error() string {
+	return fmt.Sprintf("CA profile: %s failed with %s, a new order was placed with: %s, publish TXT %s with value %s and complete again: %s",
+		e.From, e.Class, e.To, e.RecordName, e.RecordValue, e.Err)
+}
+
+func (e *FallbackError) Unwrap() error {
+	return e.Err
+}
+
+// classifyACMEError tells whether err is one of the failures we fall back to another CA for
+func classifyACMEError(err error) (FailureClass, bool) {
+	if err == nil {
+		return "", false
+	}
+
+	// Running out of our own budget for a CA is as good as being rate limited by it
+	var budgetErr *BudgetExceededError
+	if errors.As(err, &budgetErr) {
+		return FailureRateLimited, true
+	}
+
+	var authzErr *acme.AuthorizationError
+	if errors.As(err, &authzErr) {
+		for _, challengeErr := range authzErr.Errors {
+			if class, ok := classifyACMEError(challengeErr); ok {
+				return class, true
+			}
+		}
+		return "", false
+	}
+
+	var acmeErr *acme.Error
+	if errors.As(err, &acmeErr) {
+		problemType := strings.ToLower(acmeErr.ProblemType)
+		switch {
+		case strings.HasSuffix(problemType, ":ratelimited"):
+			return FailureRateLimited, true
+		case strings.HasSuffix(problemType, ":caa"):
+			return FailureCAA, true
+		case strings.HasSuffix(problemType, ":serverinternal"), acmeErr.StatusCode >= 500:
+			return FailureServerError, true
+		}
+		for _, subproblem := range acmeErr.Subproblems {
+			if strings.HasSuffix(strings.ToLower(subproblem.Type), ":caa") {
+				return FailureCAA, true
+			}
+		}
+		return "", false
+	}
+
+	// A CA we can't reach is as good as one returning 5xx
+	var urlErr *url.Error
+	var netErr net.Error
+	if errors.As(err, &urlErr) || errors.As(err, &netErr) {
+		return FailureServerError, true
+	}
+	return "", false
+}
+
+// profileChain returns the profiles to try in order for a request. Without an explicit profile the whole fallback
+// order is used, an explicit profile is followed by the profiles after it in the fallback order.
+func (s *Service) profileChain(profile string) ([]string, error) {
+	fallbackOrder := s.acmeSettings.FallbackOrder
+	if profile == "" && len(fallbackOrder) > 0 {
+		profile = fallbackOrder[0]
+	}
+	first, _, err := s.resolveProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	chain := []string{first}
+	for i, name := range fallbackOrder {
+		if name != first {
+			continue
+		}
+		for _, next := range fallbackOrder[i+1:] {
+			_, _, err := s.resolveProfile(next)
+			if err != nil {
+				return nil, fmt.Errorf("acme fallback_order: %w", err)
+			}
+			chain = append(chain, next)
+		}
+		break
+	}
+	return chain, nil
+}
+
+// nextProfile returns the profile after current in the fallback order
+func (s *Service) nextProfile(current string) (string, bool) {
+	chain, err := s.profileChain(current)
+	if err != nil || len(chain) < 2 {
+		return "", false
+	}
+	return chain[1], true
+}
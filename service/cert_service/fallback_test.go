@@ -0,0 +1,241 @@
+package cert_service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/acme"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testDomain = "example.com"
+
+// fakeACME is an ACME directory that answers just enough of RFC 8555 to place an order with a pending DNS-01
+// challenge. Signatures aren't checked. newOrder fails with orderProblem when it is set.
+type fakeACME struct {
+	server       *httptest.Server
+	orderStatus  int
+	orderProblem string
+	orders       atomic.Int32
+}
+
+func newFakeACME(t *testing.T) *fakeACME {
+	t.Helper()
+	f := &fakeACME{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+		f.writeJSON(w, http.StatusOK, map[string]string{
+			"newNonce":   f.url("/new-nonce"),
+			"newAccount": f.url("/new-account"),
+			"newOrder":   f.url("/new-order"),
+			"revokeCert": f.url("/revoke-cert"),
+			"keyChange":  f.url("/key-change"),
+		})
+	})
+	mux.HandleFunc("/new-nonce", func(w http.ResponseWriter, r *http.Request) {
+		f.nonce(w)
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/new-account", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", f.url("/account/1"))
+		f.writeJSON(w, http.StatusOK, map[string]any{"status": "valid"})
+	})
+	mux.HandleFunc("/new-order", func(w http.ResponseWriter, r *http.Request) {
+		f.orders.Add(1)
+		if f.orderProblem != "" {
+			f.nonce(w)
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(f.orderStatus)
+			_ = json.NewEncoder(w).Encode(map[string]string{"type": f.orderProblem, "detail": "refused by the fake CA"})
+			return
+		}
+		w.Header().Set("Location", f.url("/order/1"))
+		f.writeJSON(w, http.StatusCreated, map[string]any{
+			"status":         "pending",
+			"identifiers":    []map[string]string{{"type": "dns", "value": testDomain}},
+			"authorizations": []string{f.url("/authz/1")},
+			"finalize":       f.url("/finalize/1"),
+		})
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, r *http.Request) {
+		f.writeJSON(w, http.StatusOK, map[string]any{
+			"status":     "pending",
+			"identifier": map[string]string{"type": "dns", "value": testDomain},
+			"challenges": []map[string]string{{"type": "dns-01", "url": f.url("/challenge/1"), "token": "token-1", "status": "pending"}},
+		})
+	})
+	f.server = httptest.NewServer(mux)
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeACME) url(path string) string {
+	return f.server.URL + path
+}
+
+func (f *fakeACME) nonce(w http.ResponseWriter) {
+	w.Header().Set("Replay-Nonce", uuid.NewString())
+	w.Header().Set("Cache-Control", "no-store")
+}
+
+func (f *fakeACME) writeJSON(w http.ResponseWriter, status int, body any) {
+	f.nonce(w)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// newFallbackTestService falls back from the primary to the secondary fake CA for a verified testDomain
+func newFallbackTestService(t *testing.T, primary *fakeACME, secondary *fakeACME) (*Service, uuid.UUID) {
+	t.Helper()
+	ctx := context.Background()
+	domainStore := storage.NewMemoryDomainStore()
+	userID := uuid.New()
+	err := domainStore.PutDomainInfo(ctx, models.DomainInformation{
+		DomainName:   testDomain,
+		UserID:       userID,
+		Verification: models.Verification{Verified: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := func(f *fakeACME) appconfig.CAProfile {
+		return appconfig.CAProfile{
+			DirectoryURL:       f.url("/directory"),
+			Email:              "admin@example.com",
+			AccountKeyLocation: filepath.Join(t.TempDir(), "missing.der"),
+		}
+	}
+	s := newTestService(t, storage.NewMemoryFileStore(), WithACMESettings(appconfig.ACMESettings{
+		DefaultProfile: "primary",
+		Profiles: map[string]appconfig.CAProfile{
+			"primary":   profile(primary),
+			"secondary": profile(secondary),
+		},
+		FallbackOrder: []string{"primary", "secondary"},
+	}))
+	s.domainService = domain_service.New(nil, domainStore)
+	return s, userID
+}
+
+func TestRequestCertificateFallsBackWhenPrimaryIsRateLimited(t *testing.T) {
+	primary := newFakeACME(t)
+	primary.orderStatus = http.StatusTooManyRequests
+	primary.orderProblem = "urn:ietf:params:acme:error:rateLimited"
+	secondary := newFakeACME(t)
+	s, userID := newFallbackTestService(t, primary, secondary)
+
+	// The certificate currently served came from the primary and was deployed
+	issuedAt := time.Now().Add(-80 * 24 * time.Hour).UTC().Truncate(time.Second)
+	err := s.putIssuanceRecord(context.Background(), IssuanceRecord{
+		Domain:    testDomain,
+		UserID:    userID,
+		CAProfile: "primary",
+		IssuedAt:  issuedAt,
+		IssuedBy:  "primary",
+		Hooks:     map[string]HookOutcome{"reload": {Status: "succeeded", Attempts: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recordName, recordValue, alreadyValid, err := s.RequestCertificate(userID, testDomain, "", "")
+	if err != nil {
+		t.Fatalf("RequestCertificate() error = %s", err)
+	}
+	if alreadyValid || recordName != "_acme-challenge."+testDomain || recordValue == "" {
+		t.Fatalf("RequestCertificate() = %q, %q, %t", recordName, recordValue, alreadyValid)
+	}
+	if primary.orders.Load() != 1 || secondary.orders.Load() != 1 {
+		t.Fatalf("orders primary: %d secondary: %d, want one each", primary.orders.Load(), secondary.orders.Load())
+	}
+
+	record, err := s.GetIssuanceRecord(context.Background(), testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.CAProfile != "secondary" || record.OrderURL != secondary.url("/order/1") {
+		t.Errorf("pending order is with: %s at: %s, want secondary", record.CAProfile, record.OrderURL)
+	}
+	if len(record.Fallbacks) != 1 || record.Fallbacks[0].CAProfile != "primary" || record.Fallbacks[0].Class != FailureRateLimited {
+		t.Errorf("fallbacks = %+v, want primary rate limited", record.Fallbacks)
+	}
+	if record.IssuedBy != "primary" || !record.IssuedAt.Equal(issuedAt) || record.Hooks["reload"].Status != "succeeded" {
+		t.Errorf("the served certificate's issuer: %s issued at: %s hooks: %+v were not kept", record.IssuedBy, record.IssuedAt, record.Hooks)
+	}
+}
+
+func TestRequestCertificateDoesNotFallBackOnAuthorizationErrors(t *testing.T) {
+	primary := newFakeACME(t)
+	primary.orderStatus = http.StatusForbidden
+	primary.orderProblem = "urn:ietf:params:acme:error:unauthorized"
+	secondary := newFakeACME(t)
+	s, userID := newFallbackTestService(t, primary, secondary)
+
+	_, _, _, err := s.RequestCertificate(userID, testDomain, "", "")
+	var acmeErr *acme.Error
+	if !errors.As(err, &acmeErr) || acmeErr.ProblemType != "urn:ietf:params:acme:error:unauthorized" {
+		t.Fatalf("RequestCertificate() error = %v, want the primary's unauthorized problem", err)
+	}
+	if secondary.orders.Load() != 0 {
+		t.Fatalf("secondary got %d orders, want none", secondary.orders.Load())
+	}
+}
+
+func TestClassifyACMEError(t *testing.T) {
+	problem := func(problemType string, status int) *acme.Error {
+		return &acme.Error{ProblemType: problemType, StatusCode: status}
+	}
+	tests := []struct {
+		name      string
+		err       error
+		wantClass FailureClass
+		wantFall  bool
+	}{
+		{"nil", nil, "", false},
+		{"rate limited", problem("urn:ietf:params:acme:error:rateLimited", http.StatusTooManyRequests), FailureRateLimited, true},
+		{"wrapped rate limited", fmt.Errorf("new order: %w", problem("urn:ietf:params:acme:error:rateLimited", http.StatusTooManyRequests)), FailureRateLimited, true},
+		{"own budget", &BudgetExceededError{RetryAt: time.Now().Add(time.Hour)}, FailureRateLimited, true},
+		{"caa", problem("urn:ietf:params:acme:error:caa", http.StatusForbidden), FailureCAA, true},
+		{"caa subproblem", &acme.Error{
+			ProblemType: "urn:ietf:params:acme:error:rejectedIdentifier",
+			StatusCode:  http.StatusBadRequest,
+			Subproblems: []acme.Subproblem{{Type: "urn:ietf:params:acme:error:caa"}},
+		}, FailureCAA, true},
+		{"server internal", problem("urn:ietf:params:acme:error:serverInternal", http.StatusInternalServerError), FailureServerError, true},
+		{"bad gateway", problem("", http.StatusBadGateway), FailureServerError, true},
+		{"unreachable", &url.Error{Op: "Post", URL: "https://ca.invalid", Err: errors.New("connection refused")}, FailureServerError, true},
+		{"unauthorized", problem("urn:ietf:params:acme:error:unauthorized", http.StatusForbidden), "", false},
+		{"malformed", problem("urn:ietf:params:acme:error:malformed", http.StatusBadRequest), "", false},
+		{"failed authorization", &acme.AuthorizationError{
+			URI:    "https://ca.example/authz/1",
+			Errors: []error{problem("urn:ietf:params:acme:error:unauthorized", http.StatusForbidden)},
+		}, "", false},
+		{"authorization refused by caa", &acme.AuthorizationError{
+			URI:    "https://ca.example/authz/1",
+			Errors: []error{problem("urn:ietf:params:acme:error:caa", http.StatusForbidden)},
+		}, FailureCAA, true},
+		{"other", errors.New("something else"), "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			class, fallback := classifyACMEError(tt.err)
+			if class != tt.wantClass || fallback != tt.wantFall {
+				t.Errorf("classifyACMEError() = %q, %t, want %q, %t", class, fallback, tt.wantClass, tt.wantFall)
+			}
+		})
+	}
+}
@@ -0,0 +1,509 @@
+package cert_service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"math/big"
+	"time"
+)
+
+const (
+	defaultRootLifetime         = 10 * 365 * 24 * time.Hour
+	defaultIntermediateLifetime = 5 * 365 * 24 * time.Hour
+	defaultLeafLifetime         = 90 * 24 * time.Hour
+	defaultCRLLifetime          = 24 * time.Hour
+	// certificateBackdate covers clients whose clocks are a little behind ours
+	certificateBackdate = 5 * time.Minute
+)
+
+var (
+	ErrNotInternalCA     = errors.New("CA profile is not an internal CA")
+	ErrDomainNotVerified = errors.New("domain ownership isn't verified")
+)
+
+// internalCAMaterial is the sealed form of an internal CA in the file store, certificates are DER and keys PKCS #8
+type internalCAMaterial struct {
+	RootCert         []byte `json:"root_cert"`
+	RootKey          []byte `json:"root_key"`
+	IntermediateCert []byte `json:"intermediate_cert"`
+	IntermediateKey  []byte `json:"intermediate_key"`
+}
+
+type internalCA struct {
+	root            *x509.Certificate
+	intermediate    *x509.Certificate
+	intermediateKey crypto.Signer
+}
+
+// revokedCertificate is an entry of the revocation list of an internal CA
+type revokedCertificate struct {
+	SerialNumber string    `json:"serial_number"`
+	Domain       string    `json:"domain"`
+	RevokedAt    time.Time `json:"revoked_at"`
+}
+
+func internalCAObjectKey(profileName string, name string) string {
+	return fmt.Sprintf("internal_ca/%s/%s", profileName, name)
+}
+
+func revokedObjectKey(profileName string, serial string) string {
+	return internalCAObjectKey(profileName, fmt.Sprintf("revoked/%s.json", serial))
+}
+
+// internalCAProfile resolves a profile name that has to be an internal CA
+func (s *Service) internalCAProfile(profileName string) (string, appconfig.InternalCASettings, error) {
+	name, profile, err := s.resolveProfile(profileName)
+	if err != nil {
+		return "", appconfig.InternalCASettings{}, err
+	}
+	if profile.Type != InternalCAType {
+		return "", appconfig.InternalCASettings{}, fmt.Errorf("%s: %w", name, ErrNotInternalCA)
+	}
+	return name, profile.Internal, nil
+}
+
+func (s *Service) isInternalCAProfile(profileName string) bool {
+	_, _, err := s.internalCAProfile(profileName)
+	return err == nil
+}
+
+// internalCA returns the root and intermediate of an internal CA profile, the first replica to need them creates them
+func (s *Service) internalCA(ctx context.Context, profileName string, settings appconfig.InternalCASettings) (*internalCA, error) {
+	if cached, ok := s.internalCAs.Load(profileName); ok {
+		return cached.(*internalCA), nil
+	}
+
+	ca, err := s.loadInternalCA(ctx, profileName)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		ca, err = s.initInternalCA(ctx, profileName, settings)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	s.internalCAs.Store(profileName, ca)
+	return ca, nil
+}
+
+func (s *Service) loadInternalCA(ctx context.Context, profileName string) (*internalCA, error) {
+	sealed, err := s.fileStorage.Get(ctx, internalCAObjectKey(profileName, "ca.sealed"))
+	if err != nil {
+		return nil, err
+	}
+	materialBytes, err := s.sealer.Open(ctx, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("CA profile: %s unable to decrypt internal CA: %w", profileName, err)
+	}
+	var material internalCAMaterial
+	err = json.Unmarshal(materialBytes, &material)
+	if err != nil {
+		return nil, fmt.Errorf("CA profile: %s unable to unmarshal internal CA: %w", profileName, err)
+	}
+
+	root, err := x509.ParseCertificate(material.RootCert)
+	if err != nil {
+		return nil, fmt.Errorf("CA profile: %s unable to parse root: %w", profileName, err)
+	}
+	intermediate, err := x509.ParseCertificate(material.IntermediateCert)
+	if err != nil {
+		return nil, fmt.Errorf("CA profile: %s unable to parse intermediate: %w", profileName, err)
+	}
+	intermediateKey, err := x509.ParsePKCS8PrivateKey(material.IntermediateKey)
+	if err != nil {
+		return nil, fmt.Errorf("CA profile: %s unable to parse intermediate key: %w", profileName, err)
+	}
+	signer, ok := intermediateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("CA profile: %s unsupported intermediate key type: %T", profileName, intermediateKey)
+	}
+
+	return &internalCA{
+		root:            root,
+		intermediate:    intermediate,
+		intermediateKey: signer,
+	}, nil
+}
+
+func (s *Service) initInternalCA(ctx context.Context, profileName string, settings appconfig.InternalCASettings) (*internalCA, error) {
+	logger.Info("CA profile: %s has no internal CA, creating one", profileName)
+	material, err := newInternalCAMaterial(profileName, settings)
+	if err != nil {
+		return nil, fmt.Errorf("CA profile: %s unable to create internal CA: %w", profileName, err)
+	}
+
+	materialBytes, err := json.Marshal(material)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.sealer.Seal(ctx, materialBytes)
+	if err != nil {
+		return nil, fmt.Errorf("CA profile: %s unable to encrypt internal CA: %w", profileName, err)
+	}
+	// Replicas starting together all get here, only the first CA created is used and the others load it
+	err = s.fileStorage.Create(ctx, internalCAObjectKey(profileName, "ca.sealed"), sealed)
+	if errors.Is(err, storage.ErrObjectExists) {
+		logger.Info("CA profile: %s internal CA was created by another replica, loading it", profileName)
+		return s.loadInternalCA(ctx, profileName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.loadInternalCA(ctx, profileName)
+}
+
+func newInternalCAMaterial(profileName string, settings appconfig.InternalCASettings) (internalCAMaterial, error) {
+	rootLifetime := settings.RootLifetime
+	if rootLifetime <= 0 {
+		rootLifetime = defaultRootLifetime
+	}
+	intermediateLifetime := settings.IntermediateLifetime
+	if intermediateLifetime <= 0 {
+		intermediateLifetime = defaultIntermediateLifetime
+	}
+	if intermediateLifetime > rootLifetime {
+		intermediateLifetime = rootLifetime
+	}
+	subject := pkix.Name{CommonName: fmt.Sprintf("%s Root CA", profileName)}
+	if settings.Organization != "" {
+		subject.Organization = []string{settings.Organization}
+	}
+
+	now := time.Now()
+	rootKey, err := ecdsa.GenerateKey(elliptic.P384(), cryptorand.Reader)
+	if err != nil {
+		return internalCAMaterial{}, err
+	}
+	rootSerial, err := randomSerialNumber()
+	if err != nil {
+		return internalCAMaterial{}, err
+	}
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          rootSerial,
+		Subject:               subject,
+		NotBefore:             now.Add(-certificateBackdate),
+		NotAfter:              now.Add(rootLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            1,
+	}
+	rootDER, err := x509.CreateCertificate(cryptorand.Reader, rootTemplate, rootTemplate, rootKey.Public(), rootKey)
+	if err != nil {
+		return internalCAMaterial{}, err
+	}
+	root, err := x509.ParseCertificate(rootDER)
+	if err != nil {
+		return internalCAMaterial{}, err
+	}
+
+	intermediateKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return internalCAMaterial{}, err
+	}
+	intermediateSerial, err := randomSerialNumber()
+	if err != nil {
+		return internalCAMaterial{}, err
+	}
+	subject.CommonName = fmt.Sprintf("%s Intermediate CA", profileName)
+	intermediateTemplate := &x509.Certificate{
+		SerialNumber:          intermediateSerial,
+		Subject:               subject,
+		NotBefore:             now.Add(-certificateBackdate),
+		NotAfter:              now.Add(intermediateLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	intermediateDER, err := x509.CreateCertificate(cryptorand.Reader, intermediateTemplate, root, intermediateKey.Public(), rootKey)
+	if err != nil {
+		return internalCAMaterial{}, err
+	}
+
+	rootKeyBytes, err := x509.MarshalPKCS8PrivateKey(rootKey)
+	if err != nil {
+		return internalCAMaterial{}, err
+	}
+	intermediateKeyBytes, err := x509.MarshalPKCS8PrivateKey(intermediateKey)
+	if err != nil {
+		return internalCAMaterial{}, err
+	}
+	return internalCAMaterial{
+		RootCert:         rootDER,
+		RootKey:          rootKeyBytes,
+		IntermediateCert: intermediateDER,
+		IntermediateKey:  intermediateKeyBytes,
+	}, nil
+}
+
+// issueInternalCertificate issues a leaf for a verified domain from an internal CA and stores it where ACME
+// certificates go, so serving, listing, downloading and the deployment hooks work the same for both
+func (s *Service) issueInternalCertificate(ctx context.Context, userID uuid.UUID, domain string, domainInfo models.DomainInformation, profileName string, fallbacks []FallbackAttempt) error {
+	name, settings, err := s.internalCAProfile(profileName)
+	if err != nil {
+		return err
+	}
+
+	err = s.verifyOwnershipForInternalCA(ctx, userID, domain, domainInfo)
+	if err != nil {
+		return err
+	}
+
+	ca, err := s.internalCA(ctx, name, settings)
+	if err != nil {
+		return err
+	}
+
+	leafLifetime := settings.LeafLifetime
+	if leafLifetime <= 0 {
+		leafLifetime = defaultLeafLifetime
+	}
+	now := time.Now()
+	notAfter := now.Add(leafLifetime)
+	if notAfter.After(ca.intermediate.NotAfter) {
+		notAfter = ca.intermediate.NotAfter
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    now.Add(-certificateBackdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if settings.CRLURL != "" {
+		template.CRLDistributionPoints = []string{settings.CRLURL}
+	}
+
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return fmt.Errorf("problem generating key: %w", err)
+	}
+	leafDER, err := x509.CreateCertificate(cryptorand.Reader, template, ca.intermediate, privateKey.Public(), ca.intermediateKey)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to issue certificate: %w", domain, err)
+	}
+	logger.Info("domain: %s issued certificate: %s from internal CA: %s", domain, serial.Text(16), name)
+
+	err = s.putIssuanceRecord(ctx, IssuanceRecord{
+		Domain:      domain,
+		UserID:      userID,
+		CAProfile:   name,
+		RequestedAt: now,
+		IssuedAt:    now,
+		IssuedBy:    name,
+		Fallbacks:   fallbacks,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = s.WriteToStorage(ctx, privateKey, domain, [][]byte{leafDER, ca.intermediate.Raw})
+	if err != nil {
+		return err
+	}
+
+	return s.scheduleDeployment(ctx, userID, domain)
+}
+
+// verifyOwnershipForInternalCA accepts a verified ownership TXT record or a delegation to us. Internal names are
+// checked with whatever resolvers this service runs against, which is what makes them verifiable at all.
+func (s *Service) verifyOwnershipForInternalCA(ctx context.Context, userID uuid.UUID, domain string, domainInfo models.DomainInformation) error {
+	if domainInfo.Verification.Verified {
+		return nil
+	}
+	if delegated, err := s.domainService.VerifyARecord(ctx, userID, domain); err == nil && delegated {
+		return nil
+	}
+	if delegated, err := s.domainService.VerifyCNAME(ctx, userID, domain); err == nil && delegated {
+		return nil
+	}
+	return fmt.Errorf("domain: %s %w", domain, ErrDomainNotVerified)
+}
+
+// RevokeInternalCertificate puts the current certificate of a domain on the CRL of the internal CA that issued it
+func (s *Service) RevokeInternalCertificate(ctx context.Context, domain string) error {
+	record, err := s.GetIssuanceRecord(ctx, domain)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to get issuance record: %w", domain, err)
+	}
+	name, _, err := s.internalCAProfile(record.IssuedBy)
+	if err != nil {
+		return err
+	}
+
+	chain, err := s.readCertificateChain(ctx, domain)
+	if err != nil {
+		return err
+	}
+	serial := chain[0].SerialNumber.Text(16)
+
+	// Every revocation is its own object, concurrent revocations can't drop each other
+	revokedBytes, err := json.Marshal(revokedCertificate{
+		SerialNumber: serial,
+		Domain:       domain,
+		RevokedAt:    time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	err = s.fileStorage.Create(ctx, revokedObjectKey(name, serial), revokedBytes)
+	if errors.Is(err, storage.ErrObjectExists) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info("domain: %s revoked certificate: %s of internal CA: %s", domain, serial, name)
+	return nil
+}
+
+// getRevokedCertificates returns the revocations of an internal CA, the revoked.json list older versions kept
+// is still read
+func (s *Service) getRevokedCertificates(ctx context.Context, profileName string) ([]revokedCertificate, error) {
+	var revoked []revokedCertificate
+	legacyBytes, err := s.fileStorage.Get(ctx, internalCAObjectKey(profileName, "revoked.json"))
+	if err != nil && !errors.Is(err, storage.ErrObjectNotFound) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(legacyBytes, &revoked)
+		if err != nil {
+			return nil, fmt.Errorf("CA profile: %s unable to unmarshal revocation list: %w", profileName, err)
+		}
+	}
+
+	seen := make(map[string]bool, len(revoked))
+	for _, entry := range revoked {
+		seen[entry.SerialNumber] = true
+	}
+
+	keys, err := s.fileStorage.List(ctx, internalCAObjectKey(profileName, "revoked/"))
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		entryBytes, err := s.fileStorage.Get(ctx, key)
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var entry revokedCertificate
+		err = json.Unmarshal(entryBytes, &entry)
+		if err != nil {
+			return nil, fmt.Errorf("CA profile: %s unable to unmarshal revocation: %s: %w", profileName, key, err)
+		}
+		if seen[entry.SerialNumber] {
+			continue
+		}
+		seen[entry.SerialNumber] = true
+		revoked = append(revoked, entry)
+	}
+	return revoked, nil
+}
+
+// internalCertificateRevoked reports whether a certificate issued by an internal CA is on its revocation list
+func (s *Service) internalCertificateRevoked(ctx context.Context, profileName string, cert *x509.Certificate) (bool, error) {
+	serial := cert.SerialNumber.Text(16)
+	_, err := s.fileStorage.Get(ctx, revokedObjectKey(profileName, serial))
+	if err == nil {
+		return true, nil
+	}
+	if !errors.Is(err, storage.ErrObjectNotFound) {
+		return false, err
+	}
+
+	revoked, err := s.getRevokedCertificates(ctx, profileName)
+	if err != nil {
+		return false, err
+	}
+	for _, entry := range revoked {
+		if entry.SerialNumber == serial {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// InternalCARoot returns the PEM root certificate of an internal CA, this is what clients have to trust
+func (s *Service) InternalCARoot(ctx context.Context, profileName string) ([]byte, error) {
+	name, settings, err := s.internalCAProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := s.internalCA(ctx, name, settings)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw}), nil
+}
+
+// InternalCACRL returns a DER CRL of an internal CA signed by its intermediate, it is made fresh for every call
+func (s *Service) InternalCACRL(ctx context.Context, profileName string) ([]byte, error) {
+	name, settings, err := s.internalCAProfile(profileName)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := s.internalCA(ctx, name, settings)
+	if err != nil {
+		return nil, err
+	}
+	revoked, err := s.getRevokedCertificates(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	crlLifetime := settings.CRLLifetime
+	if crlLifetime <= 0 {
+		crlLifetime = defaultCRLLifetime
+	}
+	now := time.Now()
+	template := &x509.RevocationList{
+		// CRL numbers have to grow, the time we signed at does
+		Number:     big.NewInt(now.Unix()),
+		ThisUpdate: now,
+		NextUpdate: now.Add(crlLifetime),
+	}
+	for _, entry := range revoked {
+		serial, ok := new(big.Int).SetString(entry.SerialNumber, 16)
+		if !ok {
+			continue
+		}
+		template.RevokedCertificates = append(template.RevokedCertificates, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: entry.RevokedAt,
+		})
+	}
+
+	return x509.CreateRevocationList(cryptorand.Reader, template, ca.intermediate, ca.intermediateKey)
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	serial, err := cryptorand.Int(cryptorand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("unable to generate serial number: %w", err)
+	}
+	return serial, nil
+}
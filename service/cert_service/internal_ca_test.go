@@ -0,0 +1,294 @@
+package cert_service
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testInternalProfile = "internal"
+
+func internalCASettings() ServiceOpt {
+	return WithACMESettings(appconfig.ACMESettings{
+		DefaultProfile: testInternalProfile,
+		Profiles: map[string]appconfig.CAProfile{
+			testInternalProfile: {
+				Type: InternalCAType,
+				Internal: appconfig.InternalCASettings{
+					Organization: "Example Org",
+					LeafLifetime: 7 * 24 * time.Hour,
+				},
+			},
+		},
+	})
+}
+
+func newInternalCATestService(t *testing.T) *Service {
+	t.Helper()
+	s := newTestService(t, storage.NewMemoryFileStore(), internalCASettings())
+	s.domainService = domain_service.New(nil, storage.NewMemoryDomainStore())
+	return s
+}
+
+func verifiedDomain(userID uuid.UUID, domain string) models.DomainInformation {
+	return models.DomainInformation{
+		UserID:       userID,
+		DomainName:   domain,
+		Verification: models.Verification{Verified: true},
+	}
+}
+
+func TestInternalCARacingReplicasShareOneCA(t *testing.T) {
+	fileStore := storage.NewMemoryFileStore()
+	sealer := newTestSealer(t)
+
+	const replicas = 2
+	roots := make([][]byte, replicas)
+	errs := make([]error, replicas)
+	var wg sync.WaitGroup
+	for i := 0; i < replicas; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := New(nil, fileStore, nil, WithSealer(sealer), internalCASettings())
+			roots[i], errs[i] = s.InternalCARoot(context.Background(), testInternalProfile)
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < replicas; i++ {
+		if errs[i] != nil {
+			t.Fatalf("replica %d: %s", i, errs[i])
+		}
+		if string(roots[i]) != string(roots[0]) {
+			t.Fatalf("replica %d got a different root than replica 0", i)
+		}
+	}
+
+	stored, err := New(nil, fileStore, nil, WithSealer(sealer)).loadInternalCA(context.Background(), testInternalProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(roots[0])
+	if block == nil || string(block.Bytes) != string(stored.root.Raw) {
+		t.Fatal("stored root isn't the one the replicas use")
+	}
+}
+
+func TestIssueInternalCertificate(t *testing.T) {
+	ctx := context.Background()
+	s := newInternalCATestService(t)
+	userID := uuid.New()
+
+	err := s.issueInternalCertificate(ctx, userID, testDomain, verifiedDomain(userID, testDomain), testInternalProfile, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chain, err := s.readCertificateChain(ctx, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 {
+		t.Fatalf("chain has %d certificates, want the leaf and the intermediate", len(chain))
+	}
+	leaf := chain[0]
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != testDomain {
+		t.Fatalf("leaf names: %v, want [%s]", leaf.DNSNames, testDomain)
+	}
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	if want := 7*24*time.Hour + certificateBackdate; lifetime < want-time.Minute || lifetime > want+time.Minute {
+		t.Fatalf("leaf lifetime: %s, want about %s", lifetime, want)
+	}
+
+	rootPEM, err := s.InternalCARoot(ctx, testInternalProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(rootPEM) {
+		t.Fatal("root download isn't a PEM certificate")
+	}
+	intermediates := x509.NewCertPool()
+	intermediates.AddCert(chain[1])
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       testDomain,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		t.Fatalf("leaf doesn't chain to the root: %s", err)
+	}
+
+	record, err := s.GetIssuanceRecord(ctx, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.IssuedBy != testInternalProfile || record.UserID != userID {
+		t.Fatalf("issuance record: %+v", record)
+	}
+}
+
+func TestInternalCARootIsPEM(t *testing.T) {
+	s := newInternalCATestService(t)
+
+	rootPEM, err := s.InternalCARoot(context.Background(), testInternalProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, rest := pem.Decode(rootPEM)
+	if block == nil || block.Type != "CERTIFICATE" || len(rest) != 0 {
+		t.Fatalf("root download: %q", rootPEM)
+	}
+	root, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !root.IsCA || root.Subject.CommonName != testInternalProfile+" Root CA" {
+		t.Fatalf("root: CA %t subject %s", root.IsCA, root.Subject)
+	}
+	if len(root.Subject.Organization) != 1 || root.Subject.Organization[0] != "Example Org" {
+		t.Fatalf("root organization: %v", root.Subject.Organization)
+	}
+
+	_, err = s.InternalCARoot(context.Background(), "missing")
+	if !errors.Is(err, ErrUnknownCAProfile) {
+		t.Fatalf("root of an unknown profile: %v, want %s", err, ErrUnknownCAProfile)
+	}
+}
+
+func TestVerifyOwnershipForInternalCA(t *testing.T) {
+	ctx := context.Background()
+	s := newInternalCATestService(t)
+	userID := uuid.New()
+
+	err := s.verifyOwnershipForInternalCA(ctx, userID, testDomain, verifiedDomain(userID, testDomain))
+	if err != nil {
+		t.Fatalf("verified domain: %s", err)
+	}
+
+	// The domain isn't in the store, so neither delegation check can resolve anything
+	err = s.verifyOwnershipForInternalCA(ctx, userID, testDomain, models.DomainInformation{UserID: userID, DomainName: testDomain})
+	if !errors.Is(err, ErrDomainNotVerified) {
+		t.Fatalf("unverified domain: %v, want %s", err, ErrDomainNotVerified)
+	}
+
+	err = s.issueInternalCertificate(ctx, userID, testDomain, models.DomainInformation{UserID: userID, DomainName: testDomain}, testInternalProfile, nil)
+	if !errors.Is(err, ErrDomainNotVerified) {
+		t.Fatalf("issuing for an unverified domain: %v, want %s", err, ErrDomainNotVerified)
+	}
+	_, err = s.readCertificateChain(ctx, testDomain)
+	if err == nil {
+		t.Fatal("a certificate was stored for an unverified domain")
+	}
+}
+
+func TestInternalCACRLListsRevocations(t *testing.T) {
+	ctx := context.Background()
+	s := newInternalCATestService(t)
+	userID := uuid.New()
+
+	const domains = 4
+	serials := map[string]bool{}
+	for i := 0; i < domains; i++ {
+		domain := fmt.Sprintf("host%d.%s", i, testDomain)
+		err := s.issueInternalCertificate(ctx, userID, domain, verifiedDomain(userID, domain), testInternalProfile, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, err := s.readCertificateChain(ctx, domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+		serials[chain[0].SerialNumber.Text(16)] = true
+	}
+
+	// Revocations racing each other all have to land on the CRL
+	errs := make([]error, domains)
+	var wg sync.WaitGroup
+	for i := 0; i < domains; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = s.RevokeInternalCertificate(ctx, fmt.Sprintf("host%d.%s", i, testDomain))
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("revoking host%d: %s", i, err)
+		}
+	}
+	// Revoking again is a no-op
+	err := s.RevokeInternalCertificate(ctx, "host0."+testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crlDER, err := s.InternalCACRL(ctx, testInternalProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(crlDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := s.loadInternalCA(ctx, testInternalProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = crl.CheckSignatureFrom(ca.intermediate)
+	if err != nil {
+		t.Fatalf("CRL isn't signed by the intermediate: %s", err)
+	}
+	if len(crl.RevokedCertificates) != domains {
+		t.Fatalf("CRL lists %d certificates, want %d", len(crl.RevokedCertificates), domains)
+	}
+	for _, entry := range crl.RevokedCertificates {
+		if !serials[entry.SerialNumber.Text(16)] {
+			t.Fatalf("CRL lists unknown serial %s", entry.SerialNumber.Text(16))
+		}
+	}
+
+	chain, err := s.readCertificateChain(ctx, "host1."+testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := s.internalCertificateRevoked(ctx, testInternalProfile, chain[0])
+	if err != nil || !revoked {
+		t.Fatalf("revoked certificate reported revoked %t: %v", revoked, err)
+	}
+}
+
+func TestInternalCARevocationsReadLegacyList(t *testing.T) {
+	ctx := context.Background()
+	s := newInternalCATestService(t)
+	err := s.fileStorage.Put(ctx, internalCAObjectKey(testInternalProfile, "revoked.json"),
+		[]byte(`[{"serial_number":"abc","domain":"old.example.com","revoked_at":"2024-01-01T00:00:00Z"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.fileStorage.Create(ctx, revokedObjectKey(testInternalProfile, "def"),
+		[]byte(`{"serial_number":"def","domain":"new.example.com","revoked_at":"2024-02-01T00:00:00Z"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, err := s.getRevokedCertificates(ctx, testInternalProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 2 || revoked[0].SerialNumber != "abc" || revoked[1].SerialNumber != "def" {
+		t.Fatalf("revocations: %+v", revoked)
+	}
+}
@@ -0,0 +1,239 @@
+package cert_service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CertificateDetails is the parsed metadata of the leaf certificate we have stored for a domain
+type CertificateDetails struct {
+	Domain        string    `json:"domain"`
+	UserID        uuid.UUID `json:"user_id"`
+	Subject       string    `json:"subject"`
+	SANs          []string  `json:"sans"`
+	Issuer        string    `json:"issuer"`
+	CAProfile     string    `json:"ca_profile,omitempty"`
+	SerialNumber  string    `json:"serial_number"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	KeyType       string    `json:"key_type"`
+	DaysRemaining int       `json:"days_remaining"`
+}
+
+// CertificateFilter narrows down a certificate listing, empty strings and a nil ExpiringWithinDays don't filter
+type CertificateFilter struct {
+	// ExpiringWithinDays only keeps certificates that expire in the next N days, including expired ones, 0 keeps the
+	// expired ones and those expiring today. Nil doesn't filter.
+	ExpiringWithinDays *int
+	// Issuer is matched case-insensitively against the issuer common name and organization
+	Issuer string
+	// KeyType is matched case-insensitively against CertificateDetails.KeyType, e.g. "ecdsa" or "rsa"
+	KeyType string
+}
+
+func (f CertificateFilter) matches(details CertificateDetails) bool {
+	if f.ExpiringWithinDays != nil && details.DaysRemaining > *f.ExpiringWithinDays {
+		return false
+	}
+	if f.Issuer != "" && !strings.Contains(strings.ToLower(details.Issuer), strings.ToLower(f.Issuer)) {
+		return false
+	}
+	if f.KeyType != "" && !strings.HasPrefix(strings.ToLower(details.KeyType), strings.ToLower(f.KeyType)) {
+		return false
+	}
+	return true
+}
+
+// ListUserCertificates returns the stored certificates for all the domains of a single user
+func (s *Service) ListUserCertificates(ctx context.Context, userID uuid.UUID, filter CertificateFilter) ([]CertificateDetails, error) {
+	domains, err := s.domainService.GetUserDomains(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get domains for user: %s: %w", userID, err)
+	}
+
+	return s.listCertificates(ctx, domains, filter, false)
+}
+
+// ListAllCertificates returns the stored certificate of every domain name, certificates nobody holds a verified
+// claim on are listed without a user
+func (s *Service) ListAllCertificates(ctx context.Context, filter CertificateFilter) ([]CertificateDetails, error) {
+	users, err := s.domainService.GetAllRecords(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get all records: %w", err)
+	}
+
+	domains := map[string]models.DomainInformation{}
+	for _, user := range users {
+		for name, domainInfo := range user.Domains {
+			domains[user.ID+"/"+name] = domainInfo
+		}
+	}
+
+	return s.listCertificates(ctx, domains, filter, true)
+}
+
+// listCertificates lists the certificate of each domain name once. Certificates are stored per name, so they belong
+// to the user whose domain is verified and are only listed without one when keepUnclaimed is set.
+func (s *Service) listCertificates(ctx context.Context, domains map[string]models.DomainInformation, filter CertificateFilter, keepUnclaimed bool) ([]CertificateDetails, error) {
+	holders := map[string]uuid.UUID{}
+	for _, domainInfo := range domains {
+		if domainInfo.Verification.Verified {
+			holders[domainInfo.DomainName] = domainInfo.UserID
+		} else if _, ok := holders[domainInfo.DomainName]; !ok {
+			holders[domainInfo.DomainName] = uuid.Nil
+		}
+	}
+
+	retCerts := []CertificateDetails{}
+	for domain, holder := range holders {
+		if holder == uuid.Nil && !keepUnclaimed {
+			continue
+		}
+		details, err := s.GetCertificateDetails(ctx, domain)
+		if errors.Is(err, storage.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			// One unreadable chain shouldn't hide the rest of the inventory
+			logger.Error("domain: %s unable to read stored certificate: %s", domain, err)
+			continue
+		}
+		details.UserID = holder
+		if filter.matches(details) {
+			retCerts = append(retCerts, details)
+		}
+	}
+
+	sort.Slice(retCerts, func(i, j int) bool {
+		if retCerts[i].NotAfter.Equal(retCerts[j].NotAfter) {
+			return retCerts[i].Domain < retCerts[j].Domain
+		}
+		return retCerts[i].NotAfter.Before(retCerts[j].NotAfter)
+	})
+	return retCerts, nil
+}
+
+// GetCertificateDetails reads the stored chain for a domain and parses its leaf certificate
+func (s *Service) GetCertificateDetails(ctx context.Context, domain string) (CertificateDetails, error) {
+	chain, err := s.readCertificateChain(ctx, domain)
+	if err != nil {
+		return CertificateDetails{}, err
+	}
+
+	leaf := chain[0]
+	details := CertificateDetails{
+		Domain:        domain,
+		Subject:       leaf.Subject.String(),
+		SANs:          certificateSANs(leaf),
+		Issuer:        leaf.Issuer.String(),
+		SerialNumber:  leaf.SerialNumber.Text(16),
+		NotBefore:     leaf.NotBefore,
+		NotAfter:      leaf.NotAfter,
+		KeyType:       keyType(leaf),
+		DaysRemaining: daysRemaining(leaf.NotAfter, time.Now()),
+	}
+
+	record, err := s.GetIssuanceRecord(ctx, domain)
+	if err != nil {
+		return CertificateDetails{}, err
+	}
+	details.CAProfile = record.CAProfile
+	return details, nil
+}
+
+// GetCertificateChainPEM returns the PEM chain of a domain of the user, leaf first. The private key never leaves
+// through here, it is only handed to the deployment hooks.
+func (s *Service) GetCertificateChainPEM(ctx context.Context, userID uuid.UUID, domain string) ([]byte, error) {
+	_, err := s.domainService.GetDomainByUser(ctx, userID, domain)
+	if err != nil {
+		return nil, fmt.Errorf("domain: %s unable to get DomainInfo from database: %w", domain, err)
+	}
+
+	chain, err := s.readCertificateChain(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	var chainPEM []byte
+	for _, cert := range chain {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	return chainPEM, nil
+}
+
+// readCertificateChain returns the stored chain for a domain with the leaf first, WriteToStorage stores the chain as
+// concatenated DER but we also accept PEM so that manually uploaded chains work
+func (s *Service) readCertificateChain(ctx context.Context, domain string) ([]*x509.Certificate, error) {
+	certBytes, err := s.fileStorage.Get(ctx, certificateObjectKey(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCertificateChain(certBytes)
+}
+
+func parseCertificateChain(certBytes []byte) ([]*x509.Certificate, error) {
+	ders := certBytes
+	if strings.HasPrefix(strings.TrimSpace(string(certBytes)), "-----BEGIN") {
+		ders = nil
+		rest := certBytes
+		for {
+			var block *pem.Block
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			if block.Type == "CERTIFICATE" {
+				ders = append(ders, block.Bytes...)
+			}
+		}
+	}
+
+	chain, err := x509.ParseCertificates(ders)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse certificate chain: %w", err)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("certificate chain is empty")
+	}
+	return chain, nil
+}
+
+func certificateSANs(cert *x509.Certificate) []string {
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	return sans
+}
+
+func keyType(cert *x509.Certificate) string {
+	switch pub := cert.PublicKey.(type) {
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", pub.Curve.Params().Name)
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d", pub.N.BitLen())
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return cert.PublicKeyAlgorithm.String()
+	}
+}
+
+func daysRemaining(notAfter time.Time, now time.Time) int {
+	return int(math.Floor(notAfter.Sub(now).Hours() / 24))
+}
@@ -0,0 +1,193 @@
+package cert_service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/edwinavalos/common/models"
+	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestCertificateFilterMatches(t *testing.T) {
+	zero, week := 0, 7
+	details := CertificateDetails{Issuer: "CN=R3,O=Let's Encrypt,C=US", KeyType: "ECDSA P-256", DaysRemaining: 5}
+	tests := []struct {
+		name   string
+		filter CertificateFilter
+		days   int
+		want   bool
+	}{
+		{"empty filter", CertificateFilter{}, 5, true},
+		{"expiring within a week", CertificateFilter{ExpiringWithinDays: &week}, 5, true},
+		{"expiring later", CertificateFilter{ExpiringWithinDays: &week}, 30, false},
+		{"zero keeps expiring today", CertificateFilter{ExpiringWithinDays: &zero}, 0, true},
+		{"zero keeps expired", CertificateFilter{ExpiringWithinDays: &zero}, -3, true},
+		{"zero drops tomorrow", CertificateFilter{ExpiringWithinDays: &zero}, 1, false},
+		{"issuer is case-insensitive", CertificateFilter{Issuer: "let's encrypt"}, 5, true},
+		{"other issuer", CertificateFilter{Issuer: "ZeroSSL"}, 5, false},
+		{"key type prefix", CertificateFilter{KeyType: "ecdsa"}, 5, true},
+		{"other key type", CertificateFilter{KeyType: "rsa"}, 5, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			details.DaysRemaining = tt.days
+			if got := tt.filter.matches(details); got != tt.want {
+				t.Errorf("matches() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDaysRemaining(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		notAfter time.Time
+		want     int
+	}{
+		{now.Add(30 * 24 * time.Hour), 30},
+		{now.Add(30*24*time.Hour - time.Minute), 29},
+		{now.Add(time.Hour), 0},
+		{now, 0},
+		{now.Add(-time.Hour), -1},
+		{now.Add(-48 * time.Hour), -2},
+	}
+	for _, tt := range tests {
+		if got := daysRemaining(tt.notAfter, now); got != tt.want {
+			t.Errorf("daysRemaining(%s) = %d, want %d", tt.notAfter.Sub(now), got, tt.want)
+		}
+	}
+}
+
+// newTestChain returns a leaf and the CA that signed it as DER
+func newTestChain(t *testing.T, domain string) [][]byte {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}, caTemplate, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return [][]byte{leafDER, caDER}
+}
+
+func TestParseCertificateChain(t *testing.T) {
+	ders := newTestChain(t, testDomain)
+	var der, chainPEM []byte
+	for _, cert := range ders {
+		der = append(der, cert...)
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})...)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("not a certificate")})
+
+	tests := []struct {
+		name  string
+		input []byte
+	}{
+		{"DER", der},
+		{"PEM", chainPEM},
+		{"PEM with a key and whitespace", append(append([]byte("\n  "), keyPEM...), chainPEM...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			chain, err := parseCertificateChain(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chain) != 2 || chain[0].Subject.CommonName != testDomain || chain[1].Subject.CommonName != "Test CA" {
+				t.Fatalf("expected the leaf then the CA, got %d certificates", len(chain))
+			}
+		})
+	}
+
+	for name, input := range map[string][]byte{
+		"garbage":         []byte("not a certificate"),
+		"PEM without one": keyPEM,
+		"empty":           nil,
+	} {
+		_, err := parseCertificateChain(input)
+		if err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestListCertificatesAttributesToVerifiedHolder(t *testing.T) {
+	ctx := context.Background()
+	store := storage.NewMemoryDomainStore()
+	s := newTestService(t, storage.NewMemoryFileStore())
+	s.domainService = domain_service.New(nil, store)
+	holder, other := uuid.New(), uuid.New()
+	for _, di := range []models.DomainInformation{
+		{DomainName: testDomain, UserID: holder, Verification: models.Verification{Verified: true}},
+		{DomainName: testDomain, UserID: other},
+		{DomainName: "unclaimed.example.com", UserID: other},
+	} {
+		err := store.PutDomainInfo(ctx, di)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSelfSignedCertificate(t, s, testDomain)
+	writeSelfSignedCertificate(t, s, "unclaimed.example.com")
+
+	certs, err := s.ListUserCertificates(ctx, holder, CertificateFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Domain != testDomain || certs[0].UserID != holder {
+		t.Errorf("holder's certificates = %+v", certs)
+	}
+	certs, err = s.ListUserCertificates(ctx, other, CertificateFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 0 {
+		t.Errorf("expected a user without a verified domain to get no certificates, got %+v", certs)
+	}
+
+	certs, err = s.ListAllCertificates(ctx, CertificateFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	owners := map[string]uuid.UUID{}
+	for _, details := range certs {
+		owners[details.Domain] = details.UserID
+	}
+	if len(certs) != 2 || owners[testDomain] != holder || owners["unclaimed.example.com"] != uuid.Nil {
+		t.Errorf("expected each certificate once, attributed to its verified holder, got %+v", certs)
+	}
+}
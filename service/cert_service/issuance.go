@@ -0,0 +1,76 @@
+package cert_service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"time"
+)
+
+// IssuanceRecord is what we know about how the certificate of a domain was ordered. It lives next to the certificate
+// in the file store because models.CertInfo is owned by the common module and only carries the ACME urls.
+type IssuanceRecord struct {
+	Domain      string    `json:"domain"`
+	UserID      uuid.UUID `json:"user_id"`
+	CAProfile   string    `json:"ca_profile"`
+	OrderURL    string    `json:"order_url,omitempty"`
+	RequestedAt time.Time `json:"requested_at"`
+	IssuedAt    time.Time `json:"issued_at"`
+	// IssuedBy is the profile of the CA that issued the current certificate
+	IssuedBy  string            `json:"issued_by,omitempty"`
+	Fallbacks []FallbackAttempt `json:"fallbacks,omitempty"`
+	// Hooks is the deployment outcome of the current certificate by hook name
+	Hooks map[string]HookOutcome `json:"hooks,omitempty"`
+	// ChallengeProvider published the challenge of the pending order, empty when the customer has to
+	ChallengeProvider string `json:"challenge_provider,omitempty"`
+}
+
+// startOrder records a new order in the record, what it says about the certificate currently served is kept until
+// the order is completed
+func (r *IssuanceRecord) startOrder(userID uuid.UUID, profileName string, orderURL string, fallbacks []FallbackAttempt, challengeProvider string) {
+	r.UserID = userID
+	r.CAProfile = profileName
+	r.OrderURL = orderURL
+	r.RequestedAt = time.Now()
+	r.Fallbacks = fallbacks
+	r.ChallengeProvider = challengeProvider
+}
+
+func issuanceObjectKey(domain string) string {
+	return fmt.Sprintf("mastodon_le_certs/%s/issuance.json", domain)
+}
+
+// GetIssuanceRecord returns the issuance record of a domain, domains ordered before records existed get an empty
+// record using the default profile
+func (s *Service) GetIssuanceRecord(ctx context.Context, domain string) (IssuanceRecord, error) {
+	recordBytes, err := s.fileStorage.Get(ctx, issuanceObjectKey(domain))
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		profileName, _, err := s.resolveProfile("")
+		if err != nil {
+			return IssuanceRecord{}, err
+		}
+		return IssuanceRecord{Domain: domain, CAProfile: profileName}, nil
+	}
+	if err != nil {
+		return IssuanceRecord{}, err
+	}
+
+	var record IssuanceRecord
+	err = json.Unmarshal(recordBytes, &record)
+	if err != nil {
+		return IssuanceRecord{}, fmt.Errorf("domain: %s unable to unmarshal issuance record: %w", domain, err)
+	}
+	return record, nil
+}
+
+func (s *Service) putIssuanceRecord(ctx context.Context, record IssuanceRecord) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.fileStorage.Put(ctx, issuanceObjectKey(record.Domain), recordBytes)
+}
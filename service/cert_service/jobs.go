@@ -0,0 +1,234 @@
+package cert_service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	completionJobKind = "complete_certificate"
+	deploymentJobKind = "deploy_certificate"
+
+	defaultJobPollInterval  = 5 * time.Second
+	defaultJobLeaseDuration = 5 * time.Minute
+	defaultJobMaxAttempts   = 5
+	defaultJobRetryBackoff  = 30 * time.Second
+	defaultJobRetention     = 7 * 24 * time.Hour
+	maxJobRetryBackoff      = 30 * time.Minute
+)
+
+// WithJobStore enables the background completion of certificate requests
+func WithJobStore(jobStore storage.JobStore, settings appconfig.JobSettings) ServiceOpt {
+	return func(s *Service) {
+		if settings.PollInterval <= 0 {
+			settings.PollInterval = defaultJobPollInterval
+		}
+		if settings.LeaseDuration <= 0 {
+			settings.LeaseDuration = defaultJobLeaseDuration
+		}
+		if settings.MaxAttempts <= 0 {
+			settings.MaxAttempts = defaultJobMaxAttempts
+		}
+		if settings.RetryBackoff <= 0 {
+			settings.RetryBackoff = defaultJobRetryBackoff
+		}
+		if settings.Retention <= 0 {
+			settings.Retention = defaultJobRetention
+		}
+		s.jobStore = jobStore
+		s.jobSettings = settings
+	}
+}
+
+// SubmitCompletionJob persists a job that completes the pending certificate order of a domain, the job is picked up
+// by RunJobWorker on this or any other replica
+func (s *Service) SubmitCompletionJob(ctx context.Context, userID uuid.UUID, domain string) (storage.Job, error) {
+	if s.jobStore == nil {
+		return storage.Job{}, fmt.Errorf("no job store configured")
+	}
+
+	// Fail fast on domains we don't know instead of burning job attempts on them
+	_, err := s.domainService.GetDomainByUser(ctx, userID, domain)
+	if err != nil {
+		return storage.Job{}, fmt.Errorf("domain: %s unable to get DomainInfo from database: %w", domain, err)
+	}
+
+	return s.submitJob(ctx, completionJobKind, userID, domain)
+}
+
+func (s *Service) submitJob(ctx context.Context, kind string, userID uuid.UUID, domain string) (storage.Job, error) {
+	now := time.Now()
+	job := storage.Job{
+		ID:            uuid.New(),
+		Kind:          kind,
+		UserID:        userID,
+		Domain:        domain,
+		State:         storage.JobPending,
+		CreatedAt:     now,
+		NextAttemptAt: now.Unix(),
+	}
+	err := s.jobStore.PutJob(ctx, job)
+	if err != nil {
+		return storage.Job{}, fmt.Errorf("unable to store job: %w", err)
+	}
+
+	select {
+	case s.jobKick <- struct{}{}:
+	default:
+	}
+	return job, nil
+}
+
+func (s *Service) GetJob(ctx context.Context, id uuid.UUID) (storage.Job, error) {
+	if s.jobStore == nil {
+		return storage.Job{}, fmt.Errorf("no job store configured")
+	}
+	return s.jobStore.GetJob(ctx, id)
+}
+
+// RunJobWorker runs due jobs until ctx is done. Jobs left running by a replica that went away are picked up again
+// once their lease expires.
+func (s *Service) RunJobWorker(ctx context.Context) {
+	if s.jobStore == nil {
+		return
+	}
+
+	ticker := time.NewTicker(s.jobSettings.PollInterval)
+	defer ticker.Stop()
+	for {
+		s.runDueJobs(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.jobKick:
+		}
+	}
+}
+
+func (s *Service) runDueJobs(ctx context.Context) {
+	jobs, err := s.jobStore.ListRunnableJobs(ctx)
+	if err != nil {
+		logger.Error("unable to list runnable jobs: %s", err)
+		return
+	}
+
+	for _, job := range jobs {
+		if ctx.Err() != nil {
+			return
+		}
+		claimed, err := s.jobStore.ClaimJob(ctx, job.ID, s.jobSettings.LeaseDuration)
+		if errors.Is(err, storage.ErrJobAlreadyHeld) {
+			continue
+		}
+		if err != nil {
+			logger.Error("job: %s unable to claim: %s", job.ID, err)
+			continue
+		}
+		s.runJob(ctx, claimed)
+	}
+}
+
+func (s *Service) runJob(ctx context.Context, job storage.Job) {
+	attemptCtx, cancel := context.WithTimeout(ctx, s.jobSettings.LeaseDuration)
+	defer cancel()
+	attemptCtx = withProgress(attemptCtx, func(progress any) {
+		progressBytes, err := json.Marshal(progress)
+		if err != nil {
+			logger.Error("job: %s unable to marshal progress: %s", job.ID, err)
+			return
+		}
+		job.Progress = progressBytes
+		err = s.jobStore.UpdateJobProgress(ctx, job.ID, progressBytes)
+		if err != nil {
+			logger.Error("job: %s unable to store progress: %s", job.ID, err)
+		}
+	})
+
+	var err error
+	switch job.Kind {
+	case completionJobKind:
+		err = s.CompleteCertificateRequest(attemptCtx, job.UserID, job.Domain, "")
+	case deploymentJobKind:
+		err = s.RunDeploymentHooks(attemptCtx, job.Domain)
+	default:
+		err = fmt.Errorf("unknown job kind: %s", job.Kind)
+		job.Attempts = s.jobSettings.MaxAttempts
+	}
+
+	var fallbackErr *FallbackError
+	var budgetErr *BudgetExceededError
+	switch {
+	case err == nil:
+		job.State = storage.JobSucceeded
+		job.LastError = ""
+		logger.Info("job: %s domain: %s succeeded after %d attempts", job.ID, job.Domain, job.Attempts)
+	case errors.As(err, &fallbackErr):
+		// The new order needs a new challenge record first, retrying now would only burn validations
+		job.State = storage.JobFailed
+		job.LastError = err.Error()
+		logger.Error("job: %s domain: %s moved to CA profile: %s: %s", job.ID, job.Domain, fallbackErr.To, err)
+	case errors.As(err, &budgetErr):
+		// Waiting on our own budget isn't a failed attempt, the CA was never contacted
+		job.State = storage.JobPending
+		job.Attempts--
+		job.LastError = err.Error()
+		job.NextAttemptAt = budgetErr.RetryAt.Unix()
+		logger.Info("job: %s domain: %s deferred until: %s", job.ID, job.Domain, budgetErr.RetryAt)
+	case job.Attempts >= s.jobSettings.MaxAttempts:
+		job.State = storage.JobFailed
+		job.LastError = err.Error()
+		logger.Error("job: %s domain: %s failed for good: %s", job.ID, job.Domain, err)
+	default:
+		job.State = storage.JobPending
+		job.LastError = err.Error()
+		job.NextAttemptAt = time.Now().Add(s.retryBackoff(job.Attempts)).Unix()
+		logger.Error("job: %s domain: %s attempt %d failed, retrying: %s", job.ID, job.Domain, job.Attempts, err)
+	}
+
+	if job.State == storage.JobSucceeded || job.State == storage.JobFailed {
+		job.ExpiresAt = time.Now().Add(s.jobSettings.Retention).Unix()
+	}
+
+	// The attempt context may be done by now but the outcome still has to be recorded
+	err = s.jobStore.FinishAttempt(context.Background(), job)
+	if errors.Is(err, storage.ErrJobLeaseLost) {
+		logger.Error("job: %s attempt %d outlived its lease, its outcome is dropped for the worker that took over", job.ID, job.Attempts)
+		return
+	}
+	if err != nil {
+		logger.Error("job: %s unable to store outcome: %s", job.ID, err)
+	}
+}
+
+func (s *Service) retryBackoff(attempts int) time.Duration {
+	backoff := s.jobSettings.RetryBackoff
+	for i := 1; i < attempts && backoff < maxJobRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxJobRetryBackoff {
+		backoff = maxJobRetryBackoff
+	}
+	return backoff
+}
+
+type progressKey struct{}
+
+// withProgress lets code running for a job report how far it got, the job keeps the last report
+func withProgress(ctx context.Context, report func(progress any)) context.Context {
+	return context.WithValue(ctx, progressKey{}, report)
+}
+
+func reportProgress(ctx context.Context, progress any) {
+	report, ok := ctx.Value(progressKey{}).(func(progress any))
+	if ok {
+		report(progress)
+	}
+}
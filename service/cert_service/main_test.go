@@ -0,0 +1,30 @@
+package cert_service
+
+import (
+	"bytes"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/dns-verifier/encryption"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger.New()
+	os.Exit(m.Run())
+}
+
+func newTestSealer(t *testing.T) *encryption.Sealer {
+	t.Helper()
+	wrapper, err := encryption.NewLocalKeyWrapper(bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encryption.NewSealer(wrapper)
+}
+
+// newTestService returns a service without a domain service that keeps its objects in fileStore
+func newTestService(t *testing.T, fileStore storage.CertificateStore, opts ...ServiceOpt) *Service {
+	t.Helper()
+	return New(nil, fileStore, nil, append([]ServiceOpt{WithSealer(newTestSealer(t))}, opts...)...)
+}
@@ -0,0 +1,182 @@
+package cert_service
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"golang.org/x/crypto/acme"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultCAProfile is the name of the profile built from le_settings when no acme profiles are configured
+	DefaultCAProfile = "default"
+
+	ACMECAType     = "acme"
+	InternalCAType = "internal"
+)
+
+var ErrUnknownCAProfile = errors.New("unknown CA profile")
+
+// WithACMESettings configures the named CA profiles certificate requests can pick from
+func WithACMESettings(settings appconfig.ACMESettings) ServiceOpt {
+	return func(s *Service) {
+		s.acmeSettings = settings
+	}
+}
+
+// CAProfiles returns the names of all the CA profiles that certificates can be requested from
+func (s *Service) CAProfiles() []string {
+	if len(s.acmeSettings.Profiles) == 0 {
+		return []string{DefaultCAProfile}
+	}
+
+	var names []string
+	for name := range s.acmeSettings.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolveProfile returns the profile for the given name, an empty name resolves to the default profile
+func (s *Service) resolveProfile(name string) (string, appconfig.CAProfile, error) {
+	if len(s.acmeSettings.Profiles) == 0 {
+		if name != "" && name != DefaultCAProfile {
+			return "", appconfig.CAProfile{}, fmt.Errorf("%s: %w", name, ErrUnknownCAProfile)
+		}
+		return DefaultCAProfile, appconfig.CAProfile{
+			DirectoryURL:       s.cfg.LECADirURL(),
+			AccountKeyLocation: s.cfg.LEPrivateKeyLocation(),
+		}, nil
+	}
+
+	if name == "" {
+		name = s.acmeSettings.DefaultProfile
+	}
+	profile, ok := s.acmeSettings.Profiles[name]
+	if !ok {
+		return "", appconfig.CAProfile{}, fmt.Errorf("%s: %w", name, ErrUnknownCAProfile)
+	}
+	switch profile.Type {
+	case "", ACMECAType:
+		if profile.DirectoryURL == "" {
+			return "", appconfig.CAProfile{}, fmt.Errorf("CA profile: %s is missing directory_url", name)
+		}
+	case InternalCAType:
+		return name, profile, nil
+	default:
+		return "", appconfig.CAProfile{}, fmt.Errorf("CA profile: %s has unknown type: %s", name, profile.Type)
+	}
+	if profile.AccountKeyLocation == "" {
+		profile.AccountKeyLocation = s.cfg.LEPrivateKeyLocation()
+	}
+	return name, profile, nil
+}
+
+// acmeClient returns a client for the named profile whose account is registered with the CA
+func (s *Service) acmeClient(ctx context.Context, profileName string) (*acme.Client, *ecdsa.PrivateKey, error) {
+	name, profile, err := s.resolveProfile(profileName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if profile.Type == InternalCAType {
+		return nil, nil, fmt.Errorf("CA profile: %s is an internal CA and doesn't speak ACME", name)
+	}
+
+	privateKey, err := s.accountKey(ctx, name, profile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("CA profile: %s unable to get account key: %w", name, err)
+	}
+
+	client := &acme.Client{
+		Key:          privateKey,
+		DirectoryURL: profile.DirectoryURL,
+		RetryBackoff: acmeRetryBackoff,
+	}
+
+	if _, registered := s.registeredProfiles.Load(name); registered {
+		return client, privateKey, nil
+	}
+	err = s.ensureAccount(ctx, client, profile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("CA profile: %s unable to register account: %w", name, err)
+	}
+	s.registeredProfiles.Store(name, true)
+
+	return client, privateKey, nil
+}
+
+// maxACMERetries bounds how often a request the CA failed with a server error is retried before the order falls back
+const maxACMERetries = 3
+
+// acmeRetryBackoff gives up right away when the CA rate limits us, retrying wouldn't get through before the limit
+// resets and the order can move on to the next CA instead. The client keeps retrying until the context is done
+// without it.
+func acmeRetryBackoff(n int, _ *http.Request, resp *http.Response) time.Duration {
+	if resp.StatusCode == http.StatusTooManyRequests || n > maxACMERetries {
+		return 0
+	}
+	return time.Duration(n) * time.Second
+}
+
+// ensureAccount looks up the account for the client key and registers it when the CA doesn't know it yet
+func (s *Service) ensureAccount(ctx context.Context, client *acme.Client, profile appconfig.CAProfile) error {
+	// the url parameter is legacy and not used
+	_, err := client.GetReg(ctx, "")
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, acme.ErrNoAccount) {
+		return err
+	}
+
+	email := profile.Email
+	if email == "" {
+		email = s.cfg.LEAdminEmail()
+	}
+	account := &acme.Account{}
+	if email != "" {
+		account.Contact = []string{"mailto:" + email}
+	}
+	if profile.EABKeyID != "" {
+		hmacKey, err := decodeEABKey(profile.EABHMACKey)
+		if err != nil {
+			return err
+		}
+		account.ExternalAccountBinding = &acme.ExternalAccountBinding{
+			KID: profile.EABKeyID,
+			Key: hmacKey,
+		}
+	}
+
+	account, err = client.Register(ctx, account, acme.AcceptTOS)
+	if err != nil {
+		return err
+	}
+	logger.Info("registered ACME account: %s with %s", account.URI, client.DirectoryURL)
+	return nil
+}
+
+// decodeEABKey accepts the HMAC key in the base64url form CAs hand out, padded or not, and standard base64
+func decodeEABKey(key string) ([]byte, error) {
+	if key == "" {
+		return nil, fmt.Errorf("eab_key_id is set but eab_hmac_key is missing")
+	}
+	trimmed := strings.TrimRight(key, "=")
+	if decoded, err := base64.RawURLEncoding.DecodeString(trimmed); err == nil {
+		return decoded, nil
+	}
+	decoded, err := base64.RawStdEncoding.DecodeString(trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode eab_hmac_key: %w", err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,57 @@
+package cert_service
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestDecodeEABKey(t *testing.T) {
+	// 0xfb 0xff encodes differently in the URL and standard alphabets
+	key := []byte{0xfb, 0xff, 0x01, 0x02, 0x03}
+	for name, encoded := range map[string]string{
+		"base64url":        base64.RawURLEncoding.EncodeToString(key),
+		"padded base64url": base64.URLEncoding.EncodeToString(key),
+		"std base64":       base64.RawStdEncoding.EncodeToString(key),
+		"padded std":       base64.StdEncoding.EncodeToString(key),
+	} {
+		decoded, err := decodeEABKey(encoded)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if !bytes.Equal(decoded, key) {
+			t.Errorf("%s: decodeEABKey(%q) = %x, want %x", name, encoded, decoded, key)
+		}
+	}
+
+	for _, encoded := range []string{"", "not base64!", "a"} {
+		_, err := decodeEABKey(encoded)
+		if err == nil {
+			t.Errorf("decodeEABKey(%q) expected an error", encoded)
+		}
+	}
+}
+
+func TestACMERetryBackoff(t *testing.T) {
+	tests := []struct {
+		name   string
+		n      int
+		status int
+		retry  bool
+	}{
+		{"server error", 1, http.StatusInternalServerError, true},
+		{"last retry", maxACMERetries, http.StatusServiceUnavailable, true},
+		{"retries used up", maxACMERetries + 1, http.StatusServiceUnavailable, false},
+		{"rate limited", 1, http.StatusTooManyRequests, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backoff := acmeRetryBackoff(tt.n, nil, &http.Response{StatusCode: tt.status})
+			if (backoff > 0) != tt.retry {
+				t.Errorf("acmeRetryBackoff(%d, %d) = %s, want retry: %t", tt.n, tt.status, backoff, tt.retry)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package cert_service
+
+import (
+	"context"
+	"fmt"
+	"github.com/edwinavalos/common/models"
+	"github.com/edwinavalos/dns-verifier/service/dns_service"
+)
+
+// WithPropagationChecker makes completions wait until every authoritative nameserver serves the challenge record
+func WithPropagationChecker(checker *dns_service.Checker) ServiceOpt {
+	return func(s *Service) {
+		s.propagation = checker
+	}
+}
+
+// waitForChallengeRecord waits for the challenge record of a domain to reach its authoritative nameservers and
+// reports the progress to the job it runs for. Without a checker only our own resolver is asked.
+func (s *Service) waitForChallengeRecord(ctx context.Context, domainInfo models.DomainInformation) error {
+	if s.propagation == nil {
+		if !s.recordInPlace(ctx, domainInfo) {
+			return fmt.Errorf("unable to verify that your record is in place before completing request")
+		}
+		return nil
+	}
+
+	_, err := s.propagation.WaitForPropagation(ctx, domainInfo.Verification.Zone, domainInfo.Verification.Key, func(status dns_service.PropagationStatus) {
+		reportProgress(ctx, status)
+	})
+	return err
+}
@@ -0,0 +1,164 @@
+package cert_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"golang.org/x/crypto/acme"
+	"time"
+)
+
+const defaultPurgeInterval = time.Hour
+
+// PurgeResult counts what PurgeDeletedDomains did with the domains past their retention
+type PurgeResult struct {
+	Purged  int `json:"purged"`
+	Revoked int `json:"revoked"`
+	Failed  int `json:"failed"`
+}
+
+// WithRetention sets how often deleted domains are purged and whether their certificates are revoked
+func WithRetention(settings appconfig.DomainRetentionSettings) ServiceOpt {
+	return func(s *Service) {
+		if settings.PurgeInterval <= 0 {
+			settings.PurgeInterval = defaultPurgeInterval
+		}
+		s.retention = settings
+	}
+}
+
+// RunPurger purges deleted domains past their retention until ctx is done
+func (s *Service) RunPurger(ctx context.Context) {
+	interval := s.retention.PurgeInterval
+	if interval <= 0 {
+		interval = defaultPurgeInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		result, err := s.PurgeDeletedDomains(ctx)
+		if err != nil {
+			logger.Error("unable to purge deleted domains: %s", err)
+		} else if result.Purged > 0 || result.Failed > 0 {
+			logger.Info("purged: %d revoked: %d failed: %d deleted domains", result.Purged, result.Revoked, result.Failed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PurgeDeletedDomains removes the deleted domains whose retention has ended together with their certificate objects.
+// The objects are shared by every user of a domain name, so they are only removed when nobody else holds the domain.
+// A domain whose record fails to be purged is left deleted and tried again on the next run.
+func (s *Service) PurgeDeletedDomains(ctx context.Context) (PurgeResult, error) {
+	var result PurgeResult
+	records, err := s.domainService.ListPurgeableDomains(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		revoked, err := s.purgeDomain(ctx, record)
+		if err != nil {
+			logger.Error("domain: %s of user: %s unable to purge: %s", record.DomainName, record.UserID, err)
+			result.Failed++
+			continue
+		}
+		if revoked {
+			result.Revoked++
+		}
+		result.Purged++
+	}
+	return result, nil
+}
+
+// purgeDomain removes the record first so that a domain restored in the meantime keeps its certificate. Objects that
+// fail to be removed after that are only logged, nothing is left to retry them from.
+func (s *Service) purgeDomain(ctx context.Context, record storage.DomainRecord) (bool, error) {
+	domain := record.DomainName
+	err := s.domainService.PurgeDomain(ctx, record)
+	if err != nil {
+		return false, err
+	}
+	logger.Info("domain: %s of user: %s purged, deleted by: %s at: %s", domain, record.UserID, record.Deleted.DeletedBy, record.Deleted.DeletedAt)
+
+	claims, err := s.domainService.GetDomainClaims(ctx, domain)
+	if err != nil {
+		return false, fmt.Errorf("unable to look up other claims: %w", err)
+	}
+	if len(claims) > 0 {
+		logger.Info("domain: %s is still held by %d other users, keeping its certificate objects", domain, len(claims))
+		return false, nil
+	}
+
+	revoked := false
+	if s.retention.RevokeCertificates {
+		revoked, err = s.revokeCertificate(ctx, domain)
+		if err != nil {
+			logger.Error("domain: %s unable to revoke certificate: %s", domain, err)
+		}
+	}
+	err = s.deleteDomainObjects(ctx, domain)
+	if err != nil {
+		logger.Error("domain: %s unable to delete certificate objects: %s", domain, err)
+	}
+	return revoked, nil
+}
+
+// revokeCertificate revokes the current certificate of a domain with the CA that issued it, domains without one are
+// left alone
+func (s *Service) revokeCertificate(ctx context.Context, domain string) (bool, error) {
+	chain, err := s.readCertificateChain(ctx, domain)
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	record, err := s.GetIssuanceRecord(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+
+	_, profile, err := s.resolveProfile(record.IssuedBy)
+	if err != nil {
+		return false, err
+	}
+	if profile.Type == InternalCAType {
+		return true, s.RevokeInternalCertificate(ctx, domain)
+	}
+
+	client, _, err := s.acmeClient(ctx, record.IssuedBy)
+	if err != nil {
+		return false, err
+	}
+	err = client.RevokeCert(ctx, nil, chain[0].Raw, acme.CRLReasonCessationOfOperation)
+	if err != nil {
+		return false, err
+	}
+	logger.Info("domain: %s revoked certificate: %s", domain, chain[0].SerialNumber.Text(16))
+	return true, nil
+}
+
+func (s *Service) deleteDomainObjects(ctx context.Context, domain string) error {
+	objectKeys, err := s.fileStorage.List(ctx, fmt.Sprintf("mastodon_le_certs/%s/", domain))
+	if err != nil {
+		return err
+	}
+	for _, objectKey := range objectKeys {
+		err = s.fileStorage.Delete(ctx, objectKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package cert_service
+
+import (
+	"context"
+	"errors"
+	"github.com/edwinavalos/common/models"
+	"github.com/edwinavalos/dns-verifier/service/domain_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+// newPurgeTestService returns a service whose deleted domains can be purged right away, with a certificate for
+// testDomain and a deleted entry for it
+func newPurgeTestService(t *testing.T) (*Service, *storage.MemoryDomainStore, *storage.MemoryFileStore, uuid.UUID) {
+	t.Helper()
+	ctx := context.Background()
+	store, fileStore := storage.NewMemoryDomainStore(), storage.NewMemoryFileStore()
+	s := newTestService(t, fileStore)
+	s.domainService = domain_service.New(nil, store, domain_service.WithRetention(time.Nanosecond))
+
+	userID := uuid.New()
+	err := s.domainService.CreateDomain(ctx, models.DomainInformation{DomainName: testDomain, UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSelfSignedCertificate(t, s, testDomain)
+	_, err = s.domainService.DeleteDomain(ctx, userID, testDomain, userID.String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	return s, store, fileStore, userID
+}
+
+func domainObjects(t *testing.T, fileStore storage.CertificateStore) []string {
+	t.Helper()
+	keys, err := fileStore.List(context.Background(), "mastodon_le_certs/"+testDomain+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestPurgeDeletedDomainsRemovesRecordAndObjects(t *testing.T) {
+	s, store, fileStore, userID := newPurgeTestService(t)
+
+	result, err := s.PurgeDeletedDomains(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Purged != 1 || result.Failed != 0 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	_, err = store.GetDomainRecord(context.Background(), userID, testDomain)
+	if !errors.Is(err, storage.ErrDomainNotFound) {
+		t.Errorf("expected the record to be purged, got %v", err)
+	}
+	if keys := domainObjects(t, fileStore); len(keys) != 0 {
+		t.Errorf("expected the certificate objects to be deleted, got %v", keys)
+	}
+}
+
+func TestPurgeLosesToRestore(t *testing.T) {
+	s, store, fileStore, userID := newPurgeTestService(t)
+	ctx := context.Background()
+	records, err := s.domainService.ListPurgeableDomains(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected one purgeable domain, got %d", len(records))
+	}
+
+	err = s.domainService.RestoreDomain(ctx, userID, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.purgeDomain(ctx, records[0])
+	if !errors.Is(err, storage.ErrVersionConflict) {
+		t.Fatalf("expected ErrVersionConflict, got %v", err)
+	}
+	record, err := store.GetDomainRecord(ctx, userID, testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Deleted != nil {
+		t.Error("expected the domain to stay restored")
+	}
+	if keys := domainObjects(t, fileStore); len(keys) == 0 {
+		t.Error("expected the restored domain to keep its certificate objects")
+	}
+}
+
+func TestPurgeKeepsObjectsOfSharedDomains(t *testing.T) {
+	s, _, fileStore, _ := newPurgeTestService(t)
+	err := s.domainService.CreateDomain(context.Background(), models.DomainInformation{DomainName: testDomain, UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := s.PurgeDeletedDomains(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Purged != 1 {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+	if keys := domainObjects(t, fileStore); len(keys) == 0 {
+		t.Error("expected the certificate objects to be kept for the other user")
+	}
+}
@@ -0,0 +1,280 @@
+package cert_service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"golang.org/x/net/publicsuffix"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type LedgerEvent string
+
+const (
+	LedgerOrder            LedgerEvent = "order"
+	LedgerFailedValidation LedgerEvent = "failed_validation"
+	LedgerIssuance         LedgerEvent = "issuance"
+
+	// accountLedgerScope is the ledger that tracks events of an account across all registered domains
+	accountLedgerScope = "_account"
+)
+
+type ledgerEntry struct {
+	Event    LedgerEvent `json:"event"`
+	Hostname string      `json:"hostname"`
+	At       time.Time   `json:"at"`
+}
+
+// ledger is what a ledger object held before every event got its own object, it is still counted until it ages out
+type ledger struct {
+	Entries []ledgerEntry `json:"entries"`
+}
+
+// BudgetExceededError is returned instead of contacting a CA when doing so would go over one of our rate limit
+// budgets, RetryAt is when enough of the budget frees up again
+type BudgetExceededError struct {
+	Budget    string
+	CAProfile string
+	Scope     string
+	Limit     int
+	RetryAt   time.Time
+}
+
+func (e *BudgetExceededError) Error() string {
+	return fmt.Sprintf("CA profile: %s %s budget of %d for %s is used up, capacity frees up at %s",
+		e.CAProfile, e.Budget, e.Limit, e.Scope, e.RetryAt.Format(time.RFC3339))
+}
+
+// WithRateLimits sets the budgets checked before orders and validations are sent to a CA
+func WithRateLimits(settings appconfig.RateLimitSettings) ServiceOpt {
+	return func(s *Service) {
+		s.rateLimits = settings
+	}
+}
+
+// ledgerPrefix is where the events of a ledger are kept. Each event is its own object so that replicas recording
+// events at the same time can't overwrite each other, and its key says what it counts so checks only need a listing.
+func ledgerPrefix(profileName string, scope string) string {
+	return fmt.Sprintf("acme_ledger/%s/%s/", profileName, scope)
+}
+
+func ledgerEventKey(profileName string, scope string, entry ledgerEntry) string {
+	return fmt.Sprintf("%s%s/%s/%d-%s.json", ledgerPrefix(profileName, scope), entry.Event, entry.Hostname, entry.At.UnixNano(), uuid.NewString())
+}
+
+// legacyLedgerObjectKey is the single object a ledger used to be read-modify-written in
+func legacyLedgerObjectKey(profileName string, scope string) string {
+	return fmt.Sprintf("acme_ledger/%s/%s.json", profileName, scope)
+}
+
+func registeredDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	registered, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return registered
+}
+
+// checkOrderBudget makes sure a new order for domain fits in the account's order budget and that the certificate it
+// will turn into fits in the registered domain's budget
+func (s *Service) checkOrderBudget(ctx context.Context, profileName string, domain string) error {
+	err := s.checkBudget(ctx, profileName, accountLedgerScope, "new orders", LedgerOrder, "",
+		s.rateLimits.NewOrdersPerAccount, s.rateLimits.NewOrdersWindow)
+	if err != nil {
+		return err
+	}
+
+	return s.checkValidationBudget(ctx, profileName, domain)
+}
+
+// checkValidationBudget makes sure a validation for domain fits in the failed validations budget of the hostname and
+// that the resulting certificate fits in the registered domain's budget
+func (s *Service) checkValidationBudget(ctx context.Context, profileName string, domain string) error {
+	registered := registeredDomain(domain)
+	err := s.checkBudget(ctx, profileName, registered, "certificates per registered domain", LedgerIssuance, "",
+		s.rateLimits.CertificatesPerRegisteredDomain, s.rateLimits.CertificatesWindow)
+	if err != nil {
+		return err
+	}
+
+	return s.checkBudget(ctx, profileName, registered, "failed validations", LedgerFailedValidation, domain,
+		s.rateLimits.FailedValidationsPerHostname, s.rateLimits.FailedValidationsWindow)
+}
+
+func (s *Service) checkBudget(ctx context.Context, profileName string, scope string, budget string, event LedgerEvent, hostname string, limit int, window time.Duration) error {
+	if limit <= 0 || window <= 0 {
+		return nil
+	}
+
+	entries, err := s.ledgerEntries(ctx, profileName, scope)
+	if err != nil {
+		return err
+	}
+	return budgetError(entries, time.Now(), budget, profileName, scope, event, hostname, limit, window)
+}
+
+// budgetError returns a *BudgetExceededError when limit events like event, of hostname unless it is empty, happened
+// in the window before now
+func budgetError(entries []ledgerEntry, now time.Time, budget string, profileName string, scope string, event LedgerEvent, hostname string, limit int, window time.Duration) error {
+	var inWindow []time.Time
+	for _, entry := range entries {
+		if entry.Event != event || (hostname != "" && entry.Hostname != hostname) {
+			continue
+		}
+		if entry.At.Add(window).After(now) {
+			inWindow = append(inWindow, entry.At)
+		}
+	}
+	if len(inWindow) < limit {
+		return nil
+	}
+
+	// Enough of the oldest entries have to age out of the window to get back under the limit
+	sort.Slice(inWindow, func(i, j int) bool {
+		return inWindow[i].Before(inWindow[j])
+	})
+	scopeName := scope
+	if hostname != "" {
+		scopeName = hostname
+	}
+	return &BudgetExceededError{
+		Budget:    budget,
+		CAProfile: profileName,
+		Scope:     scopeName,
+		Limit:     limit,
+		RetryAt:   inWindow[len(inWindow)-limit].Add(window),
+	}
+}
+
+// recordLedgerEvent notes something we asked the CA for and drops the events no budget looks at anymore, failing to
+// record it is logged rather than failing the request that already happened
+func (s *Service) recordLedgerEvent(ctx context.Context, profileName string, domain string, event LedgerEvent) {
+	scope := registeredDomain(domain)
+	if event == LedgerOrder {
+		scope = accountLedgerScope
+	}
+
+	entry := ledgerEntry{Event: event, Hostname: domain, At: time.Now()}
+	entryBytes, err := json.Marshal(entry)
+	if err != nil {
+		logger.Error("domain: %s unable to marshal %s ledger event: %s", domain, scope, err)
+		return
+	}
+	err = s.fileStorage.Create(ctx, ledgerEventKey(profileName, scope, entry), entryBytes)
+	if err != nil {
+		logger.Error("domain: %s unable to save %s ledger event: %s", domain, scope, err)
+		return
+	}
+
+	s.pruneLedger(ctx, profileName, scope, entry.At.Add(-s.maxBudgetWindow()))
+}
+
+// pruneLedger deletes the events of a ledger from before cutoff
+func (s *Service) pruneLedger(ctx context.Context, profileName string, scope string, cutoff time.Time) {
+	keys, err := s.fileStorage.List(ctx, ledgerPrefix(profileName, scope))
+	if err != nil {
+		logger.Error("unable to list %s ledger: %s", scope, err)
+		return
+	}
+	for _, key := range keys {
+		entry, ok := parseLedgerEventKey(ledgerPrefix(profileName, scope), key)
+		if !ok || !entry.At.Before(cutoff) {
+			continue
+		}
+		err = s.fileStorage.Delete(ctx, key)
+		if err != nil {
+			logger.Error("unable to delete %s ledger event: %s: %s", scope, key, err)
+		}
+	}
+
+	legacy, err := s.legacyLedger(ctx, profileName, scope)
+	if err != nil || len(legacy.Entries) == 0 {
+		return
+	}
+	for _, entry := range legacy.Entries {
+		if !entry.At.Before(cutoff) {
+			return
+		}
+	}
+	err = s.fileStorage.Delete(ctx, legacyLedgerObjectKey(profileName, scope))
+	if err != nil {
+		logger.Error("unable to delete %s legacy ledger: %s", scope, err)
+	}
+}
+
+// ledgerEntries returns the events of a ledger, read from their keys
+func (s *Service) ledgerEntries(ctx context.Context, profileName string, scope string) ([]ledgerEntry, error) {
+	prefix := ledgerPrefix(profileName, scope)
+	keys, err := s.fileStorage.List(ctx, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %s ledger: %w", scope, err)
+	}
+	legacy, err := s.legacyLedger(ctx, profileName, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := legacy.Entries
+	for _, key := range keys {
+		entry, ok := parseLedgerEventKey(prefix, key)
+		if !ok {
+			logger.Error("ignoring unexpected %s ledger object: %s", scope, key)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// parseLedgerEventKey reads an event back from the key ledgerEventKey gave it
+func parseLedgerEventKey(prefix string, key string) (ledgerEntry, bool) {
+	parts := strings.Split(strings.TrimPrefix(key, prefix), "/")
+	if len(parts) != 3 {
+		return ledgerEntry{}, false
+	}
+	at, _, found := strings.Cut(parts[2], "-")
+	if !found {
+		return ledgerEntry{}, false
+	}
+	nanos, err := strconv.ParseInt(at, 10, 64)
+	if err != nil {
+		return ledgerEntry{}, false
+	}
+	return ledgerEntry{Event: LedgerEvent(parts[0]), Hostname: parts[1], At: time.Unix(0, nanos)}, true
+}
+
+func (s *Service) legacyLedger(ctx context.Context, profileName string, scope string) (ledger, error) {
+	ledgerBytes, err := s.fileStorage.Get(ctx, legacyLedgerObjectKey(profileName, scope))
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return ledger{}, nil
+	}
+	if err != nil {
+		return ledger{}, err
+	}
+
+	var l ledger
+	err = json.Unmarshal(ledgerBytes, &l)
+	if err != nil {
+		return ledger{}, fmt.Errorf("unable to unmarshal %s ledger: %w", scope, err)
+	}
+	return l, nil
+}
+
+func (s *Service) maxBudgetWindow() time.Duration {
+	maxWindow := s.rateLimits.CertificatesWindow
+	for _, window := range []time.Duration{s.rateLimits.FailedValidationsWindow, s.rateLimits.NewOrdersWindow} {
+		if window > maxWindow {
+			maxWindow = window
+		}
+	}
+	return maxWindow
+}
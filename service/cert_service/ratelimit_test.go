@@ -0,0 +1,141 @@
+package cert_service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegisteredDomain(t *testing.T) {
+	for domain, want := range map[string]string{
+		"example.com":              "example.com",
+		"www.shop.example.com":     "example.com",
+		"WWW.Example.COM":          "example.com",
+		"www.example.com.":         "example.com",
+		"shop.example.co.uk":       "example.co.uk",
+		"a.b.example.github.io":    "example.github.io",
+		"com":                      "com",
+		"shop.example.test":        "example.test",
+		"xn--bcher-kva.example.de": "example.de",
+	} {
+		if got := registeredDomain(domain); got != want {
+			t.Errorf("registeredDomain(%q) = %q, want %q", domain, got, want)
+		}
+	}
+}
+
+func TestBudgetError(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	window := time.Hour
+	entries := []ledgerEntry{
+		{Event: LedgerFailedValidation, Hostname: "a.example.com", At: now.Add(-2 * time.Hour)},
+		{Event: LedgerFailedValidation, Hostname: "a.example.com", At: now.Add(-50 * time.Minute)},
+		{Event: LedgerFailedValidation, Hostname: "a.example.com", At: now.Add(-10 * time.Minute)},
+		{Event: LedgerFailedValidation, Hostname: "b.example.com", At: now.Add(-5 * time.Minute)},
+		{Event: LedgerIssuance, Hostname: "a.example.com", At: now.Add(-5 * time.Minute)},
+	}
+	tests := []struct {
+		name     string
+		hostname string
+		limit    int
+		retryAt  time.Time
+	}{
+		{"under the limit", "a.example.com", 3, time.Time{}},
+		{"limit reached", "a.example.com", 2, now.Add(-50 * time.Minute).Add(window)},
+		{"oldest in window has to age out", "a.example.com", 1, now.Add(-10 * time.Minute).Add(window)},
+		{"entries outside the window don't count", "b.example.com", 2, time.Time{}},
+		{"every hostname counts without one", "", 3, now.Add(-50 * time.Minute).Add(window)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := budgetError(entries, now, "failed validations", "letsencrypt", "example.com", LedgerFailedValidation, tt.hostname, tt.limit, window)
+			if tt.retryAt.IsZero() {
+				if err != nil {
+					t.Fatalf("expected the budget to allow it, got %v", err)
+				}
+				return
+			}
+			var exceeded *BudgetExceededError
+			if !errors.As(err, &exceeded) {
+				t.Fatalf("expected a BudgetExceededError, got %v", err)
+			}
+			if !exceeded.RetryAt.Equal(tt.retryAt) || exceeded.Limit != tt.limit {
+				t.Errorf("RetryAt = %s limit: %d, want %s limit: %d", exceeded.RetryAt, exceeded.Limit, tt.retryAt, tt.limit)
+			}
+			wantScope := tt.hostname
+			if wantScope == "" {
+				wantScope = "example.com"
+			}
+			if exceeded.Scope != wantScope {
+				t.Errorf("Scope = %s, want %s", exceeded.Scope, wantScope)
+			}
+		})
+	}
+}
+
+func TestCheckBudgetCountsConcurrentEvents(t *testing.T) {
+	const events = 20
+	s := newTestService(t, storage.NewMemoryFileStore(), WithRateLimits(appconfig.RateLimitSettings{
+		NewOrdersPerAccount: events,
+		NewOrdersWindow:     time.Hour,
+	}))
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for i := 0; i < events-1; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.recordLedgerEvent(ctx, "letsencrypt", testDomain, LedgerOrder)
+		}()
+	}
+	wg.Wait()
+	err := s.checkOrderBudget(ctx, "letsencrypt", testDomain)
+	if err != nil {
+		t.Fatalf("expected one order to be left, got %v", err)
+	}
+
+	s.recordLedgerEvent(ctx, "letsencrypt", testDomain, LedgerOrder)
+	var exceeded *BudgetExceededError
+	err = s.checkOrderBudget(ctx, "letsencrypt", testDomain)
+	if !errors.As(err, &exceeded) {
+		t.Fatalf("expected every concurrent order to count, got %v", err)
+	}
+}
+
+func TestRecordLedgerEventPrunesOldEvents(t *testing.T) {
+	fileStore := storage.NewMemoryFileStore()
+	s := newTestService(t, fileStore, WithRateLimits(appconfig.RateLimitSettings{
+		CertificatesPerRegisteredDomain: 5,
+		CertificatesWindow:              time.Hour,
+	}))
+	ctx := context.Background()
+
+	old := ledgerEntry{Event: LedgerIssuance, Hostname: testDomain, At: time.Now().Add(-2 * time.Hour)}
+	err := fileStore.Put(ctx, ledgerEventKey("letsencrypt", testDomain, old), []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	legacy, err := json.Marshal(ledger{Entries: []ledgerEntry{old}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fileStore.Put(ctx, legacyLedgerObjectKey("letsencrypt", testDomain), legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.recordLedgerEvent(ctx, "letsencrypt", testDomain, LedgerIssuance)
+	entries, err := s.ledgerEntries(ctx, "letsencrypt", testDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Event != LedgerIssuance || entries[0].Hostname != testDomain {
+		t.Errorf("expected only the new event to be left, got %+v", entries)
+	}
+}
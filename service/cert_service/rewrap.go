@@ -0,0 +1,89 @@
+package cert_service
+
+import (
+	"context"
+	"errors"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/dns-verifier/encryption"
+	"strings"
+)
+
+// RewrapResult counts what RewrapKeys did with the key objects it found
+type RewrapResult struct {
+	Rewrapped int `json:"rewrapped"`
+	Encrypted int `json:"encrypted"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+}
+
+// keyObjectPrefixes are where private keys are kept, with the suffixes of the key objects under each of them
+var keyObjectPrefixes = map[string][]string{
+	"mastodon_le_certs/": {"/cert.key", "/rfc2136.sealed"},
+	"acme_accounts/":     {"/account.key", "/account.key.pending"},
+	"internal_ca/":       {"/ca.sealed"},
+}
+
+// RewrapKeys wraps the data key of every stored private key with the current key encryption key and encrypts keys
+// that were stored in plaintext. Run it after rotating the master key, before dropping the previous one from the
+// config.
+func (s *Service) RewrapKeys(ctx context.Context) (RewrapResult, error) {
+	var result RewrapResult
+	for prefix, suffixes := range keyObjectPrefixes {
+		objectKeys, err := s.fileStorage.List(ctx, prefix)
+		if err != nil {
+			return result, err
+		}
+
+		for _, objectKey := range objectKeys {
+			if !hasAnySuffix(objectKey, suffixes) {
+				continue
+			}
+			err = s.rewrapKey(ctx, objectKey, &result)
+			if err != nil {
+				result.Failed++
+				logger.Error("unable to rewrap: %s: %s", objectKey, err)
+			}
+		}
+	}
+	return result, nil
+}
+
+func (s *Service) rewrapKey(ctx context.Context, objectKey string, result *RewrapResult) error {
+	stored, err := s.fileStorage.Get(ctx, objectKey)
+	if err != nil {
+		return err
+	}
+
+	rewrapped, changed, err := s.sealer.Rewrap(ctx, stored)
+	encrypted := errors.Is(err, encryption.ErrNotSealed)
+	if encrypted {
+		rewrapped, err = s.sealer.Seal(ctx, stored)
+	}
+	if err != nil {
+		return err
+	}
+	if !changed && !encrypted {
+		result.Unchanged++
+		return nil
+	}
+
+	err = s.fileStorage.Put(ctx, objectKey, rewrapped)
+	if err != nil {
+		return err
+	}
+	if encrypted {
+		result.Encrypted++
+	} else {
+		result.Rewrapped++
+	}
+	return nil
+}
+
+func hasAnySuffix(s string, suffixes []string) bool {
+	for _, suffix := range suffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
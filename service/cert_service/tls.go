@@ -0,0 +1,85 @@
+package cert_service
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/dns-verifier/encryption"
+)
+
+// LoadTLSCertificate reads the stored chain and private key of a domain into a certificate that can be served
+func (s *Service) LoadTLSCertificate(ctx context.Context, domain string) (*tls.Certificate, error) {
+	chain, err := s.readCertificateChain(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, err := s.readPrivateKey(ctx, domain)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{
+		PrivateKey: privateKey,
+		Leaf:       chain[0],
+	}
+	for _, c := range chain {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+func (s *Service) readPrivateKey(ctx context.Context, domain string) (crypto.Signer, error) {
+	keyBytes, err := s.fileStorage.Get(ctx, privateKeyObjectKey(domain))
+	if err != nil {
+		return nil, err
+	}
+
+	keyBytes, err = s.openPrivateKey(ctx, domain, keyBytes)
+	if err != nil {
+		return nil, err
+	}
+	return parsePrivateKey(keyBytes)
+}
+
+// openPrivateKey decrypts a stored private key. Keys written before they were encrypted are plain PEM until
+// rewrap-keys gets to them.
+func (s *Service) openPrivateKey(ctx context.Context, domain string, keyBytes []byte) ([]byte, error) {
+	opened, err := s.sealer.Open(ctx, keyBytes)
+	if errors.Is(err, encryption.ErrNotSealed) {
+		return keyBytes, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("domain: %s unable to decrypt private key: %w", domain, err)
+	}
+	return opened, nil
+}
+
+// parsePrivateKey reads the PEM private keys written by WriteToStorage, which are SEC 1 EC keys, as well as PKCS #8 and
+// PKCS #1 keys
+func parsePrivateKey(keyBytes []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyBytes)
+	if block == nil {
+		return nil, fmt.Errorf("private key is not PEM encoded")
+	}
+
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type: %T", key)
+	}
+	return signer, nil
+}
@@ -0,0 +1,160 @@
+package cert_service
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"os"
+	"time"
+)
+
+const defaultRenewBefore = 30 * 24 * time.Hour
+
+var ErrCertificateValid = errors.New("certificate is still valid, not creating a new request")
+
+// CertificateValidity is whether the stored certificate of a domain can keep being served, Reason says why not
+type CertificateValidity struct {
+	Exists   bool      `json:"exists"`
+	Valid    bool      `json:"valid"`
+	Reason   string    `json:"reason,omitempty"`
+	NotAfter time.Time `json:"not_after,omitempty"`
+}
+
+// CertificateValid checks the certificate we stored for a domain: its private key has to match, the chain has to
+// build to a trusted root, a SAN has to cover the domain and it can't expire within the renewal window. Errors are
+// only returned when the file store can't be read or the key can't be decrypted, a certificate or key that doesn't
+// parse is just not valid.
+func (s *Service) CertificateValid(ctx context.Context, domain string) (CertificateValidity, error) {
+	certBytes, err := s.fileStorage.Get(ctx, certificateObjectKey(domain))
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		return CertificateValidity{Reason: "no certificate stored"}, nil
+	}
+	if err != nil {
+		return CertificateValidity{}, fmt.Errorf("domain: %s unable to read certificate: %w", domain, err)
+	}
+	chain, err := parseCertificateChain(certBytes)
+	if err != nil {
+		return CertificateValidity{Exists: true, Reason: err.Error()}, nil
+	}
+	leaf := chain[0]
+	validity := CertificateValidity{Exists: true, NotAfter: leaf.NotAfter}
+
+	keyBytes, err := s.fileStorage.Get(ctx, privateKeyObjectKey(domain))
+	if errors.Is(err, storage.ErrObjectNotFound) {
+		validity.Reason = "no private key stored"
+		return validity, nil
+	}
+	if err != nil {
+		return CertificateValidity{}, fmt.Errorf("domain: %s unable to read private key: %w", domain, err)
+	}
+	keyBytes, err = s.openPrivateKey(ctx, domain, keyBytes)
+	if err != nil {
+		return CertificateValidity{}, err
+	}
+	privateKey, err := parsePrivateKey(keyBytes)
+	if err != nil {
+		validity.Reason = err.Error()
+		return validity, nil
+	}
+	if !publicKeysEqual(leaf.PublicKey, privateKey.Public()) {
+		validity.Reason = "private key doesn't match the certificate"
+		return validity, nil
+	}
+
+	err = leaf.VerifyHostname(domain)
+	if err != nil {
+		validity.Reason = err.Error()
+		return validity, nil
+	}
+
+	record, err := s.GetIssuanceRecord(ctx, domain)
+	if err != nil {
+		return CertificateValidity{}, fmt.Errorf("domain: %s unable to get issuance record: %w", domain, err)
+	}
+	roots, err := s.trustedRoots(ctx, record)
+	if err != nil {
+		return CertificateValidity{}, err
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	if err != nil {
+		validity.Reason = err.Error()
+		return validity, nil
+	}
+
+	if s.isInternalCAProfile(record.IssuedBy) {
+		revoked, err := s.internalCertificateRevoked(ctx, record.IssuedBy, leaf)
+		if err != nil {
+			return CertificateValidity{}, err
+		}
+		if revoked {
+			validity.Reason = "certificate was revoked"
+			return validity, nil
+		}
+	}
+
+	renewBefore := s.acmeSettings.RenewBefore
+	if renewBefore <= 0 {
+		renewBefore = defaultRenewBefore
+	}
+	if time.Now().Add(renewBefore).After(leaf.NotAfter) {
+		validity.Reason = fmt.Sprintf("certificate expires within %s", renewBefore)
+		return validity, nil
+	}
+
+	validity.Valid = true
+	return validity, nil
+}
+
+// trustedRoots returns the system roots plus the extra roots of the CA profile that issued the certificate, or the
+// root of the internal CA that did
+func (s *Service) trustedRoots(ctx context.Context, record IssuanceRecord) (*x509.CertPool, error) {
+	roots, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load system roots: %w", err)
+	}
+	if record.IssuedBy == "" {
+		return roots, nil
+	}
+	name, profile, err := s.resolveProfile(record.IssuedBy)
+	if err != nil {
+		// The profile may have been removed from the config since, the system roots still apply
+		return roots, nil
+	}
+
+	if profile.Type == InternalCAType {
+		ca, err := s.internalCA(ctx, name, profile.Internal)
+		if err != nil {
+			return nil, err
+		}
+		roots.AddCert(ca.root)
+		return roots, nil
+	}
+	if profile.RootsFile == "" {
+		return roots, nil
+	}
+
+	rootsPEM, err := os.ReadFile(profile.RootsFile)
+	if err != nil {
+		return nil, fmt.Errorf("CA profile: %s unable to read roots_file: %w", name, err)
+	}
+	if !roots.AppendCertsFromPEM(rootsPEM) {
+		return nil, fmt.Errorf("CA profile: %s roots_file has no certificates", name)
+	}
+	return roots, nil
+}
+
+func publicKeysEqual(a crypto.PublicKey, b crypto.PublicKey) bool {
+	key, ok := a.(interface{ Equal(crypto.PublicKey) bool })
+	return ok && key.Equal(b)
+}
@@ -0,0 +1,298 @@
+package dns_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/miekg/dns"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPropagationTimeout = 2 * time.Minute
+	defaultPollInterval       = 5 * time.Second
+	defaultQueryTimeout       = 5 * time.Second
+	// maxCNAMEChain bounds how many CNAMEs we follow from a challenge name, e.g. to an acme-dns zone
+	maxCNAMEChain = 8
+)
+
+// fallbackResolvers are used when neither resolvers are configured nor /etc/resolv.conf can be read, e.g. on windows
+var fallbackResolvers = []string{"8.8.8.8:53", "1.1.1.1:53"}
+
+var ErrNotPropagated = errors.New("record hasn't propagated to every authoritative nameserver")
+
+// NameserverStatus is what one authoritative nameserver answered for the record
+type NameserverStatus struct {
+	Nameserver string   `json:"nameserver"`
+	Address    string   `json:"address"`
+	Found      bool     `json:"found"`
+	Values     []string `json:"values,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// PropagationStatus is how far a TXT record got, Complete is set once every authoritative nameserver serves it
+type PropagationStatus struct {
+	Name        string             `json:"name"`
+	Expected    string             `json:"expected"`
+	Zone        string             `json:"zone"`
+	Nameservers []NameserverStatus `json:"nameservers"`
+	Propagated  int                `json:"propagated"`
+	Total       int                `json:"total"`
+	Complete    bool               `json:"complete"`
+	CheckedAt   time.Time          `json:"checked_at"`
+}
+
+// Checker asks the authoritative nameservers of a name directly, caching resolvers can't tell us whether the CA's
+// resolvers will see a record
+type Checker struct {
+	resolvers    []string
+	client       *dns.Client
+	timeout      time.Duration
+	pollInterval time.Duration
+	// nameserverPort is where authoritative nameservers are asked, only tests change it
+	nameserverPort string
+}
+
+func NewChecker(settings appconfig.PropagationSettings) *Checker {
+	checker := &Checker{
+		resolvers:      settings.Resolvers,
+		timeout:        settings.Timeout,
+		pollInterval:   settings.PollInterval,
+		nameserverPort: "53",
+	}
+	if checker.timeout <= 0 {
+		checker.timeout = defaultPropagationTimeout
+	}
+	if checker.pollInterval <= 0 {
+		checker.pollInterval = defaultPollInterval
+	}
+	queryTimeout := settings.QueryTimeout
+	if queryTimeout <= 0 {
+		queryTimeout = defaultQueryTimeout
+	}
+	checker.client = &dns.Client{Timeout: queryTimeout}
+
+	if len(checker.resolvers) == 0 {
+		clientConfig, err := dns.ClientConfigFromFile("/etc/resolv.conf")
+		if err != nil {
+			logger.Info("unable to read system resolvers, using: %s", strings.Join(fallbackResolvers, ", "))
+			checker.resolvers = fallbackResolvers
+		} else {
+			for _, server := range clientConfig.Servers {
+				checker.resolvers = append(checker.resolvers, net.JoinHostPort(server, clientConfig.Port))
+			}
+		}
+	}
+	return checker
+}
+
+// WaitForPropagation checks the record until every authoritative nameserver serves expected or the configured
+// timeout passes, progress is called with the status of every round
+func (c *Checker) WaitForPropagation(ctx context.Context, name string, expected string, progress func(PropagationStatus)) (PropagationStatus, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	var status PropagationStatus
+	for {
+		current, err := c.Check(ctx, name, expected)
+		// A round the timeout cut short says nothing, the error reports the last full one
+		if ctx.Err() == nil {
+			if err != nil {
+				logger.Error("name: %s propagation check failed: %s", name, err)
+			} else {
+				status = current
+				if progress != nil {
+					progress(status)
+				}
+			}
+		}
+		if status.Complete {
+			return status, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if status.Total == 0 {
+				return status, fmt.Errorf("name: %s %w, no nameservers answered", name, ErrNotPropagated)
+			}
+			return status, fmt.Errorf("name: %s %w, %d of %d have it", name, ErrNotPropagated, status.Propagated, status.Total)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check asks every authoritative nameserver of name for its TXT records once
+func (c *Checker) Check(ctx context.Context, name string, expected string) (PropagationStatus, error) {
+	status := PropagationStatus{
+		Name:      name,
+		Expected:  expected,
+		CheckedAt: time.Now(),
+	}
+
+	target, err := c.followCNAMEs(ctx, dns.Fqdn(name))
+	if err != nil {
+		return status, err
+	}
+	zone, nameservers, err := c.authoritativeNameservers(ctx, target)
+	if err != nil {
+		return status, err
+	}
+	status.Zone = zone
+
+	for _, nameserver := range nameservers {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, strings.TrimSuffix(nameserver, "."))
+		if err != nil {
+			status.Nameservers = append(status.Nameservers, NameserverStatus{
+				Nameserver: nameserver,
+				Error:      err.Error(),
+			})
+			continue
+		}
+		for _, addr := range addrs {
+			status.Nameservers = append(status.Nameservers, c.queryNameserver(ctx, nameserver, addr, target, expected))
+		}
+	}
+
+	status.Total = len(status.Nameservers)
+	for _, ns := range status.Nameservers {
+		if ns.Found {
+			status.Propagated++
+		}
+	}
+	status.Complete = status.Total > 0 && status.Propagated == status.Total
+	return status, nil
+}
+
+func (c *Checker) queryNameserver(ctx context.Context, nameserver string, addr string, name string, expected string) NameserverStatus {
+	result := NameserverStatus{
+		Nameserver: nameserver,
+		Address:    addr,
+	}
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeTXT)
+	msg.RecursionDesired = false
+	resp, err := c.exchange(ctx, msg, net.JoinHostPort(addr, c.nameserverPort))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		result.Error = dns.RcodeToString[resp.Rcode]
+		return result
+	}
+
+	for _, rr := range resp.Answer {
+		txt, ok := rr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		value := strings.Join(txt.Txt, "")
+		result.Values = append(result.Values, value)
+		if value == expected {
+			result.Found = true
+		}
+	}
+	return result
+}
+
+// followCNAMEs returns the name the TXT record actually lives at
+func (c *Checker) followCNAMEs(ctx context.Context, name string) (string, error) {
+	for i := 0; i < maxCNAMEChain; i++ {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeCNAME)
+		resp, err := c.resolve(ctx, msg)
+		if err != nil {
+			return "", err
+		}
+		var target string
+		for _, rr := range resp.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+			}
+		}
+		if target == "" {
+			return name, nil
+		}
+		name = target
+	}
+	return "", fmt.Errorf("name: %s has more than %d CNAMEs", name, maxCNAMEChain)
+}
+
+// FindZone returns the zone name lives in, after following its CNAMEs
+func (c *Checker) FindZone(ctx context.Context, name string) (string, error) {
+	target, err := c.followCNAMEs(ctx, dns.Fqdn(name))
+	if err != nil {
+		return "", err
+	}
+	zone, _, err := c.authoritativeNameservers(ctx, target)
+	return zone, err
+}
+
+// authoritativeNameservers walks up from name to the closest zone cut and returns its nameservers
+func (c *Checker) authoritativeNameservers(ctx context.Context, name string) (string, []string, error) {
+	labels := dns.SplitDomainName(name)
+	for i := range labels {
+		zone := dns.Fqdn(strings.Join(labels[i:], "."))
+		msg := new(dns.Msg)
+		msg.SetQuestion(zone, dns.TypeNS)
+		resp, err := c.resolve(ctx, msg)
+		if err != nil {
+			return "", nil, err
+		}
+
+		var nameservers []string
+		for _, rr := range resp.Answer {
+			if ns, ok := rr.(*dns.NS); ok && strings.EqualFold(ns.Hdr.Name, zone) {
+				nameservers = append(nameservers, strings.ToLower(ns.Ns))
+			}
+		}
+		if len(nameservers) > 0 {
+			sort.Strings(nameservers)
+			return zone, nameservers, nil
+		}
+	}
+	return "", nil, fmt.Errorf("name: %s unable to find authoritative nameservers", name)
+}
+
+// resolve sends a recursive query to the first resolver that answers
+func (c *Checker) resolve(ctx context.Context, msg *dns.Msg) (*dns.Msg, error) {
+	msg.RecursionDesired = true
+	var lastErr error
+	for _, resolver := range c.resolvers {
+		resp, err := c.exchange(ctx, msg, resolver)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+			lastErr = fmt.Errorf("%s answered: %s", resolver, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+		return resp, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no resolvers configured")
+	}
+	return nil, lastErr
+}
+
+// exchange retries over TCP when the UDP answer was truncated
+func (c *Checker) exchange(ctx context.Context, msg *dns.Msg, addr string) (*dns.Msg, error) {
+	resp, _, err := c.client.ExchangeContext(ctx, msg, addr)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Truncated {
+		tcpClient := &dns.Client{Net: "tcp", Timeout: c.client.Timeout}
+		resp, _, err = tcpClient.ExchangeContext(ctx, msg, addr)
+	}
+	return resp, err
+}
@@ -0,0 +1,225 @@
+package dns_service
+
+import (
+	"context"
+	"errors"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testChallengeName = "_acme-challenge.shop.example.test"
+	testCNAMETarget   = "0123abcd." + testZone
+)
+
+// fakeResolver is the recursive resolver the checker is pointed at, it answers the CNAME and NS queries the checker
+// uses to find the authoritative nameservers
+type fakeResolver struct {
+	cnames      map[string]string
+	nameservers map[string][]string
+}
+
+func (f *fakeResolver) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	question := req.Question[0]
+	name := dns.CanonicalName(question.Name)
+	switch question.Qtype {
+	case dns.TypeCNAME:
+		if target, ok := f.cnames[name]; ok {
+			resp.Answer = append(resp.Answer, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: question.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+				Target: dns.Fqdn(target),
+			})
+		}
+	case dns.TypeNS:
+		for _, ns := range f.nameservers[name] {
+			resp.Answer = append(resp.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 60},
+				Ns:  dns.Fqdn(ns),
+			})
+		}
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func startFakeResolver(t *testing.T, resolver *fakeResolver) string {
+	t.Helper()
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: packetConn, Handler: resolver}
+	go func() { _ = server.ActivateAndServe() }()
+	t.Cleanup(func() { _ = server.Shutdown() })
+	return packetConn.LocalAddr().String()
+}
+
+// propagationSetup is a challenge zone served by two responders on 127.0.0.1 and 127.0.0.2, the challenge name of
+// a customer domain is CNAMEd into it
+type propagationSetup struct {
+	checker *Checker
+	sources []*MemoryTXTSource
+}
+
+func newPropagationSetup(t *testing.T, settings appconfig.PropagationSettings) *propagationSetup {
+	t.Helper()
+	setup := &propagationSetup{}
+	var port string
+	for _, host := range []string{"127.0.0.1", "127.0.0.2"} {
+		source := NewMemoryTXTSource()
+		listen := net.JoinHostPort(host, "0")
+		if port != "" {
+			listen = net.JoinHostPort(host, port)
+		}
+		responder, err := NewResponder(appconfig.ChallengeDNSSettings{
+			Listen:     listen,
+			Zone:       testZone,
+			Nameserver: "ns1.verifier.test",
+		}, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = responder.Start()
+		if err != nil && port != "" {
+			t.Skipf("unable to serve a second nameserver on %s: %s", listen, err)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = responder.Shutdown(context.Background()) })
+		_, port, _ = net.SplitHostPort(responder.Addr())
+		setup.sources = append(setup.sources, source)
+	}
+
+	resolverAddr := startFakeResolver(t, &fakeResolver{
+		cnames: map[string]string{
+			dns.CanonicalName(testChallengeName): testCNAMETarget,
+		},
+		nameservers: map[string][]string{
+			dns.CanonicalName(testZone): {"127.0.0.1", "127.0.0.2"},
+		},
+	})
+	settings.Resolvers = []string{resolverAddr}
+	settings.QueryTimeout = time.Second
+	setup.checker = NewChecker(settings)
+	setup.checker.nameserverPort = port
+	return setup
+}
+
+func TestCheckFollowsCNAMEToEveryNameserver(t *testing.T) {
+	setup := newPropagationSetup(t, appconfig.PropagationSettings{})
+	for _, source := range setup.sources {
+		source.Set(testCNAMETarget, "old-token", "dns-01-value")
+	}
+
+	status, err := setup.checker.Check(context.Background(), testChallengeName, "dns-01-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Zone != dns.Fqdn(testZone) {
+		t.Errorf("zone = %s, want %s", status.Zone, dns.Fqdn(testZone))
+	}
+	if !status.Complete || status.Propagated != 2 || status.Total != 2 {
+		t.Fatalf("status: %d of %d complete: %t", status.Propagated, status.Total, status.Complete)
+	}
+	for _, ns := range status.Nameservers {
+		if !ns.Found || len(ns.Values) != 2 || ns.Error != "" {
+			t.Errorf("nameserver: %+v", ns)
+		}
+	}
+}
+
+func TestCheckPartialPropagation(t *testing.T) {
+	setup := newPropagationSetup(t, appconfig.PropagationSettings{})
+	// The second nameserver hasn't got the record yet and answers NXDOMAIN
+	setup.sources[0].Set(testCNAMETarget, "dns-01-value")
+
+	status, err := setup.checker.Check(context.Background(), testChallengeName, "dns-01-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Complete || status.Propagated != 1 || status.Total != 2 {
+		t.Fatalf("status: %d of %d complete: %t", status.Propagated, status.Total, status.Complete)
+	}
+	for _, ns := range status.Nameservers {
+		switch ns.Address {
+		case "127.0.0.1":
+			if !ns.Found {
+				t.Errorf("nameserver with the record: %+v", ns)
+			}
+		case "127.0.0.2":
+			// NXDOMAIN is an answer, the record just isn't there yet
+			if ns.Found || len(ns.Values) != 0 || ns.Error != "" {
+				t.Errorf("nameserver without the record: %+v", ns)
+			}
+		default:
+			t.Errorf("unexpected nameserver: %+v", ns)
+		}
+	}
+}
+
+func TestWaitForPropagationCompletes(t *testing.T) {
+	setup := newPropagationSetup(t, appconfig.PropagationSettings{
+		Timeout:      5 * time.Second,
+		PollInterval: 20 * time.Millisecond,
+	})
+	setup.sources[0].Set(testCNAMETarget, "dns-01-value")
+
+	var mu sync.Mutex
+	var rounds []PropagationStatus
+	status, err := setup.checker.WaitForPropagation(context.Background(), testChallengeName, "dns-01-value", func(status PropagationStatus) {
+		mu.Lock()
+		defer mu.Unlock()
+		rounds = append(rounds, status)
+		// The second nameserver catches up after the first round
+		setup.sources[1].Set(testCNAMETarget, "dns-01-value")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !status.Complete || status.Propagated != 2 {
+		t.Fatalf("status: %d of %d complete: %t", status.Propagated, status.Total, status.Complete)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(rounds) < 2 || rounds[0].Propagated != 1 {
+		t.Fatalf("progress rounds: %+v, want a partial round before the complete one", rounds)
+	}
+}
+
+func TestWaitForPropagationTimesOutWithCounts(t *testing.T) {
+	setup := newPropagationSetup(t, appconfig.PropagationSettings{
+		Timeout:      200 * time.Millisecond,
+		PollInterval: 20 * time.Millisecond,
+	})
+	setup.sources[0].Set(testCNAMETarget, "dns-01-value")
+
+	status, err := setup.checker.WaitForPropagation(context.Background(), testChallengeName, "dns-01-value", nil)
+	if !errors.Is(err, ErrNotPropagated) {
+		t.Fatalf("err: %v, want %s", err, ErrNotPropagated)
+	}
+	if !strings.Contains(err.Error(), "1 of 2 have it") {
+		t.Errorf("err: %s, want the 1 of 2 count", err)
+	}
+	if status.Propagated != 1 || status.Total != 2 {
+		t.Errorf("status: %d of %d", status.Propagated, status.Total)
+	}
+}
+
+func TestFindZoneFollowsCNAME(t *testing.T) {
+	setup := newPropagationSetup(t, appconfig.PropagationSettings{})
+
+	zone, err := setup.checker.FindZone(context.Background(), testChallengeName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zone != dns.Fqdn(testZone) {
+		t.Fatalf("zone = %s, want %s", zone, dns.Fqdn(testZone))
+	}
+}
@@ -0,0 +1,242 @@
+package dns_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/miekg/dns"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResponderListen = ":53"
+	// defaultChallengeTTL is short because tokens change with every order
+	defaultChallengeTTL = 60
+	lookupTimeout       = 3 * time.Second
+)
+
+var ErrNoRecords = errors.New("no records for name")
+
+// TXTSource looks up the TXT values served for a name inside the zone, it returns ErrNoRecords for names it
+// doesn't know
+type TXTSource interface {
+	TXTValues(ctx context.Context, name string) ([]string, error)
+}
+
+// Responder is an authoritative DNS server for the challenge zone, it answers SOA and NS at the apex and TXT for the
+// challenge names below it and refuses everything else
+type Responder struct {
+	listen     string
+	zone       string
+	nameserver string
+	mbox       string
+	ttl        uint32
+	source     TXTSource
+
+	mu      sync.Mutex
+	servers []*dns.Server
+	addr    string
+}
+
+func NewResponder(settings appconfig.ChallengeDNSSettings, source TXTSource) (*Responder, error) {
+	if settings.Zone == "" || settings.Nameserver == "" {
+		return nil, fmt.Errorf("challenge_dns needs a zone and a nameserver")
+	}
+	r := &Responder{
+		listen:     settings.Listen,
+		zone:       dns.CanonicalName(settings.Zone),
+		nameserver: dns.CanonicalName(settings.Nameserver),
+		mbox:       "hostmaster." + dns.CanonicalName(settings.Zone),
+		ttl:        settings.TTL,
+		source:     source,
+	}
+	if r.listen == "" {
+		r.listen = defaultResponderListen
+	}
+	if r.ttl == 0 {
+		r.ttl = defaultChallengeTTL
+	}
+	if settings.AdminEmail != "" {
+		r.mbox = dns.Fqdn(strings.Replace(settings.AdminEmail, "@", ".", 1))
+	}
+	return r, nil
+}
+
+// Zone is the canonical name of the zone the responder is authoritative for
+func (r *Responder) Zone() string {
+	return r.zone
+}
+
+// Start binds the UDP and TCP listeners and serves them in the background, a listen port of 0 picks a free one
+// which Addr returns afterwards
+func (r *Responder) Start() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	packetConn, err := net.ListenPacket("udp", r.listen)
+	if err != nil {
+		return fmt.Errorf("unable to listen on udp: %s: %w", r.listen, err)
+	}
+	// TCP binds the port UDP got so that a port of 0 ends up the same on both
+	listener, err := net.Listen("tcp", packetConn.LocalAddr().String())
+	if err != nil {
+		_ = packetConn.Close()
+		return fmt.Errorf("unable to listen on tcp: %s: %w", r.listen, err)
+	}
+	r.addr = packetConn.LocalAddr().String()
+
+	r.servers = []*dns.Server{
+		{PacketConn: packetConn, Handler: r},
+		{Listener: listener, Handler: r},
+	}
+	for _, server := range r.servers {
+		go func(server *dns.Server) {
+			err := server.ActivateAndServe()
+			if err != nil {
+				logger.Error("challenge dns server stopped: %s", err)
+			}
+		}(server)
+	}
+	logger.Info("challenge dns serving zone: %s on: %s", r.zone, r.addr)
+	return nil
+}
+
+// Addr is the address the responder listens on once started
+func (r *Responder) Addr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addr
+}
+
+func (r *Responder) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []string
+	for _, server := range r.servers {
+		err := server.ShutdownContext(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	r.servers = nil
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (r *Responder) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Authoritative = true
+	resp.RecursionAvailable = false
+	defer func() {
+		err := w.WriteMsg(resp)
+		if err != nil {
+			logger.Error("challenge dns unable to write response: %s", err)
+		}
+	}()
+
+	if len(req.Question) != 1 {
+		resp.SetRcode(req, dns.RcodeFormatError)
+		return
+	}
+	question := req.Question[0]
+	name := dns.CanonicalName(question.Name)
+	if !dns.IsSubDomain(r.zone, name) {
+		resp.Authoritative = false
+		resp.SetRcode(req, dns.RcodeRefused)
+		return
+	}
+
+	if name == r.zone {
+		switch question.Qtype {
+		case dns.TypeSOA:
+			resp.Answer = append(resp.Answer, r.soa())
+		case dns.TypeNS:
+			resp.Answer = append(resp.Answer, r.ns())
+		default:
+			resp.Ns = append(resp.Ns, r.soa())
+		}
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+	values, err := r.source.TXTValues(ctx, name)
+	if errors.Is(err, ErrNoRecords) {
+		resp.SetRcode(req, dns.RcodeNameError)
+		resp.Ns = append(resp.Ns, r.soa())
+		return
+	}
+	if err != nil {
+		logger.Error("challenge dns unable to look up: %s: %s", name, err)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		return
+	}
+
+	if question.Qtype != dns.TypeTXT && question.Qtype != dns.TypeANY {
+		resp.Ns = append(resp.Ns, r.soa())
+		return
+	}
+	for _, value := range values {
+		resp.Answer = append(resp.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: r.ttl},
+			Txt: []string{value},
+		})
+	}
+}
+
+func (r *Responder) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: r.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: r.ttl},
+		Ns:      r.nameserver,
+		Mbox:    r.mbox,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  r.ttl,
+	}
+}
+
+func (r *Responder) ns() dns.RR {
+	return &dns.NS{
+		Hdr: dns.RR_Header{Name: r.zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: r.ttl},
+		Ns:  r.nameserver,
+	}
+}
+
+// MemoryTXTSource keeps TXT values in memory, for tests and running the responder locally
+type MemoryTXTSource struct {
+	mu      sync.RWMutex
+	records map[string][]string
+}
+
+func NewMemoryTXTSource() *MemoryTXTSource {
+	return &MemoryTXTSource{
+		records: map[string][]string{},
+	}
+}
+
+func (m *MemoryTXTSource) Set(name string, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.records[dns.CanonicalName(name)] = values
+}
+
+func (m *MemoryTXTSource) TXTValues(ctx context.Context, name string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	values, ok := m.records[dns.CanonicalName(name)]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, ErrNoRecords)
+	}
+	return values, nil
+}
@@ -0,0 +1,124 @@
+package dns_service
+
+import (
+	"context"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/miekg/dns"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const testZone = "challenges.verifier.test"
+
+func TestMain(m *testing.M) {
+	logger.New()
+	os.Exit(m.Run())
+}
+
+// startResponder serves source on a free localhost port and returns its address
+func startResponder(t *testing.T, source TXTSource) string {
+	t.Helper()
+	responder, err := NewResponder(appconfig.ChallengeDNSSettings{
+		Listen:     "127.0.0.1:0",
+		Zone:       testZone,
+		Nameserver: "ns1.verifier.test",
+		TTL:        30,
+	}, source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = responder.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = responder.Shutdown(context.Background()) })
+	return responder.Addr()
+}
+
+func query(t *testing.T, network string, addr string, name string, qtype uint16) *dns.Msg {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(name), qtype)
+	client := &dns.Client{Net: network}
+	resp, _, err := client.Exchange(req, addr)
+	if err != nil {
+		t.Fatalf("%s query for %s: %s", network, name, err)
+	}
+	return resp
+}
+
+func txtAnswers(resp *dns.Msg) []string {
+	var values []string
+	for _, rr := range resp.Answer {
+		if txt, ok := rr.(*dns.TXT); ok {
+			values = append(values, txt.Txt...)
+		}
+	}
+	return values
+}
+
+func TestResponderAnswersTXT(t *testing.T) {
+	source := NewMemoryTXTSource()
+	source.Set("0123abcd."+testZone, "token-1", "token-2")
+	addr := startResponder(t, source)
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			resp := query(t, network, addr, "0123ABCD."+testZone, dns.TypeTXT)
+			if resp.Rcode != dns.RcodeSuccess || !resp.Authoritative {
+				t.Fatalf("rcode: %s authoritative: %t", dns.RcodeToString[resp.Rcode], resp.Authoritative)
+			}
+			if got := txtAnswers(resp); !reflect.DeepEqual(got, []string{"token-1", "token-2"}) {
+				t.Fatalf("TXT answers = %v", got)
+			}
+			if resp.Answer[0].Header().Ttl != 30 {
+				t.Errorf("TTL = %d, want 30", resp.Answer[0].Header().Ttl)
+			}
+		})
+	}
+}
+
+func TestResponderNegativeAnswers(t *testing.T) {
+	source := NewMemoryTXTSource()
+	source.Set("0123abcd."+testZone, "token-1")
+	addr := startResponder(t, source)
+
+	resp := query(t, "udp", addr, "unknown."+testZone, dns.TypeTXT)
+	if resp.Rcode != dns.RcodeNameError || len(resp.Ns) != 1 || resp.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("unknown name: rcode: %s authority: %v, want NXDOMAIN with the SOA", dns.RcodeToString[resp.Rcode], resp.Ns)
+	}
+
+	resp = query(t, "udp", addr, "0123abcd."+testZone, dns.TypeA)
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 0 || len(resp.Ns) != 1 {
+		t.Errorf("A query: rcode: %s answers: %v, want NODATA", dns.RcodeToString[resp.Rcode], resp.Answer)
+	}
+
+	resp = query(t, "udp", addr, "example.com", dns.TypeTXT)
+	if resp.Rcode != dns.RcodeRefused || resp.Authoritative {
+		t.Errorf("name outside the zone: rcode: %s, want REFUSED", dns.RcodeToString[resp.Rcode])
+	}
+}
+
+func TestResponderApex(t *testing.T) {
+	addr := startResponder(t, NewMemoryTXTSource())
+
+	resp := query(t, "udp", addr, testZone, dns.TypeSOA)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("SOA answers = %v", resp.Answer)
+	}
+	soa, ok := resp.Answer[0].(*dns.SOA)
+	if !ok || soa.Ns != "ns1.verifier.test." || soa.Mbox != "hostmaster."+testZone+"." {
+		t.Errorf("SOA answer = %v", resp.Answer)
+	}
+
+	resp = query(t, "udp", addr, testZone, dns.TypeNS)
+	if len(resp.Answer) != 1 {
+		t.Fatalf("NS answers = %v", resp.Answer)
+	}
+	ns, ok := resp.Answer[0].(*dns.NS)
+	if !ok || ns.Ns != "ns1.verifier.test." {
+		t.Errorf("NS answer = %v", resp.Answer)
+	}
+}
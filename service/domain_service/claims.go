@@ -0,0 +1,278 @@
+package domain_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	"github.com/edwinavalos/dns-verifier/service/notification_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	// ClaimPolicyFirstVerified keeps a domain with the user who verified it first, later verifications are refused
+	ClaimPolicyFirstVerified = "first_verified"
+	// ClaimPolicySupersede moves a domain to whoever verified it last, the previous owner is notified
+	ClaimPolicySupersede = "supersede"
+	// ClaimPolicyAdminReview leaves a contested domain with its owner until an admin awards it
+	ClaimPolicyAdminReview = "admin_review"
+)
+
+const (
+	// maxClaimAttempts bounds how often a verification retries when other requests keep swapping the name claim
+	maxClaimAttempts = 5
+	// claimGracePeriod is how long a name claim protects a holder whose record isn't verified yet
+	claimGracePeriod = 5 * time.Minute
+)
+
+var (
+	ErrDomainClaimed      = errors.New("domain is verified by another user")
+	ErrClaimPendingReview = errors.New("domain is verified by another user, the claim is waiting for review")
+	ErrUnknownClaimPolicy = errors.New("unknown domain claim policy")
+)
+
+// WithClaimPolicy sets how conflicting verifications of a domain are resolved
+func WithClaimPolicy(policy string) ServiceOpt {
+	return func(s *Service) {
+		if policy == "" {
+			policy = ClaimPolicyFirstVerified
+		}
+		s.claimPolicy = policy
+	}
+}
+
+func WithNotifications(notifications *notification_service.Service) ServiceOpt {
+	return func(s *Service) {
+		s.notifications = notifications
+	}
+}
+
+// GetDomainClaims returns every user's entry for a domain name
+func (s *Service) GetDomainClaims(ctx context.Context, domainName string) ([]models.DomainInformation, error) {
+	return s.verifierStore.GetDomainsByName(ctx, domainName)
+}
+
+// HasVerifiedClaim reports whether some user verified the domain name and hasn't deleted it
+func (s *Service) HasVerifiedClaim(ctx context.Context, domainName string) (bool, error) {
+	claims, err := s.verifierStore.GetDomainsByName(ctx, domainName)
+	if err != nil {
+		return false, err
+	}
+	for _, claim := range claims {
+		if claim.Verification.Verified {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HoldsVerifiedClaim reports whether the user verified the domain name and is the holder of its claim
+func (s *Service) HoldsVerifiedClaim(ctx context.Context, userID uuid.UUID, domainName string) (bool, error) {
+	di, err := s.verifierStore.GetDomainByUser(ctx, userID, domainName)
+	if err != nil {
+		return false, err
+	}
+	if !di.Verification.Verified {
+		return false, nil
+	}
+	claim, err := s.verifierStore.GetNameClaim(ctx, domainName)
+	if err != nil {
+		return false, err
+	}
+	return claim.UserID == userID, nil
+}
+
+// VerifyOwnership checks the user's TXT record and, when it is in place, settles the claim against other users
+// that verified the same domain
+func (s *Service) VerifyOwnership(ctx context.Context, userID uuid.UUID, domainName string) (bool, error) {
+	record, err := s.verifierStore.GetDomainRecord(ctx, userID, domainName)
+	if err != nil {
+		return false, err
+	}
+	if record.Deleted != nil {
+		return false, fmt.Errorf("domain: %s %w", domainName, ErrDomainDeleted)
+	}
+	di := record.Domain
+	if !di.Verification.Verified && (di.Verification.Key == "" || record.Pending != nil && record.Pending.KeyExpiresAt != nil && time.Now().After(*record.Pending.KeyExpiresAt)) {
+		return false, fmt.Errorf("domain: %s %w", domainName, ErrNoVerificationKey)
+	}
+
+	found, err := s.VerifyTXTRecord(ctx, di.Verification.Zone, di.Verification.Key)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		if di.Verification.Verified {
+			_, err = s.UpdateDomain(ctx, userID, domainName, setVerified(false))
+			if err != nil {
+				return false, err
+			}
+			s.releaseNameClaim(ctx, userID, domainName)
+		}
+		return false, nil
+	}
+	if di.Verification.Verified {
+		return true, nil
+	}
+
+	err = s.takeNameClaim(ctx, userID, domainName, s.claimPolicy)
+	if err != nil {
+		return false, err
+	}
+	err = s.verifyWithClaim(ctx, userID, domainName)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// takeNameClaim makes the user the holder of the domain name's claim, settling it by policy against the users that
+// verified the name before. Replicas verifying the same name at once are serialized by the conditional swap.
+func (s *Service) takeNameClaim(ctx context.Context, userID uuid.UUID, domainName string, policy string) error {
+	for attempt := 0; attempt < maxClaimAttempts; attempt++ {
+		claim, err := s.verifierStore.GetNameClaim(ctx, domainName)
+		if err != nil {
+			return err
+		}
+		if claim.UserID == userID {
+			return nil
+		}
+
+		others, err := s.verifiedByOthers(ctx, userID, domainName)
+		if err != nil {
+			return err
+		}
+		// A holder that isn't verified yet may be between taking the claim and writing its record
+		if len(others) == 0 && claim.UserID != uuid.Nil && time.Since(claim.ClaimedAt) < claimGracePeriod {
+			others = []models.DomainInformation{{DomainName: domainName, UserID: claim.UserID}}
+		}
+		if len(others) > 0 {
+			err = s.settleClaim(ctx, userID, domainName, others, policy)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.verifierStore.SwapNameClaim(ctx, domainName, claim.UserID, userID)
+		if errors.Is(err, storage.ErrNameClaimChanged) {
+			continue
+		}
+		return err
+	}
+	return fmt.Errorf("domain: %s %w", domainName, storage.ErrNameClaimChanged)
+}
+
+// settleClaim applies the claim policy to a user verifying a name others hold, nil means the user may take it over
+func (s *Service) settleClaim(ctx context.Context, userID uuid.UUID, domainName string, others []models.DomainInformation, policy string) error {
+	switch policy {
+	case ClaimPolicyFirstVerified, "":
+		return fmt.Errorf("domain: %s %w", domainName, ErrDomainClaimed)
+	case ClaimPolicyAdminReview:
+		s.notifications.Notify(ctx, notification_service.Notification{
+			Kind:    notification_service.ClaimReviewRequested,
+			Domain:  domainName,
+			Message: fmt.Sprintf("user: %s verified: %s which user: %s already holds", userID, domainName, others[0].UserID),
+		})
+		return fmt.Errorf("domain: %s %w", domainName, ErrClaimPendingReview)
+	case ClaimPolicySupersede:
+		return s.supersede(ctx, others, userID)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownClaimPolicy, policy)
+	}
+}
+
+// verifyWithClaim marks the user's domain verified and checks the claim again afterwards. When another replica took
+// the claim over in between, the user's verification is undone.
+func (s *Service) verifyWithClaim(ctx context.Context, userID uuid.UUID, domainName string) error {
+	_, err := s.UpdateDomain(ctx, userID, domainName, setVerified(true))
+	if err != nil {
+		return err
+	}
+	claim, err := s.verifierStore.GetNameClaim(ctx, domainName)
+	if err != nil {
+		return err
+	}
+	if claim.UserID == userID {
+		return nil
+	}
+	_, err = s.UpdateDomain(ctx, userID, domainName, setVerified(false))
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("domain: %s %w", domainName, ErrDomainClaimed)
+}
+
+// releaseNameClaim lets go of the user's claim on a name when their domain stops being verified. A claim left behind
+// by a failure here is taken over once claimGracePeriod has passed.
+func (s *Service) releaseNameClaim(ctx context.Context, userID uuid.UUID, domainName string) {
+	err := s.verifierStore.SwapNameClaim(ctx, domainName, userID, uuid.Nil)
+	if err != nil && !errors.Is(err, storage.ErrNameClaimChanged) {
+		logger.Error("domain: %s unable to release the name claim of user: %s: %s", domainName, userID, err)
+	}
+}
+
+// AwardClaim makes a user the verified owner of a domain they have an entry for, whatever the policy, and unverifies
+// every other claim
+func (s *Service) AwardClaim(ctx context.Context, userID uuid.UUID, domainName string) error {
+	_, err := s.verifierStore.GetDomainByUser(ctx, userID, domainName)
+	if err != nil {
+		return err
+	}
+	err = s.takeNameClaim(ctx, userID, domainName, ClaimPolicySupersede)
+	if err != nil {
+		return err
+	}
+	err = s.verifyWithClaim(ctx, userID, domainName)
+	if err != nil {
+		return err
+	}
+	s.notifications.Notify(ctx, notification_service.Notification{
+		Kind:    notification_service.ClaimAwarded,
+		UserID:  userID,
+		Domain:  domainName,
+		Message: fmt.Sprintf("%s was awarded to you after review", domainName),
+	})
+	return nil
+}
+
+func (s *Service) verifiedByOthers(ctx context.Context, userID uuid.UUID, domainName string) ([]models.DomainInformation, error) {
+	claims, err := s.verifierStore.GetDomainsByName(ctx, domainName)
+	if err != nil {
+		return nil, fmt.Errorf("domain: %s unable to look up other claims: %w", domainName, err)
+	}
+	var others []models.DomainInformation
+	for _, claim := range claims {
+		if claim.UserID != userID && claim.Verification.Verified {
+			others = append(others, claim)
+		}
+	}
+	return others, nil
+}
+
+// supersede unverifies the claims of other users and tells them, their entries are kept so they can verify again
+func (s *Service) supersede(ctx context.Context, claims []models.DomainInformation, newOwner uuid.UUID) error {
+	for _, claim := range claims {
+		_, err := s.UpdateDomain(ctx, claim.UserID, claim.DomainName, setVerified(false))
+		if err != nil {
+			return fmt.Errorf("domain: %s unable to unverify claim of user: %s: %w", claim.DomainName, claim.UserID, err)
+		}
+		logger.Info("domain: %s claim of user: %s superseded by user: %s", claim.DomainName, claim.UserID, newOwner)
+		s.notifications.Notify(ctx, notification_service.Notification{
+			Kind:    notification_service.ClaimSuperseded,
+			UserID:  claim.UserID,
+			Domain:  claim.DomainName,
+			Message: fmt.Sprintf("%s was verified by another user and is no longer verified for you", claim.DomainName),
+		})
+	}
+	return nil
+}
+
+func setVerified(verified bool) func(di *models.DomainInformation) error {
+	return func(di *models.DomainInformation) error {
+		di.Verification.Verified = verified
+		return nil
+	}
+}
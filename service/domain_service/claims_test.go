@@ -0,0 +1,223 @@
+package domain_service
+
+import (
+	"context"
+	"errors"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"os"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	logger.New()
+	os.Exit(m.Run())
+}
+
+func newTestService(t *testing.T, opts ...ServiceOpt) (*Service, *storage.MemoryDomainStore) {
+	t.Helper()
+	store := storage.NewMemoryDomainStore()
+	return New(nil, store, opts...), store
+}
+
+func createTestDomain(t *testing.T, s *Service, userID uuid.UUID, domainName string) {
+	t.Helper()
+	err := s.CreateDomain(context.Background(), models.DomainInformation{
+		DomainName:   domainName,
+		UserID:       userID,
+		Verification: models.Verification{Key: "key"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConcurrentClaimsVerifyOneUser(t *testing.T) {
+	s, store := newTestService(t)
+	ctx := context.Background()
+	users := make([]uuid.UUID, 8)
+	for i := range users {
+		users[i] = uuid.New()
+		createTestDomain(t, s, users[i], "example.com")
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(users))
+	for i, userID := range users {
+		wg.Add(1)
+		go func(i int, userID uuid.UUID) {
+			defer wg.Done()
+			errs[i] = s.takeNameClaim(ctx, userID, "example.com", ClaimPolicyFirstVerified)
+			if errs[i] == nil {
+				errs[i] = s.verifyWithClaim(ctx, userID, "example.com")
+			}
+		}(i, userID)
+	}
+	wg.Wait()
+
+	won := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, ErrDomainClaimed):
+			t.Fatal(err)
+		}
+	}
+	if won != 1 {
+		t.Fatalf("expected exactly one user to win the claim, got %d", won)
+	}
+	claims, err := store.GetDomainsByName(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	verified := 0
+	for _, claim := range claims {
+		if claim.Verification.Verified {
+			verified++
+		}
+	}
+	if verified != 1 {
+		t.Fatalf("expected one verified entry, got %d", verified)
+	}
+}
+
+func TestVerifyWithClaimUndoesLostClaim(t *testing.T) {
+	s, store := newTestService(t)
+	ctx := context.Background()
+	alice, bob := uuid.New(), uuid.New()
+	createTestDomain(t, s, alice, "example.com")
+
+	err := store.SwapNameClaim(ctx, "example.com", uuid.Nil, bob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.verifyWithClaim(ctx, alice, "example.com")
+	if !errors.Is(err, ErrDomainClaimed) {
+		t.Fatalf("expected ErrDomainClaimed, got %v", err)
+	}
+	di, err := store.GetDomainByUser(ctx, alice, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if di.Verification.Verified {
+		t.Fatal("expected the verification to be undone")
+	}
+}
+
+func TestSupersedeTakesClaimOver(t *testing.T) {
+	s, store := newTestService(t, WithClaimPolicy(ClaimPolicySupersede))
+	ctx := context.Background()
+	alice, bob := uuid.New(), uuid.New()
+	createTestDomain(t, s, alice, "example.com")
+	createTestDomain(t, s, bob, "example.com")
+
+	for _, userID := range []uuid.UUID{alice, bob} {
+		err := s.takeNameClaim(ctx, userID, "example.com", s.claimPolicy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = s.verifyWithClaim(ctx, userID, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	aliceDomain, err := store.GetDomainByUser(ctx, alice, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobDomain, err := store.GetDomainByUser(ctx, bob, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aliceDomain.Verification.Verified || !bobDomain.Verification.Verified {
+		t.Fatalf("expected bob to supersede alice, got alice: %t bob: %t", aliceDomain.Verification.Verified, bobDomain.Verification.Verified)
+	}
+	claim, err := store.GetNameClaim(ctx, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claim.UserID != bob {
+		t.Fatalf("expected bob to hold the claim, got %s", claim.UserID)
+	}
+}
+
+func TestDeleteAndRestoreHandOverClaim(t *testing.T) {
+	s, store := newTestService(t)
+	ctx := context.Background()
+	alice, bob := uuid.New(), uuid.New()
+	createTestDomain(t, s, alice, "example.com")
+	createTestDomain(t, s, bob, "example.com")
+
+	err := s.takeNameClaim(ctx, alice, "example.com", s.claimPolicy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.verifyWithClaim(ctx, alice, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.DeleteDomain(ctx, alice, "example.com", alice.String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.takeNameClaim(ctx, bob, "example.com", s.claimPolicy)
+	if err != nil {
+		t.Fatalf("expected the deleted domain's claim to be released, got %v", err)
+	}
+	err = s.verifyWithClaim(ctx, bob, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.RestoreDomain(ctx, alice, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	di, err := store.GetDomainByUser(ctx, alice, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if di.Verification.Verified {
+		t.Fatal("expected alice's domain to be restored unverified")
+	}
+}
+
+func TestHoldsVerifiedClaim(t *testing.T) {
+	s, _ := newTestService(t)
+	ctx := context.Background()
+	holder, other := uuid.New(), uuid.New()
+	createTestDomain(t, s, holder, "example.com")
+	createTestDomain(t, s, other, "example.com")
+
+	holds, err := s.HoldsVerifiedClaim(ctx, holder, "example.com")
+	if err != nil || holds {
+		t.Fatalf("before verifying: holds %t err %v", holds, err)
+	}
+
+	err = s.takeNameClaim(ctx, holder, "example.com", ClaimPolicyFirstVerified)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.verifyWithClaim(ctx, holder, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	holds, err = s.HoldsVerifiedClaim(ctx, holder, "example.com")
+	if err != nil || !holds {
+		t.Fatalf("holder: holds %t err %v", holds, err)
+	}
+	holds, err = s.HoldsVerifiedClaim(ctx, other, "example.com")
+	if err != nil || holds {
+		t.Fatalf("other user: holds %t err %v", holds, err)
+	}
+	_, err = s.HoldsVerifiedClaim(ctx, uuid.New(), "example.com")
+	if err == nil {
+		t.Fatal("a user without the domain got no error")
+	}
+}
@@ -0,0 +1,119 @@
+package domain_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"time"
+)
+
+// defaultRetention is how long a deleted domain can be restored before it is purged
+const defaultRetention = 30 * 24 * time.Hour
+
+var (
+	ErrDomainDeleted    = errors.New("domain is deleted")
+	ErrDomainNotDeleted = errors.New("domain is not deleted")
+)
+
+// WithRetention sets how long deleted domains are kept before they can be purged
+func WithRetention(retention time.Duration) ServiceOpt {
+	return func(s *Service) {
+		if retention <= 0 {
+			retention = defaultRetention
+		}
+		s.retention = retention
+	}
+}
+
+// DeleteDomain soft deletes a domain, it disappears from every lookup and listing but can be restored until its
+// retention ends and the purger removes it
+func (s *Service) DeleteDomain(ctx context.Context, userID uuid.UUID, domainName string, deletedBy string, reason string) (storage.Tombstone, error) {
+	if deletedBy == "" {
+		deletedBy = userID.String()
+	}
+	record, err := s.updateRecord(ctx, userID, domainName, func(record *storage.DomainRecord) error {
+		if record.Deleted != nil {
+			return fmt.Errorf("domain: %s %w", domainName, ErrDomainDeleted)
+		}
+		s.tombstone(record, deletedBy, reason, time.Now())
+		return nil
+	})
+	if err != nil {
+		return storage.Tombstone{}, err
+	}
+	if record.Domain.Verification.Verified {
+		s.releaseNameClaim(ctx, userID, domainName)
+	}
+	logger.Info("domain: %s of user: %s deleted by: %s, purging after: %s", domainName, userID, deletedBy, record.Deleted.PurgeAfter)
+	return *record.Deleted, nil
+}
+
+func (s *Service) tombstone(record *storage.DomainRecord, deletedBy string, reason string, now time.Time) {
+	record.Deleted = &storage.Tombstone{
+		DeletedAt:  now,
+		DeletedBy:  deletedBy,
+		Reason:     reason,
+		PurgeAfter: now.Add(s.retention),
+	}
+	record.AddHistory(storage.AuditEvent{At: now, Event: DeletedEvent, Actor: deletedBy, Detail: reason})
+}
+
+// RestoreDomain brings back a domain that was deleted and hasn't been purged yet. A verified domain comes back
+// unverified when another user verified the name in the meantime.
+func (s *Service) RestoreDomain(ctx context.Context, userID uuid.UUID, domainName string) error {
+	record, err := s.verifierStore.GetDomainRecord(ctx, userID, domainName)
+	if err != nil {
+		return err
+	}
+	keepVerified := false
+	if record.Deleted != nil && record.Domain.Verification.Verified {
+		err = s.takeNameClaim(ctx, userID, domainName, ClaimPolicyFirstVerified)
+		if err != nil && !errors.Is(err, ErrDomainClaimed) {
+			return err
+		}
+		keepVerified = err == nil
+	}
+
+	_, err = s.updateRecord(ctx, userID, domainName, func(record *storage.DomainRecord) error {
+		if record.Deleted == nil {
+			return fmt.Errorf("domain: %s %w", domainName, ErrDomainNotDeleted)
+		}
+		record.Deleted = nil
+		record.Domain.Verification.Verified = record.Domain.Verification.Verified && keepVerified
+		// A domain the sweeper deleted gets a fresh start, otherwise the next sweep deletes it again
+		if record.Pending != nil {
+			s.startPending(record, time.Now())
+			record.Pending.Since = time.Now()
+			record.Pending.DeleteWarnedAt = nil
+		}
+		record.AddHistory(storage.AuditEvent{Event: RestoredEvent, Actor: userID.String()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("domain: %s of user: %s restored", domainName, userID)
+	return nil
+}
+
+// ListPurgeableDomains returns the deleted domains whose retention has ended
+func (s *Service) ListPurgeableDomains(ctx context.Context) ([]storage.DomainRecord, error) {
+	return s.verifierStore.ListDeletedDomains(ctx, time.Now())
+}
+
+// PurgeDomain removes a deleted domain for good if it hasn't changed since it was listed, so a restore racing the
+// purger wins. Domains that aren't deleted are refused.
+func (s *Service) PurgeDomain(ctx context.Context, record storage.DomainRecord) error {
+	domainName := record.Domain.DomainName
+	if record.Deleted == nil {
+		return fmt.Errorf("domain: %s %w", domainName, ErrDomainNotDeleted)
+	}
+	err := s.verifierStore.DeleteDomainRecord(ctx, record)
+	if errors.Is(err, storage.ErrVersionConflict) {
+		return fmt.Errorf("domain: %s changed while purging it: %w", domainName, err)
+	}
+	return err
+}
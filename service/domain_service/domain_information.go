@@ -7,10 +7,13 @@ import (
 	"github.com/edwinavalos/common/config"
 	"github.com/edwinavalos/common/logger"
 	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/service/notification_service"
 	"github.com/edwinavalos/dns-verifier/storage"
 	"github.com/edwinavalos/dns-verifier/utils"
 	"github.com/google/uuid"
 	"net"
+	"time"
 )
 
 var (
@@ -20,17 +23,24 @@ var (
 )
 
 type Service struct {
-	verifierStore *storage.VerifierDataStore
+	verifierStore storage.DomainStore
 	cfg           *config.Config
+	claimPolicy   string
+	notifications *notification_service.Service
+	retention     time.Duration
+	expiry        appconfig.VerificationExpirySettings
 }
 
 type ServiceOpt func(s *Service)
 
-func New(conf *config.Config, store *storage.VerifierDataStore, opts ...ServiceOpt) *Service {
+func New(conf *config.Config, store storage.DomainStore, opts ...ServiceOpt) *Service {
 	s := &Service{
 		verifierStore: store,
 		cfg:           conf,
+		claimPolicy:   ClaimPolicyFirstVerified,
+		retention:     defaultRetention,
 	}
+	WithVerificationExpiry(appconfig.VerificationExpirySettings{})(s)
 	for _, opt := range opts {
 		opt(s)
 	}
@@ -55,32 +65,38 @@ func (s *Service) GetUserDomains(ctx context.Context, userId uuid.UUID) (map[str
 	return s.verifierStore.GetUserDomains(ctx, userId)
 }
 
-func (s *Service) GetDomainByUser(ctx context.Context, userID uuid.UUID, domain string) (models.DomainInformation, error) {
-	return s.verifierStore.GetDomainByUser(ctx, userID, domain)
-}
-
-func (s *Service) PutDomain(ctx context.Context, domainInfo models.DomainInformation) error {
-	return s.verifierStore.PutDomainInfo(ctx, domainInfo)
+// ListDomains returns a page of the domains matching filter
+func (s *Service) ListDomains(ctx context.Context, filter storage.DomainFilter, limit int, cursor string) (storage.DomainPage, error) {
+	err := filter.Validate()
+	if err != nil {
+		return storage.DomainPage{}, err
+	}
+	return s.verifierStore.ListDomains(ctx, filter, limit, cursor)
 }
 
-func (s *Service) DeleteDomain(ctx context.Context, userID uuid.UUID, domainName string) error {
-	return s.verifierStore.DeleteDomain(ctx, userID, domainName)
+func (s *Service) GetDomainByUser(ctx context.Context, userID uuid.UUID, domain string) (models.DomainInformation, error) {
+	return s.verifierStore.GetDomainByUser(ctx, userID, domain)
 }
 
 func (s *Service) GenerateOwnershipKey(ctx context.Context, userID uuid.UUID, domainName string) (string, error) {
-	di, err := s.verifierStore.GetDomainByUser(ctx, userID, domainName)
-	if err != nil {
-		return "", err
-	}
-
-	di.Verification.Key = fmt.Sprintf("%s;%s;%s", s.cfg.VerificationTxtRecordName(), di.DomainName, utils.RandomString(30))
-	di.Verification.Zone = fmt.Sprintf(domainName + ".")
-	err = s.PutDomain(ctx, di)
+	key := fmt.Sprintf("%s;%s;%s", s.cfg.VerificationTxtRecordName(), domainName, utils.RandomString(30))
+	_, err := s.updateLiveRecord(ctx, userID, domainName, func(record *storage.DomainRecord) error {
+		record.Domain.Verification.Key = key
+		record.Domain.Verification.Zone = fmt.Sprintf(domainName + ".")
+		if !record.Domain.Verification.Verified {
+			s.startPending(record, time.Now())
+			expiresAt := time.Now().Add(s.expiry.KeyLifetime)
+			record.Pending.KeyExpiresAt = &expiresAt
+			record.Pending.KeyWarnedAt = nil
+		}
+		record.AddHistory(storage.AuditEvent{Event: KeyGeneratedEvent, Actor: userID.String()})
+		return nil
+	})
 	if err != nil {
 		return "", err
 	}
 
-	return di.Verification.Key, nil
+	return key, nil
 }
 
 func (s *Service) VerifyTXTRecord(ctx context.Context, verificationZone string, verificationKey string) (bool, error) {
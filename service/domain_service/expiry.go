@@ -0,0 +1,211 @@
+package domain_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/service/notification_service"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	defaultKeyLifetime   = 7 * 24 * time.Hour
+	defaultWarnBefore    = 24 * time.Hour
+	defaultSweepInterval = time.Hour
+
+	// systemActor makes changes that follow from DNS lookups rather than from a request
+	systemActor = "dns-verifier"
+	// expiryActor is the sweeper in the audit history and in tombstones
+	expiryActor = "verification_expiry"
+)
+
+// Audit history events
+const (
+	CreatedEvent       = "created"
+	KeyGeneratedEvent  = "key_generated"
+	VerifiedEvent      = "verified"
+	UnverifiedEvent    = "unverified"
+	KeyWarningEvent    = "key_expiry_warning"
+	KeyExpiredEvent    = "key_expired"
+	DeleteWarningEvent = "deletion_warning"
+	DeletedEvent       = "deleted"
+	RestoredEvent      = "restored"
+)
+
+var ErrNoVerificationKey = errors.New("no valid verification key, generate a new one")
+
+// errNothingDue stops an expiry update when the domain changed and nothing is due anymore
+var errNothingDue = errors.New("nothing due")
+
+// ExpiryResult counts what SweepPendingVerifications did
+type ExpiryResult struct {
+	KeyWarnings    int `json:"key_warnings"`
+	KeysExpired    int `json:"keys_expired"`
+	DeleteWarnings int `json:"delete_warnings"`
+	Deleted        int `json:"deleted"`
+	Failed         int `json:"failed"`
+}
+
+// WithVerificationExpiry sets how long verification keys are accepted and when never verified domains are deleted
+func WithVerificationExpiry(settings appconfig.VerificationExpirySettings) ServiceOpt {
+	return func(s *Service) {
+		if settings.KeyLifetime <= 0 {
+			settings.KeyLifetime = defaultKeyLifetime
+		}
+		if settings.WarnBefore <= 0 {
+			settings.WarnBefore = defaultWarnBefore
+		}
+		if settings.SweepInterval <= 0 {
+			settings.SweepInterval = defaultSweepInterval
+		}
+		s.expiry = settings
+	}
+}
+
+// startPending gives the record its own copy of the pending verification to change, starting one if it has none
+func (s *Service) startPending(record *storage.DomainRecord, now time.Time) {
+	if record.Pending == nil {
+		record.Pending = &storage.PendingVerification{Since: now}
+		return
+	}
+	pending := *record.Pending
+	record.Pending = &pending
+}
+
+// RunExpirySweeper expires pending verifications until ctx is done
+func (s *Service) RunExpirySweeper(ctx context.Context) {
+	ticker := time.NewTicker(s.expiry.SweepInterval)
+	defer ticker.Stop()
+	for {
+		result, err := s.SweepPendingVerifications(ctx)
+		if err != nil {
+			logger.Error("unable to sweep pending verifications: %s", err)
+		} else if result != (ExpiryResult{}) {
+			logger.Info("pending verifications: key warnings: %d keys expired: %d deletion warnings: %d deleted: %d failed: %d",
+				result.KeyWarnings, result.KeysExpired, result.DeleteWarnings, result.Deleted, result.Failed)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// SweepPendingVerifications warns owners of keys and domains about to expire, expires keys past their lifetime and
+// deletes domains that were never verified when delete_unverified_after is set. Deleted domains go through the
+// normal retention and can be restored.
+func (s *Service) SweepPendingVerifications(ctx context.Context) (ExpiryResult, error) {
+	return s.sweepPendingVerifications(ctx, time.Now())
+}
+
+func (s *Service) sweepPendingVerifications(ctx context.Context, now time.Time) (ExpiryResult, error) {
+	var result ExpiryResult
+	records, err := s.verifierStore.ListPendingDomains(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	for _, record := range records {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		// Most domains have nothing due, checking a copy first saves them a write
+		if len(s.expirePending(&record, now)) == 0 {
+			continue
+		}
+
+		var notifications []notification_service.Notification
+		_, err = s.updateLiveRecord(ctx, record.Domain.UserID, record.DomainName, func(record *storage.DomainRecord) error {
+			notifications = s.expirePending(record, now)
+			if len(notifications) == 0 {
+				return errNothingDue
+			}
+			return nil
+		})
+		if errors.Is(err, errNothingDue) || errors.Is(err, ErrDomainDeleted) {
+			continue
+		}
+		if err != nil {
+			logger.Error("domain: %s of user: %s unable to expire pending verification: %s", record.DomainName, record.UserID, err)
+			result.Failed++
+			continue
+		}
+
+		for _, notification := range notifications {
+			switch notification.Kind {
+			case notification_service.VerificationExpiring:
+				result.KeyWarnings++
+			case notification_service.VerificationExpired:
+				result.KeysExpired++
+			case notification_service.DomainExpiring:
+				result.DeleteWarnings++
+			case notification_service.DomainExpired:
+				result.Deleted++
+			}
+			s.notifications.Notify(ctx, notification)
+		}
+	}
+	return result, nil
+}
+
+// expirePending applies whatever is due on a pending domain and returns the notifications for its owner
+func (s *Service) expirePending(record *storage.DomainRecord, now time.Time) []notification_service.Notification {
+	if record.Pending == nil || record.Domain.Verification.Verified {
+		return nil
+	}
+	s.startPending(record, now)
+	pending := record.Pending
+	notify := func(kind notification_service.Kind, message string) notification_service.Notification {
+		return notification_service.Notification{
+			Kind:    kind,
+			UserID:  record.Domain.UserID,
+			Domain:  record.DomainName,
+			Message: message,
+		}
+	}
+
+	var notifications []notification_service.Notification
+	if s.expiry.DeleteUnverifiedAfter > 0 {
+		deleteAt := pending.Since.Add(s.expiry.DeleteUnverifiedAfter)
+		if !now.Before(deleteAt) {
+			s.tombstone(record, expiryActor, "never verified", now)
+			return append(notifications, notify(notification_service.DomainExpired,
+				fmt.Sprintf("%s was deleted because it was never verified, it can be restored until %s", record.DomainName, record.Deleted.PurgeAfter.Format(time.RFC3339))))
+		}
+		if pending.DeleteWarnedAt == nil && !now.Before(deleteAt.Add(-s.expiry.WarnBefore)) {
+			pending.DeleteWarnedAt = &now
+			record.AddHistory(storage.AuditEvent{At: now, Event: DeleteWarningEvent, Actor: expiryActor})
+			notifications = append(notifications, notify(notification_service.DomainExpiring,
+				fmt.Sprintf("%s will be deleted at %s unless it is verified", record.DomainName, deleteAt.Format(time.RFC3339))))
+		}
+	}
+
+	if pending.KeyExpiresAt != nil {
+		expiresAt := *pending.KeyExpiresAt
+		if !now.Before(expiresAt) {
+			record.Domain.Verification.Key = ""
+			record.Domain.Verification.Zone = ""
+			pending.KeyExpiresAt = nil
+			pending.KeyWarnedAt = nil
+			record.AddHistory(storage.AuditEvent{At: now, Event: KeyExpiredEvent, Actor: expiryActor})
+			notifications = append(notifications, notify(notification_service.VerificationExpired,
+				fmt.Sprintf("the verification key of %s expired, generate a new one to verify it", record.DomainName)))
+		} else if pending.KeyWarnedAt == nil && !now.Before(expiresAt.Add(-s.expiry.WarnBefore)) {
+			pending.KeyWarnedAt = &now
+			record.AddHistory(storage.AuditEvent{At: now, Event: KeyWarningEvent, Actor: expiryActor})
+			notifications = append(notifications, notify(notification_service.VerificationExpiring,
+				fmt.Sprintf("the verification key of %s expires at %s", record.DomainName, expiresAt.Format(time.RFC3339))))
+		}
+	}
+	return notifications
+}
+
+// GetDomainHistory returns the audit history of a domain, deleted domains included until they are purged
+func (s *Service) GetDomainHistory(ctx context.Context, userID uuid.UUID, domainName string) (storage.DomainRecord, error) {
+	return s.verifierStore.GetDomainRecord(ctx, userID, domainName)
+}
@@ -0,0 +1,208 @@
+package domain_service
+
+import (
+	"context"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+var expirySince = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	testKeyLifetime = 7 * 24 * time.Hour
+	testDeleteAfter = 30 * 24 * time.Hour
+	testRetention   = 48 * time.Hour
+)
+
+func newExpiryTestService(t *testing.T) (*Service, *storage.MemoryDomainStore) {
+	t.Helper()
+	return newTestService(t,
+		WithRetention(testRetention),
+		WithVerificationExpiry(appconfig.VerificationExpirySettings{
+			KeyLifetime:           testKeyLifetime,
+			WarnBefore:            24 * time.Hour,
+			DeleteUnverifiedAfter: testDeleteAfter,
+		}))
+}
+
+// putPendingDomain stores a domain that has waited since expirySince, with a key that expires after testKeyLifetime
+func putPendingDomain(t *testing.T, store *storage.MemoryDomainStore, userID uuid.UUID, domainName string, verified bool) {
+	t.Helper()
+	keyExpiresAt := expirySince.Add(testKeyLifetime)
+	_, err := store.PutDomainRecord(context.Background(), storage.DomainRecord{
+		Domain: models.DomainInformation{
+			DomainName:   domainName,
+			UserID:       userID,
+			Verification: models.Verification{Key: "key", Zone: "zone", Verified: verified},
+		},
+		Pending: &storage.PendingVerification{Since: expirySince, KeyExpiresAt: &keyExpiresAt},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func lastEvent(record storage.DomainRecord) string {
+	if len(record.History) == 0 {
+		return ""
+	}
+	return record.History[len(record.History)-1].Event
+}
+
+func TestSweepPendingVerifications(t *testing.T) {
+	tests := []struct {
+		name   string
+		now    time.Time
+		want   ExpiryResult
+		verify func(t *testing.T, record storage.DomainRecord, now time.Time)
+	}{
+		{
+			name: "nothing due",
+			now:  expirySince.Add(24 * time.Hour),
+			verify: func(t *testing.T, record storage.DomainRecord, now time.Time) {
+				if record.Version != 1 || record.Pending.KeyWarnedAt != nil {
+					t.Fatalf("record was written: version %d pending %+v", record.Version, record.Pending)
+				}
+			},
+		},
+		{
+			name: "key warning",
+			now:  expirySince.Add(testKeyLifetime - time.Hour),
+			want: ExpiryResult{KeyWarnings: 1},
+			verify: func(t *testing.T, record storage.DomainRecord, now time.Time) {
+				if record.Pending.KeyWarnedAt == nil || !record.Pending.KeyWarnedAt.Equal(now) {
+					t.Fatalf("key warned at: %v, want %s", record.Pending.KeyWarnedAt, now)
+				}
+				if record.Domain.Verification.Key != "key" {
+					t.Fatal("the key was cleared before it expired")
+				}
+				if lastEvent(record) != KeyWarningEvent {
+					t.Fatalf("last event: %s, want %s", lastEvent(record), KeyWarningEvent)
+				}
+			},
+		},
+		{
+			name: "key expiry",
+			now:  expirySince.Add(testKeyLifetime),
+			want: ExpiryResult{KeysExpired: 1},
+			verify: func(t *testing.T, record storage.DomainRecord, now time.Time) {
+				if record.Domain.Verification.Key != "" || record.Domain.Verification.Zone != "" {
+					t.Fatalf("verification: %+v, want the key and zone cleared", record.Domain.Verification)
+				}
+				if record.Pending.KeyExpiresAt != nil || record.Pending.KeyWarnedAt != nil {
+					t.Fatalf("pending: %+v", record.Pending)
+				}
+				if !record.Pending.Since.Equal(expirySince) {
+					t.Fatalf("pending since moved to %s", record.Pending.Since)
+				}
+				if lastEvent(record) != KeyExpiredEvent {
+					t.Fatalf("last event: %s, want %s", lastEvent(record), KeyExpiredEvent)
+				}
+			},
+		},
+		{
+			name: "delete warning",
+			now:  expirySince.Add(testDeleteAfter - time.Hour),
+			want: ExpiryResult{KeysExpired: 1, DeleteWarnings: 1},
+			verify: func(t *testing.T, record storage.DomainRecord, now time.Time) {
+				if record.Pending.DeleteWarnedAt == nil || !record.Pending.DeleteWarnedAt.Equal(now) {
+					t.Fatalf("delete warned at: %v, want %s", record.Pending.DeleteWarnedAt, now)
+				}
+				if record.Deleted != nil {
+					t.Fatal("domain was deleted before it was due")
+				}
+			},
+		},
+		{
+			name: "deletion",
+			now:  expirySince.Add(testDeleteAfter),
+			want: ExpiryResult{Deleted: 1},
+			verify: func(t *testing.T, record storage.DomainRecord, now time.Time) {
+				if record.Deleted == nil {
+					t.Fatal("domain wasn't deleted")
+				}
+				if record.Deleted.DeletedBy != expiryActor || !record.Deleted.DeletedAt.Equal(now) || !record.Deleted.PurgeAfter.Equal(now.Add(testRetention)) {
+					t.Fatalf("tombstone: %+v", record.Deleted)
+				}
+				if lastEvent(record) != DeletedEvent {
+					t.Fatalf("last event: %s, want %s", lastEvent(record), DeletedEvent)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, store := newExpiryTestService(t)
+			userID := uuid.New()
+			putPendingDomain(t, store, userID, "example.com", false)
+
+			result, err := s.sweepPendingVerifications(ctx, test.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != test.want {
+				t.Fatalf("result: %+v, want %+v", result, test.want)
+			}
+			record, err := store.GetDomainRecord(ctx, userID, "example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.verify(t, record, test.now)
+
+			// A second sweep at the same time has nothing left to do
+			result, err = s.sweepPendingVerifications(ctx, test.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result != (ExpiryResult{}) {
+				t.Fatalf("second sweep: %+v, want nothing", result)
+			}
+		})
+	}
+}
+
+func TestSweepLeavesVerifiedDomainAlone(t *testing.T) {
+	ctx := context.Background()
+	s, store := newExpiryTestService(t)
+	userID := uuid.New()
+	putPendingDomain(t, store, userID, "example.com", true)
+
+	result, err := s.sweepPendingVerifications(ctx, expirySince.Add(testDeleteAfter+time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (ExpiryResult{}) {
+		t.Fatalf("result: %+v, want nothing", result)
+	}
+	record, err := store.GetDomainRecord(ctx, userID, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Version != 1 || record.Deleted != nil || record.Domain.Verification.Key != "key" {
+		t.Fatalf("verified domain was changed: %+v", record)
+	}
+}
+
+func TestExpirePendingDoesNotChangeTheStoredPending(t *testing.T) {
+	s, _ := newExpiryTestService(t)
+	keyExpiresAt := expirySince.Add(testKeyLifetime)
+	pending := &storage.PendingVerification{Since: expirySince, KeyExpiresAt: &keyExpiresAt}
+	record := storage.DomainRecord{
+		Domain:  models.DomainInformation{DomainName: "example.com", UserID: uuid.New()},
+		Pending: pending,
+	}
+
+	notifications := s.expirePending(&record, expirySince.Add(testKeyLifetime-time.Hour))
+	if len(notifications) != 1 {
+		t.Fatalf("notifications: %+v, want the key warning", notifications)
+	}
+	// The sweep checks a copy of every record first, that check mustn't leak into the record it copied
+	if pending.KeyWarnedAt != nil || record.Pending == pending {
+		t.Fatal("expirePending changed the pending verification it was given")
+	}
+}
@@ -0,0 +1,107 @@
+package domain_service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"time"
+)
+
+// maxUpdateAttempts bounds how often UpdateDomain re-reads a domain that keeps changing under it
+const maxUpdateAttempts = 3
+
+var ErrDomainExists = errors.New("domain already exists")
+
+// UpdateDomain applies mutate to the current domain and writes it if nobody else changed it in between, otherwise it
+// reads the domain again and re-applies mutate. mutate must only set the fields it is responsible for so that
+// applying it to a newer domain keeps the other request's changes. Deleted domains can't be updated.
+func (s *Service) UpdateDomain(ctx context.Context, userID uuid.UUID, domainName string, mutate func(di *models.DomainInformation) error) (models.DomainInformation, error) {
+	record, err := s.updateLiveRecord(ctx, userID, domainName, func(record *storage.DomainRecord) error {
+		return mutate(&record.Domain)
+	})
+	if err != nil {
+		return models.DomainInformation{}, err
+	}
+	return record.Domain, nil
+}
+
+// updateLiveRecord refuses deleted domains and keeps the pending verification and the history in step with the
+// verified flag
+func (s *Service) updateLiveRecord(ctx context.Context, userID uuid.UUID, domainName string, mutate func(record *storage.DomainRecord) error) (storage.DomainRecord, error) {
+	return s.updateRecord(ctx, userID, domainName, func(record *storage.DomainRecord) error {
+		if record.Deleted != nil {
+			return fmt.Errorf("domain: %s %w", domainName, ErrDomainDeleted)
+		}
+		wasVerified := record.Domain.Verification.Verified
+		err := mutate(record)
+		if err != nil {
+			return err
+		}
+
+		switch verified := record.Domain.Verification.Verified; {
+		case verified && !wasVerified:
+			record.Pending = nil
+			record.AddHistory(storage.AuditEvent{Event: VerifiedEvent, Actor: systemActor})
+		case !verified && wasVerified:
+			s.startPending(record, time.Now())
+			record.AddHistory(storage.AuditEvent{Event: UnverifiedEvent, Actor: systemActor})
+		}
+		return nil
+	})
+}
+
+// updateRecord is the retry loop behind UpdateDomain, mutate gets the whole record so it can change the tombstone
+func (s *Service) updateRecord(ctx context.Context, userID uuid.UUID, domainName string, mutate func(record *storage.DomainRecord) error) (storage.DomainRecord, error) {
+	var err error
+	for attempt := 1; attempt <= maxUpdateAttempts; attempt++ {
+		var record storage.DomainRecord
+		record, err = s.verifierStore.GetDomainRecord(ctx, userID, domainName)
+		if err != nil {
+			return storage.DomainRecord{}, err
+		}
+		err = mutate(&record)
+		if err != nil {
+			return storage.DomainRecord{}, err
+		}
+
+		record, err = s.verifierStore.PutDomainRecord(ctx, record)
+		if err == nil {
+			return record, nil
+		}
+		if !errors.Is(err, storage.ErrVersionConflict) {
+			return storage.DomainRecord{}, err
+		}
+		logger.Info("domain: %s changed while updating it, attempt: %d of %d", domainName, attempt, maxUpdateAttempts)
+	}
+	return storage.DomainRecord{}, err
+}
+
+// CreateDomain adds a domain for a user, it returns ErrDomainExists instead of overwriting one and ErrDomainDeleted
+// for a deleted domain that has to be restored or purged first
+func (s *Service) CreateDomain(ctx context.Context, domainInfo models.DomainInformation) error {
+	record, err := s.verifierStore.GetDomainRecord(ctx, domainInfo.UserID, domainInfo.DomainName)
+	if err == nil {
+		if record.Deleted != nil {
+			return fmt.Errorf("domain: %s %w", domainInfo.DomainName, ErrDomainDeleted)
+		}
+		return fmt.Errorf("domain: %s %w", domainInfo.DomainName, ErrDomainExists)
+	}
+	if !errors.Is(err, storage.ErrDomainNotFound) {
+		return err
+	}
+
+	record = storage.DomainRecord{Domain: domainInfo}
+	if !domainInfo.Verification.Verified {
+		s.startPending(&record, time.Now())
+	}
+	record.AddHistory(storage.AuditEvent{Event: CreatedEvent, Actor: domainInfo.UserID.String()})
+	_, err = s.verifierStore.PutDomainRecord(ctx, record)
+	if errors.Is(err, storage.ErrVersionConflict) {
+		return fmt.Errorf("domain: %s %w", domainInfo.DomainName, ErrDomainExists)
+	}
+	return err
+}
@@ -0,0 +1,128 @@
+package domain_service
+
+import (
+	"context"
+	"errors"
+	"github.com/edwinavalos/common/models"
+	"github.com/edwinavalos/dns-verifier/storage"
+	"github.com/google/uuid"
+	"testing"
+)
+
+// racingStore lets another request change the record right before each of the first races writes, so that the
+// write conflicts
+type racingStore struct {
+	*storage.MemoryDomainStore
+	races  int
+	puts   int
+	getErr error
+}
+
+func (r *racingStore) GetDomainRecord(ctx context.Context, userID uuid.UUID, domain string) (storage.DomainRecord, error) {
+	if r.getErr != nil {
+		return storage.DomainRecord{}, r.getErr
+	}
+	return r.MemoryDomainStore.GetDomainRecord(ctx, userID, domain)
+}
+
+func (r *racingStore) PutDomainRecord(ctx context.Context, record storage.DomainRecord) (storage.DomainRecord, error) {
+	r.puts++
+	if r.races > 0 {
+		r.races--
+		current, err := r.MemoryDomainStore.GetDomainRecord(ctx, record.Domain.UserID, record.Domain.DomainName)
+		if err == nil {
+			current.Domain.Verification.Zone = "zone-" + uuid.NewString()
+			_, err = r.MemoryDomainStore.PutDomainRecord(ctx, current)
+		}
+		if err != nil {
+			return storage.DomainRecord{}, err
+		}
+	}
+	return r.MemoryDomainStore.PutDomainRecord(ctx, record)
+}
+
+func newRacingService(t *testing.T, userID uuid.UUID) (*Service, *racingStore) {
+	t.Helper()
+	store := &racingStore{MemoryDomainStore: storage.NewMemoryDomainStore()}
+	s := New(nil, store)
+	createTestDomain(t, s, userID, "example.com")
+	store.puts = 0
+	return s, store
+}
+
+func TestUpdateDomainRetriesConflicts(t *testing.T) {
+	userID := uuid.New()
+	s, store := newRacingService(t, userID)
+	store.races = maxUpdateAttempts - 1
+
+	di, err := s.UpdateDomain(context.Background(), userID, "example.com", setVerified(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.puts != maxUpdateAttempts {
+		t.Errorf("expected %d writes, got %d", maxUpdateAttempts, store.puts)
+	}
+	if !di.Verification.Verified || di.Verification.Zone == "" {
+		t.Errorf("expected the update to keep the other request's change, got %+v", di.Verification)
+	}
+}
+
+func TestUpdateDomainGivesUpOnConflicts(t *testing.T) {
+	userID := uuid.New()
+	s, store := newRacingService(t, userID)
+	store.races = maxUpdateAttempts
+
+	_, err := s.UpdateDomain(context.Background(), userID, "example.com", setVerified(true))
+	if !errors.Is(err, storage.ErrVersionConflict) {
+		t.Fatalf("expected ErrVersionConflict, got %v", err)
+	}
+	di, err := store.GetDomainByUser(context.Background(), userID, "example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if di.Verification.Verified {
+		t.Error("expected the update not to be written")
+	}
+}
+
+func TestCreateDomainDoesNotOverwrite(t *testing.T) {
+	userID := uuid.New()
+	s, store := newRacingService(t, userID)
+
+	err := s.CreateDomain(context.Background(), models.DomainInformation{DomainName: "example.com", UserID: userID})
+	if !errors.Is(err, ErrDomainExists) {
+		t.Fatalf("expected ErrDomainExists, got %v", err)
+	}
+
+	store.getErr = errors.New("store unavailable")
+	err = s.CreateDomain(context.Background(), models.DomainInformation{DomainName: "other.example.com", UserID: userID})
+	if !errors.Is(err, store.getErr) {
+		t.Fatalf("expected the read error, got %v", err)
+	}
+	if store.puts != 0 {
+		t.Errorf("expected no writes, got %d", store.puts)
+	}
+}
+
+// createRacingStore lets another request create the domain right before a new domain is written
+type createRacingStore struct {
+	*storage.MemoryDomainStore
+}
+
+func (c *createRacingStore) PutDomainRecord(ctx context.Context, record storage.DomainRecord) (storage.DomainRecord, error) {
+	if record.Version == 0 {
+		_, err := c.MemoryDomainStore.PutDomainRecord(ctx, storage.DomainRecord{Domain: record.Domain})
+		if err != nil {
+			return storage.DomainRecord{}, err
+		}
+	}
+	return c.MemoryDomainStore.PutDomainRecord(ctx, record)
+}
+
+func TestCreateDomainLosesRaceToAnotherCreate(t *testing.T) {
+	s := New(nil, &createRacingStore{MemoryDomainStore: storage.NewMemoryDomainStore()})
+	err := s.CreateDomain(context.Background(), models.DomainInformation{DomainName: "example.com", UserID: uuid.New()})
+	if !errors.Is(err, ErrDomainExists) {
+		t.Fatalf("expected ErrDomainExists, got %v", err)
+	}
+}
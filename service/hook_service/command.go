@@ -0,0 +1,70 @@
+package hook_service
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"os"
+	"os/exec"
+	"time"
+)
+
+const (
+	defaultCommandTimeout = 30 * time.Second
+	// maxCommandOutput is how much of the command's output ends up in an error
+	maxCommandOutput = 1024
+)
+
+// CommandHook runs a local command with the certificate passed in DNS_VERIFIER_* environment variables. The private key
+// is never put in the environment, pair this with the pem_directory hook if the command needs it.
+type CommandHook struct {
+	path    string
+	args    []string
+	timeout time.Duration
+}
+
+func NewCommandHook(settings appconfig.CommandHookSettings) *CommandHook {
+	hook := &CommandHook{
+		path:    settings.Path,
+		args:    settings.Args,
+		timeout: settings.Timeout,
+	}
+	if hook.timeout <= 0 {
+		hook.timeout = defaultCommandTimeout
+	}
+	return hook
+}
+
+func (h *CommandHook) Name() string {
+	return "command"
+}
+
+func (h *CommandHook) Run(ctx context.Context, event Event) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.path, h.args...)
+	cmd.Env = append(os.Environ(),
+		"DNS_VERIFIER_DOMAIN="+event.Domain,
+		"DNS_VERIFIER_USER_ID="+event.UserID.String(),
+		"DNS_VERIFIER_CA_PROFILE="+event.CAProfile,
+		"DNS_VERIFIER_SERIAL_NUMBER="+event.SerialNumber,
+		"DNS_VERIFIER_NOT_BEFORE="+event.NotBefore.UTC().Format(time.RFC3339),
+		"DNS_VERIFIER_NOT_AFTER="+event.NotAfter.UTC().Format(time.RFC3339),
+		"DNS_VERIFIER_CERTIFICATE_PEM="+string(event.CertificatePEM),
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err != nil {
+		out := output.Bytes()
+		if len(out) > maxCommandOutput {
+			out = out[len(out)-maxCommandOutput:]
+		}
+		return fmt.Errorf("%s failed: %w: %s", h.path, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package hook_service
+
+import (
+	"context"
+	"fmt"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Event describes a certificate that was just issued or renewed
+type Event struct {
+	Domain       string
+	UserID       uuid.UUID
+	CAProfile    string
+	SerialNumber string
+	NotBefore    time.Time
+	NotAfter     time.Time
+	// CertificatePEM is the full chain with the leaf first
+	CertificatePEM []byte
+	PrivateKeyPEM  []byte
+}
+
+// Hook deploys a certificate somewhere after it is issued, Run has to be safe to call again after a failure
+type Hook interface {
+	Name() string
+	Run(ctx context.Context, event Event) error
+}
+
+type Service struct {
+	hooks []Hook
+}
+
+func New(hooks ...Hook) *Service {
+	return &Service{
+		hooks: hooks,
+	}
+}
+
+// NewFromSettings builds the hooks that are configured
+func NewFromSettings(settings appconfig.HookSettings) (*Service, error) {
+	var hooks []Hook
+	if settings.PEMDirectory.Path != "" {
+		hook, err := NewPEMDirectoryHook(settings.PEMDirectory)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+	if settings.Command.Path != "" {
+		hooks = append(hooks, NewCommandHook(settings.Command))
+	}
+	if settings.Webhook.URL != "" {
+		hook, err := NewWebhookHook(settings.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, hook)
+	}
+
+	return New(hooks...), nil
+}
+
+// Names returns the names of the configured hooks
+func (s *Service) Names() []string {
+	var names []string
+	for _, hook := range s.hooks {
+		names = append(names, hook.Name())
+	}
+	return names
+}
+
+// Run runs the named hooks, or all of them when names is empty, and returns the outcome of each one by name
+func (s *Service) Run(ctx context.Context, event Event, names ...string) map[string]error {
+	results := map[string]error{}
+	for _, hook := range s.hooks {
+		if len(names) > 0 && !contains(names, hook.Name()) {
+			continue
+		}
+		err := hook.Run(ctx, event)
+		if err != nil {
+			err = fmt.Errorf("hook: %s: %w", hook.Name(), err)
+		}
+		results[hook.Name()] = err
+	}
+	return results
+}
+
+func contains[T comparable](elems []T, v T) bool {
+	for _, s := range elems {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
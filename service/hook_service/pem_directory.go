@@ -0,0 +1,148 @@
+package hook_service
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	defaultPEMFileMode = 0644
+	privateKeyFileMode = 0600
+)
+
+// PEMDirectoryHook writes the certificate as PEM files to <path>/<domain>/, every file is replaced with an atomic
+// rename so readers never see a half written certificate
+type PEMDirectoryHook struct {
+	path     string
+	ownerUID int
+	ownerGID int
+	fileMode os.FileMode
+}
+
+func NewPEMDirectoryHook(settings appconfig.PEMDirectoryHookSettings) (*PEMDirectoryHook, error) {
+	hook := &PEMDirectoryHook{
+		path:     settings.Path,
+		ownerUID: -1,
+		ownerGID: -1,
+		fileMode: defaultPEMFileMode,
+	}
+	if settings.OwnerUID != nil {
+		hook.ownerUID = *settings.OwnerUID
+	}
+	if settings.OwnerGID != nil {
+		hook.ownerGID = *settings.OwnerGID
+	}
+	if settings.FileMode != "" {
+		mode, err := strconv.ParseUint(settings.FileMode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pem_directory file_mode: %s: %w", settings.FileMode, err)
+		}
+		hook.fileMode = os.FileMode(mode)
+	}
+	return hook, nil
+}
+
+func (h *PEMDirectoryHook) Name() string {
+	return "pem_directory"
+}
+
+func (h *PEMDirectoryHook) Run(ctx context.Context, event Event) error {
+	dir := filepath.Join(h.path, filepath.Base(event.Domain))
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	leaf, chain, err := splitChain(event.CertificatePEM)
+	if err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+		mode os.FileMode
+	}{
+		{name: "cert.pem", data: leaf, mode: h.fileMode},
+		{name: "chain.pem", data: chain, mode: h.fileMode},
+		{name: "fullchain.pem", data: event.CertificatePEM, mode: h.fileMode},
+		{name: "privkey.pem", data: event.PrivateKeyPEM, mode: h.fileMode & privateKeyFileMode},
+	}
+	for _, file := range files {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		err = h.writeAtomic(filepath.Join(dir, file.name), file.data, file.mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *PEMDirectoryHook) writeAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write: %s: %w", path, err)
+	}
+
+	err = os.Chmod(tmpName, mode)
+	if err != nil {
+		return err
+	}
+	if h.ownerUID >= 0 || h.ownerGID >= 0 {
+		err = os.Chown(tmpName, h.ownerUID, h.ownerGID)
+		if err != nil {
+			return fmt.Errorf("unable to chown: %s: %w", path, err)
+		}
+	}
+
+	return os.Rename(tmpName, path)
+}
+
+// splitChain returns the leaf and the rest of a PEM chain
+func splitChain(chainPEM []byte) ([]byte, []byte, error) {
+	var leaf, chain []byte
+	rest := chainPEM
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, nil, fmt.Errorf("unable to parse certificate: %w", err)
+		}
+		if leaf == nil {
+			leaf = pem.EncodeToMemory(block)
+			continue
+		}
+		chain = append(chain, pem.EncodeToMemory(block)...)
+	}
+	if leaf == nil {
+		return nil, nil, fmt.Errorf("no certificate in chain")
+	}
+	return leaf, chain, nil
+}
@@ -0,0 +1,109 @@
+package hook_service
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultWebhookTimeout = 10 * time.Second
+	// SignatureHeader carries "sha256=<hex>", the HMAC-SHA256 of "<timestamp>.<body>" keyed with the webhook secret
+	SignatureHeader = "X-DNS-Verifier-Signature"
+	// TimestampHeader is the unix time the notification was signed at, receivers should reject old ones
+	TimestampHeader = "X-DNS-Verifier-Timestamp"
+)
+
+// WebhookPayload is the JSON body POSTed to the webhook, it never includes the private key
+type WebhookPayload struct {
+	Event          string    `json:"event"`
+	Domain         string    `json:"domain"`
+	UserID         string    `json:"user_id"`
+	CAProfile      string    `json:"ca_profile"`
+	SerialNumber   string    `json:"serial_number"`
+	NotBefore      time.Time `json:"not_before"`
+	NotAfter       time.Time `json:"not_after"`
+	CertificatePEM string    `json:"certificate_pem"`
+}
+
+// WebhookHook notifies a URL that a certificate was issued
+type WebhookHook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookHook refuses a webhook without a secret, receivers couldn't tell our notifications from anyone else's
+func NewWebhookHook(settings appconfig.WebhookHookSettings) (*WebhookHook, error) {
+	if settings.Secret == "" {
+		return nil, fmt.Errorf("webhook hook: %s needs a secret to sign notifications with", settings.URL)
+	}
+	timeout := settings.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &WebhookHook{
+		url:    settings.URL,
+		secret: []byte(settings.Secret),
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (h *WebhookHook) Name() string {
+	return "webhook"
+}
+
+func (h *WebhookHook) Run(ctx context.Context, event Event) error {
+	body, err := json.Marshal(WebhookPayload{
+		Event:          "certificate_issued",
+		Domain:         event.Domain,
+		UserID:         event.UserID.String(),
+		CAProfile:      event.CAProfile,
+		SerialNumber:   event.SerialNumber,
+		NotBefore:      event.NotBefore.UTC(),
+		NotAfter:       event.NotAfter.UTC(),
+		CertificatePEM: string(event.CertificatePEM),
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, "sha256="+Sign(h.secret, timestamp, body))
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with: %s", h.url, resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the hex HMAC-SHA256 receivers compare the signature header against
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,95 @@
+package notification_service
+
+import (
+	"context"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/google/uuid"
+	"time"
+)
+
+type Kind string
+
+const (
+	// ClaimSuperseded tells a user another user's verification of their domain replaced theirs
+	ClaimSuperseded Kind = "claim_superseded"
+	// ClaimAwarded tells a user an admin decided a contested domain is theirs
+	ClaimAwarded Kind = "claim_awarded"
+	// ClaimReviewRequested asks an admin to decide who a contested domain belongs to
+	ClaimReviewRequested Kind = "claim_review_requested"
+	// VerificationExpiring tells a user the verification key of their domain is about to expire
+	VerificationExpiring Kind = "verification_expiring"
+	// VerificationExpired tells a user the verification key of their domain expired
+	VerificationExpired Kind = "verification_expired"
+	// DomainExpiring tells a user their domain is about to be deleted for never being verified
+	DomainExpiring Kind = "domain_expiring"
+	// DomainExpired tells a user their domain was deleted for never being verified
+	DomainExpired Kind = "domain_expired"
+)
+
+// Notification is something a user, or an admin when UserID is nil, has to be told about
+type Notification struct {
+	Kind      Kind      `json:"kind"`
+	UserID    uuid.UUID `json:"user_id"`
+	Domain    string    `json:"domain"`
+	Message   string    `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Notifier delivers notifications, getting them to the user is up to whatever receives them
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, notification Notification) error
+}
+
+type Service struct {
+	notifiers []Notifier
+}
+
+func New(notifiers ...Notifier) *Service {
+	return &Service{
+		notifiers: notifiers,
+	}
+}
+
+// NewFromSettings always logs notifications and also POSTs them to the webhook when one is configured
+func NewFromSettings(settings appconfig.NotificationSettings) (*Service, error) {
+	notifiers := []Notifier{LogNotifier{}}
+	if settings.Webhook.URL != "" {
+		notifier, err := NewWebhookNotifier(settings.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	return New(notifiers...), nil
+}
+
+// Notify hands the notification to every notifier, failures are logged rather than returned because the change the
+// notification is about has already happened
+func (s *Service) Notify(ctx context.Context, notification Notification) {
+	if s == nil {
+		return
+	}
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = time.Now()
+	}
+	for _, notifier := range s.notifiers {
+		err := notifier.Notify(ctx, notification)
+		if err != nil {
+			logger.Error("domain: %s unable to send: %s notification with: %s: %s", notification.Domain, notification.Kind, notifier.Name(), err)
+		}
+	}
+}
+
+// LogNotifier writes notifications to the log
+type LogNotifier struct{}
+
+func (LogNotifier) Name() string {
+	return "log"
+}
+
+func (LogNotifier) Notify(ctx context.Context, notification Notification) error {
+	logger.Info("notification: %s user: %s domain: %s: %s", notification.Kind, notification.UserID, notification.Domain, notification.Message)
+	return nil
+}
@@ -0,0 +1,71 @@
+package notification_service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/edwinavalos/dns-verifier/service/hook_service"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultWebhookTimeout = 10 * time.Second
+
+// WebhookNotifier POSTs notifications as JSON, signed the same way as the certificate webhook
+type WebhookNotifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+// NewWebhookNotifier refuses a webhook without a secret, receivers couldn't tell our notifications from anyone else's
+func NewWebhookNotifier(settings appconfig.WebhookHookSettings) (*WebhookNotifier, error) {
+	if settings.Secret == "" {
+		return nil, fmt.Errorf("notification webhook: %s needs a secret to sign notifications with", settings.URL)
+	}
+	timeout := settings.Timeout
+	if timeout <= 0 {
+		timeout = defaultWebhookTimeout
+	}
+	return &WebhookNotifier{
+		url:    settings.URL,
+		secret: []byte(settings.Secret),
+		client: &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (w *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(hook_service.TimestampHeader, timestamp)
+	req.Header.Set(hook_service.SignatureHeader, "sha256="+hook_service.Sign(w.secret, timestamp, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with: %s", w.url, resp.Status)
+	}
+	return nil
+}
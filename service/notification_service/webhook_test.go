@@ -0,0 +1,21 @@
+package notification_service
+
+import (
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"testing"
+)
+
+func TestNewFromSettingsNeedsWebhookSecret(t *testing.T) {
+	_, err := NewFromSettings(appconfig.NotificationSettings{Webhook: appconfig.WebhookHookSettings{URL: "https://hooks.example.com"}})
+	if err == nil {
+		t.Fatal("expected a webhook without a secret to be refused")
+	}
+
+	s, err := NewFromSettings(appconfig.NotificationSettings{Webhook: appconfig.WebhookHookSettings{URL: "https://hooks.example.com", Secret: "whsec_test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.notifiers) != 2 {
+		t.Errorf("expected the log and webhook notifiers, got %d", len(s.notifiers))
+	}
+}
@@ -2,68 +2,37 @@ package storage
 
 import (
 	"context"
-	"fmt"
-	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
-	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 	"github.com/edwinavalos/common/config"
 	"github.com/edwinavalos/common/datastore/dynamo"
-	"github.com/edwinavalos/common/logger"
 	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
 	"github.com/google/uuid"
-	"time"
 )
 
 type VerifierDataStore struct {
 	*dynamo.Storage
 }
 
-func NewDataStore(conf *config.Config) (*VerifierDataStore, error) {
+// NewDataStore opens the storage table of the common config, creating it from tables when it doesn't exist yet
+func NewDataStore(conf *config.Config, tables appconfig.TableSettings) (*VerifierDataStore, error) {
 	storage, err := dynamo.New(conf)
-	err = storage.NewLockTable()
 	if err != nil {
 		return nil, err
 	}
+	err = storage.NewLockTable()
 	if err != nil {
 		return nil, err
 	}
-	exists, err := storage.TableExists()
-	if exists {
-		logger.Info("table: %s already exists, not creating", storage.TableName)
-		return &VerifierDataStore{
-			Storage: storage,
-		}, nil
-	}
-	createTableInput := &dynamodb.CreateTableInput{
-		AttributeDefinitions: []types.AttributeDefinition{
-			{
-				AttributeName: aws.String("user_id"),
-				AttributeType: types.ScalarAttributeTypeS,
-			},
-		},
-		KeySchema: []types.KeySchemaElement{
-			{
-				AttributeName: aws.String("user_id"),
-				KeyType:       types.KeyTypeHash,
-			},
-		},
-		TableName: aws.String(storage.TableName),
-		ProvisionedThroughput: &types.ProvisionedThroughput{
-			ReadCapacityUnits:  aws.Int64(10),
-			WriteCapacityUnits: aws.Int64(10),
-		},
-	}
 
-	_, err = storage.Client.CreateTable(context.TODO(), createTableInput)
+	err = ensureTable(context.TODO(), &storage.Client, tableDefinition{
+		name:       storage.TableName,
+		attributes: stringAttributes("user_id"),
+		keySchema:  hashKey("user_id"),
+	}, tables)
 	if err != nil {
-		return nil, fmt.Errorf("unable to create table: %w", err)
-	}
-	waiter := dynamodb.NewTableExistsWaiter(&storage.Client)
-	err = waiter.Wait(context.TODO(), &dynamodb.DescribeTableInput{
-		TableName: aws.String(storage.TableName)}, 5*time.Minute)
-	if err != nil {
-		return nil, fmt.Errorf("wait for table exists failed: %w", err)
+		return nil, err
 	}
 
 	return &VerifierDataStore{Storage: storage}, nil
@@ -87,14 +56,50 @@ func (v *VerifierDataStore) GetUser(ctx context.Context, userID uuid.UUID) (mode
 		return userInfo, err
 	}
 
-	err = attributevalue.UnmarshalMap(output.Item, &userInfo)
+	userInfo, _, err = unmarshalLegacyUser(output.Item)
 	if err != nil {
 		return models.User{}, err
 	}
+	if userInfo.ID == "" {
+		userInfo.ID = userID.String()
+	}
 
 	return userInfo, nil
 }
 
+// unmarshalLegacyUser reads a user item with its nested domains upgraded to the current schema, the records carry
+// what the upgrade found that the nested map has no place for
+func unmarshalLegacyUser(item map[string]types.AttributeValue) (models.User, []DomainRecord, error) {
+	var user models.User
+	err := attributevalue.UnmarshalMap(item, &user)
+	if err != nil {
+		return models.User{}, nil, err
+	}
+
+	var storedDomains map[string]types.AttributeValue
+	if domainsAV, ok := item["Domains"].(*types.AttributeValueMemberM); ok {
+		storedDomains = domainsAV.Value
+	}
+	var records []DomainRecord
+	for name, domainInfo := range user.Domains {
+		record := DomainRecord{UserID: user.ID, DomainName: name, Domain: domainInfo}
+		stored, ok := storedDomains[name]
+		err = upgradeRecord(func(v any) error {
+			if !ok {
+				return nil
+			}
+			return attributevalue.Unmarshal(stored, v)
+		}, &record)
+		if err != nil {
+			return models.User{}, nil, err
+		}
+		user.Domains[name] = record.Domain
+		records = append(records, record)
+	}
+	sortRecords(records)
+	return user, records, nil
+}
+
 func (v *VerifierDataStore) GetDomainByUser(ctx context.Context, userID uuid.UUID, domain string) (models.DomainInformation, error) {
 	userInfo, err := v.GetUser(ctx, userID)
 	if err != nil {
@@ -107,7 +112,7 @@ func (v *VerifierDataStore) GetDomainByUser(ctx context.Context, userID uuid.UUI
 		}
 	}
 
-	return models.DomainInformation{}, fmt.Errorf("user: %s does not have a domain entry for: %s", userID, domain)
+	return models.DomainInformation{}, domainNotFound(userID, domain)
 }
 
 func (v *VerifierDataStore) PutDomainInfo(ctx context.Context, domainInfo models.DomainInformation) error {
@@ -148,26 +153,50 @@ func (v *VerifierDataStore) DeleteDomain(ctx context.Context, userID uuid.UUID,
 	}
 
 	delete(userInfo.Domains, domainName)
-	return nil
+	item, err := attributevalue.MarshalMap(userInfo)
+	if err != nil {
+		return err
+	}
+	ctx = context.WithValue(ctx, "lock_key", userInfo.ID)
+	return v.Storage.PutItem(ctx, item)
 }
 
 func (v *VerifierDataStore) GetAllRecords(ctx context.Context) ([]models.User, error) {
 	var retRecords []models.User
+	err := v.scanUsers(ctx, func(user models.User, _ []DomainRecord) {
+		retRecords = append(retRecords, user)
+	})
+	if err != nil {
+		return []models.User{}, err
+	}
+
+	return retRecords, nil
+}
+
+// scanUsers calls fn with every user item and the records of its domains
+func (v *VerifierDataStore) scanUsers(ctx context.Context, fn func(user models.User, records []DomainRecord)) error {
 	records, err := v.Storage.GetAllRecords(ctx)
 	if err != nil {
-		return retRecords, err
+		return err
 	}
 
 	for _, record := range records {
 		for _, item := range record.Items {
-			user := models.User{}
-			err = attributevalue.UnmarshalMap(item, &user)
+			user, domainRecords, err := unmarshalLegacyUser(item)
 			if err != nil {
-				return []models.User{}, err
+				return err
 			}
-			retRecords = append(retRecords, user)
+			fn(user, domainRecords)
 		}
 	}
+	return nil
+}
 
-	return retRecords, nil
+// GetDomainsByName has to scan every user item, the per-domain table has an index for it
+func (v *VerifierDataStore) GetDomainsByName(ctx context.Context, domainName string) ([]models.DomainInformation, error) {
+	users, err := v.GetAllRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return domainsByName(users, domainName), nil
 }
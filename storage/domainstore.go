@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/config"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	DynamoDBBackend = "dynamodb"
+	MemoryBackend   = "memory"
+	SQLBackend      = "sql"
+)
+
+// DomainStore is what the services need from the database that holds users and their domains. A user without any
+// domains is returned empty rather than as an error so that their first domain can be put.
+type DomainStore interface {
+	GetUser(ctx context.Context, userID uuid.UUID) (models.User, error)
+	GetDomainByUser(ctx context.Context, userID uuid.UUID, domain string) (models.DomainInformation, error)
+	PutDomainInfo(ctx context.Context, domainInfo models.DomainInformation) error
+	GetUserDomains(ctx context.Context, userID uuid.UUID) (map[string]models.DomainInformation, error)
+	// DeleteDomain removes the domain for good, soft deletes are a PutDomainRecord with a Tombstone
+	DeleteDomain(ctx context.Context, userID uuid.UUID, domainName string) error
+	// DeleteDomainRecord removes a record for good if it is still at record's version, otherwise it returns a
+	// *ConflictError
+	DeleteDomainRecord(ctx context.Context, record DomainRecord) error
+	GetAllRecords(ctx context.Context) ([]models.User, error)
+	// GetDomainsByName returns the claims every user has on a domain name
+	GetDomainsByName(ctx context.Context, domainName string) ([]models.DomainInformation, error)
+	// ListDomains returns the domains matching filter a page at a time, cursor is the NextCursor of the previous page
+	ListDomains(ctx context.Context, filter DomainFilter, limit int, cursor string) (DomainPage, error)
+	// GetDomainRecord returns a domain with the version PutDomainRecord has to be given to change it
+	GetDomainRecord(ctx context.Context, userID uuid.UUID, domain string) (DomainRecord, error)
+	// PutDomainRecord writes the domain if its stored version is still record.Version, a version of 0 expects the
+	// domain not to exist yet. It returns the record with its new version or a *ConflictError.
+	PutDomainRecord(ctx context.Context, record DomainRecord) (DomainRecord, error)
+	// ListDeletedDomains returns the soft deleted domains whose retention ended before purgeBefore
+	ListDeletedDomains(ctx context.Context, purgeBefore time.Time) ([]DomainRecord, error)
+	// ListPendingDomains returns the domains that are waiting to be verified and aren't deleted
+	ListPendingDomains(ctx context.Context) ([]DomainRecord, error)
+	// ListDomainRecords returns every record, deleted ones included, for backups
+	ListDomainRecords(ctx context.Context) ([]DomainRecord, error)
+	// GetNameClaim returns who holds the verified claim on a domain name, a zero NameClaim when nobody does
+	GetNameClaim(ctx context.Context, domainName string) (NameClaim, error)
+	// SwapNameClaim hands the claim on a domain name to holder if previous still holds it, uuid.Nil stands for
+	// nobody on either side. It returns ErrNameClaimChanged when another request swapped it first.
+	SwapNameClaim(ctx context.Context, domainName string, previous uuid.UUID, holder uuid.UUID) error
+}
+
+// DomainRecord is one domain of one user, user_id is the partition key and domain_name the sort key so that writes
+// to one domain don't touch the others of the user
+type DomainRecord struct {
+	UserID     string                   `dynamodbav:"user_id" json:"user_id"`
+	DomainName string                   `dynamodbav:"domain_name" json:"domain_name"`
+	Domain     models.DomainInformation `dynamodbav:"domain" json:"domain"`
+	// Version counts the writes to the domain, records written before it existed are at 0
+	Version   int64     `dynamodbav:"version" json:"version"`
+	UpdatedAt time.Time `dynamodbav:"updated_at" json:"updated_at"`
+	// Deleted is set on soft deleted domains, which every other read treats as gone
+	Deleted *Tombstone `dynamodbav:"deleted,omitempty" json:"deleted,omitempty"`
+	// Pending is set while the domain waits to be verified, domains from before it existed never expire
+	Pending *PendingVerification `dynamodbav:"pending,omitempty" json:"pending,omitempty"`
+	// History is the audit history of the domain, oldest first and capped at MaxHistoryEvents
+	History []AuditEvent `dynamodbav:"history,omitempty" json:"history,omitempty"`
+	// SchemaVersion is the shape the domain was stored in, see CurrentSchemaVersion
+	SchemaVersion int `dynamodbav:"schema_version" json:"schema_version"`
+	// upgraded is set when the record was read at an older schema version and still has to be written back
+	upgraded bool
+}
+
+// Upgraded reports whether the record was stored at an older schema version than it was read as
+func (r DomainRecord) Upgraded() bool {
+	return r.upgraded
+}
+
+// MaxHistoryEvents is how many audit events a domain keeps, older ones are dropped
+const MaxHistoryEvents = 100
+
+// AuditEvent is one change to a domain
+type AuditEvent struct {
+	At    time.Time `dynamodbav:"at" json:"at"`
+	Event string    `dynamodbav:"event" json:"event"`
+	// Actor is the user or the background process that made the change
+	Actor  string `dynamodbav:"actor" json:"actor"`
+	Detail string `dynamodbav:"detail,omitempty" json:"detail,omitempty"`
+}
+
+// PendingVerification tracks a domain that hasn't been verified yet
+type PendingVerification struct {
+	// Since is when the domain started waiting, it doesn't move when a new key is generated
+	Since time.Time `dynamodbav:"since" json:"since"`
+	// KeyExpiresAt is when the current verification key stops being accepted, nil while there is no key
+	KeyExpiresAt   *time.Time `dynamodbav:"key_expires_at,omitempty" json:"key_expires_at,omitempty"`
+	KeyWarnedAt    *time.Time `dynamodbav:"key_warned_at,omitempty" json:"key_warned_at,omitempty"`
+	DeleteWarnedAt *time.Time `dynamodbav:"delete_warned_at,omitempty" json:"delete_warned_at,omitempty"`
+}
+
+// AddHistory appends an event to the audit history, dropping the oldest events past MaxHistoryEvents. The history is
+// copied so that records sharing it aren't changed.
+func (r *DomainRecord) AddHistory(event AuditEvent) {
+	if event.At.IsZero() {
+		event.At = time.Now()
+	}
+	history := r.History
+	if len(history) >= MaxHistoryEvents {
+		history = history[len(history)-MaxHistoryEvents+1:]
+	}
+	r.History = append(append([]AuditEvent{}, history...), event)
+}
+
+// Tombstone records who deleted a domain and until when it can be restored
+type Tombstone struct {
+	DeletedAt  time.Time `dynamodbav:"deleted_at" json:"deleted_at"`
+	DeletedBy  string    `dynamodbav:"deleted_by" json:"deleted_by"`
+	Reason     string    `dynamodbav:"reason" json:"reason,omitempty"`
+	PurgeAfter time.Time `dynamodbav:"purge_after" json:"purge_after"`
+}
+
+// NameClaim is the one user a domain name can be verified for. Verifications of a name are serialized on it, the
+// verified flag of the user's record follows after.
+type NameClaim struct {
+	DomainName string    `json:"domain_name"`
+	UserID     uuid.UUID `json:"user_id"`
+	ClaimedAt  time.Time `json:"claimed_at"`
+}
+
+var ErrNameClaimChanged = errors.New("domain name claim was changed by another request")
+
+func nameClaimChanged(domainName string) error {
+	return fmt.Errorf("domain: %s %w", domainName, ErrNameClaimChanged)
+}
+
+var ErrVersionConflict = errors.New("domain was changed by another request")
+
+// ConflictError is returned when a domain changed between reading and writing it
+type ConflictError struct {
+	UserID     string
+	DomainName string
+	Version    int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("user: %s domain: %s is no longer at version: %d: %s", e.UserID, e.DomainName, e.Version, ErrVersionConflict)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrVersionConflict
+}
+
+var (
+	_ DomainStore = (*DynamoDomainStore)(nil)
+	_ DomainStore = (*MemoryDomainStore)(nil)
+	_ DomainStore = (*SQLDomainStore)(nil)
+)
+
+// NewDomainStore opens the backend chosen in settings, DynamoDB when none is set
+func NewDomainStore(conf *config.Config, settings appconfig.DomainStoreSettings) (DomainStore, error) {
+	switch settings.Backend {
+	case "", DynamoDBBackend:
+		return NewDynamoDomainStore(conf, settings.DynamoDB)
+	case MemoryBackend:
+		return NewMemoryDomainStore(), nil
+	case SQLBackend:
+		return NewSQLDomainStore(settings.SQL)
+	default:
+		return nil, fmt.Errorf("unknown domain_store backend: %s", settings.Backend)
+	}
+}
+
+// domainsByName picks the claims on a domain name out of every user, for backends without an index on it
+func domainsByName(users []models.User, domainName string) []models.DomainInformation {
+	var claims []models.DomainInformation
+	for _, user := range users {
+		if domainInfo, ok := user.Domains[domainName]; ok {
+			claims = append(claims, domainInfo)
+		}
+	}
+	return claims
+}
+
+var ErrDomainNotFound = errors.New("domain not found")
+
+func domainNotFound(userID uuid.UUID, domain string) error {
+	return fmt.Errorf("user: %s does not have a domain entry for: %s: %w", userID, domain, ErrDomainNotFound)
+}
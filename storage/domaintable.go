@@ -0,0 +1,821 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/edwinavalos/common/config"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/google/uuid"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DomainNameIndex is the GSI that finds the users of a domain name without knowing them
+const DomainNameIndex = "domain_name-index"
+
+// DynamoDomainStore keeps one item per domain. Until migrate-domains has run, domains that only exist in the nested
+// map of the legacy user item are read from there.
+type DynamoDomainStore struct {
+	client    *dynamodb.Client
+	tableName string
+	// claimsTableName holds one item per claimed domain name, "<domain table>-claims"
+	claimsTableName string
+	legacy          *VerifierDataStore
+	legacyFallback  bool
+}
+
+// MigrationResult counts what MigrateLegacyDomains did with the domains of the legacy user items
+type MigrationResult struct {
+	Users           int `json:"users"`
+	Copied          int `json:"copied"`
+	AlreadyMigrated int `json:"already_migrated"`
+	Failed          int `json:"failed"`
+}
+
+func NewDynamoDomainStore(conf *config.Config, settings appconfig.DynamoDBStoreSettings) (*DynamoDomainStore, error) {
+	legacy, err := NewDataStore(conf, settings.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &DynamoDomainStore{
+		client:         &legacy.Storage.Client,
+		tableName:      settings.TableName,
+		legacy:         legacy,
+		legacyFallback: settings.LegacyFallback == nil || *settings.LegacyFallback,
+	}
+	if store.tableName == "" {
+		store.tableName = legacy.TableName + "-domains"
+	}
+
+	err = ensureTable(context.TODO(), store.client, tableDefinition{
+		name:       store.tableName,
+		attributes: stringAttributes("user_id", "domain_name"),
+		keySchema: []types.KeySchemaElement{
+			{
+				AttributeName: aws.String("user_id"),
+				KeyType:       types.KeyTypeHash,
+			},
+			{
+				AttributeName: aws.String("domain_name"),
+				KeyType:       types.KeyTypeRange,
+			},
+		},
+		indexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName:  aws.String(DomainNameIndex),
+				KeySchema:  hashKey("domain_name"),
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+	}, settings.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	store.claimsTableName = store.tableName + "-claims"
+	err = ensureTable(context.TODO(), store.client, tableDefinition{
+		name:       store.claimsTableName,
+		attributes: stringAttributes("domain_name"),
+		keySchema:  hashKey("domain_name"),
+	}, settings.Tables)
+	if err != nil {
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// DataStore is the legacy user table, its client is shared with the job store
+func (d *DynamoDomainStore) DataStore() *VerifierDataStore {
+	return d.legacy
+}
+
+func domainRecordKey(userID string, domain string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"user_id":     &types.AttributeValueMemberS{Value: userID},
+		"domain_name": &types.AttributeValueMemberS{Value: domain},
+	}
+}
+
+func (d *DynamoDomainStore) GetUser(ctx context.Context, userID uuid.UUID) (models.User, error) {
+	domains, err := d.GetUserDomains(ctx, userID)
+	if err != nil {
+		return models.User{}, err
+	}
+	return models.User{ID: userID.String(), Domains: domains}, nil
+}
+
+func (d *DynamoDomainStore) GetDomainByUser(ctx context.Context, userID uuid.UUID, domain string) (models.DomainInformation, error) {
+	record, err := d.GetDomainRecord(ctx, userID, domain)
+	if err != nil {
+		return models.DomainInformation{}, err
+	}
+	if record.Deleted != nil {
+		return models.DomainInformation{}, domainNotFound(userID, domain)
+	}
+	return record.Domain, nil
+}
+
+func (d *DynamoDomainStore) GetDomainRecord(ctx context.Context, userID uuid.UUID, domain string) (DomainRecord, error) {
+	output, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            domainRecordKey(userID.String(), domain),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	if output.Item == nil {
+		if !d.legacyFallback {
+			return DomainRecord{}, domainNotFound(userID, domain)
+		}
+		// A legacy domain is at version 0 until its first write puts it in this table
+		domainInfo, err := d.legacy.GetDomainByUser(ctx, userID, domain)
+		if err != nil {
+			return DomainRecord{}, err
+		}
+		return DomainRecord{UserID: userID.String(), DomainName: domain, Domain: domainInfo}, nil
+	}
+
+	record, err := unmarshalRecord(output.Item)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	if record.upgraded {
+		// Upgrade lazily, a conflicting write means someone else already wrote the record in the current schema
+		written, err := d.PutDomainRecord(ctx, record)
+		if err == nil {
+			return written, nil
+		}
+		if !errors.Is(err, ErrVersionConflict) {
+			logger.Error("domain: %s unable to write back schema upgrade: %s", domain, err)
+		}
+	}
+	return record, nil
+}
+
+// unmarshalRecord reads a domain item and upgrades it to the current schema
+func unmarshalRecord(item map[string]types.AttributeValue) (DomainRecord, error) {
+	var record DomainRecord
+	err := attributevalue.UnmarshalMap(item, &record)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	err = upgradeRecord(func(v any) error {
+		return attributevalue.Unmarshal(item["domain"], v)
+	}, &record)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	return record, nil
+}
+
+func unmarshalRecords(items []map[string]types.AttributeValue) ([]DomainRecord, error) {
+	records := make([]DomainRecord, 0, len(items))
+	for _, item := range items {
+		record, err := unmarshalRecord(item)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// PutDomainInfo writes the domain whatever its version, only tools that own the whole table should use it
+func (d *DynamoDomainStore) PutDomainInfo(ctx context.Context, domainInfo models.DomainInformation) error {
+	domainAV, err := attributevalue.Marshal(domainInfo)
+	if err != nil {
+		return err
+	}
+	updatedAt, err := attributevalue.Marshal(time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(d.tableName),
+		Key:              domainRecordKey(domainInfo.UserID.String(), domainInfo.DomainName),
+		UpdateExpression: aws.String("SET #domain = :domain, updated_at = :updated_at, schema_version = :schema_version ADD version :one"),
+		ExpressionAttributeNames: map[string]string{
+			"#domain": "domain",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":domain":         domainAV,
+			":updated_at":     updatedAt,
+			":one":            &types.AttributeValueMemberN{Value: "1"},
+			":schema_version": &types.AttributeValueMemberN{Value: strconv.Itoa(CurrentSchemaVersion)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to put domain information: %w", domainInfo.DomainName, err)
+	}
+	return nil
+}
+
+func (d *DynamoDomainStore) PutDomainRecord(ctx context.Context, record DomainRecord) (DomainRecord, error) {
+	expected := record.Version
+	record.UserID = record.Domain.UserID.String()
+	record.DomainName = record.Domain.DomainName
+	record.Version++
+	record.UpdatedAt = time.Now()
+	record.SchemaVersion = CurrentSchemaVersion
+	record.upgraded = false
+	item, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+
+	condition := "version = :expected"
+	if expected == 0 {
+		// Items from before versions, or from migrate-domains, have none or 0
+		condition = "attribute_not_exists(version) OR version = :expected"
+	}
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(d.tableName),
+		Item:                item,
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expected": &types.AttributeValueMemberN{Value: strconv.FormatInt(expected, 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return DomainRecord{}, &ConflictError{UserID: record.UserID, DomainName: record.DomainName, Version: expected}
+	}
+	if err != nil {
+		return DomainRecord{}, fmt.Errorf("domain: %s unable to put domain information: %w", record.DomainName, err)
+	}
+	return record, nil
+}
+
+func (d *DynamoDomainStore) GetUserDomains(ctx context.Context, userID uuid.UUID) (map[string]models.DomainInformation, error) {
+	domains := map[string]models.DomainInformation{}
+	if d.legacyFallback {
+		legacyDomains, err := d.legacy.GetUserDomains(ctx, userID)
+		if err != nil {
+			return map[string]models.DomainInformation{}, err
+		}
+		for name, domainInfo := range legacyDomains {
+			domains[name] = domainInfo
+		}
+	}
+
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:              aws.String(d.tableName),
+		KeyConditionExpression: aws.String("user_id = :user_id"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":user_id": &types.AttributeValueMemberS{Value: userID.String()},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return map[string]models.DomainInformation{}, err
+		}
+		records, err := unmarshalRecords(page.Items)
+		if err != nil {
+			return map[string]models.DomainInformation{}, err
+		}
+		for _, record := range records {
+			// A tombstone also hides the legacy copy of the domain
+			if record.Deleted != nil {
+				delete(domains, record.DomainName)
+				continue
+			}
+			domains[record.DomainName] = record.Domain
+		}
+	}
+	return domains, nil
+}
+
+func (d *DynamoDomainStore) DeleteDomain(ctx context.Context, userID uuid.UUID, domainName string) error {
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.tableName),
+		Key:       domainRecordKey(userID.String(), domainName),
+	})
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to delete domain information: %w", domainName, err)
+	}
+	// An unmigrated copy would otherwise come back through the fallback
+	if d.legacyFallback {
+		return d.removeLegacyDomains(ctx, userID.String(), []string{domainName})
+	}
+	return nil
+}
+
+func (d *DynamoDomainStore) DeleteDomainRecord(ctx context.Context, record DomainRecord) error {
+	userID, domainName := record.Domain.UserID.String(), record.Domain.DomainName
+	condition := "version = :expected"
+	if record.Version == 0 {
+		condition = "attribute_not_exists(version) OR version = :expected"
+	}
+	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:           aws.String(d.tableName),
+		Key:                 domainRecordKey(userID, domainName),
+		ConditionExpression: aws.String(condition),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":expected": &types.AttributeValueMemberN{Value: strconv.FormatInt(record.Version, 10)},
+		},
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return &ConflictError{UserID: userID, DomainName: domainName, Version: record.Version}
+	}
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to delete domain information: %w", domainName, err)
+	}
+	if d.legacyFallback {
+		return d.removeLegacyDomains(ctx, userID, []string{domainName})
+	}
+	return nil
+}
+
+func (d *DynamoDomainStore) GetAllRecords(ctx context.Context) ([]models.User, error) {
+	users := map[string]models.User{}
+	if d.legacyFallback {
+		legacyUsers, err := d.legacy.GetAllRecords(ctx)
+		if err != nil {
+			return []models.User{}, err
+		}
+		for _, user := range legacyUsers {
+			users[user.ID] = copyUser(user)
+		}
+	}
+
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName: aws.String(d.tableName),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return []models.User{}, err
+		}
+		records, err := unmarshalRecords(page.Items)
+		if err != nil {
+			return []models.User{}, err
+		}
+		for _, record := range records {
+			user, ok := users[record.UserID]
+			if !ok {
+				user = models.User{ID: record.UserID}
+			}
+			if user.Domains == nil {
+				user.Domains = map[string]models.DomainInformation{}
+			}
+			if record.Deleted != nil {
+				delete(user.Domains, record.DomainName)
+			} else {
+				user.Domains[record.DomainName] = record.Domain
+			}
+			users[record.UserID] = user
+		}
+	}
+
+	var retRecords []models.User
+	for _, user := range users {
+		retRecords = append(retRecords, user)
+	}
+	sort.Slice(retRecords, func(i, j int) bool { return retRecords[i].ID < retRecords[j].ID })
+	return retRecords, nil
+}
+
+// GetDomainsByName queries the domain name index, legacy claims are found by scanning the user items while the
+// fallback is on
+func (d *DynamoDomainStore) GetDomainsByName(ctx context.Context, domainName string) ([]models.DomainInformation, error) {
+	claims := map[string]models.DomainInformation{}
+	if d.legacyFallback {
+		legacyClaims, err := d.legacy.GetDomainsByName(ctx, domainName)
+		if err != nil {
+			return nil, err
+		}
+		for _, domainInfo := range legacyClaims {
+			claims[domainInfo.UserID.String()] = domainInfo
+		}
+	}
+
+	paginator := dynamodb.NewQueryPaginator(d.client, &dynamodb.QueryInput{
+		TableName:              aws.String(d.tableName),
+		IndexName:              aws.String(DomainNameIndex),
+		KeyConditionExpression: aws.String("domain_name = :domain_name"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":domain_name": &types.AttributeValueMemberS{Value: domainName},
+		},
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		records, err := unmarshalRecords(page.Items)
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if record.Deleted != nil {
+				delete(claims, record.UserID)
+				continue
+			}
+			claims[record.UserID] = record.Domain
+		}
+	}
+
+	var retClaims []models.DomainInformation
+	for _, domainInfo := range claims {
+		retClaims = append(retClaims, domainInfo)
+	}
+	sort.Slice(retClaims, func(i, j int) bool { return retClaims[i].UserID.String() < retClaims[j].UserID.String() })
+	return retClaims, nil
+}
+
+// ListDomains queries the user's partition or scans the table, filtering in DynamoDB. While the legacy fallback is
+// on it has to look at every user item as well, so it pages through all records in memory until migrate-domains ran.
+func (d *DynamoDomainStore) ListDomains(ctx context.Context, filter DomainFilter, limit int, cursor string) (DomainPage, error) {
+	if d.legacyFallback {
+		users, err := d.GetAllRecords(ctx)
+		if err != nil {
+			return DomainPage{}, err
+		}
+		return pageFromUsers(users, filter, limit, cursor)
+	}
+
+	start, err := decodeCursor(cursor)
+	if err != nil {
+		return DomainPage{}, err
+	}
+	limit = PageSize(limit)
+
+	names := map[string]string{}
+	values := map[string]types.AttributeValue{}
+	filters := []string{"attribute_not_exists(deleted)"}
+	if filter.Verified != nil {
+		names["#domain"], names["#verification"], names["#verified"] = "domain", "Verification", "Verified"
+		values[":verified"] = &types.AttributeValueMemberBOOL{Value: *filter.Verified}
+		filters = append(filters, "#domain.#verification.#verified = :verified")
+	}
+	if filter.HasCertificate != nil {
+		names["#domain"], names["#verification"], names["#certinfo"], names["#certurl"] = "domain", "Verification", "CertInfo", "CertURL"
+		values[":empty"] = &types.AttributeValueMemberS{Value: ""}
+		if *filter.HasCertificate {
+			filters = append(filters, "#domain.#verification.#certinfo.#certurl > :empty")
+		} else {
+			filters = append(filters, "(attribute_not_exists(#domain.#verification.#certinfo.#certurl) OR #domain.#verification.#certinfo.#certurl = :empty)")
+		}
+	}
+	switch filter.Delegation {
+	case ARecordDelegation, CNameDelegation:
+		names["#domain"], names["#delegations"] = "domain", "Delegations"
+		names["#records"] = "ARecords"
+		if filter.Delegation == CNameDelegation {
+			names["#records"] = "CNames"
+		}
+		values[":zero"] = &types.AttributeValueMemberN{Value: "0"}
+		filters = append(filters, "size(#domain.#delegations.#records) > :zero")
+	}
+
+	var keyCondition string
+	if filter.UserID != uuid.Nil {
+		keyCondition = "user_id = :user_id"
+		values[":user_id"] = &types.AttributeValueMemberS{Value: filter.UserID.String()}
+		if filter.NamePrefix != "" {
+			keyCondition += " AND begins_with(domain_name, :prefix)"
+			values[":prefix"] = &types.AttributeValueMemberS{Value: filter.NamePrefix}
+		}
+	} else if filter.NamePrefix != "" {
+		filters = append(filters, "begins_with(domain_name, :prefix)")
+		values[":prefix"] = &types.AttributeValueMemberS{Value: filter.NamePrefix}
+	}
+
+	filterExpression := aws.String(strings.Join(filters, " AND "))
+	if len(names) == 0 {
+		names = nil
+	}
+	if len(values) == 0 {
+		values = nil
+	}
+
+	var startKey map[string]types.AttributeValue
+	if start != nil {
+		startKey = domainRecordKey(start.UserID, start.DomainName)
+	}
+
+	page := DomainPage{Domains: []models.DomainInformation{}}
+	for {
+		// DynamoDB limits what it evaluates, not what it returns, so asking for the remainder never overfills a page
+		remaining := int32(limit - len(page.Domains))
+		var items []map[string]types.AttributeValue
+		var lastKey map[string]types.AttributeValue
+		if keyCondition != "" {
+			output, err := d.client.Query(ctx, &dynamodb.QueryInput{
+				TableName:                 aws.String(d.tableName),
+				KeyConditionExpression:    aws.String(keyCondition),
+				FilterExpression:          filterExpression,
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+				ExclusiveStartKey:         startKey,
+				Limit:                     aws.Int32(remaining),
+			})
+			if err != nil {
+				return DomainPage{}, err
+			}
+			items, lastKey = output.Items, output.LastEvaluatedKey
+		} else {
+			output, err := d.client.Scan(ctx, &dynamodb.ScanInput{
+				TableName:                 aws.String(d.tableName),
+				FilterExpression:          filterExpression,
+				ExpressionAttributeNames:  names,
+				ExpressionAttributeValues: values,
+				ExclusiveStartKey:         startKey,
+				Limit:                     aws.Int32(remaining),
+			})
+			if err != nil {
+				return DomainPage{}, err
+			}
+			items, lastKey = output.Items, output.LastEvaluatedKey
+		}
+
+		records, err := unmarshalRecords(items)
+		if err != nil {
+			return DomainPage{}, err
+		}
+		for _, record := range records {
+			page.Domains = append(page.Domains, record.Domain)
+		}
+
+		if len(lastKey) == 0 {
+			return page, nil
+		}
+		var next pageCursor
+		err = attributevalue.UnmarshalMap(lastKey, &next)
+		if err != nil {
+			return DomainPage{}, err
+		}
+		if len(page.Domains) == limit {
+			page.NextCursor = next.encode()
+			return page, nil
+		}
+		startKey = lastKey
+	}
+}
+
+// ListDeletedDomains scans for tombstones, the purge times are compared here since they are stored as text
+func (d *DynamoDomainStore) ListDeletedDomains(ctx context.Context, purgeBefore time.Time) ([]DomainRecord, error) {
+	records, err := d.scanRecords(ctx, "attribute_exists(deleted)")
+	if err != nil {
+		return nil, err
+	}
+	var deleted []DomainRecord
+	for _, record := range records {
+		if record.Deleted != nil && record.Deleted.PurgeAfter.Before(purgeBefore) {
+			deleted = append(deleted, record)
+		}
+	}
+	return deleted, nil
+}
+
+func (d *DynamoDomainStore) ListPendingDomains(ctx context.Context) ([]DomainRecord, error) {
+	return d.scanRecords(ctx, "attribute_exists(pending) AND attribute_not_exists(deleted)")
+}
+
+// ListDomainRecords includes the domains only the legacy user items have while the fallback is on, at version 0 like
+// GetDomainRecord returns them
+func (d *DynamoDomainStore) ListDomainRecords(ctx context.Context) ([]DomainRecord, error) {
+	records, err := d.scanRecords(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if !d.legacyFallback {
+		return records, nil
+	}
+
+	migrated := map[[2]string]bool{}
+	for _, record := range records {
+		migrated[[2]string{record.UserID, record.DomainName}] = true
+	}
+	err = d.legacy.scanUsers(ctx, func(user models.User, legacyRecords []DomainRecord) {
+		for _, record := range legacyRecords {
+			if !migrated[[2]string{record.UserID, record.DomainName}] {
+				records = append(records, record)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+// scanRecords returns every domain item matching the filter expression, all of them when it is empty
+func (d *DynamoDomainStore) scanRecords(ctx context.Context, filterExpression string) ([]DomainRecord, error) {
+	var records []DomainRecord
+	input := &dynamodb.ScanInput{
+		TableName: aws.String(d.tableName),
+	}
+	if filterExpression != "" {
+		input.FilterExpression = aws.String(filterExpression)
+	}
+	paginator := dynamodb.NewScanPaginator(d.client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pageRecords, err := unmarshalRecords(page.Items)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, pageRecords...)
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+// MigrateLegacyDomains copies the domains nested in the legacy user items to their own items and removes them from
+// the user item. It can run while the service is serving, a domain that was already written to the new table is newer
+// than its legacy copy and is left alone.
+func (d *DynamoDomainStore) MigrateLegacyDomains(ctx context.Context) (MigrationResult, error) {
+	var result MigrationResult
+	legacyRecords := map[string][]DomainRecord{}
+	err := d.legacy.scanUsers(ctx, func(user models.User, records []DomainRecord) {
+		if len(records) > 0 {
+			legacyRecords[user.ID] = records
+		}
+	})
+	if err != nil {
+		return result, err
+	}
+
+	for userID, records := range legacyRecords {
+		result.Users++
+
+		var migrated []string
+		for _, record := range records {
+			name := record.DomainName
+			record.UpdatedAt = time.Now()
+			record.SchemaVersion = CurrentSchemaVersion
+			item, err := attributevalue.MarshalMap(record)
+			if err != nil {
+				logger.Error("user: %s domain: %s unable to marshal: %s", userID, name, err)
+				result.Failed++
+				continue
+			}
+			_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+				TableName:           aws.String(d.tableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(user_id)"),
+			})
+			var conditionFailed *types.ConditionalCheckFailedException
+			switch {
+			case err == nil:
+				result.Copied++
+			case errors.As(err, &conditionFailed):
+				result.AlreadyMigrated++
+			default:
+				logger.Error("user: %s domain: %s unable to migrate: %s", userID, name, err)
+				result.Failed++
+				continue
+			}
+			migrated = append(migrated, name)
+		}
+
+		err = d.removeLegacyDomains(ctx, userID, migrated)
+		if err != nil {
+			logger.Error("user: %s unable to remove migrated domains from legacy item: %s", userID, err)
+			result.Failed++
+		}
+	}
+	return result, nil
+}
+
+// removeLegacyDomains deletes entries of the nested domain map without rewriting the rest of the user item
+func (d *DynamoDomainStore) removeLegacyDomains(ctx context.Context, userID string, domains []string) error {
+	if len(domains) == 0 {
+		return nil
+	}
+	names := map[string]string{"#domains": "Domains"}
+	var removes []string
+	for i, domain := range domains {
+		placeholder := fmt.Sprintf("#d%d", i)
+		names[placeholder] = domain
+		removes = append(removes, "#domains."+placeholder)
+	}
+
+	_, err := d.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(d.legacy.TableName),
+		Key: map[string]types.AttributeValue{
+			"user_id": &types.AttributeValueMemberS{Value: userID},
+		},
+		UpdateExpression:         aws.String("REMOVE " + strings.Join(removes, ", ")),
+		ConditionExpression:      aws.String("attribute_exists(#domains)"),
+		ExpressionAttributeNames: names,
+	})
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nil
+	}
+	return err
+}
+
+func (d *DynamoDomainStore) GetNameClaim(ctx context.Context, domainName string) (NameClaim, error) {
+	output, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(d.claimsTableName),
+		Key: map[string]types.AttributeValue{
+			"domain_name": &types.AttributeValueMemberS{Value: domainName},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return NameClaim{}, fmt.Errorf("domain: %s unable to get name claim: %w", domainName, err)
+	}
+	if output.Item == nil {
+		return NameClaim{}, nil
+	}
+	var item nameClaimItem
+	err = attributevalue.UnmarshalMap(output.Item, &item)
+	if err != nil {
+		return NameClaim{}, fmt.Errorf("domain: %s unable to unmarshal name claim: %w", domainName, err)
+	}
+	userID, err := uuid.Parse(item.UserID)
+	if err != nil {
+		return NameClaim{}, fmt.Errorf("domain: %s name claim has an invalid user id: %w", domainName, err)
+	}
+	return NameClaim{DomainName: item.DomainName, UserID: userID, ClaimedAt: item.ClaimedAt}, nil
+}
+
+// nameClaimItem is the stored form of a NameClaim, user_id is a string so conditions can compare it
+type nameClaimItem struct {
+	DomainName string    `dynamodbav:"domain_name"`
+	UserID     string    `dynamodbav:"user_id"`
+	ClaimedAt  time.Time `dynamodbav:"claimed_at"`
+}
+
+func (d *DynamoDomainStore) SwapNameClaim(ctx context.Context, domainName string, previous uuid.UUID, holder uuid.UUID) error {
+	if previous == uuid.Nil && holder == uuid.Nil {
+		return d.checkNoNameClaim(ctx, domainName)
+	}
+	key := map[string]types.AttributeValue{
+		"domain_name": &types.AttributeValueMemberS{Value: domainName},
+	}
+	previousValue := map[string]types.AttributeValue{
+		":previous": &types.AttributeValueMemberS{Value: previous.String()},
+	}
+
+	var err error
+	switch {
+	case holder == uuid.Nil:
+		_, err = d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:                 aws.String(d.claimsTableName),
+			Key:                       key,
+			ConditionExpression:       aws.String("user_id = :previous"),
+			ExpressionAttributeValues: previousValue,
+		})
+	default:
+		var item map[string]types.AttributeValue
+		item, err = attributevalue.MarshalMap(nameClaimItem{DomainName: domainName, UserID: holder.String(), ClaimedAt: time.Now()})
+		if err != nil {
+			return err
+		}
+		input := &dynamodb.PutItemInput{
+			TableName:                 aws.String(d.claimsTableName),
+			Item:                      item,
+			ConditionExpression:       aws.String("user_id = :previous"),
+			ExpressionAttributeValues: previousValue,
+		}
+		if previous == uuid.Nil {
+			input.ConditionExpression = aws.String("attribute_not_exists(domain_name)")
+			input.ExpressionAttributeValues = nil
+		}
+		_, err = d.client.PutItem(ctx, input)
+	}
+	var conditionFailed *types.ConditionalCheckFailedException
+	if errors.As(err, &conditionFailed) {
+		return nameClaimChanged(domainName)
+	}
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to swap name claim: %w", domainName, err)
+	}
+	return nil
+}
+
+// checkNoNameClaim is the swap from nobody to nobody, it only fails when someone holds the claim
+func (d *DynamoDomainStore) checkNoNameClaim(ctx context.Context, domainName string) error {
+	claim, err := d.GetNameClaim(ctx, domainName)
+	if err != nil {
+		return err
+	}
+	if claim.UserID != uuid.Nil {
+		return nameClaimChanged(domainName)
+	}
+	return nil
+}
@@ -1,21 +1,191 @@
 package storage
 
 import (
-	"github.com/edwinavalos/common/config"
-	"github.com/edwinavalos/common/datastore/s3_filestore"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"io"
+	"net/http"
+	"time"
 )
 
-type VerifierFileStore struct {
-	*s3_filestore.S3Store
+const (
+	S3Backend    = "s3"
+	LocalBackend = "local"
+)
+
+var (
+	ErrObjectNotFound = errors.New("object not found in file store")
+	ErrObjectExists   = errors.New("object already exists in file store")
+)
+
+// CertificateStore holds the certificates, keys and the other objects of the cert service. Keys are slash separated
+// paths like "mastodon_le_certs/<domain>/cert.crt".
+type CertificateStore interface {
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put creates or replaces an object
+	Put(ctx context.Context, key string, data []byte) error
+	// Create only writes the object when the key is still free and returns ErrObjectExists otherwise, of replicas
+	// racing to create the same key exactly one wins
+	Create(ctx context.Context, key string, data []byte) error
+	// List returns the keys of every object under prefix in lexical order
+	List(ctx context.Context, prefix string) ([]string, error)
+	// Delete removes an object, deleting one that doesn't exist isn't an error
+	Delete(ctx context.Context, key string) error
+	// Stat returns the metadata of an object without reading it
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+}
+
+// ObjectInfo is the metadata of a stored object
+type ObjectInfo struct {
+	Key        string
+	Size       int64
+	ModifiedAt time.Time
+}
+
+var (
+	_ CertificateStore = (*S3FileStore)(nil)
+	_ CertificateStore = (*LocalFileStore)(nil)
+	_ CertificateStore = (*MemoryFileStore)(nil)
+)
+
+// NewFileStore opens the backend chosen in settings, S3 when none is set
+func NewFileStore(settings *appconfig.Settings) (CertificateStore, error) {
+	switch settings.FileStore.Backend {
+	case "", S3Backend:
+		return NewS3FileStore(settings.CloudProvider)
+	case LocalBackend:
+		return NewLocalFileStore(settings.FileStore.Local)
+	case MemoryBackend:
+		return NewMemoryFileStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown file_store backend: %s", settings.FileStore.Backend)
+	}
+}
+
+// S3FileStore keeps every object in the bucket of the cloud provider settings
+type S3FileStore struct {
+	client     *s3.Client
+	bucketName string
+}
+
+func NewS3FileStore(settings appconfig.CloudProviderSettings) (*S3FileStore, error) {
+	if settings.BucketName == "" {
+		return nil, fmt.Errorf("the s3 file_store needs cloud_provider.bucket_name")
+	}
+
+	awsCfg, err := awsconfig.LoadDefaultConfig(context.TODO(), awsconfig.WithRegion(settings.Region))
+	if err != nil {
+		return nil, fmt.Errorf("unable to load aws config for file store: %w", err)
+	}
+
+	return &S3FileStore{
+		client:     s3.NewFromConfig(awsCfg),
+		bucketName: settings.BucketName,
+	}, nil
+}
+
+func (v *S3FileStore) Get(ctx context.Context, key string) ([]byte, error) {
+	output, err := v.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(v.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		var noSuchKey *types.NoSuchKey
+		if errors.As(err, &noSuchKey) {
+			return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+		}
+		return nil, fmt.Errorf("unable to get object: %s: %w", key, err)
+	}
+	defer output.Body.Close()
+
+	return io.ReadAll(output.Body)
+}
+
+func (v *S3FileStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := v.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(v.bucketName),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to put object: %s: %w", key, err)
+	}
+	return nil
+}
+
+func (v *S3FileStore) Create(ctx context.Context, key string, data []byte) error {
+	_, err := v.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(v.bucketName),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}, func(o *s3.Options) {
+		o.APIOptions = append(o.APIOptions, smithyhttp.AddHeaderValue("If-None-Match", "*"))
+	})
+	var responseErr *awshttp.ResponseError
+	if errors.As(err, &responseErr) && responseErr.HTTPStatusCode() == http.StatusPreconditionFailed {
+		return fmt.Errorf("%s: %w", key, ErrObjectExists)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create object: %s: %w", key, err)
+	}
+	return nil
+}
+
+func (v *S3FileStore) List(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	paginator := s3.NewListObjectsV2Paginator(v.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(v.bucketName),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list objects: %s: %w", prefix, err)
+		}
+		for _, object := range page.Contents {
+			keys = append(keys, aws.ToString(object.Key))
+		}
+	}
+	return keys, nil
+}
+
+func (v *S3FileStore) Delete(ctx context.Context, key string) error {
+	_, err := v.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(v.bucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("unable to delete object: %s: %w", key, err)
+	}
+	return nil
 }
 
-func NewFileStore(cfg *config.Config) (*VerifierFileStore, error) {
-	filestore, err := s3_filestore.New(cfg)
+func (v *S3FileStore) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	output, err := v.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(v.bucketName),
+		Key:    aws.String(key),
+	})
 	if err != nil {
-		return nil, err
+		// HEAD responses have no body, a missing key comes back as NotFound rather than NoSuchKey
+		var notFound *types.NotFound
+		if errors.As(err, &notFound) {
+			return ObjectInfo{}, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+		}
+		return ObjectInfo{}, fmt.Errorf("unable to stat object: %s: %w", key, err)
 	}
 
-	return &VerifierFileStore{
-		S3Store: filestore,
+	return ObjectInfo{
+		Key:        key,
+		Size:       output.ContentLength,
+		ModifiedAt: aws.ToTime(output.LastModified),
 	}, nil
 }
@@ -0,0 +1,415 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/google/uuid"
+	"sync/atomic"
+	"time"
+)
+
+type JobState string
+
+const (
+	JobPending   JobState = "pending"
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+var (
+	ErrJobNotFound    = errors.New("job not found")
+	ErrJobAlreadyHeld = errors.New("job is held by another worker")
+	ErrJobLeaseLost   = errors.New("job lease expired and the job was claimed again")
+)
+
+// RunnableJobsIndex finds the due jobs of a state without scanning the finished ones
+const RunnableJobsIndex = "state-next_attempt_at-index"
+
+// Job is a unit of background work that has to survive restarts, times that are compared in conditions are kept as
+// unix seconds
+type Job struct {
+	ID             uuid.UUID `dynamodbav:"id" json:"id"`
+	Kind           string    `dynamodbav:"kind" json:"kind"`
+	UserID         uuid.UUID `dynamodbav:"user_id" json:"user_id"`
+	Domain         string    `dynamodbav:"domain" json:"domain"`
+	State          JobState  `dynamodbav:"state" json:"state"`
+	Attempts       int       `dynamodbav:"attempts" json:"attempts"`
+	LastError      string    `dynamodbav:"last_error" json:"last_error,omitempty"`
+	CreatedAt      time.Time `dynamodbav:"created_at" json:"created_at"`
+	UpdatedAt      time.Time `dynamodbav:"updated_at" json:"updated_at"`
+	NextAttemptAt  int64     `dynamodbav:"next_attempt_at" json:"next_attempt_at"`
+	LeaseExpiresAt int64     `dynamodbav:"lease_expires_at" json:"-"`
+	// LeaseOwner is set by every claim so that only the worker holding the lease can record the outcome
+	LeaseOwner string `dynamodbav:"lease_owner,omitempty" json:"-"`
+	// ExpiresAt is when DynamoDB may delete a finished job, 0 while it isn't finished
+	ExpiresAt int64 `dynamodbav:"expires_at,omitempty" json:"-"`
+	// Progress is kind specific JSON a running job reports while it waits on something, e.g. DNS propagation
+	Progress json.RawMessage `dynamodbav:"progress,omitempty" json:"progress,omitempty"`
+}
+
+// JobStore is what the job worker needs from the database background jobs are kept in
+type JobStore interface {
+	GetJob(ctx context.Context, id uuid.UUID) (Job, error)
+	// PutJob creates or replaces a job
+	PutJob(ctx context.Context, job Job) error
+	// FinishAttempt records the outcome of an attempt, it fails with ErrJobLeaseLost when the lease ClaimJob gave the
+	// job ran out and another worker claimed it since
+	FinishAttempt(ctx context.Context, job Job) error
+	// UpdateJobProgress replaces the progress of a running job without touching the rest of it
+	UpdateJobProgress(ctx context.Context, id uuid.UUID, progress json.RawMessage) error
+	// ClaimJob marks a job as running for leaseDuration and counts the attempt, it fails with ErrJobAlreadyHeld when
+	// the job isn't due or another worker's lease on it hasn't expired yet
+	ClaimJob(ctx context.Context, id uuid.UUID, leaseDuration time.Duration) (Job, error)
+	// ListRunnableJobs returns the jobs that are due or whose worker went away
+	ListRunnableJobs(ctx context.Context) ([]Job, error)
+}
+
+var (
+	_ JobStore = (*VerifierJobStore)(nil)
+	_ JobStore = (*MemoryJobStore)(nil)
+	_ JobStore = (*SQLJobStore)(nil)
+)
+
+// OpenJobStore opens the job store of the domain store's backend, jobs are kept in the same database as the domains
+func OpenJobStore(domainStore DomainStore, settings appconfig.JobSettings, tables appconfig.TableSettings) (JobStore, error) {
+	switch store := domainStore.(type) {
+	case *DynamoDomainStore:
+		jobStore, err := NewJobStore(store.DataStore(), settings.TableName, tables)
+		if err != nil {
+			return nil, err
+		}
+		return jobStore, nil
+	case *SQLDomainStore:
+		jobStore, err := NewSQLJobStore(store, settings.TableName)
+		if err != nil {
+			return nil, err
+		}
+		return jobStore, nil
+	case *MemoryDomainStore:
+		return NewMemoryJobStore(), nil
+	default:
+		return nil, fmt.Errorf("no job store for domain store: %T", domainStore)
+	}
+}
+
+// VerifierJobStore keeps jobs in their own DynamoDB table so that workers can claim them with conditional writes
+type VerifierJobStore struct {
+	client    *dynamodb.Client
+	tableName string
+	// indexActive is set once RunnableJobsIndex has been backfilled, until then the runnable jobs are scanned for
+	indexActive atomic.Bool
+}
+
+// NewJobStore opens the job table, creating it from tables when it doesn't exist yet
+func NewJobStore(datastore *VerifierDataStore, tableName string, tables appconfig.TableSettings) (*VerifierJobStore, error) {
+	if tableName == "" {
+		tableName = datastore.TableName + "-jobs"
+	}
+	jobStore := &VerifierJobStore{
+		client:    &datastore.Storage.Client,
+		tableName: tableName,
+	}
+
+	err := ensureTable(context.TODO(), jobStore.client, tableDefinition{
+		name: tableName,
+		attributes: append(stringAttributes("id", "state"), types.AttributeDefinition{
+			AttributeName: aws.String("next_attempt_at"),
+			AttributeType: types.ScalarAttributeTypeN,
+		}),
+		keySchema: hashKey("id"),
+		indexes: []types.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(RunnableJobsIndex),
+				KeySchema: []types.KeySchemaElement{
+					{
+						AttributeName: aws.String("state"),
+						KeyType:       types.KeyTypeHash,
+					},
+					{
+						AttributeName: aws.String("next_attempt_at"),
+						KeyType:       types.KeyTypeRange,
+					},
+				},
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		},
+		ttlAttribute: "expires_at",
+	}, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	return jobStore, nil
+}
+
+func jobKey(id uuid.UUID) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"id": &types.AttributeValueMemberS{Value: id.String()},
+	}
+}
+
+// jobItem is the stored form of a Job, the ids are strings because the table is keyed on a string id
+type jobItem struct {
+	Job
+	ID     string `dynamodbav:"id"`
+	UserID string `dynamodbav:"user_id"`
+}
+
+func marshalJob(job Job) (map[string]types.AttributeValue, error) {
+	return attributevalue.MarshalMap(jobItem{Job: job, ID: job.ID.String(), UserID: job.UserID.String()})
+}
+
+func unmarshalJob(item map[string]types.AttributeValue) (Job, error) {
+	var stored jobItem
+	err := attributevalue.UnmarshalMap(item, &stored)
+	if err != nil {
+		return Job{}, err
+	}
+	job := stored.Job
+	job.ID, err = uuid.Parse(stored.ID)
+	if err != nil {
+		return Job{}, fmt.Errorf("job has an invalid id: %w", err)
+	}
+	job.UserID, err = uuid.Parse(stored.UserID)
+	if err != nil {
+		return Job{}, fmt.Errorf("job: %s has an invalid user id: %w", job.ID, err)
+	}
+	return job, nil
+}
+
+func unmarshalJobs(items []map[string]types.AttributeValue) ([]Job, error) {
+	jobs := make([]Job, 0, len(items))
+	for _, item := range items {
+		job, err := unmarshalJob(item)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (j *VerifierJobStore) GetJob(ctx context.Context, id uuid.UUID) (Job, error) {
+	output, err := j.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(j.tableName),
+		Key:            jobKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return Job{}, err
+	}
+	if output.Item == nil {
+		return Job{}, fmt.Errorf("%s: %w", id, ErrJobNotFound)
+	}
+
+	return unmarshalJob(output.Item)
+}
+
+func (j *VerifierJobStore) PutJob(ctx context.Context, job Job) error {
+	job.UpdatedAt = time.Now()
+	item, err := marshalJob(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(j.tableName),
+		Item:      item,
+	})
+	return err
+}
+
+// FinishAttempt records the outcome of an attempt, it fails with ErrJobLeaseLost when the lease ClaimJob gave the
+// job ran out and another worker claimed it since
+func (j *VerifierJobStore) FinishAttempt(ctx context.Context, job Job) error {
+	job.UpdatedAt = time.Now()
+	item, err := marshalJob(job)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:           aws.String(j.tableName),
+		Item:                item,
+		ConditionExpression: aws.String("lease_owner = :owner AND lease_expires_at = :lease"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":owner": &types.AttributeValueMemberS{Value: job.LeaseOwner},
+			":lease": &types.AttributeValueMemberN{Value: fmt.Sprint(job.LeaseExpiresAt)},
+		},
+	})
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return fmt.Errorf("%s: %w", job.ID, ErrJobLeaseLost)
+		}
+		return err
+	}
+	return nil
+}
+
+// UpdateJobProgress replaces the progress of a running job without touching the rest of it
+func (j *VerifierJobStore) UpdateJobProgress(ctx context.Context, id uuid.UUID, progress json.RawMessage) error {
+	_, err := j.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(j.tableName),
+		Key:                 jobKey(id),
+		UpdateExpression:    aws.String("SET progress = :progress, updated_at = :updated"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":progress": &types.AttributeValueMemberB{Value: progress},
+			":updated":  &types.AttributeValueMemberS{Value: time.Now().Format(time.RFC3339Nano)},
+		},
+	})
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return fmt.Errorf("%s: %w", id, ErrJobNotFound)
+		}
+		return err
+	}
+	return nil
+}
+
+// ClaimJob marks a job as running for leaseDuration and counts the attempt, it fails with ErrJobAlreadyHeld when
+// the job isn't due or another worker's lease on it hasn't expired yet
+func (j *VerifierJobStore) ClaimJob(ctx context.Context, id uuid.UUID, leaseDuration time.Duration) (Job, error) {
+	now := time.Now()
+	output, err := j.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(j.tableName),
+		Key:                 jobKey(id),
+		UpdateExpression:    aws.String("SET #state = :running, attempts = attempts + :one, lease_expires_at = :lease, lease_owner = :owner, updated_at = :updated"),
+		ConditionExpression: aws.String("(#state = :pending AND next_attempt_at <= :now) OR (#state = :running AND lease_expires_at < :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#state": "state",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":running": &types.AttributeValueMemberS{Value: string(JobRunning)},
+			":pending": &types.AttributeValueMemberS{Value: string(JobPending)},
+			":lease":   &types.AttributeValueMemberN{Value: fmt.Sprint(now.Add(leaseDuration).Unix())},
+			":owner":   &types.AttributeValueMemberS{Value: uuid.NewString()},
+			":now":     &types.AttributeValueMemberN{Value: fmt.Sprint(now.Unix())},
+			":one":     &types.AttributeValueMemberN{Value: "1"},
+			":updated": &types.AttributeValueMemberS{Value: now.Format(time.RFC3339Nano)},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var conditionFailed *types.ConditionalCheckFailedException
+		if errors.As(err, &conditionFailed) {
+			return Job{}, fmt.Errorf("%s: %w", id, ErrJobAlreadyHeld)
+		}
+		return Job{}, err
+	}
+
+	return unmarshalJob(output.Attributes)
+}
+
+// ListRunnableJobs returns the jobs that are due or whose worker went away
+func (j *VerifierJobStore) ListRunnableJobs(ctx context.Context) ([]Job, error) {
+	now := &types.AttributeValueMemberN{Value: fmt.Sprint(time.Now().Unix())}
+	if !j.runnableIndexActive(ctx) {
+		return j.scanRunnableJobs(ctx, now)
+	}
+
+	pending, err := j.queryJobs(ctx, &dynamodb.QueryInput{
+		KeyConditionExpression: aws.String("#state = :pending AND next_attempt_at <= :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":pending": &types.AttributeValueMemberS{Value: string(JobPending)},
+			":now":     now,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Few jobs are running at any time, filtering them by lease is cheap
+	abandoned, err := j.queryJobs(ctx, &dynamodb.QueryInput{
+		KeyConditionExpression: aws.String("#state = :running"),
+		FilterExpression:       aws.String("lease_expires_at < :now"),
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":running": &types.AttributeValueMemberS{Value: string(JobRunning)},
+			":now":     now,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(pending, abandoned...), nil
+}
+
+func (j *VerifierJobStore) queryJobs(ctx context.Context, input *dynamodb.QueryInput) ([]Job, error) {
+	input.TableName = aws.String(j.tableName)
+	input.IndexName = aws.String(RunnableJobsIndex)
+	input.ExpressionAttributeNames = map[string]string{"#state": "state"}
+	paginator := dynamodb.NewQueryPaginator(j.client, input)
+
+	var jobs []Job
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pageJobs, err := unmarshalJobs(page.Items)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, pageJobs...)
+	}
+	return jobs, nil
+}
+
+// runnableIndexActive reports whether RunnableJobsIndex can be queried, an index added to an existing table can't be
+// until it is backfilled
+func (j *VerifierJobStore) runnableIndexActive(ctx context.Context) bool {
+	if j.indexActive.Load() {
+		return true
+	}
+	output, err := j.client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(j.tableName)})
+	if err != nil {
+		logger.Error("table: %s unable to describe: %s", j.tableName, err)
+		return false
+	}
+	index := findIndex(output.Table, RunnableJobsIndex)
+	if index == nil || index.IndexStatus != types.IndexStatusActive {
+		return false
+	}
+	j.indexActive.Store(true)
+	return true
+}
+
+// scanRunnableJobs finds the runnable jobs while RunnableJobsIndex isn't there yet
+func (j *VerifierJobStore) scanRunnableJobs(ctx context.Context, now types.AttributeValue) ([]Job, error) {
+	paginator := dynamodb.NewScanPaginator(j.client, &dynamodb.ScanInput{
+		TableName:        aws.String(j.tableName),
+		FilterExpression: aws.String("(#state = :pending AND next_attempt_at <= :now) OR (#state = :running AND lease_expires_at < :now)"),
+		ExpressionAttributeNames: map[string]string{
+			"#state": "state",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":running": &types.AttributeValueMemberS{Value: string(JobRunning)},
+			":pending": &types.AttributeValueMemberS{Value: string(JobPending)},
+			":now":     now,
+		},
+	})
+
+	var jobs []Job
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		pageJobs, err := unmarshalJobs(page.Items)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, pageJobs...)
+	}
+	return jobs, nil
+}
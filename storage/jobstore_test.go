@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+// jobStores runs test against every job backend that doesn't need a server
+func jobStores(t *testing.T, test func(t *testing.T, store JobStore)) {
+	t.Run("memory", func(t *testing.T) { test(t, NewMemoryJobStore()) })
+	t.Run("sqlite", func(t *testing.T) {
+		store, err := NewSQLJobStore(newTestSQLDomainStore(t), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		test(t, store)
+	})
+}
+
+func newTestJob(nextAttemptAt time.Time) Job {
+	return Job{
+		ID:            uuid.New(),
+		Kind:          "complete_certificate",
+		UserID:        uuid.New(),
+		Domain:        "example.com",
+		State:         JobPending,
+		CreatedAt:     time.Now().UTC().Truncate(time.Second),
+		NextAttemptAt: nextAttemptAt.Unix(),
+	}
+}
+
+func TestJobStorePutGet(t *testing.T) {
+	jobStores(t, func(t *testing.T, store JobStore) {
+		ctx := context.Background()
+		job := newTestJob(time.Now())
+		err := store.PutJob(ctx, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.GetJob(ctx, job.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID != job.ID || got.UserID != job.UserID || got.Kind != job.Kind || got.State != JobPending || !got.CreatedAt.Equal(job.CreatedAt) {
+			t.Errorf("GetJob() = %+v, want %+v", got, job)
+		}
+
+		err = store.UpdateJobProgress(ctx, job.ID, json.RawMessage(`{"waiting_on":"ns1.example.com"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ = store.GetJob(ctx, job.ID)
+		if string(got.Progress) != `{"waiting_on":"ns1.example.com"}` {
+			t.Errorf("progress = %s", got.Progress)
+		}
+
+		_, err = store.GetJob(ctx, uuid.New())
+		if !errors.Is(err, ErrJobNotFound) {
+			t.Errorf("GetJob() of an unknown job error = %v, want ErrJobNotFound", err)
+		}
+		err = store.UpdateJobProgress(ctx, uuid.New(), json.RawMessage(`{}`))
+		if !errors.Is(err, ErrJobNotFound) {
+			t.Errorf("UpdateJobProgress() of an unknown job error = %v, want ErrJobNotFound", err)
+		}
+	})
+}
+
+func TestJobStoreClaims(t *testing.T) {
+	jobStores(t, func(t *testing.T, store JobStore) {
+		ctx := context.Background()
+		due := newTestJob(time.Now().Add(-time.Minute))
+		later := newTestJob(time.Now().Add(time.Hour))
+		for _, job := range []Job{due, later} {
+			err := store.PutJob(ctx, job)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		runnable, err := store.ListRunnableJobs(ctx)
+		if err != nil || len(runnable) != 1 || runnable[0].ID != due.ID {
+			t.Fatalf("ListRunnableJobs() = %v, %v, want the due job", runnable, err)
+		}
+		_, err = store.ClaimJob(ctx, later.ID, time.Minute)
+		if !errors.Is(err, ErrJobAlreadyHeld) {
+			t.Errorf("ClaimJob() of a job that isn't due error = %v, want ErrJobAlreadyHeld", err)
+		}
+
+		claimed, err := store.ClaimJob(ctx, due.ID, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claimed.State != JobRunning || claimed.Attempts != 1 || claimed.LeaseOwner == "" {
+			t.Errorf("claimed job = %+v", claimed)
+		}
+		_, err = store.ClaimJob(ctx, due.ID, time.Minute)
+		if !errors.Is(err, ErrJobAlreadyHeld) {
+			t.Errorf("second ClaimJob() error = %v, want ErrJobAlreadyHeld", err)
+		}
+		runnable, _ = store.ListRunnableJobs(ctx)
+		if len(runnable) != 0 {
+			t.Errorf("ListRunnableJobs() while the lease holds = %v", runnable)
+		}
+
+		claimed.State = JobSucceeded
+		err = store.FinishAttempt(ctx, claimed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, _ := store.GetJob(ctx, due.ID)
+		if got.State != JobSucceeded {
+			t.Errorf("state after FinishAttempt() = %s", got.State)
+		}
+	})
+}
+
+func TestJobStoreLeaseLost(t *testing.T) {
+	jobStores(t, func(t *testing.T, store JobStore) {
+		ctx := context.Background()
+		job := newTestJob(time.Now().Add(-time.Minute))
+		err := store.PutJob(ctx, job)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// A lease that already ran out lets the next worker take the job over
+		first, err := store.ClaimJob(ctx, job.ID, -time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		runnable, _ := store.ListRunnableJobs(ctx)
+		if len(runnable) != 1 {
+			t.Errorf("ListRunnableJobs() with an expired lease = %v, want the job", runnable)
+		}
+		second, err := store.ClaimJob(ctx, job.ID, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.Attempts != 2 || second.LeaseOwner == first.LeaseOwner {
+			t.Errorf("taken over job = %+v", second)
+		}
+
+		first.State = JobFailed
+		err = store.FinishAttempt(ctx, first)
+		if !errors.Is(err, ErrJobLeaseLost) {
+			t.Errorf("FinishAttempt() of the first worker error = %v, want ErrJobLeaseLost", err)
+		}
+		got, _ := store.GetJob(ctx, job.ID)
+		if got.State != JobRunning || got.LeaseOwner != second.LeaseOwner {
+			t.Errorf("job after the lost FinishAttempt() = %+v, want it still held by the second worker", got)
+		}
+	})
+}
+
+func TestJobStoreExpiresFinishedJobs(t *testing.T) {
+	jobStores(t, func(t *testing.T, store JobStore) {
+		ctx := context.Background()
+		expired := newTestJob(time.Now())
+		expired.State = JobSucceeded
+		expired.ExpiresAt = time.Now().Add(-time.Minute).Unix()
+		kept := newTestJob(time.Now())
+		kept.State = JobFailed
+		kept.ExpiresAt = time.Now().Add(time.Hour).Unix()
+		for _, job := range []Job{expired, kept} {
+			err := store.PutJob(ctx, job)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err := store.ListRunnableJobs(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetJob(ctx, expired.ID)
+		if !errors.Is(err, ErrJobNotFound) {
+			t.Errorf("GetJob() of an expired job error = %v, want ErrJobNotFound", err)
+		}
+		_, err = store.GetJob(ctx, kept.ID)
+		if err != nil {
+			t.Errorf("GetJob() of a job within its retention error = %v", err)
+		}
+	})
+}
+
+func TestJobItemKeysAreStrings(t *testing.T) {
+	job := newTestJob(time.Now())
+	item, err := marshalJob(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"id": job.ID.String(), "user_id": job.UserID.String()} {
+		value, ok := item[name].(*types.AttributeValueMemberS)
+		if !ok || value.Value != want {
+			t.Errorf("%s = %#v, want string %s", name, item[name], want)
+		}
+	}
+
+	got, err := unmarshalJob(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != job.ID || got.UserID != job.UserID || got.Kind != job.Kind || !got.CreatedAt.Equal(job.CreatedAt) {
+		t.Errorf("unmarshalJob() = %+v, want %+v", got, job)
+	}
+}
@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/models"
+	"github.com/google/uuid"
+	"sort"
+	"strings"
+)
+
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+
+	ARecordDelegation = "arecord"
+	CNameDelegation   = "cname"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+	ErrInvalidFilter = errors.New("invalid filter")
+)
+
+// DomainFilter narrows a listing, unset fields match everything
+type DomainFilter struct {
+	// UserID lists the domains of one user, uuid.Nil lists every user's
+	UserID         uuid.UUID
+	Verified       *bool
+	HasCertificate *bool
+	// Delegation is ARecordDelegation or CNameDelegation, matching domains that have such a delegation recorded
+	Delegation string
+	NamePrefix string
+}
+
+// DomainPage is one page of a listing, NextCursor is empty on the last page. A page can hold fewer than the
+// requested domains and still have a next one.
+type DomainPage struct {
+	Domains    []models.DomainInformation `json:"domains"`
+	NextCursor string                     `json:"next_cursor,omitempty"`
+}
+
+// pageCursor is where the next page starts, it is the key of the last domain that was looked at. Clients get it as
+// an opaque token.
+type pageCursor struct {
+	UserID     string `dynamodbav:"user_id" json:"user_id"`
+	DomainName string `dynamodbav:"domain_name" json:"domain_name"`
+}
+
+func (c pageCursor) encode() string {
+	cursorBytes, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(cursorBytes)
+}
+
+func decodeCursor(cursor string) (*pageCursor, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	cursorBytes, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c pageCursor
+	err = json.Unmarshal(cursorBytes, &c)
+	if err != nil || c.UserID == "" || c.DomainName == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+// after reports whether the key sorts after the cursor, listings are ordered by user and then domain name
+func (c *pageCursor) after(userID string, domainName string) bool {
+	if c == nil {
+		return true
+	}
+	if userID != c.UserID {
+		return userID > c.UserID
+	}
+	return domainName > c.DomainName
+}
+
+// PageSize clamps a requested page size to what a listing allows
+func PageSize(limit int) int {
+	if limit <= 0 {
+		return DefaultPageSize
+	}
+	if limit > MaxPageSize {
+		return MaxPageSize
+	}
+	return limit
+}
+
+// Validate rejects filters a backend can't express
+func (f DomainFilter) Validate() error {
+	switch f.Delegation {
+	case "", ARecordDelegation, CNameDelegation:
+		return nil
+	default:
+		return fmt.Errorf("%w: unknown delegation type: %s", ErrInvalidFilter, f.Delegation)
+	}
+}
+
+// Matches applies the filter to one domain
+func (f DomainFilter) Matches(domainInfo models.DomainInformation) bool {
+	if f.UserID != uuid.Nil && domainInfo.UserID != f.UserID {
+		return false
+	}
+	if !strings.HasPrefix(domainInfo.DomainName, f.NamePrefix) {
+		return false
+	}
+	if f.Verified != nil && domainInfo.Verification.Verified != *f.Verified {
+		return false
+	}
+	if f.HasCertificate != nil && (domainInfo.Verification.CertInfo.CertURL != "") != *f.HasCertificate {
+		return false
+	}
+	switch f.Delegation {
+	case ARecordDelegation:
+		return len(domainInfo.Delegations.ARecords) > 0
+	case CNameDelegation:
+		return len(domainInfo.Delegations.CNames) > 0
+	}
+	return true
+}
+
+// pageFromUsers pages through domains that are already in memory
+func pageFromUsers(users []models.User, filter DomainFilter, limit int, cursor string) (DomainPage, error) {
+	start, err := decodeCursor(cursor)
+	if err != nil {
+		return DomainPage{}, err
+	}
+	limit = PageSize(limit)
+
+	var keys []pageCursor
+	domains := map[pageCursor]models.DomainInformation{}
+	for _, user := range users {
+		for name, domainInfo := range user.Domains {
+			key := pageCursor{UserID: user.ID, DomainName: name}
+			if !start.after(key.UserID, key.DomainName) || !filter.Matches(domainInfo) {
+				continue
+			}
+			keys = append(keys, key)
+			domains[key] = domainInfo
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].UserID != keys[j].UserID {
+			return keys[i].UserID < keys[j].UserID
+		}
+		return keys[i].DomainName < keys[j].DomainName
+	})
+
+	page := DomainPage{Domains: []models.DomainInformation{}}
+	for i, key := range keys {
+		if i == limit {
+			page.NextCursor = keys[i-1].encode()
+			break
+		}
+		page.Domains = append(page.Domains, domains[key])
+	}
+	return page, nil
+}
+
+func sortRecords(records []DomainRecord) {
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].UserID != records[j].UserID {
+			return records[i].UserID < records[j].UserID
+		}
+		return records[i].DomainName < records[j].DomainName
+	})
+}
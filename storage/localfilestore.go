@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const tempFilePrefix = ".tmp-"
+
+// LocalFileStore keeps every object as a file under a directory, for running without S3. Only the owner can read
+// the directory and its files.
+type LocalFileStore struct {
+	directory string
+}
+
+func NewLocalFileStore(settings appconfig.LocalFileStoreSettings) (*LocalFileStore, error) {
+	if settings.Directory == "" {
+		return nil, fmt.Errorf("the local file_store needs a directory")
+	}
+	directory, err := filepath.Abs(settings.Directory)
+	if err != nil {
+		return nil, fmt.Errorf("file store directory: %s: %w", settings.Directory, err)
+	}
+	err = os.MkdirAll(directory, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create file store directory: %s: %w", directory, err)
+	}
+	// MkdirAll leaves an existing directory as it was
+	err = os.Chmod(directory, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to restrict file store directory: %s: %w", directory, err)
+	}
+	return &LocalFileStore{directory: directory}, nil
+}
+
+// validObjectKey refuses keys that would resolve outside of the directory or to the directory itself
+func validObjectKey(key string) bool {
+	return key != "" && key != "." && path.Clean(key) == key && !path.IsAbs(key) &&
+		key != ".." && !strings.HasPrefix(key, "../") && !strings.HasPrefix(path.Base(key), tempFilePrefix)
+}
+
+func (l *LocalFileStore) path(key string) (string, error) {
+	if !validObjectKey(key) {
+		return "", fmt.Errorf("invalid object key: %q", key)
+	}
+	return filepath.Join(l.directory, filepath.FromSlash(key)), nil
+}
+
+func (l *LocalFileStore) Get(_ context.Context, key string) ([]byte, error) {
+	objectPath, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(objectPath)
+	if err != nil {
+		// A key that is only a prefix of other keys is a directory here, in S3 it doesn't exist
+		info, statErr := os.Stat(objectPath)
+		if errors.Is(err, fs.ErrNotExist) || (statErr == nil && info.IsDir()) {
+			return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+		}
+		return nil, fmt.Errorf("unable to get object: %s: %w", key, err)
+	}
+	return data, nil
+}
+
+// Put writes the object to a temporary file next to it and renames it into place, so that readers see either the
+// old or the new object and never a partial one
+func (l *LocalFileStore) Put(_ context.Context, key string, data []byte) error {
+	objectPath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	tmpPath, err := writeTempFile(objectPath, data)
+	if err != nil {
+		return fmt.Errorf("unable to put object: %s: %w", key, err)
+	}
+	defer os.Remove(tmpPath)
+
+	err = os.Rename(tmpPath, objectPath)
+	if err != nil {
+		return fmt.Errorf("unable to put object: %s: %w", key, err)
+	}
+	return syncDir(filepath.Dir(objectPath))
+}
+
+// Create writes the object like Put but links it into place, which unlike a rename fails when the key exists
+func (l *LocalFileStore) Create(_ context.Context, key string, data []byte) error {
+	objectPath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	tmpPath, err := writeTempFile(objectPath, data)
+	if err != nil {
+		return fmt.Errorf("unable to create object: %s: %w", key, err)
+	}
+	defer os.Remove(tmpPath)
+
+	err = os.Link(tmpPath, objectPath)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%s: %w", key, ErrObjectExists)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create object: %s: %w", key, err)
+	}
+	return syncDir(filepath.Dir(objectPath))
+}
+
+// writeTempFile writes data to a new temporary file in the directory of objectPath and returns its path
+func writeTempFile(objectPath string, data []byte) (string, error) {
+	dir := filepath.Dir(objectPath)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", err
+	}
+
+	// CreateTemp opens the file with 0600
+	tmp, err := os.CreateTemp(dir, tempFilePrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// syncDir makes a rename in dir survive a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (l *LocalFileStore) List(_ context.Context, prefix string) ([]string, error) {
+	// Only walk the directory the prefix is in, a prefix that isn't a valid key walks everything and filters
+	root := l.directory
+	if i := strings.LastIndex(prefix, "/"); i > 0 && validObjectKey(prefix[:i]) {
+		root = filepath.Join(l.directory, filepath.FromSlash(prefix[:i]))
+	}
+
+	var keys []string
+	err := filepath.WalkDir(root, func(walkPath string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			return nil
+		}
+		relative, err := filepath.Rel(l.directory, walkPath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list objects: %s: %w", prefix, err)
+	}
+	// WalkDir goes through a directory before its siblings that sort after it, e.g. "a/b" before "a-c"
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (l *LocalFileStore) Delete(_ context.Context, key string) error {
+	objectPath, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(objectPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("unable to delete object: %s: %w", key, err)
+	}
+	return nil
+}
+
+func (l *LocalFileStore) Stat(_ context.Context, key string) (ObjectInfo, error) {
+	objectPath, err := l.path(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	info, err := os.Stat(objectPath)
+	if errors.Is(err, fs.ErrNotExist) || (err == nil && info.IsDir()) {
+		return ObjectInfo{}, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("unable to stat object: %s: %w", key, err)
+	}
+	return ObjectInfo{Key: key, Size: info.Size(), ModifiedAt: info.ModTime()}, nil
+}
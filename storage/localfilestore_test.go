@@ -0,0 +1,284 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newTestLocalFileStore(t *testing.T) *LocalFileStore {
+	t.Helper()
+	store, err := NewLocalFileStore(appconfig.LocalFileStoreSettings{Directory: filepath.Join(t.TempDir(), "objects")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+// tempFiles returns the temporary files left anywhere under the store's directory
+func tempFiles(t *testing.T, store *LocalFileStore) []string {
+	t.Helper()
+	var names []string
+	err := filepath.WalkDir(store.directory, func(walkPath string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			names = append(names, walkPath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+func TestValidObjectKey(t *testing.T) {
+	for key, want := range map[string]bool{
+		"mastodon_le_certs/example.com/cert.crt": true,
+		"account.key":                            true,
+		"a/..b/c":                                true,
+		"":                                       false,
+		".":                                      false,
+		"..":                                     false,
+		"../outside":                             false,
+		"a/../../outside":                        false,
+		"a/../b":                                 false,
+		"/etc/passwd":                            false,
+		"a//b":                                   false,
+		"a/b/":                                   false,
+		"./a":                                    false,
+		"a/" + tempFilePrefix + "123":            false,
+	} {
+		if got := validObjectKey(key); got != want {
+			t.Errorf("validObjectKey(%q) = %t, want %t", key, got, want)
+		}
+	}
+}
+
+func TestLocalFileStoreRefusesKeysOutsideDirectory(t *testing.T) {
+	store := newTestLocalFileStore(t)
+	ctx := context.Background()
+	outside := filepath.Join(filepath.Dir(store.directory), "outside")
+
+	for _, key := range []string{"../outside", "a/../../outside", "/outside", ""} {
+		if err := store.Put(ctx, key, []byte("data")); err == nil {
+			t.Errorf("Put(%q) succeeded", key)
+		}
+		if err := store.Create(ctx, key, []byte("data")); err == nil {
+			t.Errorf("Create(%q) succeeded", key)
+		}
+		if _, err := store.Get(ctx, key); err == nil || errors.Is(err, ErrObjectNotFound) {
+			t.Errorf("Get(%q) = %v, want an invalid key error", key, err)
+		}
+		if err := store.Delete(ctx, key); err == nil {
+			t.Errorf("Delete(%q) succeeded", key)
+		}
+		if _, err := store.Stat(ctx, key); err == nil {
+			t.Errorf("Stat(%q) succeeded", key)
+		}
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Errorf("expected nothing to be written outside the directory, got %v", err)
+	}
+}
+
+func TestLocalFileStorePutGet(t *testing.T) {
+	store := newTestLocalFileStore(t)
+	ctx := context.Background()
+	key := "mastodon_le_certs/example.com/cert.crt"
+
+	_, err := store.Get(ctx, key)
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Fatalf("expected ErrObjectNotFound, got %v", err)
+	}
+	for _, data := range [][]byte{[]byte("first"), []byte("second")} {
+		err = store.Put(ctx, key, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Get() = %q, want %q", got, data)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(store.directory, "mastodon_le_certs", "example.com", "cert.crt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("object mode = %v, want 0600", info.Mode().Perm())
+	}
+	if names := tempFiles(t, store); len(names) != 0 {
+		t.Errorf("expected no temporary files, got %v", names)
+	}
+
+	// A prefix of other keys is a directory on disk but no object
+	_, err = store.Get(ctx, "mastodon_le_certs/example.com")
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound for a prefix, got %v", err)
+	}
+	keys, err := store.List(ctx, "mastodon_le_certs/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{key}) {
+		t.Errorf("List() = %v", keys)
+	}
+
+	err = store.Delete(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.Stat(ctx, key)
+	if !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("expected ErrObjectNotFound after Delete, got %v", err)
+	}
+}
+
+func TestLocalFileStoreListIsLexical(t *testing.T) {
+	store := newTestLocalFileStore(t)
+	ctx := context.Background()
+	// "a-c" sorts before "a/b" but the walk reaches the directory a first
+	for _, key := range []string{"a/b", "a-c", "a/a/z", "b"} {
+		err := store.Put(ctx, key, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := store.List(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a-c", "a/a/z", "a/b", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List() = %v, want %v", keys, want)
+	}
+	keys, err = store.List(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a-c", "a/a/z", "a/b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("List(a) = %v, want %v", keys, want)
+	}
+}
+
+func TestLocalFileStorePutIsAtomic(t *testing.T) {
+	store := newTestLocalFileStore(t)
+	ctx := context.Background()
+	versions := [][]byte{bytes.Repeat([]byte("a"), 1<<16), bytes.Repeat([]byte("b"), 1<<16)}
+	err := store.Put(ctx, "object", versions[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for i := 0; i < 200; i++ {
+			if err := store.Put(ctx, "object", versions[i%2]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+		data, err := store.Get(ctx, "object")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, versions[0]) && !bytes.Equal(data, versions[1]) {
+			t.Fatalf("read a partial object of %d bytes", len(data))
+		}
+	}
+	wg.Wait()
+	if names := tempFiles(t, store); len(names) != 0 {
+		t.Errorf("expected no temporary files, got %v", names)
+	}
+}
+
+func TestLocalFileStoreCreate(t *testing.T) {
+	store := newTestLocalFileStore(t)
+	ctx := context.Background()
+
+	const contenders = 8
+	var wg sync.WaitGroup
+	errs := make([]error, contenders)
+	for i := 0; i < contenders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.Create(ctx, "account.key", []byte{byte(i)})
+		}(i)
+	}
+	wg.Wait()
+
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && winner == -1:
+			winner = i
+		case err == nil:
+			t.Fatalf("both %d and %d created the object", winner, i)
+		case !errors.Is(err, ErrObjectExists):
+			t.Fatal(err)
+		}
+	}
+	if winner == -1 {
+		t.Fatal("expected one Create to succeed")
+	}
+	data, err := store.Get(ctx, "account.key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, []byte{byte(winner)}) {
+		t.Errorf("Get() = %v, want the winner's %d", data, winner)
+	}
+	if names := tempFiles(t, store); len(names) != 0 {
+		t.Errorf("expected no temporary files, got %v", names)
+	}
+}
+
+func TestNewLocalFileStoreRestrictsDirectory(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "objects")
+	err := os.Mkdir(directory, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewLocalFileStore(appconfig.LocalFileStoreSettings{Directory: directory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("directory mode = %v, want 0700", info.Mode().Perm())
+	}
+
+	_, err = NewLocalFileStore(appconfig.LocalFileStoreSettings{})
+	if err == nil {
+		t.Error("expected a store without a directory to be refused")
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemoryFileStore keeps objects in memory, for tests and running locally. Everything is gone when the process exits.
+type MemoryFileStore struct {
+	mu      sync.RWMutex
+	objects map[string]memoryObject
+}
+
+type memoryObject struct {
+	data       []byte
+	modifiedAt time.Time
+}
+
+func NewMemoryFileStore() *MemoryFileStore {
+	return &MemoryFileStore{objects: make(map[string]memoryObject)}
+}
+
+func (m *MemoryFileStore) Get(_ context.Context, key string) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	return append([]byte{}, object.data...), nil
+}
+
+func (m *MemoryFileStore) Put(_ context.Context, key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memoryObject{data: append([]byte{}, data...), modifiedAt: time.Now()}
+	return nil
+}
+
+func (m *MemoryFileStore) Create(_ context.Context, key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.objects[key]; ok {
+		return fmt.Errorf("%s: %w", key, ErrObjectExists)
+	}
+	m.objects[key] = memoryObject{data: append([]byte{}, data...), modifiedAt: time.Now()}
+	return nil
+}
+
+func (m *MemoryFileStore) List(_ context.Context, prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var keys []string
+	for key := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *MemoryFileStore) Delete(_ context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *MemoryFileStore) Stat(_ context.Context, key string) (ObjectInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	object, ok := m.objects[key]
+	if !ok {
+		return ObjectInfo{}, fmt.Errorf("%s: %w", key, ErrObjectNotFound)
+	}
+	return ObjectInfo{Key: key, Size: int64(len(object.data)), ModifiedAt: object.modifiedAt}, nil
+}
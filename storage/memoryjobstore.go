@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryJobStore keeps jobs in memory next to a MemoryDomainStore, they are gone when the process exits
+type MemoryJobStore struct {
+	mu   sync.Mutex
+	jobs map[uuid.UUID]Job
+}
+
+func NewMemoryJobStore() *MemoryJobStore {
+	return &MemoryJobStore{
+		jobs: map[uuid.UUID]Job{},
+	}
+}
+
+func (m *MemoryJobStore) GetJob(ctx context.Context, id uuid.UUID) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%s: %w", id, ErrJobNotFound)
+	}
+	return job, nil
+}
+
+func (m *MemoryJobStore) PutJob(ctx context.Context, job Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.UpdatedAt = time.Now()
+	m.jobs[job.ID] = job
+	return nil
+}
+
+func (m *MemoryJobStore) FinishAttempt(ctx context.Context, job Job) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.jobs[job.ID]
+	if !ok || stored.LeaseOwner != job.LeaseOwner || stored.LeaseExpiresAt != job.LeaseExpiresAt {
+		return fmt.Errorf("%s: %w", job.ID, ErrJobLeaseLost)
+	}
+	job.UpdatedAt = time.Now()
+	m.jobs[job.ID] = job
+	return nil
+}
+
+func (m *MemoryJobStore) UpdateJobProgress(ctx context.Context, id uuid.UUID, progress json.RawMessage) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return fmt.Errorf("%s: %w", id, ErrJobNotFound)
+	}
+	job.Progress = progress
+	job.UpdatedAt = time.Now()
+	m.jobs[id] = job
+	return nil
+}
+
+func (m *MemoryJobStore) ClaimJob(ctx context.Context, id uuid.UUID, leaseDuration time.Duration) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	job, ok := m.jobs[id]
+	if !ok || !job.runnable(now.Unix()) {
+		return Job{}, fmt.Errorf("%s: %w", id, ErrJobAlreadyHeld)
+	}
+	job.State = JobRunning
+	job.Attempts++
+	job.LeaseExpiresAt = now.Add(leaseDuration).Unix()
+	job.LeaseOwner = uuid.NewString()
+	job.UpdatedAt = now
+	m.jobs[id] = job
+	return job, nil
+}
+
+// ListRunnableJobs also drops the finished jobs whose retention ended, like the TTL of the DynamoDB table does
+func (m *MemoryJobStore) ListRunnableJobs(ctx context.Context) ([]Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now().Unix()
+	var jobs []Job
+	for id, job := range m.jobs {
+		if job.ExpiresAt > 0 && job.ExpiresAt < now {
+			delete(m.jobs, id)
+			continue
+		}
+		if job.runnable(now) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].NextAttemptAt < jobs[j].NextAttemptAt })
+	return jobs, nil
+}
+
+// runnable is the condition ClaimJob puts on the DynamoDB update
+func (j Job) runnable(now int64) bool {
+	return (j.State == JobPending && j.NextAttemptAt <= now) || (j.State == JobRunning && j.LeaseExpiresAt < now)
+}
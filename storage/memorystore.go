@@ -0,0 +1,235 @@
+package storage
+
+import (
+	"context"
+	"github.com/edwinavalos/common/models"
+	"github.com/google/uuid"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryDomainStore keeps domains in memory, for tests and running locally without dynamodb-local. Everything is gone
+// when the process exits.
+type MemoryDomainStore struct {
+	mu sync.RWMutex
+	// records are keyed by user id and domain name
+	records map[[2]string]DomainRecord
+	claims  map[string]NameClaim
+}
+
+func NewMemoryDomainStore() *MemoryDomainStore {
+	return &MemoryDomainStore{
+		records: map[[2]string]DomainRecord{},
+		claims:  map[string]NameClaim{},
+	}
+}
+
+func memoryKey(userID string, domainName string) [2]string {
+	return [2]string{userID, domainName}
+}
+
+func (m *MemoryDomainStore) GetUser(ctx context.Context, userID uuid.UUID) (models.User, error) {
+	domains, err := m.GetUserDomains(ctx, userID)
+	if err != nil {
+		return models.User{}, err
+	}
+	return models.User{ID: userID.String(), Domains: domains}, nil
+}
+
+func (m *MemoryDomainStore) GetDomainByUser(ctx context.Context, userID uuid.UUID, domain string) (models.DomainInformation, error) {
+	record, err := m.GetDomainRecord(ctx, userID, domain)
+	if err != nil {
+		return models.DomainInformation{}, err
+	}
+	if record.Deleted != nil {
+		return models.DomainInformation{}, domainNotFound(userID, domain)
+	}
+	return record.Domain, nil
+}
+
+func (m *MemoryDomainStore) PutDomainInfo(ctx context.Context, domainInfo models.DomainInformation) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memoryKey(domainInfo.UserID.String(), domainInfo.DomainName)
+	record := m.records[key]
+	m.records[key] = DomainRecord{
+		UserID:        key[0],
+		DomainName:    key[1],
+		Domain:        domainInfo,
+		Version:       record.Version + 1,
+		UpdatedAt:     time.Now(),
+		Deleted:       record.Deleted,
+		Pending:       record.Pending,
+		History:       record.History,
+		SchemaVersion: CurrentSchemaVersion,
+	}
+	return nil
+}
+
+func (m *MemoryDomainStore) GetDomainRecord(ctx context.Context, userID uuid.UUID, domain string) (DomainRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	record, ok := m.records[memoryKey(userID.String(), domain)]
+	if !ok {
+		return DomainRecord{}, domainNotFound(userID, domain)
+	}
+	return record, nil
+}
+
+func (m *MemoryDomainStore) PutDomainRecord(ctx context.Context, record DomainRecord) (DomainRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	record.UserID = record.Domain.UserID.String()
+	record.DomainName = record.Domain.DomainName
+	key := memoryKey(record.UserID, record.DomainName)
+	if m.records[key].Version != record.Version {
+		return DomainRecord{}, &ConflictError{UserID: record.UserID, DomainName: record.DomainName, Version: record.Version}
+	}
+	record.Version++
+	record.UpdatedAt = time.Now()
+	record.SchemaVersion = CurrentSchemaVersion
+	record.upgraded = false
+	m.records[key] = record
+	return record, nil
+}
+
+func (m *MemoryDomainStore) GetUserDomains(ctx context.Context, userID uuid.UUID) (map[string]models.DomainInformation, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	domains := map[string]models.DomainInformation{}
+	for key, record := range m.records {
+		if key[0] == userID.String() && record.Deleted == nil {
+			domains[key[1]] = record.Domain
+		}
+	}
+	return domains, nil
+}
+
+func (m *MemoryDomainStore) DeleteDomain(ctx context.Context, userID uuid.UUID, domainName string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.records, memoryKey(userID.String(), domainName))
+	return nil
+}
+
+func (m *MemoryDomainStore) DeleteDomainRecord(ctx context.Context, record DomainRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := memoryKey(record.Domain.UserID.String(), record.Domain.DomainName)
+	current, ok := m.records[key]
+	if !ok || current.Version != record.Version {
+		return &ConflictError{UserID: record.Domain.UserID.String(), DomainName: record.Domain.DomainName, Version: record.Version}
+	}
+	delete(m.records, key)
+	return nil
+}
+
+func (m *MemoryDomainStore) GetAllRecords(ctx context.Context) ([]models.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	users := map[string]models.User{}
+	for key, record := range m.records {
+		if record.Deleted != nil {
+			continue
+		}
+		user, ok := users[key[0]]
+		if !ok {
+			user = models.User{ID: key[0], Domains: map[string]models.DomainInformation{}}
+		}
+		user.Domains[key[1]] = record.Domain
+		users[key[0]] = user
+	}
+
+	var retRecords []models.User
+	for _, user := range users {
+		retRecords = append(retRecords, user)
+	}
+	sort.Slice(retRecords, func(i, j int) bool { return retRecords[i].ID < retRecords[j].ID })
+	return retRecords, nil
+}
+
+func (m *MemoryDomainStore) GetDomainsByName(ctx context.Context, domainName string) ([]models.DomainInformation, error) {
+	users, err := m.GetAllRecords(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return domainsByName(users, domainName), nil
+}
+
+func (m *MemoryDomainStore) ListDomains(ctx context.Context, filter DomainFilter, limit int, cursor string) (DomainPage, error) {
+	users, err := m.GetAllRecords(ctx)
+	if err != nil {
+		return DomainPage{}, err
+	}
+	return pageFromUsers(users, filter, limit, cursor)
+}
+
+func (m *MemoryDomainStore) ListDeletedDomains(ctx context.Context, purgeBefore time.Time) ([]DomainRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var deleted []DomainRecord
+	for _, record := range m.records {
+		if record.Deleted != nil && record.Deleted.PurgeAfter.Before(purgeBefore) {
+			deleted = append(deleted, record)
+		}
+	}
+	sortRecords(deleted)
+	return deleted, nil
+}
+
+func (m *MemoryDomainStore) ListPendingDomains(ctx context.Context) ([]DomainRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var pending []DomainRecord
+	for _, record := range m.records {
+		if record.Pending != nil && record.Deleted == nil {
+			pending = append(pending, record)
+		}
+	}
+	sortRecords(pending)
+	return pending, nil
+}
+
+func (m *MemoryDomainStore) ListDomainRecords(ctx context.Context) ([]DomainRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	var records []DomainRecord
+	for _, record := range m.records {
+		records = append(records, record)
+	}
+	sortRecords(records)
+	return records, nil
+}
+
+// copyUser keeps callers from changing the stored domains through the returned map
+func copyUser(user models.User) models.User {
+	userCopy := models.User{ID: user.ID}
+	if user.Domains != nil {
+		userCopy.Domains = make(map[string]models.DomainInformation, len(user.Domains))
+		for name, domainInfo := range user.Domains {
+			userCopy.Domains[name] = domainInfo
+		}
+	}
+	return userCopy
+}
+
+func (m *MemoryDomainStore) GetNameClaim(ctx context.Context, domainName string) (NameClaim, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.claims[domainName], nil
+}
+
+func (m *MemoryDomainStore) SwapNameClaim(ctx context.Context, domainName string, previous uuid.UUID, holder uuid.UUID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.claims[domainName].UserID != previous {
+		return nameClaimChanged(domainName)
+	}
+	if holder == uuid.Nil {
+		delete(m.claims, domainName)
+		return nil
+	}
+	m.claims[domainName] = NameClaim{DomainName: domainName, UserID: holder, ClaimedAt: time.Now()}
+	return nil
+}
@@ -0,0 +1,343 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/edwinavalos/common/logger"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"strings"
+	"time"
+)
+
+const (
+	PayPerRequestBilling = "pay_per_request"
+	ProvisionedBilling   = "provisioned"
+
+	defaultCapacityUnits = 10
+)
+
+var ErrTableDrift = errors.New("table differs from its definition")
+
+// tableDefinition is the shape the service expects of a table it creates, billing and backups come from
+// appconfig.TableSettings
+type tableDefinition struct {
+	name       string
+	attributes []types.AttributeDefinition
+	keySchema  []types.KeySchemaElement
+	// indexes are needed by queries, they are added to an existing table that lacks them
+	indexes []types.GlobalSecondaryIndex
+	// ttlAttribute is the number attribute DynamoDB expires items by, empty when items never expire
+	ttlAttribute string
+}
+
+// TableDrift is one way an existing table differs from what the service would create
+type TableDrift struct {
+	Table    string
+	Setting  string
+	Expected string
+	Actual   string
+}
+
+func (d TableDrift) String() string {
+	return fmt.Sprintf("%s expected: %s actual: %s", d.Setting, d.Expected, d.Actual)
+}
+
+func hashKey(name string) []types.KeySchemaElement {
+	return []types.KeySchemaElement{{AttributeName: aws.String(name), KeyType: types.KeyTypeHash}}
+}
+
+func stringAttributes(names ...string) []types.AttributeDefinition {
+	var attributes []types.AttributeDefinition
+	for _, name := range names {
+		attributes = append(attributes, types.AttributeDefinition{
+			AttributeName: aws.String(name),
+			AttributeType: types.ScalarAttributeTypeS,
+		})
+	}
+	return attributes
+}
+
+// indexAttributes returns the definitions of the attributes index is keyed by
+func (d tableDefinition) indexAttributes(index types.GlobalSecondaryIndex) []types.AttributeDefinition {
+	var attributes []types.AttributeDefinition
+	for _, element := range index.KeySchema {
+		for _, attribute := range d.attributes {
+			if aws.ToString(attribute.AttributeName) == aws.ToString(element.AttributeName) {
+				attributes = append(attributes, attribute)
+			}
+		}
+	}
+	return attributes
+}
+
+func billingMode(settings appconfig.TableSettings) (types.BillingMode, error) {
+	switch settings.BillingMode {
+	case "", PayPerRequestBilling:
+		return types.BillingModePayPerRequest, nil
+	case ProvisionedBilling:
+		return types.BillingModeProvisioned, nil
+	default:
+		return "", fmt.Errorf("unknown billing_mode: %s", settings.BillingMode)
+	}
+}
+
+func provisionedThroughput(settings appconfig.TableSettings) *types.ProvisionedThroughput {
+	throughput := &types.ProvisionedThroughput{
+		ReadCapacityUnits:  aws.Int64(settings.ReadCapacity),
+		WriteCapacityUnits: aws.Int64(settings.WriteCapacity),
+	}
+	if settings.ReadCapacity <= 0 {
+		throughput.ReadCapacityUnits = aws.Int64(defaultCapacityUnits)
+	}
+	if settings.WriteCapacity <= 0 {
+		throughput.WriteCapacityUnits = aws.Int64(defaultCapacityUnits)
+	}
+	return throughput
+}
+
+// ensureTable creates the table when it doesn't exist yet. An existing table only gets the indexes and time to live
+// the service can't work without, the rest is compared against the definition.
+func ensureTable(ctx context.Context, client *dynamodb.Client, definition tableDefinition, settings appconfig.TableSettings) error {
+	mode, err := billingMode(settings)
+	if err != nil {
+		return err
+	}
+
+	output, err := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(definition.name)})
+	if err == nil {
+		logger.Info("table: %s already exists, not creating", definition.name)
+		table, err := addMissingIndexes(ctx, client, output.Table, definition, settings)
+		if err != nil {
+			return err
+		}
+		err = enableTimeToLive(ctx, client, definition)
+		if err != nil {
+			return err
+		}
+		return checkTableDrift(ctx, client, table, definition, settings)
+	}
+	var notFound *types.ResourceNotFoundException
+	if !errors.As(err, &notFound) {
+		return fmt.Errorf("unable to describe table: %s: %w", definition.name, err)
+	}
+
+	input := &dynamodb.CreateTableInput{
+		TableName:                 aws.String(definition.name),
+		AttributeDefinitions:      definition.attributes,
+		KeySchema:                 definition.keySchema,
+		BillingMode:               mode,
+		DeletionProtectionEnabled: aws.Bool(settings.DeletionProtection),
+	}
+	for _, index := range definition.indexes {
+		if mode == types.BillingModeProvisioned {
+			index.ProvisionedThroughput = provisionedThroughput(settings)
+		}
+		input.GlobalSecondaryIndexes = append(input.GlobalSecondaryIndexes, index)
+	}
+	if mode == types.BillingModeProvisioned {
+		input.ProvisionedThroughput = provisionedThroughput(settings)
+	}
+
+	_, err = client.CreateTable(ctx, input)
+	if err != nil {
+		return fmt.Errorf("unable to create table: %s: %w", definition.name, err)
+	}
+	waiter := dynamodb.NewTableExistsWaiter(client)
+	err = waiter.Wait(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(definition.name)}, 5*time.Minute)
+	if err != nil {
+		return fmt.Errorf("wait for table exists failed: %w", err)
+	}
+
+	if settings.PointInTimeRecovery {
+		_, err = client.UpdateContinuousBackups(ctx, &dynamodb.UpdateContinuousBackupsInput{
+			TableName: aws.String(definition.name),
+			PointInTimeRecoverySpecification: &types.PointInTimeRecoverySpecification{
+				PointInTimeRecoveryEnabled: aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("table: %s unable to enable point in time recovery: %w", definition.name, err)
+		}
+	}
+	err = enableTimeToLive(ctx, client, definition)
+	if err != nil {
+		return err
+	}
+	logger.Info("table: %s created with billing mode: %s", definition.name, mode)
+	return nil
+}
+
+// addMissingIndexes creates the indexes of the definition that an existing table doesn't have yet, DynamoDB
+// backfills them in the background. It returns the table as described afterwards.
+func addMissingIndexes(ctx context.Context, client *dynamodb.Client, table *types.TableDescription, definition tableDefinition, settings appconfig.TableSettings) (*types.TableDescription, error) {
+	// DynamoDB builds one new index at a time, any other missing one is added on a later startup
+	var missing *types.GlobalSecondaryIndex
+	for i, index := range definition.indexes {
+		if findIndex(table, aws.ToString(index.IndexName)) == nil {
+			missing = &definition.indexes[i]
+			break
+		}
+	}
+	if missing == nil {
+		return table, nil
+	}
+
+	var throughput *types.ProvisionedThroughput
+	if table.BillingModeSummary == nil || table.BillingModeSummary.BillingMode != types.BillingModePayPerRequest {
+		throughput = provisionedThroughput(settings)
+	}
+	_, err := client.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName:            aws.String(definition.name),
+		AttributeDefinitions: definition.indexAttributes(*missing),
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{
+			{Create: &types.CreateGlobalSecondaryIndexAction{
+				IndexName:             missing.IndexName,
+				KeySchema:             missing.KeySchema,
+				Projection:            missing.Projection,
+				ProvisionedThroughput: throughput,
+			}},
+		},
+	})
+	if err == nil {
+		logger.Info("table: %s adding index: %s, it is backfilled in the background", definition.name, aws.ToString(missing.IndexName))
+	}
+
+	output, describeErr := client.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(definition.name)})
+	if describeErr != nil {
+		return nil, fmt.Errorf("unable to describe table: %s: %w", definition.name, describeErr)
+	}
+	// Another replica starting at the same time may have added it first
+	if err != nil && findIndex(output.Table, aws.ToString(missing.IndexName)) == nil {
+		return nil, fmt.Errorf("table: %s unable to add index: %s: %w", definition.name, aws.ToString(missing.IndexName), err)
+	}
+	return output.Table, nil
+}
+
+func findIndex(table *types.TableDescription, indexName string) *types.GlobalSecondaryIndexDescription {
+	for i, index := range table.GlobalSecondaryIndexes {
+		if aws.ToString(index.IndexName) == indexName {
+			return &table.GlobalSecondaryIndexes[i]
+		}
+	}
+	return nil
+}
+
+// enableTimeToLive turns on expiring items by the ttl attribute of the definition when it isn't on yet
+func enableTimeToLive(ctx context.Context, client *dynamodb.Client, definition tableDefinition) error {
+	if definition.ttlAttribute == "" {
+		return nil
+	}
+	output, err := client.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(definition.name)})
+	if err != nil {
+		return fmt.Errorf("table: %s unable to describe time to live: %w", definition.name, err)
+	}
+	if description := output.TimeToLiveDescription; description != nil &&
+		aws.ToString(description.AttributeName) == definition.ttlAttribute &&
+		(description.TimeToLiveStatus == types.TimeToLiveStatusEnabled || description.TimeToLiveStatus == types.TimeToLiveStatusEnabling) {
+		return nil
+	}
+
+	_, err = client.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(definition.name),
+		TimeToLiveSpecification: &types.TimeToLiveSpecification{
+			AttributeName: aws.String(definition.ttlAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("table: %s unable to enable time to live on: %s: %w", definition.name, definition.ttlAttribute, err)
+	}
+	logger.Info("table: %s items now expire by: %s", definition.name, definition.ttlAttribute)
+	return nil
+}
+
+// checkTableDrift logs where an existing table differs from the definition, and fails when settings asks for it
+func checkTableDrift(ctx context.Context, client *dynamodb.Client, table *types.TableDescription, definition tableDefinition, settings appconfig.TableSettings) error {
+	backups, err := client.DescribeContinuousBackups(ctx, &dynamodb.DescribeContinuousBackupsInput{
+		TableName: aws.String(definition.name),
+	})
+	if err != nil {
+		return fmt.Errorf("table: %s unable to describe continuous backups: %w", definition.name, err)
+	}
+	pointInTimeRecovery := false
+	if backups.ContinuousBackupsDescription != nil && backups.ContinuousBackupsDescription.PointInTimeRecoveryDescription != nil {
+		pointInTimeRecovery = backups.ContinuousBackupsDescription.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus == types.PointInTimeRecoveryStatusEnabled
+	}
+
+	drift, err := tableDrift(table, pointInTimeRecovery, definition, settings)
+	if err != nil {
+		return err
+	}
+	if len(drift) == 0 {
+		return nil
+	}
+
+	var descriptions []string
+	for _, d := range drift {
+		logger.Error("table: %s drift: %s", d.Table, d)
+		descriptions = append(descriptions, d.String())
+	}
+	if settings.FailOnDrift {
+		return fmt.Errorf("table: %s: %s: %w", definition.name, strings.Join(descriptions, ", "), ErrTableDrift)
+	}
+	return nil
+}
+
+// tableDrift compares a described table with the definition and settings it would be created from
+func tableDrift(table *types.TableDescription, pointInTimeRecovery bool, definition tableDefinition, settings appconfig.TableSettings) ([]TableDrift, error) {
+	mode, err := billingMode(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	var drift []TableDrift
+	add := func(setting string, expected string, actual string) {
+		if expected != actual {
+			drift = append(drift, TableDrift{Table: definition.name, Setting: setting, Expected: expected, Actual: actual})
+		}
+	}
+
+	add("key_schema", keySchemaString(definition.keySchema), keySchemaString(table.KeySchema))
+
+	// Tables that never had their billing mode set report no summary and are provisioned
+	actualMode := types.BillingModeProvisioned
+	if table.BillingModeSummary != nil && table.BillingModeSummary.BillingMode != "" {
+		actualMode = table.BillingModeSummary.BillingMode
+	}
+	add("billing_mode", string(mode), string(actualMode))
+	if mode == types.BillingModeProvisioned && actualMode == types.BillingModeProvisioned && table.ProvisionedThroughput != nil {
+		expected := provisionedThroughput(settings)
+		add("read_capacity", fmt.Sprint(aws.ToInt64(expected.ReadCapacityUnits)), fmt.Sprint(aws.ToInt64(table.ProvisionedThroughput.ReadCapacityUnits)))
+		add("write_capacity", fmt.Sprint(aws.ToInt64(expected.WriteCapacityUnits)), fmt.Sprint(aws.ToInt64(table.ProvisionedThroughput.WriteCapacityUnits)))
+	}
+
+	actualIndexes := map[string]types.GlobalSecondaryIndexDescription{}
+	for _, index := range table.GlobalSecondaryIndexes {
+		actualIndexes[aws.ToString(index.IndexName)] = index
+	}
+	for _, index := range definition.indexes {
+		name := aws.ToString(index.IndexName)
+		actual, ok := actualIndexes[name]
+		if !ok {
+			add("index "+name, keySchemaString(index.KeySchema), "missing")
+			continue
+		}
+		add("index "+name, keySchemaString(index.KeySchema), keySchemaString(actual.KeySchema))
+	}
+
+	add("point_in_time_recovery", fmt.Sprint(settings.PointInTimeRecovery), fmt.Sprint(pointInTimeRecovery))
+	add("deletion_protection", fmt.Sprint(settings.DeletionProtection), fmt.Sprint(aws.ToBool(table.DeletionProtectionEnabled)))
+	return drift, nil
+}
+
+func keySchemaString(keySchema []types.KeySchemaElement) string {
+	var elements []string
+	for _, element := range keySchema {
+		elements = append(elements, fmt.Sprintf("%s:%s", aws.ToString(element.AttributeName), element.KeyType))
+	}
+	return strings.Join(elements, ",")
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"reflect"
+	"testing"
+)
+
+func testTableDefinition() tableDefinition {
+	return tableDefinition{
+		name:       "verifier-domains",
+		attributes: stringAttributes("user_id", "domain_name"),
+		keySchema: []types.KeySchemaElement{
+			{AttributeName: aws.String("user_id"), KeyType: types.KeyTypeHash},
+			{AttributeName: aws.String("domain_name"), KeyType: types.KeyTypeRange},
+		},
+		indexes: []types.GlobalSecondaryIndex{
+			{IndexName: aws.String(DomainNameIndex), KeySchema: hashKey("domain_name")},
+		},
+	}
+}
+
+// testTableDescription is what DynamoDB describes for a table created from testTableDefinition with default settings
+func testTableDescription() *types.TableDescription {
+	definition := testTableDefinition()
+	return &types.TableDescription{
+		KeySchema:          definition.keySchema,
+		BillingModeSummary: &types.BillingModeSummary{BillingMode: types.BillingModePayPerRequest},
+		GlobalSecondaryIndexes: []types.GlobalSecondaryIndexDescription{
+			{IndexName: aws.String(DomainNameIndex), KeySchema: hashKey("domain_name")},
+		},
+		DeletionProtectionEnabled: aws.Bool(false),
+	}
+}
+
+func provisionedTable(read int64, write int64) func(table *types.TableDescription) {
+	return func(table *types.TableDescription) {
+		table.BillingModeSummary = &types.BillingModeSummary{BillingMode: types.BillingModeProvisioned}
+		table.ProvisionedThroughput = &types.ProvisionedThroughputDescription{
+			ReadCapacityUnits:  aws.Int64(read),
+			WriteCapacityUnits: aws.Int64(write),
+		}
+	}
+}
+
+func TestTableDrift(t *testing.T) {
+	const table = "verifier-domains"
+	tests := []struct {
+		name                string
+		settings            appconfig.TableSettings
+		modify              func(table *types.TableDescription)
+		pointInTimeRecovery bool
+		want                []TableDrift
+		wantErr             bool
+	}{
+		{name: "matching table"},
+		{
+			name:     "provisioned table with default capacity",
+			settings: appconfig.TableSettings{BillingMode: ProvisionedBilling},
+			modify:   provisionedTable(defaultCapacityUnits, defaultCapacityUnits),
+		},
+		{
+			name:     "billing mode",
+			settings: appconfig.TableSettings{BillingMode: ProvisionedBilling},
+			want:     []TableDrift{{Table: table, Setting: "billing_mode", Expected: "PROVISIONED", Actual: "PAY_PER_REQUEST"}},
+		},
+		{
+			name:   "no billing summary is provisioned",
+			modify: func(table *types.TableDescription) { table.BillingModeSummary = nil },
+			want:   []TableDrift{{Table: table, Setting: "billing_mode", Expected: "PAY_PER_REQUEST", Actual: "PROVISIONED"}},
+		},
+		{
+			name:     "capacity",
+			settings: appconfig.TableSettings{BillingMode: ProvisionedBilling, ReadCapacity: 5, WriteCapacity: 20},
+			modify:   provisionedTable(10, 10),
+			want: []TableDrift{
+				{Table: table, Setting: "read_capacity", Expected: "5", Actual: "10"},
+				{Table: table, Setting: "write_capacity", Expected: "20", Actual: "10"},
+			},
+		},
+		{
+			name:     "capacity isn't compared across billing modes",
+			settings: appconfig.TableSettings{ReadCapacity: 5},
+			modify: func(table *types.TableDescription) {
+				table.ProvisionedThroughput = &types.ProvisionedThroughputDescription{ReadCapacityUnits: aws.Int64(0), WriteCapacityUnits: aws.Int64(0)}
+			},
+		},
+		{
+			name:   "missing index",
+			modify: func(table *types.TableDescription) { table.GlobalSecondaryIndexes = nil },
+			want:   []TableDrift{{Table: table, Setting: "index " + DomainNameIndex, Expected: "domain_name:HASH", Actual: "missing"}},
+		},
+		{
+			name: "index key schema",
+			modify: func(table *types.TableDescription) {
+				table.GlobalSecondaryIndexes[0].KeySchema = hashKey("user_id")
+			},
+			want: []TableDrift{{Table: table, Setting: "index " + DomainNameIndex, Expected: "domain_name:HASH", Actual: "user_id:HASH"}},
+		},
+		{
+			name:   "key schema",
+			modify: func(table *types.TableDescription) { table.KeySchema = hashKey("user_id") },
+			want:   []TableDrift{{Table: table, Setting: "key_schema", Expected: "user_id:HASH,domain_name:RANGE", Actual: "user_id:HASH"}},
+		},
+		{
+			name:     "point in time recovery off",
+			settings: appconfig.TableSettings{PointInTimeRecovery: true},
+			want:     []TableDrift{{Table: table, Setting: "point_in_time_recovery", Expected: "true", Actual: "false"}},
+		},
+		{
+			name:                "point in time recovery on",
+			pointInTimeRecovery: true,
+			want:                []TableDrift{{Table: table, Setting: "point_in_time_recovery", Expected: "false", Actual: "true"}},
+		},
+		{
+			name:     "deletion protection",
+			settings: appconfig.TableSettings{DeletionProtection: true},
+			modify:   func(table *types.TableDescription) { table.DeletionProtectionEnabled = nil },
+			want:     []TableDrift{{Table: table, Setting: "deletion_protection", Expected: "true", Actual: "false"}},
+		},
+		{
+			name:     "unknown billing mode",
+			settings: appconfig.TableSettings{BillingMode: "on_demand"},
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			description := testTableDescription()
+			if test.modify != nil {
+				test.modify(description)
+			}
+			drift, err := tableDrift(description, test.pointInTimeRecovery, testTableDefinition(), test.settings)
+			if test.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(drift, test.want) {
+				t.Fatalf("drift: %v, want %v", drift, test.want)
+			}
+		})
+	}
+}
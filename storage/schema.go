@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"time"
+)
+
+// CurrentSchemaVersion is the shape records are written in, records read at an older version are upgraded by the
+// registered migrations
+const CurrentSchemaVersion = 1
+
+var ErrSchemaTooNew = errors.New("record was written by a newer schema version")
+
+// Migration upgrades a record stored at From to From+1. decode unmarshals the domain information as it is stored
+// into any struct, so a migration can read fields models.DomainInformation no longer has. It gets the record as it was
+// read with the current models and fixes it up.
+type Migration struct {
+	From        int
+	Description string
+	Upgrade     func(decode func(v any) error, record *DomainRecord) error
+}
+
+var migrations = map[int]Migration{}
+
+// RegisterMigration adds a migration to the registry, every version below CurrentSchemaVersion needs one
+func RegisterMigration(migration Migration) {
+	if _, ok := migrations[migration.From]; ok {
+		panic(fmt.Sprintf("schema migration from version: %d registered twice", migration.From))
+	}
+	migrations[migration.From] = migration
+}
+
+func init() {
+	RegisterMigration(Migration{
+		From:        0,
+		Description: "move Verification.VerificationKey and the expire stamp to Key, Zone and the pending verification",
+		Upgrade:     upgradeVerificationKey,
+	})
+}
+
+// upgradeRecord runs the migrations a record needs to reach CurrentSchemaVersion, the record remembers that it was
+// upgraded so that it can be written back
+func upgradeRecord(decode func(v any) error, record *DomainRecord) error {
+	if record.SchemaVersion > CurrentSchemaVersion {
+		return fmt.Errorf("domain: %s schema version: %d: %w", record.DomainName, record.SchemaVersion, ErrSchemaTooNew)
+	}
+	for record.SchemaVersion < CurrentSchemaVersion {
+		migration, ok := migrations[record.SchemaVersion]
+		if !ok {
+			return fmt.Errorf("domain: %s no schema migration from version: %d", record.DomainName, record.SchemaVersion)
+		}
+		err := migration.Upgrade(decode, record)
+		if err != nil {
+			return fmt.Errorf("domain: %s unable to upgrade schema from version: %d: %w", record.DomainName, record.SchemaVersion, err)
+		}
+		record.SchemaVersion++
+		record.upgraded = true
+	}
+	return nil
+}
+
+// upgradeVerificationKey handles domains written before Verification had Key and Zone, they kept the key in
+// VerificationKey next to stamps for warning about and expiring it. Unversioned records in the current shape have no
+// VerificationKey and pass through unchanged.
+func upgradeVerificationKey(decode func(v any) error, record *DomainRecord) error {
+	var stored struct {
+		Verification struct {
+			VerificationKey         string
+			VerificationExpireStamp time.Time
+		}
+	}
+	err := decode(&stored)
+	if err != nil {
+		return err
+	}
+	old := stored.Verification
+	if old.VerificationKey == "" {
+		return nil
+	}
+
+	verification := &record.Domain.Verification
+	if verification.Key == "" {
+		verification.Key = old.VerificationKey
+		verification.Zone = record.Domain.DomainName + "."
+	}
+	// The warning stamp was when to warn, the sweeper works that out from warn_before now
+	if !verification.Verified && record.Pending == nil && !old.VerificationExpireStamp.IsZero() {
+		expiresAt := old.VerificationExpireStamp
+		record.Pending = &PendingVerification{Since: record.UpdatedAt, KeyExpiresAt: &expiresAt}
+		if record.Pending.Since.IsZero() {
+			record.Pending.Since = time.Now()
+		}
+	}
+	return nil
+}
+
+// SchemaUpgradeResult counts what UpgradeSchema did
+type SchemaUpgradeResult struct {
+	Records  int `json:"records"`
+	Upgraded int `json:"upgraded"`
+	Current  int `json:"current"`
+	Failed   int `json:"failed"`
+}
+
+// UpgradeSchema writes every record stored at an older schema version back in the current one, progress is called
+// after each record. Records only the legacy user items hold are written to the per-domain table, so run
+// migrate-domains first to move them there properly.
+func UpgradeSchema(ctx context.Context, store DomainStore, progress func(done int, total int)) (SchemaUpgradeResult, error) {
+	var result SchemaUpgradeResult
+	records, err := store.ListDomainRecords(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	result.Records = len(records)
+	for i, record := range records {
+		if ctx.Err() != nil {
+			return result, ctx.Err()
+		}
+		if !record.upgraded {
+			result.Current++
+		} else {
+			_, err = store.PutDomainRecord(ctx, record)
+			switch {
+			case err == nil:
+				result.Upgraded++
+			case errors.Is(err, ErrVersionConflict):
+				// Whoever changed the record since it was listed wrote it in the current schema
+				result.Current++
+			default:
+				logger.Error("user: %s domain: %s unable to upgrade schema: %s", record.UserID, record.DomainName, err)
+				result.Failed++
+			}
+		}
+		if progress != nil {
+			progress(i+1, len(records))
+		}
+	}
+	return result, nil
+}
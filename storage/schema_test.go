@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/edwinavalos/common/models"
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+// legacyVerification is how Verification was stored before it had Key and Zone
+type legacyVerification struct {
+	VerificationKey          string
+	Verified                 bool
+	VerificationWarningStamp time.Time
+	VerificationExpireStamp  time.Time
+}
+
+type legacyDomainInformation struct {
+	DomainName   string
+	UserID       uuid.UUID
+	Verification legacyVerification
+}
+
+var legacyExpireStamp = time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+
+func newLegacyDomain(userID uuid.UUID, domainName string, verified bool) legacyDomainInformation {
+	return legacyDomainInformation{
+		DomainName: domainName,
+		UserID:     userID,
+		Verification: legacyVerification{
+			VerificationKey:          "legacy-key",
+			Verified:                 verified,
+			VerificationWarningStamp: legacyExpireStamp.Add(-7 * 24 * time.Hour),
+			VerificationExpireStamp:  legacyExpireStamp,
+		},
+	}
+}
+
+// checkUpgradedLegacyDomain checks a record read from newLegacyDomain
+func checkUpgradedLegacyDomain(t *testing.T, record DomainRecord, verified bool) {
+	t.Helper()
+	if record.SchemaVersion != CurrentSchemaVersion {
+		t.Errorf("SchemaVersion = %d, want %d", record.SchemaVersion, CurrentSchemaVersion)
+	}
+	verification := record.Domain.Verification
+	if verification.Key != "legacy-key" || verification.Zone != record.Domain.DomainName+"." || verification.Verified != verified {
+		t.Errorf("Verification = %+v, want the legacy key in the domain's zone", verification)
+	}
+	switch {
+	case verified && record.Pending != nil:
+		t.Errorf("expected a verified domain not to be pending, got %+v", record.Pending)
+	case !verified && (record.Pending == nil || record.Pending.KeyExpiresAt == nil):
+		t.Errorf("expected the expire stamp to become the pending key expiry, got %+v", record.Pending)
+	case !verified && !record.Pending.KeyExpiresAt.Equal(legacyExpireStamp):
+		t.Errorf("KeyExpiresAt = %s, want %s", record.Pending.KeyExpiresAt, legacyExpireStamp)
+	}
+}
+
+func TestUpgradeRecordFromLegacyVerificationKey(t *testing.T) {
+	for _, verified := range []bool{false, true} {
+		t.Run(fmt.Sprintf("verified=%t", verified), func(t *testing.T) {
+			legacy := newLegacyDomain(uuid.New(), "example.com", verified)
+			info, err := json.Marshal(legacy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var record DomainRecord
+			err = json.Unmarshal(info, &record.Domain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = upgradeRecord(func(v any) error { return json.Unmarshal(info, v) }, &record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !record.Upgraded() {
+				t.Error("expected the record to be marked upgraded")
+			}
+			checkUpgradedLegacyDomain(t, record, verified)
+		})
+	}
+}
+
+func TestUpgradeRecordKeepsCurrentShape(t *testing.T) {
+	record := DomainRecord{DomainName: "example.com"}
+	record.Domain.DomainName = "example.com"
+	record.Domain.Verification.Key = "current-key"
+	record.Domain.Verification.Zone = "_verify.example.com."
+	info, err := json.Marshal(record.Domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = upgradeRecord(func(v any) error { return json.Unmarshal(info, v) }, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.SchemaVersion != CurrentSchemaVersion || record.Pending != nil {
+		t.Errorf("unexpected upgrade: %+v", record)
+	}
+	if record.Domain.Verification.Key != "current-key" || record.Domain.Verification.Zone != "_verify.example.com." {
+		t.Errorf("Verification = %+v, want it unchanged", record.Domain.Verification)
+	}
+
+	record.upgraded = false
+	err = upgradeRecord(func(v any) error { return json.Unmarshal(info, v) }, &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Upgraded() {
+		t.Error("expected a current record not to be upgraded")
+	}
+}
+
+func TestUpgradeRecordRefusesNewerSchema(t *testing.T) {
+	record := DomainRecord{DomainName: "example.com", SchemaVersion: CurrentSchemaVersion + 1}
+	err := upgradeRecord(func(v any) error { return nil }, &record)
+	if !errors.Is(err, ErrSchemaTooNew) {
+		t.Fatalf("expected ErrSchemaTooNew, got %v", err)
+	}
+}
+
+func TestMigrationsCoverEveryVersion(t *testing.T) {
+	for version := 0; version < CurrentSchemaVersion; version++ {
+		if _, ok := migrations[version]; !ok {
+			t.Errorf("no migration from version: %d", version)
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Error("expected registering a version twice to panic")
+		}
+	}()
+	RegisterMigration(Migration{From: 0})
+}
+
+func TestDynamoRecordUpgradesLegacyItem(t *testing.T) {
+	legacy := newLegacyDomain(uuid.New(), "example.com", false)
+	item, err := attributevalue.MarshalMap(struct {
+		UserID     string                  `dynamodbav:"user_id"`
+		DomainName string                  `dynamodbav:"domain_name"`
+		Domain     legacyDomainInformation `dynamodbav:"domain"`
+		Version    int64                   `dynamodbav:"version"`
+	}{legacy.UserID.String(), legacy.DomainName, legacy, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record, err := unmarshalRecord(item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !record.Upgraded() || record.Version != 3 {
+		t.Errorf("expected an upgraded record at version 3, got upgraded: %t version: %d", record.Upgraded(), record.Version)
+	}
+	checkUpgradedLegacyDomain(t, record, false)
+}
+
+// insertLegacyRow stores a domain the way it was written before schema versions
+func insertLegacyRow(t *testing.T, store *SQLDomainStore, legacy legacyDomainInformation) {
+	t.Helper()
+	info, err := json.Marshal(legacy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.db.Exec(
+		fmt.Sprintf("INSERT INTO %s (user_id, domain_name, info, version) VALUES (?, ?, ?, 1)", store.tableName),
+		legacy.UserID.String(), legacy.DomainName, string(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storedSchemaVersion(t *testing.T, store *SQLDomainStore, userID uuid.UUID, domainName string) int {
+	t.Helper()
+	var version int
+	err := store.db.QueryRow(
+		fmt.Sprintf("SELECT schema_version FROM %s WHERE user_id = ? AND domain_name = ?", store.tableName),
+		userID.String(), domainName).Scan(&version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return version
+}
+
+func TestSQLStoreUpgradesOnRead(t *testing.T) {
+	store := newTestSQLDomainStore(t)
+	legacy := newLegacyDomain(uuid.New(), "example.com", false)
+	insertLegacyRow(t, store, legacy)
+
+	record, err := store.GetDomainRecord(context.Background(), legacy.UserID, legacy.DomainName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkUpgradedLegacyDomain(t, record, false)
+	if record.Upgraded() || record.Version != 2 {
+		t.Errorf("expected the upgrade to be written back, got upgraded: %t version: %d", record.Upgraded(), record.Version)
+	}
+	if version := storedSchemaVersion(t, store, legacy.UserID, legacy.DomainName); version != CurrentSchemaVersion {
+		t.Errorf("stored schema_version = %d, want %d", version, CurrentSchemaVersion)
+	}
+}
+
+func TestUpgradeSchemaWritesBackLegacyRecords(t *testing.T) {
+	store := newTestSQLDomainStore(t)
+	ctx := context.Background()
+	unverified := newLegacyDomain(uuid.New(), "a.example.com", false)
+	verified := newLegacyDomain(uuid.New(), "b.example.com", true)
+	insertLegacyRow(t, store, unverified)
+	insertLegacyRow(t, store, verified)
+	_, err := store.PutDomainRecord(ctx, DomainRecord{Domain: models.DomainInformation{DomainName: "c.example.com", UserID: uuid.New()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var calls int
+	result, err := UpgradeSchema(ctx, store, func(done int, total int) { calls++ })
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SchemaUpgradeResult{Records: 3, Upgraded: 2, Current: 1}
+	if result != want || calls != 3 {
+		t.Errorf("UpgradeSchema() = %+v with %d progress calls, want %+v with 3", result, calls, want)
+	}
+
+	for _, legacy := range []legacyDomainInformation{unverified, verified} {
+		if version := storedSchemaVersion(t, store, legacy.UserID, legacy.DomainName); version != CurrentSchemaVersion {
+			t.Errorf("domain: %s stored schema_version = %d, want %d", legacy.DomainName, version, CurrentSchemaVersion)
+		}
+		record, err := store.GetDomainRecord(ctx, legacy.UserID, legacy.DomainName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkUpgradedLegacyDomain(t, record, legacy.Verification.Verified)
+	}
+
+	result, err = UpgradeSchema(ctx, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Upgraded != 0 || result.Current != 3 {
+		t.Errorf("expected a second run to find every record current, got %+v", result)
+	}
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"time"
+)
+
+// jobColumns are the columns scanJob reads
+const jobColumns = "id, kind, user_id, domain, state, attempts, last_error, created_at, updated_at, next_attempt_at, lease_expires_at, lease_owner, expires_at, progress"
+
+// SQLJobStore keeps jobs in a table of the database the SQLDomainStore uses, workers claim them with conditional
+// updates the same way they do on DynamoDB
+type SQLJobStore struct {
+	db        *sql.DB
+	tableName string
+	postgres  bool
+}
+
+// NewSQLJobStore creates the job table next to the domain table, tableName defaults to the domain table's name with a
+// _jobs suffix
+func NewSQLJobStore(domainStore *SQLDomainStore, tableName string) (*SQLJobStore, error) {
+	if tableName == "" {
+		tableName = domainStore.tableName + "_jobs"
+	}
+	store := &SQLJobStore{
+		db:        domainStore.db,
+		tableName: tableName,
+		postgres:  domainStore.postgres,
+	}
+	err := store.createTableIfNotExists(context.TODO())
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *SQLJobStore) createTableIfNotExists(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	id TEXT NOT NULL PRIMARY KEY,
+	kind TEXT NOT NULL,
+	user_id TEXT NOT NULL,
+	domain TEXT NOT NULL,
+	state TEXT NOT NULL,
+	attempts BIGINT NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TEXT NOT NULL,
+	updated_at TEXT NOT NULL,
+	next_attempt_at BIGINT NOT NULL DEFAULT 0,
+	lease_expires_at BIGINT NOT NULL DEFAULT 0,
+	lease_owner TEXT NOT NULL DEFAULT '',
+	expires_at BIGINT NOT NULL DEFAULT 0,
+	progress TEXT
+)`, s.tableName))
+	if err != nil {
+		return fmt.Errorf("unable to create table: %s: %w", s.tableName, err)
+	}
+	for _, index := range [][2]string{
+		{"state_next_attempt_at", "state, next_attempt_at"},
+		{"expires_at", "expires_at"},
+	} {
+		_, err = s.db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_%s ON %s (%s)", s.tableName, index[0], s.tableName, index[1]))
+		if err != nil {
+			return fmt.Errorf("unable to create %s index on: %s: %w", index[0], s.tableName, err)
+		}
+	}
+	return nil
+}
+
+func (s *SQLJobStore) query(query string) string {
+	return rebind(query, s.postgres)
+}
+
+func scanJob(row interface{ Scan(dest ...any) error }) (Job, error) {
+	var job Job
+	var id, userID, createdAt, updatedAt string
+	var progress sql.NullString
+	err := row.Scan(&id, &job.Kind, &userID, &job.Domain, &job.State, &job.Attempts, &job.LastError, &createdAt, &updatedAt,
+		&job.NextAttemptAt, &job.LeaseExpiresAt, &job.LeaseOwner, &job.ExpiresAt, &progress)
+	if err != nil {
+		return Job{}, err
+	}
+	job.ID, err = uuid.Parse(id)
+	if err == nil {
+		job.UserID, err = uuid.Parse(userID)
+	}
+	if err == nil {
+		job.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	}
+	if err == nil {
+		job.UpdatedAt, err = time.Parse(time.RFC3339Nano, updatedAt)
+	}
+	if err != nil {
+		return Job{}, fmt.Errorf("job: %s unable to read row: %w", id, err)
+	}
+	if progress.Valid {
+		job.Progress = json.RawMessage(progress.String)
+	}
+	return job, nil
+}
+
+// jobValues are the columns of jobColumns after id, in order
+func jobValues(job Job) []any {
+	progress := sql.NullString{String: string(job.Progress), Valid: len(job.Progress) > 0}
+	return []any{job.Kind, job.UserID.String(), job.Domain, string(job.State), job.Attempts, job.LastError,
+		job.CreatedAt.Format(time.RFC3339Nano), job.UpdatedAt.Format(time.RFC3339Nano), job.NextAttemptAt,
+		job.LeaseExpiresAt, job.LeaseOwner, job.ExpiresAt, progress}
+}
+
+func (s *SQLJobStore) GetJob(ctx context.Context, id uuid.UUID) (Job, error) {
+	row := s.db.QueryRowContext(ctx, s.query(fmt.Sprintf("SELECT %s FROM %s WHERE id = ?", jobColumns, s.tableName)), id.String())
+	job, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, fmt.Errorf("%s: %w", id, ErrJobNotFound)
+	}
+	return job, err
+}
+
+func (s *SQLJobStore) PutJob(ctx context.Context, job Job) error {
+	job.UpdatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, s.query(fmt.Sprintf(`INSERT INTO %s (%s) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+ON CONFLICT (id) DO UPDATE SET kind = excluded.kind, user_id = excluded.user_id, domain = excluded.domain,
+state = excluded.state, attempts = excluded.attempts, last_error = excluded.last_error, created_at = excluded.created_at,
+updated_at = excluded.updated_at, next_attempt_at = excluded.next_attempt_at, lease_expires_at = excluded.lease_expires_at,
+lease_owner = excluded.lease_owner, expires_at = excluded.expires_at, progress = excluded.progress`, s.tableName, jobColumns)),
+		append([]any{job.ID.String()}, jobValues(job)...)...)
+	if err != nil {
+		return fmt.Errorf("job: %s unable to put: %w", job.ID, err)
+	}
+	return nil
+}
+
+func (s *SQLJobStore) FinishAttempt(ctx context.Context, job Job) error {
+	job.UpdatedAt = time.Now()
+	result, err := s.db.ExecContext(ctx, s.query(fmt.Sprintf(`UPDATE %s SET kind = ?, user_id = ?, domain = ?, state = ?,
+attempts = ?, last_error = ?, created_at = ?, updated_at = ?, next_attempt_at = ?, lease_expires_at = ?, lease_owner = ?,
+expires_at = ?, progress = ? WHERE id = ? AND lease_owner = ? AND lease_expires_at = ?`, s.tableName)),
+		append(jobValues(job), job.ID.String(), job.LeaseOwner, job.LeaseExpiresAt)...)
+	if err != nil {
+		return fmt.Errorf("job: %s unable to finish attempt: %w", job.ID, err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("%s: %w", job.ID, ErrJobLeaseLost)
+	}
+	return nil
+}
+
+func (s *SQLJobStore) UpdateJobProgress(ctx context.Context, id uuid.UUID, progress json.RawMessage) error {
+	result, err := s.db.ExecContext(ctx,
+		s.query(fmt.Sprintf("UPDATE %s SET progress = ?, updated_at = ? WHERE id = ?", s.tableName)),
+		string(progress), time.Now().Format(time.RFC3339Nano), id.String())
+	if err != nil {
+		return fmt.Errorf("job: %s unable to update progress: %w", id, err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return fmt.Errorf("%s: %w", id, ErrJobNotFound)
+	}
+	return nil
+}
+
+func (s *SQLJobStore) ClaimJob(ctx context.Context, id uuid.UUID, leaseDuration time.Duration) (Job, error) {
+	now := time.Now()
+	row := s.db.QueryRowContext(ctx, s.query(fmt.Sprintf(`UPDATE %s SET state = ?, attempts = attempts + 1, lease_expires_at = ?,
+lease_owner = ?, updated_at = ? WHERE id = ? AND ((state = ? AND next_attempt_at <= ?) OR (state = ? AND lease_expires_at < ?))
+RETURNING %s`, s.tableName, jobColumns)),
+		string(JobRunning), now.Add(leaseDuration).Unix(), uuid.NewString(), now.Format(time.RFC3339Nano), id.String(),
+		string(JobPending), now.Unix(), string(JobRunning), now.Unix())
+	job, err := scanJob(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Job{}, fmt.Errorf("%s: %w", id, ErrJobAlreadyHeld)
+	}
+	if err != nil {
+		return Job{}, fmt.Errorf("job: %s unable to claim: %w", id, err)
+	}
+	return job, nil
+}
+
+// ListRunnableJobs also deletes the finished jobs whose retention ended, there is no TTL like on DynamoDB
+func (s *SQLJobStore) ListRunnableJobs(ctx context.Context) ([]Job, error) {
+	now := time.Now().Unix()
+	_, err := s.db.ExecContext(ctx, s.query(fmt.Sprintf("DELETE FROM %s WHERE expires_at > 0 AND expires_at < ?", s.tableName)), now)
+	if err != nil {
+		return nil, fmt.Errorf("unable to delete expired jobs from: %s: %w", s.tableName, err)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.query(fmt.Sprintf(`SELECT %s FROM %s
+WHERE (state = ? AND next_attempt_at <= ?) OR (state = ? AND lease_expires_at < ?) ORDER BY next_attempt_at`, jobColumns, s.tableName)),
+		string(JobPending), now, string(JobRunning), now)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list runnable jobs from: %s: %w", s.tableName, err)
+	}
+	defer rows.Close()
+
+	var jobs []Job
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
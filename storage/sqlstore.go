@@ -0,0 +1,549 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/google/uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultSQLTableName = "domains"
+
+// SQLDomainStore keeps one row per domain with the DomainInformation as JSON, it works with SQLite and Postgres.
+// database/sql only knows drivers that are linked into the binary, the binary links modernc.org/sqlite as "sqlite"
+// and github.com/lib/pq as "postgres".
+type SQLDomainStore struct {
+	db        *sql.DB
+	tableName string
+	postgres  bool
+}
+
+func NewSQLDomainStore(settings appconfig.SQLStoreSettings) (*SQLDomainStore, error) {
+	if settings.Driver == "" || settings.DSN == "" {
+		return nil, fmt.Errorf("domain_store sql needs a driver and a dsn")
+	}
+	db, err := sql.Open(settings.Driver, settings.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sql database with driver: %s: %w", settings.Driver, err)
+	}
+
+	store := &SQLDomainStore{
+		db:        db,
+		tableName: settings.TableName,
+		postgres:  strings.HasPrefix(settings.Driver, "postgres") || settings.Driver == "pgx",
+	}
+	if store.tableName == "" {
+		store.tableName = defaultSQLTableName
+	}
+
+	err = store.createTableIfNotExists(context.TODO())
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (s *SQLDomainStore) createTableIfNotExists(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	user_id TEXT NOT NULL,
+	domain_name TEXT NOT NULL,
+	info TEXT NOT NULL,
+	version BIGINT NOT NULL DEFAULT 0,
+	deleted TEXT,
+	pending TEXT,
+	history TEXT,
+	schema_version BIGINT NOT NULL DEFAULT 0,
+	PRIMARY KEY (user_id, domain_name)
+)`, s.tableName))
+	if err != nil {
+		return fmt.Errorf("unable to create table: %s: %w", s.tableName, err)
+	}
+	// Tables created by older versions are missing the columns added since
+	for _, column := range [][2]string{
+		{"deleted", "TEXT"},
+		{"pending", "TEXT"},
+		{"history", "TEXT"},
+		{"schema_version", "BIGINT NOT NULL DEFAULT 0"},
+	} {
+		_, err = s.db.ExecContext(ctx, fmt.Sprintf("SELECT %s FROM %s LIMIT 0", column[0], s.tableName))
+		if err == nil {
+			continue
+		}
+		_, err = s.db.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", s.tableName, column[0], column[1]))
+		if err != nil {
+			return fmt.Errorf("unable to add %s column to: %s: %w", column[0], s.tableName, err)
+		}
+	}
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s_domain_name ON %s (domain_name)", s.tableName, s.tableName))
+	if err != nil {
+		return fmt.Errorf("unable to create domain_name index on: %s: %w", s.tableName, err)
+	}
+	_, err = s.db.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	domain_name TEXT NOT NULL PRIMARY KEY,
+	user_id TEXT NOT NULL,
+	claimed_at TEXT NOT NULL
+)`, s.claimsTableName()))
+	if err != nil {
+		return fmt.Errorf("unable to create table: %s: %w", s.claimsTableName(), err)
+	}
+	logger.Info("sql table: %s ready", s.tableName)
+	return nil
+}
+
+// claimsTableName holds one row per claimed domain name, its primary key is what serializes verifications of a name
+func (s *SQLDomainStore) claimsTableName() string {
+	return s.tableName + "_claims"
+}
+
+func (s *SQLDomainStore) query(query string) string {
+	return rebind(query, s.postgres)
+}
+
+// rebind rewrites ? placeholders to $n for Postgres
+func rebind(query string, postgres bool) string {
+	if !postgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (s *SQLDomainStore) GetUser(ctx context.Context, userID uuid.UUID) (models.User, error) {
+	domains, err := s.GetUserDomains(ctx, userID)
+	if err != nil {
+		return models.User{}, err
+	}
+	return models.User{ID: userID.String(), Domains: domains}, nil
+}
+
+func (s *SQLDomainStore) GetDomainByUser(ctx context.Context, userID uuid.UUID, domain string) (models.DomainInformation, error) {
+	record, err := s.GetDomainRecord(ctx, userID, domain)
+	if err != nil {
+		return models.DomainInformation{}, err
+	}
+	if record.Deleted != nil {
+		return models.DomainInformation{}, domainNotFound(userID, domain)
+	}
+	return record.Domain, nil
+}
+
+func (s *SQLDomainStore) GetDomainRecord(ctx context.Context, userID uuid.UUID, domain string) (DomainRecord, error) {
+	row := s.db.QueryRowContext(ctx,
+		s.query(fmt.Sprintf("SELECT %s FROM %s WHERE user_id = ? AND domain_name = ?", recordColumns, s.tableName)),
+		userID.String(), domain)
+	record, err := scanRecord(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return DomainRecord{}, domainNotFound(userID, domain)
+	}
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	if record.upgraded {
+		// Upgrade lazily, a conflicting write means someone else already wrote the record in the current schema
+		written, err := s.PutDomainRecord(ctx, record)
+		if err == nil {
+			return written, nil
+		}
+		if !errors.Is(err, ErrVersionConflict) {
+			logger.Error("domain: %s unable to write back schema upgrade: %s", domain, err)
+		}
+	}
+	return record, nil
+}
+
+// recordColumns are the columns scanRecord reads
+const recordColumns = "user_id, domain_name, info, version, deleted, pending, history, schema_version"
+
+func scanRecord(row interface{ Scan(dest ...any) error }) (DomainRecord, error) {
+	var record DomainRecord
+	var info string
+	var deleted, pending, history sql.NullString
+	err := row.Scan(&record.UserID, &record.DomainName, &info, &record.Version, &deleted, &pending, &history, &record.SchemaVersion)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	err = json.Unmarshal([]byte(info), &record.Domain)
+	if err != nil {
+		return DomainRecord{}, fmt.Errorf("domain: %s unable to unmarshal domain information: %w", record.DomainName, err)
+	}
+	if deleted.Valid {
+		err = json.Unmarshal([]byte(deleted.String), &record.Deleted)
+	}
+	if err == nil && pending.Valid {
+		err = json.Unmarshal([]byte(pending.String), &record.Pending)
+	}
+	if err == nil && history.Valid {
+		err = json.Unmarshal([]byte(history.String), &record.History)
+	}
+	if err != nil {
+		return DomainRecord{}, fmt.Errorf("domain: %s unable to unmarshal record: %w", record.DomainName, err)
+	}
+	err = upgradeRecord(func(v any) error {
+		return json.Unmarshal([]byte(info), v)
+	}, &record)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	return record, nil
+}
+
+// nullJSON stores unset fields as NULL so that the columns can be filtered on
+func nullJSON(v any, set bool) (sql.NullString, error) {
+	if !set {
+		return sql.NullString{}, nil
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return sql.NullString{}, err
+	}
+	return sql.NullString{String: string(b), Valid: true}, nil
+}
+
+func (s *SQLDomainStore) PutDomainInfo(ctx context.Context, domainInfo models.DomainInformation) error {
+	info, err := json.Marshal(domainInfo)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx,
+		s.query(fmt.Sprintf(`INSERT INTO %s (user_id, domain_name, info, version, schema_version) VALUES (?, ?, ?, 1, ?)
+ON CONFLICT (user_id, domain_name) DO UPDATE SET info = excluded.info, version = %s.version + 1, schema_version = excluded.schema_version`, s.tableName, s.tableName)),
+		domainInfo.UserID.String(), domainInfo.DomainName, string(info), CurrentSchemaVersion)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to put domain information: %w", domainInfo.DomainName, err)
+	}
+	return nil
+}
+
+func (s *SQLDomainStore) PutDomainRecord(ctx context.Context, record DomainRecord) (DomainRecord, error) {
+	record.UserID = record.Domain.UserID.String()
+	record.DomainName = record.Domain.DomainName
+	info, err := json.Marshal(record.Domain)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	deleted, err := nullJSON(record.Deleted, record.Deleted != nil)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	pending, err := nullJSON(record.Pending, record.Pending != nil)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	history, err := nullJSON(record.History, len(record.History) > 0)
+	if err != nil {
+		return DomainRecord{}, err
+	}
+
+	var result sql.Result
+	if record.Version == 0 {
+		// A row left at version 0 can only have been written before versions existed
+		result, err = s.db.ExecContext(ctx,
+			s.query(fmt.Sprintf(`INSERT INTO %s (user_id, domain_name, info, version, deleted, pending, history, schema_version) VALUES (?, ?, ?, 1, ?, ?, ?, ?)
+ON CONFLICT (user_id, domain_name) DO UPDATE SET info = excluded.info, version = 1, deleted = excluded.deleted,
+pending = excluded.pending, history = excluded.history, schema_version = excluded.schema_version WHERE %s.version = 0`, s.tableName, s.tableName)),
+			record.UserID, record.DomainName, string(info), deleted, pending, history, CurrentSchemaVersion)
+	} else {
+		result, err = s.db.ExecContext(ctx,
+			s.query(fmt.Sprintf(`UPDATE %s SET info = ?, deleted = ?, pending = ?, history = ?, schema_version = ?, version = version + 1
+WHERE user_id = ? AND domain_name = ? AND version = ?`, s.tableName)),
+			string(info), deleted, pending, history, CurrentSchemaVersion, record.UserID, record.DomainName, record.Version)
+	}
+	if err != nil {
+		return DomainRecord{}, fmt.Errorf("domain: %s unable to put domain information: %w", record.DomainName, err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return DomainRecord{}, err
+	}
+	if rows == 0 {
+		return DomainRecord{}, &ConflictError{UserID: record.UserID, DomainName: record.DomainName, Version: record.Version}
+	}
+
+	record.Version++
+	record.UpdatedAt = time.Now()
+	record.SchemaVersion = CurrentSchemaVersion
+	record.upgraded = false
+	return record, nil
+}
+
+func (s *SQLDomainStore) GetUserDomains(ctx context.Context, userID uuid.UUID) (map[string]models.DomainInformation, error) {
+	users, err := s.scanUsers(ctx,
+		s.query(fmt.Sprintf("SELECT %s FROM %s WHERE user_id = ? AND deleted IS NULL", recordColumns, s.tableName)), userID.String())
+	if err != nil {
+		return map[string]models.DomainInformation{}, err
+	}
+	return users[userID.String()].Domains, nil
+}
+
+func (s *SQLDomainStore) DeleteDomain(ctx context.Context, userID uuid.UUID, domainName string) error {
+	_, err := s.db.ExecContext(ctx,
+		s.query(fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND domain_name = ?", s.tableName)),
+		userID.String(), domainName)
+	return err
+}
+
+func (s *SQLDomainStore) DeleteDomainRecord(ctx context.Context, record DomainRecord) error {
+	userID, domainName := record.Domain.UserID.String(), record.Domain.DomainName
+	result, err := s.db.ExecContext(ctx,
+		s.query(fmt.Sprintf("DELETE FROM %s WHERE user_id = ? AND domain_name = ? AND version = ?", s.tableName)),
+		userID, domainName, record.Version)
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to delete domain information: %w", domainName, err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return &ConflictError{UserID: userID, DomainName: domainName, Version: record.Version}
+	}
+	return nil
+}
+
+func (s *SQLDomainStore) GetAllRecords(ctx context.Context) ([]models.User, error) {
+	users, err := s.scanUsers(ctx, fmt.Sprintf("SELECT %s FROM %s WHERE deleted IS NULL", recordColumns, s.tableName))
+	if err != nil {
+		return []models.User{}, err
+	}
+
+	var retRecords []models.User
+	for _, user := range users {
+		retRecords = append(retRecords, user)
+	}
+	sort.Slice(retRecords, func(i, j int) bool { return retRecords[i].ID < retRecords[j].ID })
+	return retRecords, nil
+}
+
+func (s *SQLDomainStore) GetDomainsByName(ctx context.Context, domainName string) ([]models.DomainInformation, error) {
+	users, err := s.scanUsers(ctx,
+		s.query(fmt.Sprintf("SELECT %s FROM %s WHERE domain_name = ? AND deleted IS NULL ORDER BY user_id", recordColumns, s.tableName)), domainName)
+	if err != nil {
+		return nil, err
+	}
+	var claims []models.DomainInformation
+	for _, user := range users {
+		claims = append(claims, user.Domains[domainName])
+	}
+	sort.Slice(claims, func(i, j int) bool { return claims[i].UserID.String() < claims[j].UserID.String() })
+	return claims, nil
+}
+
+// ListDomains pages by key in SQL and filters the JSON in Go, so it keeps reading batches until a page is full
+func (s *SQLDomainStore) ListDomains(ctx context.Context, filter DomainFilter, limit int, cursor string) (DomainPage, error) {
+	start, err := decodeCursor(cursor)
+	if err != nil {
+		return DomainPage{}, err
+	}
+	limit = PageSize(limit)
+
+	page := DomainPage{Domains: []models.DomainInformation{}}
+	var last *pageCursor
+	for {
+		conditions := []string{"deleted IS NULL"}
+		var args []any
+		if filter.UserID != uuid.Nil {
+			conditions = append(conditions, "user_id = ?")
+			args = append(args, filter.UserID.String())
+		}
+		if filter.NamePrefix != "" {
+			conditions = append(conditions, "domain_name LIKE ? ESCAPE '\\'")
+			args = append(args, escapeLike(filter.NamePrefix)+"%")
+		}
+		if start != nil {
+			conditions = append(conditions, "(user_id > ? OR (user_id = ? AND domain_name > ?))")
+			args = append(args, start.UserID, start.UserID, start.DomainName)
+		}
+		query := fmt.Sprintf("SELECT %s FROM %s WHERE %s", recordColumns, s.tableName, strings.Join(conditions, " AND "))
+		// One extra row tells whether there is a next page
+		query += fmt.Sprintf(" ORDER BY user_id, domain_name LIMIT %d", limit+1)
+
+		rows, err := s.db.QueryContext(ctx, s.query(query), args...)
+		if err != nil {
+			return DomainPage{}, err
+		}
+		var batch []DomainRecord
+		for rows.Next() {
+			record, err := scanRecord(rows)
+			if err != nil {
+				rows.Close()
+				return DomainPage{}, err
+			}
+			batch = append(batch, record)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return DomainPage{}, err
+		}
+
+		for _, record := range batch {
+			if len(page.Domains) == limit {
+				page.NextCursor = last.encode()
+				return page, nil
+			}
+			last = &pageCursor{UserID: record.UserID, DomainName: record.DomainName}
+			if filter.Matches(record.Domain) {
+				page.Domains = append(page.Domains, record.Domain)
+			}
+		}
+		if len(batch) <= limit {
+			return page, nil
+		}
+		start = last
+	}
+}
+
+func (s *SQLDomainStore) ListDeletedDomains(ctx context.Context, purgeBefore time.Time) ([]DomainRecord, error) {
+	records, err := s.queryRecords(ctx, "deleted IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	var deleted []DomainRecord
+	for _, record := range records {
+		if record.Deleted.PurgeAfter.Before(purgeBefore) {
+			deleted = append(deleted, record)
+		}
+	}
+	return deleted, nil
+}
+
+func (s *SQLDomainStore) ListPendingDomains(ctx context.Context) ([]DomainRecord, error) {
+	return s.queryRecords(ctx, "pending IS NOT NULL AND deleted IS NULL")
+}
+
+func (s *SQLDomainStore) ListDomainRecords(ctx context.Context) ([]DomainRecord, error) {
+	return s.queryRecords(ctx, "1 = 1")
+}
+
+// queryRecords returns the records matching a condition without placeholders
+func (s *SQLDomainStore) queryRecords(ctx context.Context, condition string) ([]DomainRecord, error) {
+	rows, err := s.db.QueryContext(ctx, fmt.Sprintf(
+		"SELECT %s FROM %s WHERE %s ORDER BY user_id, domain_name", recordColumns, s.tableName, condition))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []DomainRecord
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(s)
+}
+
+// scanUsers groups domain rows by their user
+func (s *SQLDomainStore) scanUsers(ctx context.Context, query string, args ...any) (map[string]models.User, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := map[string]models.User{}
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		user, ok := users[record.UserID]
+		if !ok {
+			user = models.User{ID: record.UserID, Domains: map[string]models.DomainInformation{}}
+		}
+		user.Domains[record.DomainName] = record.Domain
+		users[record.UserID] = user
+	}
+	return users, rows.Err()
+}
+
+func (s *SQLDomainStore) GetNameClaim(ctx context.Context, domainName string) (NameClaim, error) {
+	var userID, claimedAt string
+	err := s.db.QueryRowContext(ctx,
+		s.query(fmt.Sprintf("SELECT user_id, claimed_at FROM %s WHERE domain_name = ?", s.claimsTableName())), domainName).Scan(&userID, &claimedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return NameClaim{}, nil
+	}
+	if err != nil {
+		return NameClaim{}, fmt.Errorf("domain: %s unable to get name claim: %w", domainName, err)
+	}
+	claim := NameClaim{DomainName: domainName}
+	claim.UserID, err = uuid.Parse(userID)
+	if err == nil {
+		claim.ClaimedAt, err = time.Parse(time.RFC3339Nano, claimedAt)
+	}
+	if err != nil {
+		return NameClaim{}, fmt.Errorf("domain: %s unable to read name claim: %w", domainName, err)
+	}
+	return claim, nil
+}
+
+func (s *SQLDomainStore) SwapNameClaim(ctx context.Context, domainName string, previous uuid.UUID, holder uuid.UUID) error {
+	claimedAt := time.Now().Format(time.RFC3339Nano)
+	var result sql.Result
+	var err error
+	switch {
+	case previous == uuid.Nil && holder == uuid.Nil:
+		return s.checkNoNameClaim(ctx, domainName)
+	case previous == uuid.Nil:
+		result, err = s.db.ExecContext(ctx,
+			s.query(fmt.Sprintf("INSERT INTO %s (domain_name, user_id, claimed_at) VALUES (?, ?, ?) ON CONFLICT (domain_name) DO NOTHING", s.claimsTableName())),
+			domainName, holder.String(), claimedAt)
+	case holder == uuid.Nil:
+		result, err = s.db.ExecContext(ctx,
+			s.query(fmt.Sprintf("DELETE FROM %s WHERE domain_name = ? AND user_id = ?", s.claimsTableName())),
+			domainName, previous.String())
+	default:
+		result, err = s.db.ExecContext(ctx,
+			s.query(fmt.Sprintf("UPDATE %s SET user_id = ?, claimed_at = ? WHERE domain_name = ? AND user_id = ?", s.claimsTableName())),
+			holder.String(), claimedAt, domainName, previous.String())
+	}
+	if err != nil {
+		return fmt.Errorf("domain: %s unable to swap name claim: %w", domainName, err)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rows == 0 {
+		return nameClaimChanged(domainName)
+	}
+	return nil
+}
+
+// checkNoNameClaim is the swap from nobody to nobody, it only fails when someone holds the claim
+func (s *SQLDomainStore) checkNoNameClaim(ctx context.Context, domainName string) error {
+	claim, err := s.GetNameClaim(ctx, domainName)
+	if err != nil {
+		return err
+	}
+	if claim.UserID != uuid.Nil {
+		return nameClaimChanged(domainName)
+	}
+	return nil
+}
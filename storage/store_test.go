@@ -0,0 +1,394 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/edwinavalos/common/logger"
+	"github.com/edwinavalos/common/models"
+	appconfig "github.com/edwinavalos/dns-verifier/config"
+	"github.com/google/uuid"
+	_ "modernc.org/sqlite"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	logger.New()
+	os.Exit(m.Run())
+}
+
+func newTestSQLDomainStore(t *testing.T) *SQLDomainStore {
+	t.Helper()
+	store, err := NewSQLDomainStore(appconfig.SQLStoreSettings{
+		Driver: "sqlite",
+		DSN:    "file:" + filepath.Join(t.TempDir(), "verifier.db") + "?_pragma=busy_timeout(5000)",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = store.db.Close() })
+	return store
+}
+
+// domainStores runs test against every backend that doesn't need a server
+func domainStores(t *testing.T, test func(t *testing.T, store DomainStore)) {
+	t.Run("memory", func(t *testing.T) { test(t, NewMemoryDomainStore()) })
+	t.Run("sqlite", func(t *testing.T) { test(t, newTestSQLDomainStore(t)) })
+}
+
+func TestDomainStoreCRUD(t *testing.T) {
+	domainStores(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		alice, bob := uuid.New(), uuid.New()
+		for _, di := range []models.DomainInformation{
+			{DomainName: "a.example.com", UserID: alice, Verification: models.Verification{Key: "key-a", Verified: true}},
+			{DomainName: "b.example.com", UserID: alice},
+			{DomainName: "a.example.com", UserID: bob},
+		} {
+			err := store.PutDomainInfo(ctx, di)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		di, err := store.GetDomainByUser(ctx, alice, "a.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if di.Verification.Key != "key-a" || !di.Verification.Verified {
+			t.Errorf("GetDomainByUser() = %+v", di)
+		}
+		domains, err := store.GetUserDomains(ctx, alice)
+		if err != nil || len(domains) != 2 {
+			t.Errorf("GetUserDomains() = %v, %v, want 2 domains", domains, err)
+		}
+		claims, err := store.GetDomainsByName(ctx, "a.example.com")
+		if err != nil || len(claims) != 2 {
+			t.Errorf("GetDomainsByName() = %v, %v, want both users", claims, err)
+		}
+		users, err := store.GetAllRecords(ctx)
+		if err != nil || len(users) != 2 {
+			t.Errorf("GetAllRecords() = %v, %v, want 2 users", users, err)
+		}
+
+		di.Verification.Key = "key-a2"
+		err = store.PutDomainInfo(ctx, di)
+		if err != nil {
+			t.Fatal(err)
+		}
+		di, err = store.GetDomainByUser(ctx, alice, "a.example.com")
+		if err != nil || di.Verification.Key != "key-a2" {
+			t.Errorf("GetDomainByUser() after update = %+v, %v", di, err)
+		}
+
+		err = store.DeleteDomain(ctx, alice, "a.example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetDomainByUser(ctx, alice, "a.example.com")
+		if !errors.Is(err, ErrDomainNotFound) {
+			t.Errorf("GetDomainByUser() after delete error = %v, want ErrDomainNotFound", err)
+		}
+		_, err = store.GetDomainRecord(ctx, alice, "a.example.com")
+		if !errors.Is(err, ErrDomainNotFound) {
+			t.Errorf("GetDomainRecord() after delete error = %v, want ErrDomainNotFound", err)
+		}
+		user, err := store.GetUser(ctx, uuid.New())
+		if err != nil || len(user.Domains) != 0 {
+			t.Errorf("GetUser() of a user without domains = %+v, %v, want empty", user, err)
+		}
+	})
+}
+
+func TestDomainStorePagination(t *testing.T) {
+	domainStores(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		alice, bob := uuid.New(), uuid.New()
+		var want []string
+		for i := 0; i < 7; i++ {
+			userID := alice
+			if i%2 == 1 {
+				userID = bob
+			}
+			name := fmt.Sprintf("d%d.example.com", i)
+			want = append(want, userID.String()+"/"+name)
+			err := store.PutDomainInfo(ctx, models.DomainInformation{DomainName: name, UserID: userID, Verification: models.Verification{Verified: i < 3}})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		list := func(filter DomainFilter) []string {
+			t.Helper()
+			var got []string
+			cursor := ""
+			for pages := 0; ; pages++ {
+				if pages > 10 {
+					t.Fatal("listing doesn't end")
+				}
+				page, err := store.ListDomains(ctx, filter, 3, cursor)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(page.Domains) > 3 {
+					t.Fatalf("page has %d domains, limit is 3", len(page.Domains))
+				}
+				for _, di := range page.Domains {
+					got = append(got, di.UserID.String()+"/"+di.DomainName)
+				}
+				if page.NextCursor == "" {
+					return got
+				}
+				cursor = page.NextCursor
+			}
+		}
+
+		got := list(DomainFilter{})
+		sort.Strings(got)
+		sort.Strings(want)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("listed %v, want every domain once: %v", got, want)
+		}
+		if got := list(DomainFilter{UserID: bob}); len(got) != 3 {
+			t.Errorf("bob's domains = %v, want 3", got)
+		}
+		verified := true
+		if got := list(DomainFilter{Verified: &verified}); len(got) != 3 {
+			t.Errorf("verified domains = %v, want 3", got)
+		}
+		if got := list(DomainFilter{NamePrefix: "d6"}); len(got) != 1 {
+			t.Errorf("domains starting with d6 = %v, want 1", got)
+		}
+
+		_, err := store.ListDomains(ctx, DomainFilter{}, 3, "not a cursor")
+		if err == nil {
+			t.Error("ListDomains() accepted a malformed cursor")
+		}
+	})
+}
+
+func TestDomainStoreConflicts(t *testing.T) {
+	domainStores(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		userID := uuid.New()
+		di := models.DomainInformation{DomainName: "example.com", UserID: userID}
+
+		created, err := store.PutDomainRecord(ctx, DomainRecord{Domain: di})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created.Version != 1 {
+			t.Errorf("created at version: %d, want 1", created.Version)
+		}
+		_, err = store.PutDomainRecord(ctx, DomainRecord{Domain: di})
+		if !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("creating an existing domain error = %v, want ErrVersionConflict", err)
+		}
+
+		stale, err := store.GetDomainRecord(ctx, userID, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fresh := stale
+		fresh.Domain.Verification.Key = "first"
+		updated, err := store.PutDomainRecord(ctx, fresh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.Version != stale.Version+1 {
+			t.Errorf("updated to version: %d, want %d", updated.Version, stale.Version+1)
+		}
+
+		stale.Domain.Verification.Key = "second"
+		_, err = store.PutDomainRecord(ctx, stale)
+		var conflict *ConflictError
+		if !errors.As(err, &conflict) || conflict.Version != stale.Version {
+			t.Fatalf("write with a stale version error = %v, want a ConflictError", err)
+		}
+
+		record, err := store.GetDomainRecord(ctx, userID, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Domain.Verification.Key != "first" || record.Version != updated.Version {
+			t.Errorf("stored key: %s version: %d, want the first write", record.Domain.Verification.Key, record.Version)
+		}
+	})
+}
+
+func TestDomainStoreSoftDelete(t *testing.T) {
+	domainStores(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		userID := uuid.New()
+		di := models.DomainInformation{DomainName: "example.com", UserID: userID, Verification: models.Verification{Verified: true}}
+		record, err := store.PutDomainRecord(ctx, DomainRecord{Domain: di})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now().UTC().Truncate(time.Second)
+		record.Deleted = &Tombstone{DeletedAt: now, DeletedBy: "admin", Reason: "test", PurgeAfter: now.Add(time.Hour)}
+		record, err = store.PutDomainRecord(ctx, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = store.GetDomainByUser(ctx, userID, "example.com")
+		if !errors.Is(err, ErrDomainNotFound) {
+			t.Errorf("GetDomainByUser() of a deleted domain error = %v, want ErrDomainNotFound", err)
+		}
+		domains, _ := store.GetUserDomains(ctx, userID)
+		claims, _ := store.GetDomainsByName(ctx, "example.com")
+		users, _ := store.GetAllRecords(ctx)
+		page, _ := store.ListDomains(ctx, DomainFilter{}, 10, "")
+		if len(domains) != 0 || len(claims) != 0 || len(users) != 0 || len(page.Domains) != 0 {
+			t.Errorf("deleted domain is still listed: user domains: %v claims: %v users: %v page: %v", domains, claims, users, page.Domains)
+		}
+
+		deleted, err := store.GetDomainRecord(ctx, userID, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted.Deleted == nil || deleted.Deleted.DeletedBy != "admin" || !deleted.Deleted.PurgeAfter.Equal(now.Add(time.Hour)) {
+			t.Errorf("tombstone = %+v", deleted.Deleted)
+		}
+		purgeable, err := store.ListDeletedDomains(ctx, now)
+		if err != nil || len(purgeable) != 0 {
+			t.Errorf("ListDeletedDomains() before the retention ended = %v, %v", purgeable, err)
+		}
+		purgeable, err = store.ListDeletedDomains(ctx, now.Add(2*time.Hour))
+		if err != nil || len(purgeable) != 1 {
+			t.Errorf("ListDeletedDomains() after the retention ended = %v, %v", purgeable, err)
+		}
+		all, err := store.ListDomainRecords(ctx)
+		if err != nil || len(all) != 1 {
+			t.Errorf("ListDomainRecords() = %v, %v, want the deleted domain for backups", all, err)
+		}
+
+		record.Deleted = nil
+		_, err = store.PutDomainRecord(ctx, record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		restored, err := store.GetDomainByUser(ctx, userID, "example.com")
+		if err != nil || !restored.Verification.Verified {
+			t.Errorf("GetDomainByUser() after restoring = %+v, %v", restored, err)
+		}
+	})
+}
+
+func TestDomainStoreNameClaims(t *testing.T) {
+	domainStores(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		alice, bob := uuid.New(), uuid.New()
+
+		claim, err := store.GetNameClaim(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claim.UserID != uuid.Nil {
+			t.Fatalf("expected nobody to hold the claim, got %s", claim.UserID)
+		}
+
+		err = store.SwapNameClaim(ctx, "example.com", uuid.Nil, alice)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.SwapNameClaim(ctx, "example.com", uuid.Nil, bob)
+		if !errors.Is(err, ErrNameClaimChanged) {
+			t.Fatalf("expected ErrNameClaimChanged taking a held claim, got %v", err)
+		}
+		err = store.SwapNameClaim(ctx, "example.com", bob, bob)
+		if !errors.Is(err, ErrNameClaimChanged) {
+			t.Fatalf("expected ErrNameClaimChanged with a stale holder, got %v", err)
+		}
+		claim, err = store.GetNameClaim(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claim.UserID != alice || claim.DomainName != "example.com" {
+			t.Fatalf("expected alice to hold the claim, got %+v", claim)
+		}
+
+		err = store.SwapNameClaim(ctx, "example.com", alice, bob)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.SwapNameClaim(ctx, "example.com", alice, uuid.Nil)
+		if !errors.Is(err, ErrNameClaimChanged) {
+			t.Fatalf("expected ErrNameClaimChanged releasing someone else's claim, got %v", err)
+		}
+		err = store.SwapNameClaim(ctx, "example.com", bob, uuid.Nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		claim, err = store.GetNameClaim(ctx, "example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if claim.UserID != uuid.Nil {
+			t.Fatalf("expected the claim to be released, got %s", claim.UserID)
+		}
+	})
+}
+
+func TestDomainStoreNameClaimsAreExclusive(t *testing.T) {
+	domainStores(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		const contenders = 8
+		results := make(chan error, contenders)
+		for i := 0; i < contenders; i++ {
+			go func() { results <- store.SwapNameClaim(ctx, "example.com", uuid.Nil, uuid.New()) }()
+		}
+		won := 0
+		for i := 0; i < contenders; i++ {
+			err := <-results
+			switch {
+			case err == nil:
+				won++
+			case !errors.Is(err, ErrNameClaimChanged):
+				t.Fatal(err)
+			}
+		}
+		if won != 1 {
+			t.Fatalf("expected exactly one claim to succeed, got %d", won)
+		}
+	})
+}
+
+func TestDomainStoreDeleteDomainRecordIsConditional(t *testing.T) {
+	domainStores(t, func(t *testing.T, store DomainStore) {
+		ctx := context.Background()
+		userID := uuid.New()
+		stale, err := store.PutDomainRecord(ctx, DomainRecord{Domain: models.DomainInformation{DomainName: "example.com", UserID: userID}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, err := store.PutDomainRecord(ctx, stale)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.DeleteDomainRecord(ctx, stale)
+		if !errors.Is(err, ErrVersionConflict) {
+			t.Fatalf("expected ErrVersionConflict deleting a stale record, got %v", err)
+		}
+		_, err = store.GetDomainRecord(ctx, userID, "example.com")
+		if err != nil {
+			t.Fatalf("expected the record to be kept, got %v", err)
+		}
+
+		err = store.DeleteDomainRecord(ctx, current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = store.GetDomainRecord(ctx, userID, "example.com")
+		if !errors.Is(err, ErrDomainNotFound) {
+			t.Fatalf("expected ErrDomainNotFound, got %v", err)
+		}
+	})
+}